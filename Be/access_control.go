@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedURLTTL is how long a signed file URL stays valid
+const signedURLTTL = 15 * time.Minute
+
+// userAuthMiddleware accepts either a student or a teacher token. Handlers
+// read "user_role" from the context to tell them apart.
+func userAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := claimsFromRequest(r)
+		if !ok {
+			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			return
+		}
+
+		var userID int
+		switch claims.Role {
+		case "student":
+			userID = claims.StudentID
+			r.Header.Set("X-Student-ID", fmt.Sprintf("%d", claims.StudentID))
+			r.Header.Set("X-Student-Email", claims.Email)
+		case "teacher":
+			userID = claims.TeacherID
+			r.Header.Set("X-Teacher-ID", fmt.Sprintf("%d", claims.TeacherID))
+			r.Header.Set("X-Teacher-Email", claims.Email)
+		default:
+			http.Error(w, "Student or teacher access required", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user_id", userID)
+		ctx = context.WithValue(ctx, "user_email", claims.Email)
+		ctx = context.WithValue(ctx, "user_role", claims.Role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// claimsFromRequest validates the bearer token of a request, if any
+func claimsFromRequest(r *http.Request) (*Claims, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, false
+	}
+	claims, err := ValidateJWT(strings.Replace(authHeader, "Bearer ", "", 1))
+	if err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// canAccessCourse reports whether a user may see a course's content: the
+// teacher who owns it, or a student enrolled in it
+func canAccessCourse(role string, userID, courseID int) bool {
+	switch role {
+	case "teacher":
+		var ownerID sql.NullInt64
+		err := DB.QueryRow("SELECT teacher_id FROM courses WHERE id = ?", courseID).Scan(&ownerID)
+		return err == nil && ownerID.Valid && int(ownerID.Int64) == userID
+	case "student":
+		return isStudentEnrolled(courseID, userID)
+	}
+	return false
+}
+
+// requestUser returns the role and ID set by userAuthMiddleware
+func requestUser(r *http.Request) (string, int, bool) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return "", 0, false
+	}
+	role, _ := r.Context().Value("user_role").(string)
+	return role, userID, true
+}
+
+// fileSignature computes the HMAC for a file path and expiry timestamp
+func fileSignature(urlPath string, expires int64) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(urlPath + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signFileURL returns a short-lived URL for an /uploads/ path
+func signFileURL(urlPath string) string {
+	key, ok := blobKeyFromURL(urlPath)
+	if !ok {
+		return ""
+	}
+	signed, err := Storage.SignedURL(context.Background(), key, signedURLTTL)
+	if err != nil {
+		log.Printf("Error signing URL for %s: %v", urlPath, err)
+		return ""
+	}
+	return signed
+}
+
+// verifyFileSignature checks the expires/sig query parameters of a file request
+func verifyFileSignature(urlPath string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := fileSignature(urlPath, expires)
+	return hmac.Equal([]byte(expected), []byte(query.Get("sig")))
+}
+
+// isPublicFile reports whether a file may be served without authorization.
+// News images and course cover images are shown on public pages.
+func isPublicFile(urlPath string) bool {
+	if strings.HasPrefix(urlPath, "/uploads/news/") {
+		return true
+	}
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM courses WHERE image_path = ?)", urlPath).Scan(&exists)
+	return err == nil && exists
+}
+
+// fileAccessPath is the file whose permissions apply to urlPath. Resized
+// image variants and PDF thumbnails are visible to whoever may see the
+// original.
+func fileAccessPath(urlPath string) string {
+	if source, ok := imageVariantSource(urlPath); ok {
+		return source
+	}
+	if source, ok := pdfThumbnailSource(urlPath); ok {
+		return source
+	}
+	return urlPath
+}
+
+// canAccessFile reports whether a user may download an uploaded file, based
+// on which course materials, quizzes or submissions reference it. Identical
+// content is stored once, so every referencing row is considered.
+func canAccessFile(role string, userID int, urlPath string) bool {
+	var query string
+	switch role {
+	case "teacher":
+		// Older versions of a material are only visible to its teacher
+		query = `
+			SELECT EXISTS(SELECT 1 FROM course_materials cm JOIN courses c ON c.id = cm.course_id
+			              WHERE cm.file_path = ? AND c.teacher_id = ?)
+			    OR EXISTS(SELECT 1 FROM quizzes_new q JOIN courses c ON c.id = q.course_id
+			              WHERE q.pdf_file_path = ? AND c.teacher_id = ?)
+			    OR EXISTS(SELECT 1 FROM material_versions mv JOIN course_materials cm ON cm.id = mv.material_id
+			              JOIN courses c ON c.id = cm.course_id
+			              WHERE mv.file_path = ? AND c.teacher_id = ?)
+			    OR EXISTS(SELECT 1 FROM quiz_submissions qs JOIN quizzes_new q ON q.id = qs.quiz_id
+			              JOIN courses c ON c.id = q.course_id
+			              WHERE qs.uploaded_file_path = ? AND c.teacher_id = ?)
+			    OR ` + fmt.Sprintf(uploadOwnedBy, "teacher")
+	case "student":
+		// Submitted answer files belong to the student who submitted them.
+		// Quiz PDFs also depend on the quiz's window and proctoring, which
+		// are checked separately.
+		query = `
+			SELECT EXISTS(SELECT 1 FROM course_materials cm JOIN course_enrollments e ON e.course_id = cm.course_id
+			              WHERE cm.file_path = ? AND e.student_id = ?)
+			    OR EXISTS(SELECT 1 FROM quiz_submissions WHERE uploaded_file_path = ? AND student_id = ?)
+			    OR ` + fmt.Sprintf(uploadOwnedBy, "student")
+	default:
+		return false
+	}
+
+	var args []interface{}
+	for i := 0; i < strings.Count(query, "?")/2; i++ {
+		args = append(args, urlPath, userID)
+	}
+	var allowed bool
+	if err := DB.QueryRow(query, args...).Scan(&allowed); err != nil {
+		log.Printf("Error checking file access for %s: %v", urlPath, err)
+		return false
+	}
+	if !allowed && role == "student" {
+		allowed = canOpenQuizPDF(userID, urlPath)
+	}
+	return allowed
+}
+
+// serveUploadHandler serves files under /uploads/. A request is allowed when
+// it carries a valid signature, when the file is public, or when the bearer
+// token belongs to someone who may see the file. Uploads never run as part
+// of the site: they are sandboxed, and only files a browser displays
+// without running anything are shown inline.
+func serveUploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	urlPath := path.Clean(r.URL.Path)
+	key, ok := blobKeyFromURL(urlPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	accessPath := fileAccessPath(urlPath)
+	allowed := verifyFileSignature(urlPath, r.URL.Query()) || isPublicFile(accessPath)
+	if !allowed {
+		if claims, ok := claimsFromRequest(r); ok {
+			userID := claims.StudentID
+			if claims.Role == "teacher" {
+				userID = claims.TeacherID
+			}
+			allowed = canAccessFile(claims.Role, userID, accessPath)
+		}
+	}
+	if !allowed {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	body, info, err := Storage.Get(r.Context(), key)
+	if err == ErrBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading %s from storage: %v", key, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Header().Set("Content-Type", info.ContentType)
+	if !servedInline(info.ContentType) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+
+	// Local files support range requests; remote objects are streamed as-is
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), info.ModTime, seeker)
+		return
+	}
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Error streaming %s: %v", key, err)
+	}
+}
+
+// inlineContentTypes are the uploads opened in the browser rather than
+// downloaded: raster images, PDFs and videos
+var inlineContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/x-ms-bmp", "application/pdf"}
+
+func servedInline(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "video/") || containsString(inlineContentTypes, mediaType)
+}
+
+// signFileHandler returns a signed URL for an uploaded file the caller may access
+func signFileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	role, userID, ok := requestUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	urlPath := path.Clean(r.URL.Query().Get("path"))
+	if _, ok := blobKeyFromURL(urlPath); !ok {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+
+	accessPath := fileAccessPath(urlPath)
+	if !isPublicFile(accessPath) && !canAccessFile(role, userID, accessPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	log.Printf("Signed file URL for %s %d: %s", role, userID, urlPath)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"url":        signFileURL(urlPath),
+		"expires_in": int(signedURLTTL.Seconds()),
+	})
+}
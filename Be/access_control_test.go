@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyFileSignature(t *testing.T) {
+	const urlPath = "/uploads/materials/bab-1.pdf"
+	future := time.Now().Add(time.Minute).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	query := func(expires int64, sig string) url.Values {
+		return url.Values{"expires": {strconv.FormatInt(expires, 10)}, "sig": {sig}}
+	}
+
+	tests := []struct {
+		name    string
+		urlPath string
+		query   url.Values
+		valid   bool
+	}{
+		{"valid", urlPath, query(future, fileSignature(urlPath, future)), true},
+		{"expired", urlPath, query(past, fileSignature(urlPath, past)), false},
+		{"other file", "/uploads/materials/bab-2.pdf", query(future, fileSignature(urlPath, future)), false},
+		{"expiry pushed back", urlPath, query(future+3600, fileSignature(urlPath, future)), false},
+		{"wrong signature", urlPath, query(future, fileSignature(urlPath, future)[1:]+"0"), false},
+		{"no signature", urlPath, url.Values{"expires": {strconv.FormatInt(future, 10)}}, false},
+		{"no expiry", urlPath, url.Values{"sig": {fileSignature(urlPath, 0)}}, false},
+		{"unreadable expiry", urlPath, url.Values{"expires": {"soon"}, "sig": {fileSignature(urlPath, future)}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyFileSignature(tt.urlPath, tt.query); got != tt.valid {
+				t.Errorf("verifyFileSignature() = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSignFileURLRoundTrip(t *testing.T) {
+	saved := Storage
+	defer func() { Storage = saved }()
+	store, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	Storage = store
+
+	const urlPath = "/uploads/materials/bab-1.pdf"
+	signed, err := url.Parse(signFileURL(urlPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Path != urlPath {
+		t.Errorf("signFileURL() path = %q, want %q", signed.Path, urlPath)
+	}
+	if !verifyFileSignature(signed.Path, signed.Query()) {
+		t.Errorf("signFileURL() = %q does not verify", signed)
+	}
+	if verifyFileSignature("/uploads/materials/bab-2.pdf", signed.Query()) {
+		t.Errorf("signature of %s verifies for another file", urlPath)
+	}
+	if got := signFileURL("/static/bab-1.pdf"); got != "" {
+		t.Errorf("signFileURL() of a path outside /uploads/ = %q, want none", got)
+	}
+}
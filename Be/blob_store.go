@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned when a key does not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored object
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore is where uploaded files live. Keys are slash-separated paths
+// relative to the uploads root, e.g. "materials/123_notes.pdf"; the public
+// URL path of a key is "/uploads/" + key.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// Storage is the configured blob store
+var Storage BlobStore
+
+// InitStorage selects the blob store from STORAGE_BACKEND ("local" or "s3")
+func InitStorage() error {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "local"
+	}
+
+	switch backend {
+	case "local":
+		root := os.Getenv("UPLOADS_DIR")
+		if root == "" {
+			root = "./uploads"
+		}
+		store, err := newLocalBlobStore(root)
+		if err != nil {
+			return err
+		}
+		Storage = store
+	case "s3":
+		store, err := newS3BlobStoreFromEnv()
+		if err != nil {
+			return err
+		}
+		Storage = store
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+
+	log.Printf("✅ File storage backend: %s", backend)
+	return nil
+}
+
+// blobKeyFromURL converts an /uploads/ URL path into a store key
+func blobKeyFromURL(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, "/uploads/") {
+		return "", false
+	}
+	key, err := cleanBlobKey(strings.TrimPrefix(urlPath, "/uploads/"))
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// blobURL is the public URL path of a key
+func blobURL(key string) string {
+	return "/uploads/" + key
+}
+
+// cleanBlobKey rejects keys that are empty or would escape the uploads root
+func cleanBlobKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "\\") || cleaned != "/"+key {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return strings.TrimPrefix(cleaned, "/"), nil
+}
+
+// blobContentType guesses a content type from the key's extension
+func blobContentType(key string) string {
+	if ct := mime.TypeByExtension(strings.ToLower(path.Ext(key))); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// localBlobStore keeps files on the local disk under root
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create uploads directory: %w", err)
+	}
+	return &localBlobStore{root: root}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial file
+func (s *localBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Get returns an *os.File, so callers can seek in it for range requests
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, nil, ErrBlobNotFound
+	}
+	return f, &BlobInfo{Key: key, Size: stat.Size(), ContentType: blobContentType(key), ModTime: stat.ModTime()}, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List walks the tree below root and returns the files whose key starts with prefix
+func (s *localBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(s.root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ContentType: blobContentType(key), ModTime: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
+
+// SignedURL points at serveUploadHandler, which checks the HMAC signature
+func (s *localBlobStore) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	urlPath := blobURL(key)
+	expires := time.Now().Add(ttl).Unix()
+	return fmt.Sprintf("%s?expires=%d&sig=%s", urlPath, expires, fileSignature(urlPath, expires)), nil
+}
@@ -3,13 +3,8 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -40,6 +35,8 @@ type UploadResponse struct {
 	Success  bool   `json:"success"`
 	FilePath string `json:"file_path"`
 	Message  string `json:"message"`
+	// Dimensions, srcset and variant URLs when the upload is an image
+	*ImageUploadInfo
 }
 
 // createCourseHandler handles the creation of a new course
@@ -97,6 +94,7 @@ func createCourseHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create course", http.StatusInternalServerError)
 		return
 	}
+	refreshUploadReferences(req.ImagePath)
 
 	// Get the ID of the newly created course
 	courseID, err := result.LastInsertId()
@@ -171,81 +169,21 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 	
-	// Validate file size
-	if handler.Size > 15<<20 { // 15 MB in bytes
-		log.Printf("File too large: %d bytes", handler.Size)
-		http.Error(w, "File too large. Maximum size is 15MB", http.StatusBadRequest)
-		return
-	}
-	
-	// Validate file type
-	fileName := handler.Filename
-	fileExt := strings.ToLower(filepath.Ext(fileName))
-	
-	// Check if the file extension is allowed
-	allowedExts := map[string]bool{
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".gif":  true,
-		".webp": true,
-	}
-	
-	if !allowedExts[fileExt] {
-		log.Printf("Invalid file type: %s", fileExt)
-		http.Error(w, "Invalid file type. Allowed types: JPG, PNG, GIF, WEBP", http.StatusBadRequest)
-		return
-	}
-	
-	log.Printf("File upload: name=%s, size=%d bytes, type=%s", fileName, handler.Size, fileExt)
-
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads"
-	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
-		err = os.MkdirAll(uploadsDir, 0755)
-		if err != nil {
-			log.Printf("Error creating uploads directory: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Generate a unique filename and clean special characters
-	cleanFilename := strings.ReplaceAll(handler.Filename, " ", "_")
-	cleanFilename = strings.ReplaceAll(cleanFilename, "(", "")
-	cleanFilename = strings.ReplaceAll(cleanFilename, ")", "")
-	cleanFilename = strings.ReplaceAll(cleanFilename, "[", "")
-	cleanFilename = strings.ReplaceAll(cleanFilename, "]", "")
-	cleanFilename = strings.ReplaceAll(cleanFilename, "{", "")
-	cleanFilename = strings.ReplaceAll(cleanFilename, "}", "")
-	filename := fmt.Sprintf("%d_%s", time.Now().UnixNano(), cleanFilename)
-
-	// Create the file
-	filePath := filepath.Join(uploadsDir, filename)
-	dst, err := os.Create(filePath)
+	// Validate, scan and save the uploaded image
+	stored, err := processUpload(r.Context(), courseImageUploads, file, handler, uploadOwner{Role: "teacher", ID: teacherID})
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		log.Printf("Course image upload %s failed: %v", handler.Filename, err)
+		writeUploadError(w, err)
 		return
 	}
-	defer dst.Close()
-
-	// Copy the file content
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		log.Printf("Error copying file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
-		return
-	}
-
-	// Create the URL path for the file (different from the filesystem path)
-	urlPath := "/uploads/" + filename
+	urlPath := stored.URLPath
 	log.Printf("File uploaded successfully. Path: %s", urlPath)
 	
 	response := UploadResponse{
-		Success:  true,
-		FilePath: urlPath,
-		Message:  "File uploaded successfully",
+		Success:         true,
+		FilePath:        urlPath,
+		Message:         "File uploaded successfully",
+		ImageUploadInfo: imageUploadInfo(stored),
 	}
 
 	w.WriteHeader(http.StatusOK)
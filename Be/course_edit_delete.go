@@ -101,12 +101,9 @@ func updateCourseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete old image if there's a new image or if image is being removed
-	if currentImagePath != "" && currentImagePath != req.ImagePath {
-		log.Printf("Deleting old image: %s", currentImagePath)
-		if err := deleteFile(currentImagePath); err != nil {
-			log.Printf("Warning: Failed to delete old image %s: %v", currentImagePath, err)
-		}
+	// The old image is garbage collected once no course uses it any more
+	if currentImagePath != req.ImagePath {
+		refreshUploadReferences(currentImagePath, req.ImagePath)
 	}
 
 	// Get updated course
@@ -209,12 +206,9 @@ func deleteCourseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the image file if it exists
-	if imagePath != "" {
-		if err := deleteFile(imagePath); err != nil {
-			log.Printf("Warning: Failed to delete image %s: %v", imagePath, err)
-		}
-	}
+	// The image may be shared with other courses; garbage collection
+	// removes it once it is unused
+	refreshUploadReferences(imagePath)
 
 	// Return success response
 	w.WriteHeader(http.StatusOK)
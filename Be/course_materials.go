@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -17,27 +17,47 @@ import (
 
 // CourseMaterial represents a course material
 type CourseMaterial struct {
-	ID          int       `json:"id"`
-	CourseID    int       `json:"course_id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Type        string    `json:"type"` // "image", "pdf", "video", "youtube"
-	FilePath    string    `json:"file_path"`
-	YouTubeURL  string    `json:"youtube_url"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID            int           `json:"id"`
+	CourseID      int           `json:"course_id"`
+	Title         string        `json:"title"`
+	Description   string        `json:"description"`
+	Type          string        `json:"type"` // "image", "pdf", "video", "youtube", "richtext", "link", "document"
+	FilePath      string        `json:"file_path"`
+	FileURL       string        `json:"file_url,omitempty"` // Short-lived signed URL for file_path
+	YouTubeURL    string        `json:"youtube_url"`
+	Content       string        `json:"content,omitempty"`        // For richtext materials
+	ContentFormat string        `json:"content_format,omitempty"` // "markdown" or "html"
+	LinkURL       string        `json:"link_url,omitempty"`
+	LinkMetadata  *LinkMetadata `json:"link_metadata,omitempty"`
+	// Background processing of uploaded videos and PDFs
+	ProcessingStatus string    `json:"processing_status,omitempty"` // queued, processing, ready or failed
+	DurationSeconds  *float64  `json:"duration_seconds,omitempty"`
+	PosterPath       string    `json:"poster_path,omitempty"`
+	PosterURL        string    `json:"poster_url,omitempty"`
+	HLSURL           string    `json:"hls_url,omitempty"` // Adaptive stream, once processing_status is ready
+	PageCount        *int      `json:"page_count,omitempty"`
+	ThumbnailPath    string    `json:"thumbnail_path,omitempty"` // First page of a PDF
+	ThumbnailURL     string    `json:"thumbnail_url,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
 // CreateMaterialRequest represents the request body for material creation
 type CreateMaterialRequest struct {
-	CourseID    int    `json:"course_id"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Type        string `json:"type"`
-	FilePath    string `json:"file_path"`
-	YouTubeURL  string `json:"youtube_url"`
+	CourseID      int    `json:"course_id"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	Type          string `json:"type"`
+	FilePath      string `json:"file_path"`
+	YouTubeURL    string `json:"youtube_url"`
+	Content       string `json:"content"`
+	ContentFormat string `json:"content_format"`
+	LinkURL       string `json:"link_url"`
 }
 
+// maxRichTextLength caps rich text materials at 1 MB of markup
+const maxRichTextLength = 1 << 20
+
 // createCourseMaterialsTable creates the course_materials table if it doesn't exist
 func createCourseMaterialsTable() error {
 	query := `
@@ -46,9 +66,13 @@ func createCourseMaterialsTable() error {
 			course_id INT NOT NULL,
 			title VARCHAR(255) NOT NULL,
 			description TEXT,
-			type ENUM('image', 'pdf', 'video', 'youtube') NOT NULL,
+			type ENUM('image', 'pdf', 'video', 'youtube', 'richtext', 'link', 'document') NOT NULL,
 			file_path VARCHAR(500),
 			youtube_url VARCHAR(500),
+			content LONGTEXT NULL,
+			content_format VARCHAR(20) NULL,
+			link_url VARCHAR(1000) NULL,
+			link_metadata JSON NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			FOREIGN KEY (course_id) REFERENCES courses(id) ON DELETE CASCADE
@@ -60,6 +84,23 @@ func createCourseMaterialsTable() error {
 		return fmt.Errorf("failed to create course_materials table: %v", err)
 	}
 
+	// Bring tables created before the richtext/link/document types up to date
+	_, err = DB.Exec("ALTER TABLE course_materials MODIFY COLUMN type ENUM('image', 'pdf', 'video', 'youtube', 'richtext', 'link', 'document') NOT NULL")
+	if err != nil {
+		return fmt.Errorf("failed to extend course_materials.type: %v", err)
+	}
+	newColumns := []struct{ name, definition string }{
+		{"content", "LONGTEXT NULL"},
+		{"content_format", "VARCHAR(20) NULL"},
+		{"link_url", "VARCHAR(1000) NULL"},
+		{"link_metadata", "JSON NULL"},
+	}
+	for _, col := range newColumns {
+		if err := ensureColumn(DB, "course_materials", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
 	log.Println("✅ Course materials table created/verified successfully!")
 	return nil
 }
@@ -113,40 +154,37 @@ func createCourseMaterialHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate type
-	validTypes := map[string]bool{
-		"image":   true,
-		"pdf":     true,
-		"video":   true,
-		"youtube": true,
-	}
-	if !validTypes[req.Type] {
-		http.Error(w, "Invalid material type", http.StatusBadRequest)
+	// Validate type-specific fields
+	linkMetadata, err := validateMaterialRequest(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Validate based on type
-	if req.Type == "youtube" && req.YouTubeURL == "" {
-		http.Error(w, "YouTube URL is required for YouTube materials", http.StatusBadRequest)
+	if err := checkMaterialFile(courseID, teacherID, &req); err != nil {
+		writeMaterialFileError(w, err)
 		return
 	}
-	if (req.Type == "image" || req.Type == "pdf" || req.Type == "video") && req.FilePath == "" {
-		http.Error(w, "File path is required for file-based materials", http.StatusBadRequest)
-		return
+
+	var linkMetadataJSON interface{}
+	if linkMetadata != nil {
+		encoded, _ := json.Marshal(linkMetadata)
+		linkMetadataJSON = string(encoded)
 	}
 
 	// Insert the material into the database
 	query := `
-		INSERT INTO course_materials (course_id, title, description, type, file_path, youtube_url)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO course_materials (course_id, title, description, type, file_path, youtube_url, content, content_format, link_url, link_metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := DB.Exec(query, req.CourseID, req.Title, req.Description, req.Type, req.FilePath, req.YouTubeURL)
+	result, err := DB.Exec(query, req.CourseID, req.Title, req.Description, req.Type, req.FilePath, req.YouTubeURL,
+		nullIfEmpty(req.Content), nullIfEmpty(req.ContentFormat), nullIfEmpty(req.LinkURL), linkMetadataJSON)
 	if err != nil {
 		log.Printf("Error creating course material: %v", err)
 		http.Error(w, "Failed to create course material", http.StatusInternalServerError)
 		return
 	}
+	refreshUploadReferences(req.FilePath)
 
 	// Get the ID of the newly created material
 	materialID, err := result.LastInsertId()
@@ -155,18 +193,24 @@ func createCourseMaterialHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to get material ID", http.StatusInternalServerError)
 		return
 	}
+	processingStatus := syncMaterialProcessing(int(materialID))
 
 	// Create response
 	material := CourseMaterial{
-		ID:          int(materialID),
-		CourseID:    req.CourseID,
-		Title:       req.Title,
-		Description: req.Description,
-		Type:        req.Type,
-		FilePath:    req.FilePath,
-		YouTubeURL:  req.YouTubeURL,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		ID:               int(materialID),
+		CourseID:         req.CourseID,
+		Title:            req.Title,
+		Description:      req.Description,
+		Type:             req.Type,
+		FilePath:         req.FilePath,
+		YouTubeURL:       req.YouTubeURL,
+		Content:          req.Content,
+		ContentFormat:    req.ContentFormat,
+		LinkURL:          req.LinkURL,
+		LinkMetadata:     linkMetadata,
+		ProcessingStatus: processingStatus,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
 	}
 
 	// Return the created material
@@ -178,10 +222,138 @@ func createCourseMaterialHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// validateMaterialRequest checks the fields required by each material type
+// and normalizes them in place. Rich text is sanitized and link materials are
+// unfurled here so the stored row is always safe to render.
+func validateMaterialRequest(ctx context.Context, req *CreateMaterialRequest) (*LinkMetadata, error) {
+	switch req.Type {
+	case "image", "pdf", "video", "document":
+	default:
+		// Only file-based materials reference an upload
+		req.FilePath = ""
+	}
+
+	switch req.Type {
+	case "youtube":
+		if req.YouTubeURL == "" {
+			return nil, fmt.Errorf("YouTube URL is required for YouTube materials")
+		}
+	case "image", "pdf", "video":
+		if req.FilePath == "" {
+			return nil, fmt.Errorf("File path is required for file-based materials")
+		}
+	case "document":
+		if req.FilePath == "" {
+			return nil, fmt.Errorf("File path is required for file-based materials")
+		}
+		if _, ok := officeDocumentMarkers[strings.ToLower(filepath.Ext(req.FilePath))]; !ok {
+			return nil, fmt.Errorf("Document materials must be DOCX or PPTX files")
+		}
+	case "richtext":
+		if req.ContentFormat == "" {
+			req.ContentFormat = "markdown"
+		}
+		if req.ContentFormat != "markdown" && req.ContentFormat != "html" {
+			return nil, fmt.Errorf("Content format must be markdown or html")
+		}
+		if strings.TrimSpace(req.Content) == "" {
+			return nil, fmt.Errorf("Content is required for rich text materials")
+		}
+		if len(req.Content) > maxRichTextLength {
+			return nil, fmt.Errorf("Content is too long. Maximum size is 1MB")
+		}
+		content, err := sanitizeRichText(req.Content, req.ContentFormat)
+		if err != nil {
+			return nil, err
+		}
+		req.Content = content
+	case "link":
+		u, err := validateLinkURL(req.LinkURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid link URL: %v", err)
+		}
+		req.LinkURL = u.String()
+		meta, err := unfurlLink(ctx, req.LinkURL)
+		if err != nil {
+			log.Printf("Warning: could not unfurl link %s: %v", req.LinkURL, err)
+		}
+		return meta, nil
+	default:
+		return nil, fmt.Errorf("Invalid material type")
+	}
+	return nil, nil
+}
+
+// materialFileKinds is the kind of file each file-based material type holds
+var materialFileKinds = map[string]string{
+	"image":    "image",
+	"pdf":      "document",
+	"video":    "video",
+	"document": "document",
+}
+
+// checkMaterialFile makes sure a material only points at a material upload
+// of the right kind that the teacher uploaded, or at a file the course
+// already uses. Materials grant access to their file, so any other path
+// would expose someone else's upload.
+func checkMaterialFile(courseID, teacherID int, req *CreateMaterialRequest) error {
+	if req.FilePath == "" {
+		return nil
+	}
+	key, ok := blobKeyFromURL(req.FilePath)
+	if !ok || blobURL(key) != req.FilePath || !strings.HasPrefix(key, materialUploads.Dir+"/") {
+		return rejectUpload("File path must be a material upload")
+	}
+	ext := strings.ToLower(filepath.Ext(key))
+	if format, known := fileFormats[ext]; !known || format.Kind != materialFileKinds[req.Type] ||
+		(req.Type == "pdf" && ext != ".pdf") {
+		return rejectUpload("File is not a valid %s material", req.Type)
+	}
+
+	var allowed bool
+	err := DB.QueryRow(`
+		SELECT `+fmt.Sprintf(uploadOwnedBy, "teacher")+`
+		    OR EXISTS(SELECT 1 FROM course_materials WHERE file_path = ? AND course_id = ?)
+		    OR EXISTS(SELECT 1 FROM material_versions mv JOIN course_materials cm ON cm.id = mv.material_id
+		              WHERE mv.file_path = ? AND cm.course_id = ?)
+	`, req.FilePath, teacherID, req.FilePath, courseID, req.FilePath, courseID).Scan(&allowed)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return rejectUpload("File not found among your uploads")
+	}
+	return nil
+}
+
+// writeMaterialFileError reports a checkMaterialFile failure
+func writeMaterialFileError(w http.ResponseWriter, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		http.Error(w, ue.Message, ue.Status)
+		return
+	}
+	log.Printf("Error checking material file: %v", err)
+	http.Error(w, "Server error", http.StatusInternalServerError)
+}
+
+// nullIfEmpty stores empty optional strings as NULL
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
 // getCourseMaterialsHandler retrieves all materials for a specific course
 func getCourseMaterialsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	role, userID, ok := requestUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	// Get course ID from URL
 	vars := mux.Vars(r)
 	courseIDStr := vars["courseId"]
@@ -191,6 +363,12 @@ func getCourseMaterialsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only course staff and enrolled students may see the materials
+	if !canAccessCourse(role, userID, courseID) {
+		http.Error(w, "Course not found or access denied", http.StatusForbidden)
+		return
+	}
+
 	// Get materials for the course
 	materials, err := GetMaterialsByCourse(courseID)
 	if err != nil {
@@ -198,6 +376,7 @@ func getCourseMaterialsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to get course materials", http.StatusInternalServerError)
 		return
 	}
+	signMaterialFiles(materials)
 
 	// Return the materials
 	w.WriteHeader(http.StatusOK)
@@ -207,13 +386,75 @@ func getCourseMaterialsHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// materialSelectColumns is the column list scanned by scanMaterial
+const materialSelectColumns = `
+	id, course_id, title, description, type,
+	IFNULL(file_path, '') as file_path,
+	IFNULL(youtube_url, '') as youtube_url,
+	IFNULL(content, '') as content,
+	IFNULL(content_format, '') as content_format,
+	IFNULL(link_url, '') as link_url,
+	link_metadata,
+	IFNULL(processing_status, '') as processing_status,
+	duration_seconds,
+	IFNULL(poster_path, '') as poster_path,
+	page_count,
+	IFNULL(thumbnail_path, '') as thumbnail_path,
+	created_at, updated_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMaterial scans a row selected with materialSelectColumns
+func scanMaterial(row rowScanner) (*CourseMaterial, error) {
+	var material CourseMaterial
+	var linkMetadata sql.NullString
+	var duration sql.NullFloat64
+	var pageCount sql.NullInt64
+	err := row.Scan(
+		&material.ID,
+		&material.CourseID,
+		&material.Title,
+		&material.Description,
+		&material.Type,
+		&material.FilePath,
+		&material.YouTubeURL,
+		&material.Content,
+		&material.ContentFormat,
+		&material.LinkURL,
+		&linkMetadata,
+		&material.ProcessingStatus,
+		&duration,
+		&material.PosterPath,
+		&pageCount,
+		&material.ThumbnailPath,
+		&material.CreatedAt,
+		&material.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if duration.Valid {
+		material.DurationSeconds = &duration.Float64
+	}
+	if pageCount.Valid {
+		pages := int(pageCount.Int64)
+		material.PageCount = &pages
+	}
+	if linkMetadata.Valid && linkMetadata.String != "" {
+		var meta LinkMetadata
+		if err := json.Unmarshal([]byte(linkMetadata.String), &meta); err == nil {
+			material.LinkMetadata = &meta
+		}
+	}
+	return &material, nil
+}
+
 // GetMaterialsByCourse retrieves all materials for a specific course
 func GetMaterialsByCourse(courseID int) ([]CourseMaterial, error) {
-	query := `
-		SELECT id, course_id, title, description, type, 
-		       IFNULL(file_path, '') as file_path, 
-		       IFNULL(youtube_url, '') as youtube_url, 
-		       created_at, updated_at
+	query := `SELECT ` + materialSelectColumns + `
 		FROM course_materials 
 		WHERE course_id = ? 
 		ORDER BY created_at DESC
@@ -227,23 +468,12 @@ func GetMaterialsByCourse(courseID int) ([]CourseMaterial, error) {
 
 	var materials []CourseMaterial
 	for rows.Next() {
-		var material CourseMaterial
-		err := rows.Scan(
-			&material.ID,
-			&material.CourseID,
-			&material.Title,
-			&material.Description,
-			&material.Type,
-			&material.FilePath,
-			&material.YouTubeURL,
-			&material.CreatedAt,
-			&material.UpdatedAt,
-		)
+		material, err := scanMaterial(rows)
 		if err != nil {
 			log.Printf("Error scanning material row: %v", err)
 			continue
 		}
-		materials = append(materials, material)
+		materials = append(materials, *material)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -253,6 +483,28 @@ func GetMaterialsByCourse(courseID int) ([]CourseMaterial, error) {
 	return materials, nil
 }
 
+// signMaterialFiles fills in short-lived download URLs for file-based materials
+func signMaterialFiles(materials []CourseMaterial) {
+	for i := range materials {
+		materials[i].FileURL = signFileURL(materials[i].FilePath)
+		if materials[i].PosterPath != "" {
+			materials[i].PosterURL = signFileURL(materials[i].PosterPath)
+		}
+		if materials[i].ThumbnailPath != "" {
+			materials[i].ThumbnailURL = signFileURL(materials[i].ThumbnailPath)
+		}
+		if materials[i].Type == "video" && materials[i].ProcessingStatus == "ready" {
+			materials[i].HLSURL = materialHLSURL(materials[i].ID)
+		}
+	}
+}
+
+// GetMaterialByID retrieves a single material
+func GetMaterialByID(materialID int) (*CourseMaterial, error) {
+	row := DB.QueryRow(`SELECT `+materialSelectColumns+` FROM course_materials WHERE id = ?`, materialID)
+	return scanMaterial(row)
+}
+
 // deleteMaterialHandler handles the deletion of a course material
 func deleteMaterialHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -291,6 +543,12 @@ func deleteMaterialHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Collect the material's files, including those kept for older versions
+	filePaths, err := materialFilePaths(materialID)
+	if err != nil {
+		log.Printf("Error collecting material files: %v", err)
+	}
+
 	// Delete the material
 	_, err = DB.Exec("DELETE FROM course_materials WHERE id = ?", materialID)
 	if err != nil {
@@ -299,6 +557,9 @@ func deleteMaterialHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Files are collected later, once unreferenced for the grace period
+	refreshUploadReferences(filePaths...)
+
 	// Return success response
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -315,7 +576,7 @@ func uploadMaterialFileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Check if user is authenticated
-	_, ok := r.Context().Value("user_id").(int)
+	teacherID, ok := r.Context().Value("user_id").(int)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -338,112 +599,22 @@ func uploadMaterialFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file size
-	if handler.Size > 100<<20 { // 100 MB in bytes
-		log.Printf("File too large: %d bytes", handler.Size)
-		http.Error(w, "File too large. Maximum size is 100MB", http.StatusBadRequest)
-		return
-	}
-
-	// Validate file type
-	fileName := handler.Filename
-	fileExt := strings.ToLower(filepath.Ext(fileName))
-
-	// Check if the file extension is allowed
-	allowedExts := map[string]bool{
-		// Images
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".gif":  true,
-		".webp": true,
-		".bmp":  true,
-		".svg":  true,
-		// Documents
-		".pdf":  true,
-		".doc":  true,
-		".docx": true,
-		".xls":  true,
-		".xlsx": true,
-		".ppt":  true,
-		".pptx": true,
-		".txt":  true,
-		".rtf":  true,
-		".odt":  true,
-		".ods":  true,
-		".odp":  true,
-		// Videos
-		".mp4":  true,
-		".avi":  true,
-		".mov":  true,
-		".wmv":  true,
-		".flv":  true,
-		".webm": true,
-		".mkv":  true,
-		".m4v":  true,
-		".3gp":  true,
-		".mpg":  true,
-		".mpeg": true,
-		// Audio
-		".mp3":  true,
-		".wav":  true,
-		".flac": true,
-		".aac":  true,
-		".ogg":  true,
-		".wma":  true,
-		".m4a":  true,
-		// Archives
-		".zip": true,
-		".rar": true,
-		".7z":  true,
-		".tar": true,
-		".gz":  true,
-		// Other
-		".csv":  true,
-		".json": true,
-		".xml":  true,
-	}
-
-	if !allowedExts[fileExt] {
-		log.Printf("Invalid file type: %s", fileExt)
-		http.Error(w, "Invalid file type. Please upload a valid document, image, video, audio, or archive file.", http.StatusBadRequest)
-		return
-	}
-
-	log.Printf("Material file upload: name=%s, size=%d bytes, type=%s", fileName, handler.Size, fileExt)
-
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads/materials"
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		log.Printf("Error creating uploads directory: %v", err)
-		http.Error(w, "Error creating upload directory", http.StatusInternalServerError)
-		return
-	}
-
-	// Generate unique filename
-	timestamp := time.Now().Unix()
-	uniqueFileName := fmt.Sprintf("%d_%s", timestamp, fileName)
-	filePath := filepath.Join(uploadsDir, uniqueFileName)
-
-	// Create the file
-	dst, err := os.Create(filePath)
-	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		http.Error(w, "Error creating file", http.StatusInternalServerError)
-		return
+	// Document materials are limited to Word and PowerPoint files
+	if r.FormValue("type") == "document" {
+		if _, ok := officeDocumentMarkers[strings.ToLower(filepath.Ext(handler.Filename))]; !ok {
+			http.Error(w, "Document materials must be DOCX or PPTX files", http.StatusBadRequest)
+			return
+		}
 	}
-	defer dst.Close()
 
-	// Copy the uploaded file to the destination
-	_, err = io.Copy(dst, file)
+	// Validate, scan and save the uploaded file
+	stored, err := processUpload(r.Context(), materialUploads, file, handler, uploadOwner{Role: "teacher", ID: teacherID})
 	if err != nil {
-		log.Printf("Error copying file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		log.Printf("Material upload %s failed: %v", handler.Filename, err)
+		writeUploadError(w, err)
 		return
 	}
-
-	// Create the URL path for the file
-	urlPath := "/uploads/materials/" + uniqueFileName
+	urlPath := stored.URLPath
 	log.Printf("Material uploaded successfully. Path: %s", urlPath)
 
 	response := map[string]interface{}{
@@ -451,6 +622,9 @@ func uploadMaterialFileHandler(w http.ResponseWriter, r *http.Request) {
 		"file_path": urlPath,
 		"message":   "File uploaded successfully",
 	}
+	if status := queueUploadedPDF(stored); status != "" {
+		response["processing_status"] = status
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
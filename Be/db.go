@@ -70,6 +70,41 @@ func InitDB() error {
 		fmt.Printf("⚠️  Warning: Gagal membuat tabel course_materials: %v\n", err)
 	}
 
+	// Create material version history and deferred file deletion tables
+	if err := createMaterialVersionsTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel material_versions: %v\n", err)
+	}
+	if err := createUploadsTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel uploads: %v\n", err)
+	}
+	if err := createUploadQuarantineTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel upload_quarantine: %v\n", err)
+	}
+	if err := createImageVariantsTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel image_variants: %v\n", err)
+	}
+	if err := createResumableUploadTables(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel resumable_uploads: %v\n", err)
+	}
+
+	// Background job queue and video transcodes
+	if err := createJobsTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel jobs: %v\n", err)
+	}
+	if err := createVideoTranscodesTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel video_transcodes: %v\n", err)
+	}
+
+	// Create PDF preview and text table
+	if err := createPDFDocumentsTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel pdf_documents: %v\n", err)
+	}
+
+	// Create material progress tracking table
+	if err := createMaterialProgressTable(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat tabel material_progress: %v\n", err)
+	}
+
 	// Initialize second database connection (admin dashboard)
 	if err := initSecondDB(); err != nil {
 		fmt.Printf("⚠️  Warning: Gagal koneksi DB2 (admin dashboard): %v\n", err)
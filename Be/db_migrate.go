@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// ensureColumn adds a column to an existing table if it is not there yet.
+// CREATE TABLE IF NOT EXISTS does not touch tables created by older
+// versions, so new columns have to be added explicitly.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+	`, table, column).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check column %s.%s: %v", table, column, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
+	log.Printf("✅ Added column %s.%s", table, column)
+	return nil
+}
+
+// ensureIndex creates an index on an existing table if it is not there yet.
+// kind is the index type prefix, e.g. "INDEX", "UNIQUE INDEX" or "FULLTEXT INDEX".
+func ensureIndex(db *sql.DB, table, name, kind, columns string) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+	`, table, name).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check index %s.%s: %v", table, name, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("CREATE %s %s ON %s (%s)", kind, name, table, columns)); err != nil {
+		return fmt.Errorf("failed to create index %s.%s: %v", table, name, err)
+	}
+	log.Printf("✅ Created index %s.%s", table, name)
+	return nil
+}
+
+// dropIndex removes an index from a table if it is there. Create the index
+// replacing it first when a foreign key depends on it.
+func dropIndex(db *sql.DB, table, name string) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+	`, table, name).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check index %s.%s: %v", table, name, err)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DROP INDEX %s ON %s", name, table)); err != nil {
+		return fmt.Errorf("failed to drop index %s.%s: %v", table, name, err)
+	}
+	log.Printf("✅ Dropped index %s.%s", table, name)
+	return nil
+}
@@ -340,4 +340,18 @@ func getAllAvailableCoursesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"courses": courses,
 	})
+}
+
+// isStudentEnrolled reports whether a student is enrolled in a course
+func isStudentEnrolled(courseID, studentID int) bool {
+	var enrolled bool
+	err := DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM course_enrollments WHERE course_id = ? AND student_id = ?)",
+		courseID, studentID,
+	).Scan(&enrolled)
+	if err != nil {
+		log.Printf("Error checking enrollment: %v", err)
+		return false
+	}
+	return enrolled
 }
\ No newline at end of file
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxImagePixels guards against decompression bombs: small files that
+	// decode to enormous images
+	maxImagePixels = 50_000_000
+	jpegQuality    = 85
+	webpQuality    = 80
+	webpTimeout    = time.Minute
+)
+
+// imageRules are the dimension limits and resized variants for a category
+// of image uploads
+type imageRules struct {
+	MinWidth      int
+	MinHeight     int
+	MaxEdge       int   // Larger images are scaled down before they are stored
+	VariantWidths []int // Widths of the resized copies, smallest first
+}
+
+var (
+	courseImageRules = &imageRules{MinWidth: 320, MinHeight: 180, MaxEdge: 2560, VariantWidths: []int{320, 640, 1280}}
+	newsImageRules   = &imageRules{MinWidth: 320, MinHeight: 180, MaxEdge: 2048, VariantWidths: []int{320, 640, 1024}}
+)
+
+// preparedImage is an uploaded image with its metadata removed
+type preparedImage struct {
+	Data   []byte      // The content to store instead of the upload, nil to keep it
+	Image  image.Image // Decoded pixels for making variants, nil for WebP
+	Format string      // jpeg, png, gif or webp
+	Width  int
+	Height int
+}
+
+// ImageVariant is a resized copy of an uploaded image
+type ImageVariant struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+}
+
+// ImageUploadInfo describes an uploaded image for <img srcset> and <picture>
+type ImageUploadInfo struct {
+	Width        int            `json:"width"`
+	Height       int            `json:"height"`
+	Variants     []ImageVariant `json:"variants"`
+	Srcset       string         `json:"srcset"`
+	WebPSrcset   string         `json:"webp_srcset,omitempty"`
+	ThumbnailURL string         `json:"thumbnail_url"`
+}
+
+// createImageVariantsTable creates the table linking images to their resized copies
+func createImageVariantsTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS image_variants (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			source_path VARCHAR(500) NOT NULL,
+			variant_path VARCHAR(500) NOT NULL,
+			width INT NOT NULL,
+			height INT NOT NULL,
+			format VARCHAR(10) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_variant_path (variant_path),
+			INDEX idx_variant_source (source_path)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	log.Println("✅ Image variants table created/verified successfully!")
+	return nil
+}
+
+// prepareImage checks an uploaded image's dimensions and strips EXIF, XMP
+// and text metadata, which for phone photos includes GPS coordinates. JPEGs
+// are rotated upright first because the orientation tag goes with the EXIF.
+// Images larger than rules.MaxEdge are scaled down. BMP images carry no
+// such metadata and are returned as nil.
+func prepareImage(ctx context.Context, src io.ReaderAt, size int64, ext string, rules *imageRules) (*preparedImage, error) {
+	if ext == ".bmp" {
+		return nil, nil
+	}
+	data := make([]byte, size)
+	if _, err := src.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if ext == ".webp" {
+		return prepareWebP(ctx, data, rules)
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, rejectUpload("Image could not be read")
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	displayWidth, displayHeight := cfg.Width, cfg.Height
+	if orientation >= 5 { // rotated a quarter turn
+		displayWidth, displayHeight = cfg.Height, cfg.Width
+	}
+	if err := checkImageDimensions(displayWidth, displayHeight, rules); err != nil {
+		return nil, err
+	}
+	prepared := &preparedImage{Format: format, Width: cfg.Width, Height: cfg.Height}
+
+	switch format {
+	case "gif":
+		// Re-encoding drops comments and XMP application extensions
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, rejectUpload("Image could not be read")
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			return nil, err
+		}
+		canvas := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+		draw.Draw(canvas, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Over)
+		prepared.Data, prepared.Image = buf.Bytes(), canvas
+		return prepared, nil
+
+	case "jpeg", "png":
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, rejectUpload("Image could not be read")
+		}
+		img = applyOrientation(img, orientation)
+		prepared.Image = img
+		prepared.Width, prepared.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+		if w, h, scaled := fitWithin(prepared.Width, prepared.Height, rules); scaled {
+			prepared.Image = resizeImage(img, w, h)
+			prepared.Width, prepared.Height = w, h
+		} else if orientation <= 1 {
+			// Nothing to change in the pixels, so strip metadata losslessly
+			if format == "jpeg" {
+				prepared.Data, err = stripJPEGMetadata(data)
+			} else {
+				prepared.Data, err = stripPNGMetadata(data)
+			}
+			if err != nil {
+				return nil, rejectUpload("Image could not be read")
+			}
+			return prepared, nil
+		}
+		prepared.Data, err = encodeImage(prepared.Image, format)
+		return prepared, err
+	}
+	return nil, rejectUpload("Unsupported image format")
+}
+
+func prepareWebP(ctx context.Context, data []byte, rules *imageRules) (*preparedImage, error) {
+	width, height, err := webpDimensions(data)
+	if err != nil {
+		return nil, rejectUpload("Image could not be read")
+	}
+	if err := checkImageDimensions(width, height, rules); err != nil {
+		return nil, err
+	}
+	stripped, err := stripWebPMetadata(data)
+	if err != nil {
+		return nil, rejectUpload("Image could not be read")
+	}
+	prepared := &preparedImage{Data: stripped, Format: "webp", Width: width, Height: height}
+
+	// WebP can only be resized when cwebp is installed
+	if w, h, scaled := fitWithin(width, height, rules); scaled && webpEncoderPath() != "" {
+		resized, err := runCWebP(ctx, stripped, ".webp", w, h)
+		if err != nil {
+			log.Printf("Warning: Failed to scale down WebP image: %v", err)
+		} else {
+			prepared.Data, prepared.Width, prepared.Height = resized, w, h
+		}
+	}
+	return prepared, nil
+}
+
+func checkImageDimensions(width, height int, rules *imageRules) error {
+	if width <= 0 || height <= 0 || width*height > maxImagePixels {
+		return rejectUpload("Image dimensions are too large")
+	}
+	if rules != nil && (width < rules.MinWidth || height < rules.MinHeight) {
+		return rejectUpload("Image must be at least %dx%d pixels, got %dx%d", rules.MinWidth, rules.MinHeight, width, height)
+	}
+	return nil
+}
+
+// fitWithin returns the size of an image scaled to fit rules.MaxEdge
+func fitWithin(width, height int, rules *imageRules) (int, int, bool) {
+	if rules == nil || rules.MaxEdge <= 0 || (width <= rules.MaxEdge && height <= rules.MaxEdge) {
+		return width, height, false
+	}
+	if width >= height {
+		return rules.MaxEdge, scaledHeight(width, height, rules.MaxEdge), true
+	}
+	return scaledHeight(height, width, rules.MaxEdge), rules.MaxEdge, true
+}
+
+// scaledHeight is the height of a width x height image scaled to newWidth
+func scaledHeight(width, height, newWidth int) int {
+	h := int(math.Round(float64(height) * float64(newWidth) / float64(width)))
+	if h < 1 {
+		h = 1
+	}
+	return h
+}
+
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// stripJPEGMetadata removes APP1 (EXIF, XMP), APP13 (IPTC) and comment
+// segments while leaving the compressed image data untouched
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker")
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA { // start of scan: the rest is image data
+			return append(out, data[i:]...), nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, fmt.Errorf("truncated JPEG segment")
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out = append(out, data[i:i+2+length]...)
+		}
+		i += 2 + length
+	}
+	return nil, fmt.Errorf("JPEG has no image data")
+}
+
+// stripPNGMetadata removes EXIF, text and timestamp chunks
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signatureLen = 8
+	if len(data) < signatureLen {
+		return nil, fmt.Errorf("not a PNG")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:signatureLen]...)
+	for i := signatureLen; i < len(data); {
+		if i+8 > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebPMetadata removes EXIF and XMP chunks from a WebP container
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP image")
+	}
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			if i+8+size == len(data) { // unpadded final chunk
+				end = len(data)
+			} else {
+				return nil, fmt.Errorf("truncated WebP chunk")
+			}
+		}
+		switch fourCC := string(data[i : i+4]); fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP present flags
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// webpDimensions reads the canvas size from a WebP header
+func webpDimensions(data []byte) (int, int, error) {
+	if len(data) < 30 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, fmt.Errorf("not a WebP image")
+	}
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		w := int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16
+		h := int(chunk[7]) | int(chunk[8])<<8 | int(chunk[9])<<16
+		return w + 1, h + 1, nil
+	case "VP8 ":
+		if chunk[3] != 0x9D || chunk[4] != 0x01 || chunk[5] != 0x2A {
+			return 0, 0, fmt.Errorf("invalid VP8 frame")
+		}
+		w := int(binary.LittleEndian.Uint16(chunk[6:]) & 0x3FFF)
+		h := int(binary.LittleEndian.Uint16(chunk[8:]) & 0x3FFF)
+		return w, h, nil
+	case "VP8L":
+		if chunk[0] != 0x2F {
+			return 0, 0, fmt.Errorf("invalid VP8L stream")
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1, nil
+	}
+	return 0, 0, fmt.Errorf("unknown WebP format")
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from the first IFD of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// applyOrientation transforms an image so that it displays upright without
+// its EXIF orientation tag
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored along the top-right diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// resizeImage scales an image down to width x height by averaging the
+// source pixels under each destination pixel
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	xWeights, yWeights := resizeWeights(sw, width), resizeWeights(sh, height)
+
+	// Horizontal pass into a float buffer, then vertical pass
+	tmp := make([]float64, width*sh*4)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, weights := range xWeights {
+			var acc [4]float64
+			for _, w := range weights {
+				p := row[w.index*4:]
+				acc[0] += float64(p[0]) * w.weight
+				acc[1] += float64(p[1]) * w.weight
+				acc[2] += float64(p[2]) * w.weight
+				acc[3] += float64(p[3]) * w.weight
+			}
+			copy(tmp[(y*width+x)*4:], acc[:])
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, weights := range yWeights {
+		for x := 0; x < width; x++ {
+			var acc [4]float64
+			for _, w := range weights {
+				p := tmp[(w.index*width+x)*4:]
+				acc[0] += p[0] * w.weight
+				acc[1] += p[1] * w.weight
+				acc[2] += p[2] * w.weight
+				acc[3] += p[3] * w.weight
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				d[c] = uint8(math.Min(255, math.Round(acc[c])))
+			}
+		}
+	}
+	return dst
+}
+
+type resizeWeight struct {
+	index  int
+	weight float64
+}
+
+// resizeWeights returns, for each destination pixel, how much each source
+// pixel it covers contributes
+func resizeWeights(srcSize, dstSize int) [][]resizeWeight {
+	scale := float64(srcSize) / float64(dstSize)
+	weights := make([][]resizeWeight, dstSize)
+	for d := range weights {
+		start, end := float64(d)*scale, float64(d+1)*scale
+		for s := int(start); s < srcSize && float64(s) < end; s++ {
+			overlap := math.Min(end, float64(s+1)) - math.Max(start, float64(s))
+			if overlap > 0 {
+				weights[d] = append(weights[d], resizeWeight{index: s, weight: overlap / scale})
+			}
+		}
+	}
+	return weights
+}
+
+var (
+	webpEncoderOnce sync.Once
+	webpEncoder     string
+)
+
+// webpEncoderPath returns the cwebp binary from CWEBP_PATH or PATH, or ""
+// when WebP variants cannot be made
+func webpEncoderPath() string {
+	webpEncoderOnce.Do(func() {
+		name := os.Getenv("CWEBP_PATH")
+		if name == "" {
+			name = "cwebp"
+		}
+		if p, err := exec.LookPath(name); err == nil {
+			webpEncoder = p
+		} else {
+			log.Printf("⚠️  cwebp not found, WebP image variants are disabled")
+		}
+	})
+	return webpEncoder
+}
+
+// runCWebP converts an image file's content to WebP, resized when width and
+// height are non-zero
+func runCWebP(ctx context.Context, input []byte, inputExt string, width, height int) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "webp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := path.Join(dir, "in"+inputExt), path.Join(dir, "out.webp")
+	if err := os.WriteFile(in, input, 0600); err != nil {
+		return nil, err
+	}
+	args := []string{"-quiet", "-metadata", "none", "-q", fmt.Sprint(webpQuality)}
+	if width > 0 && height > 0 {
+		args = append(args, "-resize", fmt.Sprint(width), fmt.Sprint(height))
+	}
+	args = append(args, in, "-o", out)
+
+	ctx, cancel := context.WithTimeout(ctx, webpTimeout)
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, webpEncoderPath(), args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cwebp: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.ReadFile(out)
+}
+
+// ensureImageVariants stores resized copies of an image, and WebP versions
+// when cwebp is available. Variants are named after the source's content
+// hash, so an image uploaded again reuses the existing ones.
+func ensureImageVariants(ctx context.Context, upload *StoredUpload, img *preparedImage, rules *imageRules) ([]ImageVariant, error) {
+	existing, err := loadImageVariants(upload.URLPath)
+	if err != nil || len(existing) > 0 {
+		return existing, err
+	}
+	sourceKey, ok := blobKeyFromURL(upload.URLPath)
+	if !ok {
+		return nil, fmt.Errorf("invalid image path %s", upload.URLPath)
+	}
+	base := strings.TrimSuffix(sourceKey, path.Ext(sourceKey))
+
+	var variants []ImageVariant
+	store := func(width, height int, format, ext string, data []byte) error {
+		key := fmt.Sprintf("%s-%dw%s", base, width, ext)
+		if err := Storage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), blobContentType(key)); err != nil {
+			return err
+		}
+		variant := ImageVariant{URL: blobURL(key), Width: width, Height: height, Format: format, Size: int64(len(data))}
+		if _, err := DB.Exec(`
+			INSERT INTO image_variants (source_path, variant_path, width, height, format, size_bytes)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE size_bytes = VALUES(size_bytes)
+		`, upload.URLPath, variant.URL, width, height, format, variant.Size); err != nil {
+			return err
+		}
+		variants = append(variants, variant)
+		return nil
+	}
+
+	for _, width := range rules.VariantWidths {
+		if width >= img.Width {
+			break
+		}
+		height := scaledHeight(img.Width, img.Height, width)
+
+		var pngData []byte
+		if img.Image != nil {
+			resized := resizeImage(img.Image, width, height)
+			format, ext := "png", ".png"
+			if img.Format == "jpeg" {
+				format, ext = "jpeg", ".jpg"
+			}
+			data, err := encodeImage(resized, format)
+			if err != nil {
+				return variants, err
+			}
+			if err := store(width, height, format, ext, data); err != nil {
+				return variants, err
+			}
+			if format == "png" {
+				pngData = data
+			} else if pngData, err = encodeImage(resized, "png"); err != nil {
+				return variants, err
+			}
+		}
+
+		if webpEncoderPath() == "" {
+			continue
+		}
+		var webp []byte
+		if pngData != nil {
+			webp, err = runCWebP(ctx, pngData, ".png", 0, 0)
+		} else {
+			webp, err = runCWebP(ctx, img.Data, ".webp", width, height)
+		}
+		if err != nil {
+			return variants, err
+		}
+		if err := store(width, height, "webp", ".webp", webp); err != nil {
+			return variants, err
+		}
+	}
+	return variants, nil
+}
+
+// loadImageVariants returns the stored variants of an image, smallest first
+func loadImageVariants(sourcePath string) ([]ImageVariant, error) {
+	rows, err := DB.Query(`
+		SELECT variant_path, width, height, format, size_bytes FROM image_variants
+		WHERE source_path = ? ORDER BY width, format
+	`, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []ImageVariant
+	for rows.Next() {
+		var v ImageVariant
+		if err := rows.Scan(&v.URL, &v.Width, &v.Height, &v.Format, &v.Size); err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
+
+// loadImageVariantPaths returns the paths of every stored image variant
+func loadImageVariantPaths() (map[string]bool, error) {
+	rows, err := DB.Query("SELECT variant_path FROM image_variants")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		paths[p] = true
+	}
+	return paths, rows.Err()
+}
+
+// regenerateImageVariants makes the variants of a stored course or news
+// image again, e.g. after it is restored from quarantine
+func regenerateImageVariants(ctx context.Context, filePath string) error {
+	key, ok := blobKeyFromURL(filePath)
+	if !ok {
+		return fmt.Errorf("invalid image path %s", filePath)
+	}
+	ext := strings.ToLower(path.Ext(key))
+	var category uploadCategory
+	switch path.Dir(key) {
+	case ".":
+		category = courseImageUploads
+	case newsImageUploads.Dir:
+		category = newsImageUploads
+	default:
+		return nil
+	}
+	if !category.allows(ext) {
+		return nil
+	}
+
+	body, info, err := Storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	// The stored copy already passed the dimension checks when it was uploaded
+	rules := *category.Image
+	rules.MinWidth, rules.MinHeight = 0, 0
+	prepared, err := prepareImage(ctx, bytes.NewReader(data), info.Size, ext, &rules)
+	if err != nil || prepared == nil {
+		return err
+	}
+	_, err = ensureImageVariants(ctx, &StoredUpload{URLPath: filePath}, prepared, &rules)
+	return err
+}
+
+// imageVariantSource returns the image a variant was made from. Access to a
+// variant follows access to its source.
+func imageVariantSource(urlPath string) (string, bool) {
+	var source string
+	err := DB.QueryRow("SELECT source_path FROM image_variants WHERE variant_path = ?", urlPath).Scan(&source)
+	return source, err == nil
+}
+
+// deleteImageVariants removes the variants of an image that is being deleted
+func deleteImageVariants(ctx context.Context, sourcePath string) {
+	variants, err := loadImageVariants(sourcePath)
+	if err != nil {
+		log.Printf("Warning: Failed to load variants of %s: %v", sourcePath, err)
+		return
+	}
+	for _, v := range variants {
+		if key, ok := blobKeyFromURL(v.URL); ok {
+			if err := Storage.Delete(ctx, key); err != nil && err != ErrBlobNotFound {
+				log.Printf("Warning: Failed to delete image variant %s: %v", v.URL, err)
+				continue
+			}
+		}
+		DB.Exec("DELETE FROM image_variants WHERE variant_path = ?", v.URL)
+	}
+}
+
+// imageUploadInfo builds srcset strings for an uploaded image. The original
+// is the widest candidate in srcset; the thumbnail is the smallest variant,
+// preferring WebP.
+func imageUploadInfo(upload *StoredUpload) *ImageUploadInfo {
+	if upload.Width == 0 {
+		return nil
+	}
+	info := &ImageUploadInfo{Width: upload.Width, Height: upload.Height, Variants: upload.Variants, ThumbnailURL: upload.URLPath}
+	if info.Variants == nil {
+		info.Variants = []ImageVariant{}
+	}
+
+	var srcset, webpSrcset []string
+	for _, v := range upload.Variants {
+		candidate := fmt.Sprintf("%s %dw", v.URL, v.Width)
+		if v.Format == "webp" {
+			webpSrcset = append(webpSrcset, candidate)
+		} else {
+			srcset = append(srcset, candidate)
+		}
+	}
+	original := fmt.Sprintf("%s %dw", upload.URLPath, upload.Width)
+	if strings.HasSuffix(upload.URLPath, ".webp") {
+		webpSrcset = append(webpSrcset, original)
+	} else {
+		srcset = append(srcset, original)
+	}
+	info.Srcset = strings.Join(srcset, ", ")
+	info.WebPSrcset = strings.Join(webpSrcset, ", ")
+	if info.Srcset == "" { // WebP originals only have WebP variants
+		info.Srcset, info.WebPSrcset = info.WebPSrcset, ""
+	}
+
+	for _, v := range upload.Variants {
+		if v.Format == "webp" {
+			info.ThumbnailURL = v.URL
+			break
+		}
+	}
+	if info.ThumbnailURL == upload.URLPath && len(upload.Variants) > 0 {
+		info.ThumbnailURL = upload.Variants[0].URL
+	}
+	return info
+}
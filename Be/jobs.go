@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Background jobs are rows in the jobs table, claimed by worker goroutines
+// with SELECT ... FOR UPDATE SKIP LOCKED so several server processes can
+// share the queue. Failed jobs are retried with exponential backoff.
+
+const (
+	jobPollInterval     = 5 * time.Second
+	defaultJobAttempts  = 3
+	jobRetryBaseBackoff = time.Minute
+	// Jobs still marked running after this long belonged to a worker that
+	// died and are handed out again
+	jobStaleAfter = 2 * time.Hour
+)
+
+// Job is a claimed row of the jobs table
+type Job struct {
+	ID          int64
+	Type        string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+}
+
+// FinalAttempt reports whether a failure now will not be retried
+func (j *Job) FinalAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+// jobHandler runs one job. Returning an error schedules a retry until the
+// job runs out of attempts.
+type jobHandler func(ctx context.Context, job *Job) error
+
+var jobHandlers = map[string]jobHandler{}
+
+// registerJobHandler sets the function that runs jobs of a type. Handlers
+// are registered from init functions.
+func registerJobHandler(jobType string, handler jobHandler) {
+	jobHandlers[jobType] = handler
+}
+
+// createJobsTable creates the background job queue
+func createJobsTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			job_type VARCHAR(50) NOT NULL,
+			payload JSON NOT NULL,
+			status ENUM('queued', 'running', 'completed', 'failed') NOT NULL DEFAULT 'queued',
+			attempts INT NOT NULL DEFAULT 0,
+			max_attempts INT NOT NULL DEFAULT 3,
+			run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			locked_by VARCHAR(100) NULL,
+			locked_at TIMESTAMP NULL,
+			last_error TEXT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_jobs_ready (status, run_at),
+			INDEX idx_jobs_type (job_type, status)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	log.Println("✅ Jobs table created/verified successfully!")
+	return nil
+}
+
+// enqueueJob adds a job to the queue and returns its ID
+func enqueueJob(jobType string, payload interface{}) (int64, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	result, err := DB.Exec(`
+		INSERT INTO jobs (job_type, payload, max_attempts, run_at) VALUES (?, ?, ?, ?)
+	`, jobType, string(encoded), defaultJobAttempts, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// startJobWorkers starts JOB_WORKERS (default 1) goroutines processing the queue
+func startJobWorkers() {
+	workers, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 1
+	}
+	host, _ := os.Hostname()
+	for i := 0; i < workers; i++ {
+		workerID := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), i)
+		go runJobWorker(workerID)
+	}
+	log.Printf("Started %d background job worker(s)", workers)
+}
+
+func runJobWorker(workerID string) {
+	for {
+		job, err := claimJob(workerID)
+		if err != nil {
+			log.Printf("Warning: Failed to claim job: %v", err)
+		}
+		if job == nil {
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		runJob(job)
+	}
+}
+
+// claimJob takes the oldest due job, or a running job whose worker has gone
+func claimJob(workerID string) (*Job, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var job Job
+	var payload string
+	err = tx.QueryRow(`
+		SELECT id, job_type, payload, attempts, max_attempts FROM jobs
+		WHERE (status = 'queued' AND run_at <= ?) OR (status = 'running' AND locked_at < ?)
+		ORDER BY run_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`, now, now.Add(-jobStaleAfter)).Scan(&job.ID, &job.Type, &payload, &job.Attempts, &job.MaxAttempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job.Attempts++
+	if _, err := tx.Exec(`
+		UPDATE jobs SET status = 'running', attempts = ?, locked_by = ?, locked_at = ? WHERE id = ?
+	`, job.Attempts, workerID, now, job.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	job.Payload = json.RawMessage(payload)
+	return &job, nil
+}
+
+func runJob(job *Job) {
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		finishJob(job, fmt.Errorf("no handler for job type %q", job.Type), false)
+		return
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("job panicked: %v", p)
+			}
+		}()
+		return handler(context.Background(), job)
+	}()
+	finishJob(job, err, true)
+}
+
+// finishJob records the outcome of a job, rescheduling it after a failure
+// while it has attempts left
+func finishJob(job *Job, jobErr error, retry bool) {
+	var err error
+	switch {
+	case jobErr == nil:
+		_, err = DB.Exec(`
+			UPDATE jobs SET status = 'completed', locked_by = NULL, locked_at = NULL, last_error = NULL WHERE id = ?
+		`, job.ID)
+	case retry && !job.FinalAttempt():
+		backoff := jobRetryBaseBackoff << (job.Attempts - 1)
+		log.Printf("Job %d (%s) failed, retrying in %s: %v", job.ID, job.Type, backoff, jobErr)
+		_, err = DB.Exec(`
+			UPDATE jobs SET status = 'queued', run_at = ?, locked_by = NULL, locked_at = NULL, last_error = ? WHERE id = ?
+		`, time.Now().Add(backoff), jobErr.Error(), job.ID)
+	default:
+		log.Printf("Job %d (%s) failed: %v", job.ID, job.Type, jobErr)
+		_, err = DB.Exec(`
+			UPDATE jobs SET status = 'failed', locked_by = NULL, locked_at = NULL, last_error = ? WHERE id = ?
+		`, jobErr.Error(), job.ID)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to record result of job %d: %v", job.ID, err)
+	}
+}
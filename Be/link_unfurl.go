@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LinkMetadata is the preview information shown for link materials
+type LinkMetadata struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	ImageURL    string    `json:"image_url,omitempty"`
+	SiteName    string    `json:"site_name,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+var (
+	htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlMetaPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern  = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// unfurlHTTPClient refuses to connect to loopback, private and link-local
+// addresses so teachers cannot use link materials to probe the school network
+var unfurlHTTPClient = &http.Client{
+	Timeout: 8 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return fmt.Errorf("too many redirects")
+		}
+		return nil
+	},
+}
+
+// blockedPrefixes are the address ranges link previews never connect to:
+// special-purpose ranges from the IANA registries, and translation prefixes
+// that could reach them
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This network", reaches localhost on Linux
+	netip.MustParsePrefix("10.0.0.0/8"),      // Private
+	netip.MustParsePrefix("100.64.0.0/10"),   // Carrier-grade NAT, has cloud metadata endpoints
+	netip.MustParsePrefix("127.0.0.0/8"),     // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // Link-local, has cloud metadata endpoints
+	netip.MustParsePrefix("172.16.0.0/12"),   // Private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // Private
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved and broadcast
+	netip.MustParsePrefix("::/128"),          // Unspecified
+	netip.MustParsePrefix("::1/128"),         // Loopback
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // Discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, includes Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // Unique local
+	netip.MustParsePrefix("fe80::/10"),       // Link-local
+	netip.MustParsePrefix("ff00::/8"),        // Multicast
+}
+
+func isPublicIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	addr = addr.Unmap()
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateLinkURL checks that a link material points to an absolute http(s) URL
+func validateLinkURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("only http and https links are allowed")
+	}
+	return u, nil
+}
+
+// unfurlLink fetches a page and extracts its title, description and preview
+// image from <title> and OpenGraph/Twitter meta tags. Failing to fetch is not
+// fatal: the caller still gets metadata built from the URL itself.
+func unfurlLink(ctx context.Context, raw string) (*LinkMetadata, error) {
+	u, err := validateLinkURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &LinkMetadata{
+		Title:     u.Host,
+		SiteName:  u.Host,
+		FetchedAt: time.Now(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return meta, err
+	}
+	req.Header.Set("User-Agent", "LMSGarageLinkPreview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := unfurlHTTPClient.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return meta, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return meta, nil
+	}
+
+	// Metadata lives in <head>; there is no need to read whole pages
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 512<<10))
+	if err != nil {
+		return meta, err
+	}
+	page := string(body)
+
+	if m := htmlTitlePattern.FindStringSubmatch(page); m != nil {
+		if title := cleanMetaText(m[1]); title != "" {
+			meta.Title = title
+		}
+	}
+
+	for _, tag := range htmlMetaPattern.FindAllString(page, -1) {
+		var key, content string
+		for _, attr := range metaAttrPattern.FindAllStringSubmatch(tag, -1) {
+			value := attr[2] + attr[3]
+			if strings.EqualFold(attr[1], "content") {
+				content = value
+			} else {
+				key = strings.ToLower(value)
+			}
+		}
+		content = cleanMetaText(content)
+		if content == "" {
+			continue
+		}
+		switch key {
+		case "og:title", "twitter:title":
+			meta.Title = content
+		case "og:description", "twitter:description", "description":
+			if meta.Description == "" || key != "description" {
+				meta.Description = content
+			}
+		case "og:image", "twitter:image":
+			if img, err := resp.Request.URL.Parse(content); err == nil && (img.Scheme == "http" || img.Scheme == "https") {
+				meta.ImageURL = img.String()
+			}
+		case "og:site_name":
+			meta.SiteName = content
+		}
+	}
+
+	return meta, nil
+}
+
+func cleanMetaText(s string) string {
+	s = html.UnescapeString(strings.TrimSpace(s))
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > 500 {
+		s = string(runes[:500])
+	}
+	return s
+}
@@ -5,11 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -25,9 +23,12 @@ func main() {
 	}
 	fmt.Println("✅ Berhasil terhubung ke database!")
 
-	// Clean up uploads directory
-	if err := cleanupUploads(); err != nil {
-		fmt.Printf("⚠️  Warning: Failed to clean uploads directory: %v\n", err)
+	// Select file storage (local disk or S3-compatible)
+	if err := InitStorage(); err != nil {
+		log.Fatalf("Gagal menyiapkan penyimpanan file: %v", err)
+	}
+	if err := InitScanner(); err != nil {
+		log.Fatalf("Gagal menyiapkan pemindai malware: %v", err)
 	}
 
 	// Create quiz tables
@@ -35,11 +36,31 @@ func main() {
 		fmt.Printf("⚠️  Warning: Failed to create quiz tables: %v\n", err)
 	}
 
+	// Full-text indexes used by /api/search
+	if err := createSearchIndexes(); err != nil {
+		fmt.Printf("⚠️  Warning: Gagal membuat indeks pencarian: %v\n", err)
+	}
+
+	// "gc" runs the upload garbage collector once and exits
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Exit(runGCCommand(os.Args[2:]))
+	}
+
 	// Seed test data
 	if err := SeedTestData(); err != nil {
 		fmt.Printf("⚠️  Warning: Gagal seed data: %v\n", err)
 	}
 
+	// Remove uploads nothing has referenced for longer than the grace period
+	startUploadGCWorker(time.Hour)
+	startResumableUploadSweeper(time.Hour)
+
+	// Submit the saved answers of timed quiz attempts that ran out
+	startQuizAttemptSweeper(30 * time.Second)
+
+	// Process background jobs such as video transcoding
+	startJobWorkers()
+
 	// Inisialisasi router
 	r := mux.NewRouter()
 
@@ -78,6 +99,8 @@ func main() {
 	// News image upload
 	r.HandleFunc("/api/upload/news-image", adminAuthMiddleware(uploadNewsImageHandler)).Methods("POST")
 	r.HandleFunc("/api/upload/news-image", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/admin/teachers/{teacherId:[0-9]+}/storage-quota", adminAuthMiddleware(setTeacherStorageQuotaHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/teachers/{teacherId:[0-9]+}/storage-quota", optionsHandler).Methods("OPTIONS")
 
 	// Public news (read-only)
 	r.HandleFunc("/api/site/news", publicNewsHandler).Methods("GET")
@@ -122,24 +145,74 @@ func main() {
 	r.HandleFunc("/api/upload", optionsHandler).Methods("OPTIONS")
 	r.HandleFunc("/api/upload/material", teacherAuthMiddleware(uploadMaterialFileHandler)).Methods("POST")
 	r.HandleFunc("/api/upload/material", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/upload/resumable", teacherAuthMiddleware(createResumableUploadHandler)).Methods("POST")
+	r.HandleFunc("/api/upload/resumable", tusOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/upload/resumable/{uploadId:[0-9a-f]{32}}", teacherAuthMiddleware(headResumableUploadHandler)).Methods("HEAD")
+	r.HandleFunc("/api/upload/resumable/{uploadId:[0-9a-f]{32}}", teacherAuthMiddleware(getResumableUploadHandler)).Methods("GET")
+	r.HandleFunc("/api/upload/resumable/{uploadId:[0-9a-f]{32}}", teacherAuthMiddleware(patchResumableUploadHandler)).Methods("PATCH")
+	r.HandleFunc("/api/upload/resumable/{uploadId:[0-9a-f]{32}}", teacherAuthMiddleware(deleteResumableUploadHandler)).Methods("DELETE")
+	r.HandleFunc("/api/upload/resumable/{uploadId:[0-9a-f]{32}}", tusOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/teacher/storage-quota", teacherAuthMiddleware(getTeacherStorageQuotaHandler)).Methods("GET")
+	r.HandleFunc("/api/teacher/storage-quota", optionsHandler).Methods("OPTIONS")
 
 	// Course materials endpoints
 	r.HandleFunc("/api/courses/{courseId:[0-9]+}/materials", teacherAuthMiddleware(createCourseMaterialHandler)).Methods("POST")
-	r.HandleFunc("/api/courses/{courseId:[0-9]+}/materials", getCourseMaterialsHandler).Methods("GET")
+	r.HandleFunc("/api/courses/{courseId:[0-9]+}/materials", userAuthMiddleware(getCourseMaterialsHandler)).Methods("GET")
 	r.HandleFunc("/api/courses/{courseId:[0-9]+}/materials", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}", teacherAuthMiddleware(updateMaterialHandler)).Methods("PUT")
 	r.HandleFunc("/api/materials/{materialId:[0-9]+}", teacherAuthMiddleware(deleteMaterialHandler)).Methods("DELETE")
 	r.HandleFunc("/api/materials/{materialId:[0-9]+}", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/hls/{playlist:[a-z0-9]+\\.m3u8}", getMaterialHLSHandler).Methods("GET")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/hls/{playlist:[a-z0-9]+\\.m3u8}", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/versions", teacherAuthMiddleware(getMaterialVersionsHandler)).Methods("GET")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/versions", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/versions/{versionId:[0-9]+}/restore", teacherAuthMiddleware(restoreMaterialVersionHandler)).Methods("POST")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/versions/{versionId:[0-9]+}/restore", optionsHandler).Methods("OPTIONS")
+
+	// Material progress tracking endpoints
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/progress", authMiddleware(recordMaterialProgressHandler)).Methods("POST")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/progress", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/engagement", teacherAuthMiddleware(getMaterialEngagementHandler)).Methods("GET")
+	r.HandleFunc("/api/materials/{materialId:[0-9]+}/engagement", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/student/courses/{courseId:[0-9]+}/syllabus", authMiddleware(getStudentSyllabusHandler)).Methods("GET")
+	r.HandleFunc("/api/student/courses/{courseId:[0-9]+}/syllabus", optionsHandler).Methods("OPTIONS")
 
 	// Quiz endpoints
 	r.HandleFunc("/api/courses/{courseId:[0-9]+}/quizzes", teacherAuthMiddleware(createQuizHandler)).Methods("POST")
-	r.HandleFunc("/api/courses/{courseId:[0-9]+}/quizzes", getQuizzesByCourseHandler).Methods("GET")
+	r.HandleFunc("/api/courses/{courseId:[0-9]+}/quizzes", userAuthMiddleware(getQuizzesByCourseHandler)).Methods("GET")
 	r.HandleFunc("/api/courses/{courseId:[0-9]+}/quizzes", optionsHandler).Methods("OPTIONS")
-	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}", getQuizByIDHandler).Methods("GET")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}", userAuthMiddleware(getQuizByIDHandler)).Methods("GET")
 	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}", teacherAuthMiddleware(updateQuizHandler)).Methods("PUT")
 	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}", teacherAuthMiddleware(deleteQuizHandler)).Methods("DELETE")
 	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}", optionsHandler).Methods("OPTIONS")
 	r.HandleFunc("/api/upload/quiz-pdf", teacherAuthMiddleware(uploadQuizPDFHandler)).Methods("POST")
 	r.HandleFunc("/api/upload/quiz-pdf", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/bank-questions", teacherAuthMiddleware(addBankQuestionsHandler)).Methods("POST")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/bank-questions", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/draw-rules", teacherAuthMiddleware(getDrawRulesHandler)).Methods("GET")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/draw-rules", teacherAuthMiddleware(updateDrawRulesHandler)).Methods("PUT")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/draw-rules", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/regrades", teacherAuthMiddleware(getQuizRegradesHandler)).Methods("GET")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/regrades", optionsHandler).Methods("OPTIONS")
+
+	// Question bank endpoints
+	r.HandleFunc("/api/teacher/question-bank", teacherAuthMiddleware(getQuestionBankHandler)).Methods("GET")
+	r.HandleFunc("/api/teacher/question-bank", teacherAuthMiddleware(createBankQuestionHandler)).Methods("POST")
+	r.HandleFunc("/api/teacher/question-bank", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/teacher/question-bank/tags", teacherAuthMiddleware(getQuestionBankTagsHandler)).Methods("GET")
+	r.HandleFunc("/api/teacher/question-bank/tags", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/teacher/question-bank/{id:[0-9]+}", teacherAuthMiddleware(updateBankQuestionHandler)).Methods("PUT")
+	r.HandleFunc("/api/teacher/question-bank/{id:[0-9]+}", teacherAuthMiddleware(deleteBankQuestionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/teacher/question-bank/{id:[0-9]+}", optionsHandler).Methods("OPTIONS")
+
+	// Rubrics for grading essay questions
+	r.HandleFunc("/api/teacher/rubrics", teacherAuthMiddleware(getRubricsHandler)).Methods("GET")
+	r.HandleFunc("/api/teacher/rubrics", teacherAuthMiddleware(createRubricHandler)).Methods("POST")
+	r.HandleFunc("/api/teacher/rubrics", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/teacher/rubrics/{rubricId:[0-9]+}", teacherAuthMiddleware(getRubricHandler)).Methods("GET")
+	r.HandleFunc("/api/teacher/rubrics/{rubricId:[0-9]+}", teacherAuthMiddleware(updateRubricHandler)).Methods("PUT")
+	r.HandleFunc("/api/teacher/rubrics/{rubricId:[0-9]+}", teacherAuthMiddleware(deleteRubricHandler)).Methods("DELETE")
+	r.HandleFunc("/api/teacher/rubrics/{rubricId:[0-9]+}", optionsHandler).Methods("OPTIONS")
 
 	// Quiz submission endpoints
 	r.HandleFunc("/api/quiz-submissions", authMiddleware(submitQuizHandler)).Methods("POST")
@@ -149,15 +222,46 @@ func main() {
 	r.HandleFunc("/api/quiz-submissions/pdf", authMiddleware(submitQuizPDFHandler)).Methods("POST")
 	r.HandleFunc("/api/quiz-submissions/pdf", optionsHandler).Methods("OPTIONS")
 
+	// Timed quiz attempts
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/attempts", authMiddleware(getQuizAttemptHandler)).Methods("GET")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/attempts", authMiddleware(startQuizAttemptHandler)).Methods("POST")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/attempts", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/heartbeat", authMiddleware(quizAttemptHeartbeatHandler)).Methods("POST")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/heartbeat", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/submit", authMiddleware(submitQuizAttemptHandler)).Methods("POST")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/submit", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/answers/{questionId:[0-9]+}", authMiddleware(saveAttemptAnswerHandler)).Methods("PUT")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/answers/{questionId:[0-9]+}", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/events", authMiddleware(postIntegrityEventsHandler)).Methods("POST")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/events", teacherAuthMiddleware(getIntegrityEventsHandler)).Methods("GET")
+	r.HandleFunc("/api/quiz-attempts/{attemptId:[0-9]+}/events", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/my-attempts", authMiddleware(getMyQuizAttemptsHandler)).Methods("GET")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/my-attempts", optionsHandler).Methods("OPTIONS")
+
+	// Due date extensions
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/extensions", teacherAuthMiddleware(getQuizExtensionsHandler)).Methods("GET")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/extensions", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/extensions/{studentId:[0-9]+}", teacherAuthMiddleware(grantQuizExtensionHandler)).Methods("PUT")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/extensions/{studentId:[0-9]+}", teacherAuthMiddleware(revokeQuizExtensionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/extensions/{studentId:[0-9]+}", optionsHandler).Methods("OPTIONS")
+
 	// Quiz grading and results endpoints
 	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/submissions", teacherAuthMiddleware(getQuizSubmissionsHandler)).Methods("GET")
 	r.HandleFunc("/api/quizzes/{quizId:[0-9]+}/submissions", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/courses/{courseId:[0-9]+}/gradebook", teacherAuthMiddleware(getCourseGradebookHandler)).Methods("GET")
+	r.HandleFunc("/api/courses/{courseId:[0-9]+}/gradebook", optionsHandler).Methods("OPTIONS")
 	r.HandleFunc("/api/quiz-submissions/grade", teacherAuthMiddleware(gradeEssayHandler)).Methods("POST")
 	r.HandleFunc("/api/quiz-submissions/grade", optionsHandler).Methods("OPTIONS")
 	r.HandleFunc("/api/student/quiz-results", authMiddleware(getStudentQuizResultsHandler)).Methods("GET")
 	r.HandleFunc("/api/student/quiz-results", optionsHandler).Methods("OPTIONS")
 	r.HandleFunc("/api/student/quiz-results/{submissionId:[0-9]+}", authMiddleware(getStudentQuizDetailHandler)).Methods("GET")
 	r.HandleFunc("/api/student/quiz-results/{submissionId:[0-9]+}", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/student/quiz-results/{submissionId:[0-9]+}/regrade-requests", authMiddleware(createRegradeRequestHandler)).Methods("POST")
+	r.HandleFunc("/api/student/quiz-results/{submissionId:[0-9]+}/regrade-requests", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/teacher/regrade-requests", teacherAuthMiddleware(getRegradeQueueHandler)).Methods("GET")
+	r.HandleFunc("/api/teacher/regrade-requests", optionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/api/teacher/regrade-requests/{requestId:[0-9]+}", teacherAuthMiddleware(resolveRegradeRequestHandler)).Methods("PUT")
+	r.HandleFunc("/api/teacher/regrade-requests/{requestId:[0-9]+}", optionsHandler).Methods("OPTIONS")
 
 	// Debug static file test page
 	r.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
@@ -167,13 +271,16 @@ func main() {
 	// Debug quiz endpoint
 	r.HandleFunc("/api/debug/quizzes", debugQuizzesHandler).Methods("GET")
 
-	// Serve uploaded files with CORS support
-	r.PathPrefix("/uploads/").Handler(corsFileHandler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads")))))
+	// Signed download URLs for uploaded files
+	r.HandleFunc("/api/files/sign", userAuthMiddleware(signFileHandler)).Methods("GET")
+	r.HandleFunc("/api/files/sign", optionsHandler).Methods("OPTIONS")
+
+	// Search (anonymous callers only see news)
+	r.HandleFunc("/api/search", searchHandler).Methods("GET")
+	r.HandleFunc("/api/search", optionsHandler).Methods("OPTIONS")
 
-	// Create uploads directories if they don't exist
-	os.MkdirAll("./uploads", 0755)
-	os.MkdirAll("./uploads/materials", 0755)
-	os.MkdirAll("./uploads/quiz-pdfs", 0755)
+	// Serve uploaded files with CORS support; access is checked per file
+	r.PathPrefix("/uploads/").Handler(corsFileHandler(http.HandlerFunc(serveUploadHandler)))
 
 	// Endpoint dasar (dummy)
 	r.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
@@ -238,8 +345,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 		} else {
 			w.Header().Set("Access-Control-Allow-Origin", "*") // Allow all origins for development
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, "+tusHeaders+", "+attemptTokenHeader)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
@@ -438,6 +545,7 @@ func createNewsHandler(w http.ResponseWriter, r *http.Request) {
     result, err := DB2.Exec("INSERT INTO news (title, content, date, image_url, is_featured) VALUES (?, ?, ?, ?, ?)",
         p.Title, p.Content, p.Date, p.ImageURL, p.IsFeatured)
     if err != nil { http.Error(w, "Failed to create news", http.StatusInternalServerError); return }
+    refreshUploadReferences(p.ImageURL)
 
     id, _ := result.LastInsertId()
     w.Header().Set("Content-Type", "application/json")
@@ -462,9 +570,13 @@ func updateNewsHandler(w http.ResponseWriter, r *http.Request) {
     var p payload
     if err := json.NewDecoder(r.Body).Decode(&p); err != nil { http.Error(w, "Invalid payload", http.StatusBadRequest); return }
 
+    var previousImageURL sql.NullString
+    DB2.QueryRow("SELECT image_url FROM news WHERE id=?", id).Scan(&previousImageURL)
+
     _, err := DB2.Exec("UPDATE news SET title=?, content=?, date=?, image_url=?, is_featured=? WHERE id=?",
         p.Title, p.Content, p.Date, p.ImageURL, p.IsFeatured, id)
     if err != nil { http.Error(w, "Failed to update news", http.StatusInternalServerError); return }
+    refreshUploadReferences(p.ImageURL, previousImageURL.String)
 
     w.Header().Set("Content-Type", "application/json")
     w.Write([]byte(`{"message":"updated"}`))
@@ -478,8 +590,12 @@ func deleteNewsHandler(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
     if id == "" { http.Error(w, "ID required", http.StatusBadRequest); return }
 
+    var imageURL sql.NullString
+    DB2.QueryRow("SELECT image_url FROM news WHERE id=?", id).Scan(&imageURL)
+
     _, err := DB2.Exec("DELETE FROM news WHERE id=?", id)
     if err != nil { http.Error(w, "Failed to delete news", http.StatusInternalServerError); return }
+    refreshUploadReferences(imageURL.String)
 
     w.Header().Set("Content-Type", "application/json")
     w.Write([]byte(`{"message":"deleted"}`))
@@ -549,7 +665,7 @@ func uploadNewsImageHandler(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
     // Check if admin is authenticated
-    _, ok := r.Context().Value("admin_id").(int)
+    adminID, ok := r.Context().Value("admin_id").(int)
     if !ok {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
@@ -572,71 +688,21 @@ func uploadNewsImageHandler(w http.ResponseWriter, r *http.Request) {
     }
     defer file.Close()
 
-    // Validate file size (5MB max for images)
-    if handler.Size > 5<<20 {
-        log.Printf("File too large: %d bytes", handler.Size)
-        http.Error(w, "File too large. Maximum size is 5MB", http.StatusBadRequest)
-        return
-    }
-
-    // Validate file type (only images for news)
-    fileName := handler.Filename
-    fileExt := strings.ToLower(filepath.Ext(fileName))
-
-    allowedExts := map[string]bool{
-        ".jpg":  true,
-        ".jpeg": true,
-        ".png":  true,
-        ".gif":  true,
-        ".webp": true,
-    }
-
-    if !allowedExts[fileExt] {
-        log.Printf("Invalid file type: %s", fileExt)
-        http.Error(w, "Invalid file type. Only image files (jpg, jpeg, png, gif, webp) are allowed.", http.StatusBadRequest)
-        return
-    }
-
-    log.Printf("News image upload: name=%s, size=%d bytes, type=%s", fileName, handler.Size, fileExt)
-
-    // Create uploads directory if it doesn't exist
-    uploadsDir := "./uploads/news"
-    if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-        log.Printf("Error creating uploads directory: %v", err)
-        http.Error(w, "Error creating upload directory", http.StatusInternalServerError)
-        return
-    }
-
-    // Generate unique filename
-    timestamp := time.Now().Unix()
-    uniqueFileName := fmt.Sprintf("%d_%s", timestamp, fileName)
-    filePath := filepath.Join(uploadsDir, uniqueFileName)
-
-    // Create the file
-    dst, err := os.Create(filePath)
-    if err != nil {
-        log.Printf("Error creating file: %v", err)
-        http.Error(w, "Error creating file", http.StatusInternalServerError)
-        return
-    }
-    defer dst.Close()
-
-    // Copy the uploaded file to the destination
-    _, err = io.Copy(dst, file)
+    // Validate, scan and save the uploaded image
+    stored, err := processUpload(r.Context(), newsImageUploads, file, handler, uploadOwner{Role: "admin", ID: adminID})
     if err != nil {
-        log.Printf("Error copying file: %v", err)
-        http.Error(w, "Error saving file", http.StatusInternalServerError)
+        log.Printf("News image upload %s failed: %v", handler.Filename, err)
+        writeUploadError(w, err)
         return
     }
-
-    // Create the URL path for the file
-    urlPath := "/uploads/news/" + uniqueFileName
+    urlPath := stored.URLPath
     log.Printf("News image uploaded successfully. Path: %s", urlPath)
 
-    response := map[string]interface{}{
-        "success":   true,
-        "file_path": urlPath,
-        "message":   "Image uploaded successfully",
+    response := UploadResponse{
+        Success:         true,
+        FilePath:        urlPath,
+        Message:         "Image uploaded successfully",
+        ImageUploadInfo: imageUploadInfo(stored),
     }
 
     w.WriteHeader(http.StatusOK)
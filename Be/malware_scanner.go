@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScanResult is the verdict of a malware scan
+type ScanResult struct {
+	Infected  bool
+	Signature string // Name of the matched signature when infected
+}
+
+// MalwareScanner checks uploaded content before it is stored
+type MalwareScanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+// Scanner is the configured malware scanner
+var Scanner MalwareScanner = noopScanner{}
+
+// InitScanner enables ClamAV scanning when CLAMD_ADDRESS is set, e.g.
+// "unix:/var/run/clamav/clamd.ctl" or "tcp:127.0.0.1:3310". Without it
+// uploads are not scanned.
+func InitScanner() error {
+	address := os.Getenv("CLAMD_ADDRESS")
+	if address == "" {
+		log.Println("⚠️  CLAMD_ADDRESS not set, uploads will not be scanned for malware")
+		Scanner = noopScanner{}
+		return nil
+	}
+
+	network, addr, found := strings.Cut(address, ":")
+	if !found || (network != "unix" && network != "tcp") || addr == "" {
+		return fmt.Errorf("invalid CLAMD_ADDRESS %q, expected unix:<path> or tcp:<host:port>", address)
+	}
+
+	scanner := &clamdScanner{network: network, address: addr, timeout: 2 * time.Minute}
+	if err := scanner.ping(); err != nil {
+		return fmt.Errorf("clamd at %s is not reachable: %w", address, err)
+	}
+	Scanner = scanner
+	log.Printf("✅ Malware scanning enabled via clamd at %s", address)
+	return nil
+}
+
+// noopScanner accepts everything
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	return &ScanResult{}, nil
+}
+
+// clamdScanner streams files to a clamd daemon with the INSTREAM command.
+// clamd refuses streams longer than its StreamMaxLength setting, so that
+// must be at least as large as the biggest allowed upload.
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+const clamdChunkSize = 64 << 10
+
+func (c *clamdScanner) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	return conn, nil
+}
+
+func (c *clamdScanner) ping() error {
+	conn, err := c.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return err
+	}
+	if strings.TrimRight(reply, "\x00") != "PONG" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func (c *clamdScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	// Each chunk is prefixed with its length; a zero length ends the stream
+	buf := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00")))
+}
+
+// parseClamdReply understands "stream: OK", "stream: <name> FOUND" and
+// "<message> ERROR"
+func parseClamdReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimSpace(reply)
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return &ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return &ScanResult{Infected: true, Signature: signature}, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+}
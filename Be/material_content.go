@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// allowedRichTextTags lists the HTML tags teachers may use in rich text
+// materials, mapped to the attributes allowed on each tag.
+var allowedRichTextTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "div": nil, "span": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"strong": nil, "b": nil, "em": nil, "i": nil, "u": nil, "s": nil,
+	"sub": nil, "sup": nil, "mark": nil, "small": nil,
+	"ul": nil, "ol": nil, "li": nil,
+	"blockquote": nil, "pre": nil, "code": nil,
+	"table": nil, "thead": nil, "tbody": nil, "tr": nil, "th": {"colspan", "rowspan"}, "td": {"colspan", "rowspan"},
+	"a":   {"href", "title"},
+	"img": {"src", "alt", "title", "width", "height"},
+}
+
+// Tags whose whole content is dropped, not just the tag itself
+var droppedRichTextBlocks = []string{"script", "style", "iframe", "object", "embed", "noscript", "template", "svg", "math"}
+
+// richTextPolicy is the HTML allowlist of rich text materials
+var richTextPolicy = newRichTextPolicy()
+
+func newRichTextPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	for tag, attrs := range allowedRichTextTags {
+		p.AllowElements(tag)
+		if len(attrs) > 0 {
+			p.AllowAttrs(attrs...).OnElements(tag)
+		}
+	}
+	p.SkipElementsContent(droppedRichTextBlocks...)
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.AllowRelativeURLs(true)
+	p.RequireNoReferrerOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// sanitizeRichText cleans teacher-provided rich text so it is safe to render
+// in the student client. format is either "html" or "markdown". Markdown is
+// parsed the way the client renders it: its inline HTML goes through the
+// same allowlist, and links or images with an unsafe target are refused.
+func sanitizeRichText(content, format string) (string, error) {
+	if format != "markdown" {
+		return richTextPolicy.Sanitize(content), nil
+	}
+
+	src := []byte(content)
+	ctx := parser.NewContext()
+	doc := goldmark.DefaultParser().Parse(text.NewReader(src), parser.WithContext(ctx))
+
+	for _, ref := range ctx.References() {
+		if !isSafeRichTextURL(html.UnescapeString(string(ref.Destination()))) {
+			return "", fmt.Errorf("Link %q has an unsafe target", ref.Label())
+		}
+	}
+
+	// Byte ranges of inline HTML and what replaces them
+	type replacement struct {
+		start, stop int
+		html        string
+	}
+	var replacements []replacement
+	sanitizeSegments := func(segments *text.Segments) {
+		if segments.Len() == 0 {
+			return
+		}
+		start, stop := segments.At(0).Start, segments.At(segments.Len()-1).Stop
+		replacements = append(replacements, replacement{start, stop, richTextPolicy.Sanitize(string(src[start:stop]))})
+	}
+
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var target []byte
+		switch node := n.(type) {
+		case *ast.Link:
+			target = node.Destination
+		case *ast.Image:
+			target = node.Destination
+		case *ast.AutoLink:
+			target = node.URL(src)
+		case *ast.RawHTML:
+			sanitizeSegments(node.Segments)
+			return ast.WalkContinue, nil
+		case *ast.HTMLBlock:
+			lines := text.NewSegments()
+			lines.AppendAll(node.Lines().Sliced(0, node.Lines().Len()))
+			if node.HasClosure() {
+				lines.Append(node.ClosureLine)
+			}
+			sanitizeSegments(lines)
+			return ast.WalkContinue, nil
+		default:
+			return ast.WalkContinue, nil
+		}
+		if !isSafeRichTextURL(html.UnescapeString(string(target))) {
+			return ast.WalkStop, fmt.Errorf("Link %q has an unsafe target", target)
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].start < replacements[j].start })
+	var out strings.Builder
+	last := 0
+	for _, r := range replacements {
+		if r.start < last {
+			continue
+		}
+		out.Write(src[last:r.start])
+		out.WriteString(r.html)
+		last = r.stop
+	}
+	out.Write(src[last:])
+	return out.String(), nil
+}
+
+// isSafeRichTextURL accepts http(s), mailto, relative and fragment URLs
+func isSafeRichTextURL(raw string) bool {
+	value := strings.ToLower(strings.TrimSpace(raw))
+	// Strip control characters and whitespace browsers ignore inside schemes
+	value = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == ' ' {
+			return -1
+		}
+		return r
+	}, value)
+
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") ||
+		strings.HasPrefix(value, "mailto:") || strings.HasPrefix(value, "/") ||
+		strings.HasPrefix(value, "#") {
+		return true
+	}
+	// Relative paths without a scheme are fine
+	colon := strings.IndexByte(value, ':')
+	return colon < 0 || strings.ContainsAny(value[:colon], "/?#")
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// officeDocumentMarkers maps Office Open XML extensions to a part that must
+// exist inside the zip container for the file to be what it claims to be
+var officeDocumentMarkers = map[string]string{
+	".docx": "word/document.xml",
+	".pptx": "ppt/presentation.xml",
+}
+
+// validateOfficeDocument checks that a .docx/.pptx upload is a real Office
+// Open XML package and not some other file renamed
+func validateOfficeDocument(file io.ReaderAt, size int64, ext string) error {
+	marker, ok := officeDocumentMarkers[ext]
+	if !ok {
+		return fmt.Errorf("unsupported document type %s", ext)
+	}
+
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return fmt.Errorf("file is not a valid %s document", ext)
+	}
+
+	hasContentTypes := false
+	hasMarker := false
+	for _, f := range zr.File {
+		switch f.Name {
+		case "[Content_Types].xml":
+			hasContentTypes = true
+		case marker:
+			hasMarker = true
+		}
+		// Macro-enabled content has no place in a lesson handout
+		if strings.HasSuffix(strings.ToLower(f.Name), "vbaproject.bin") {
+			return fmt.Errorf("documents with macros are not allowed")
+		}
+	}
+
+	if !hasContentTypes || !hasMarker {
+		return fmt.Errorf("file is not a valid %s document", ext)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeRichText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		keep    []string // Substrings the result must contain
+		drop    []string // Substrings it must not contain
+		wantErr bool
+	}{
+		{
+			name:    "allowed tags are kept",
+			content: `<h2>Bab 1</h2><p><strong>Penting</strong> <a href="https://example.com">baca</a></p>`,
+			format:  "html",
+			keep:    []string{"<h2>Bab 1</h2>", "<strong>Penting</strong>", `href="https://example.com"`},
+		},
+		{
+			name:    "script is dropped with its content",
+			content: `<p>Halo</p><script>alert(1)</script>`,
+			format:  "html",
+			keep:    []string{"<p>Halo</p>"},
+			drop:    []string{"script", "alert"},
+		},
+		{
+			name:    "event handlers are stripped",
+			content: `<img src="/uploads/materials/a.png" onerror="alert(1)">`,
+			format:  "html",
+			keep:    []string{`src="/uploads/materials/a.png"`},
+			drop:    []string{"onerror", "alert"},
+		},
+		{
+			name:    "javascript links lose their target",
+			content: `<a href="javascript:alert(1)">klik</a>`,
+			format:  "html",
+			drop:    []string{"javascript"},
+		},
+		{
+			name:    "svg is dropped",
+			content: `<svg onload="alert(1)"><circle r="1"/></svg><p>ok</p>`,
+			format:  "html",
+			keep:    []string{"<p>ok</p>"},
+			drop:    []string{"svg", "onload"},
+		},
+		{
+			name:    "markdown is left as markdown",
+			content: "# Judul\n\n**tebal** dan [tautan](https://example.com)",
+			format:  "markdown",
+			keep:    []string{"# Judul", "**tebal**", "[tautan](https://example.com)"},
+		},
+		{
+			name:    "inline HTML in markdown is sanitized",
+			content: "Teks <img src=x onerror=alert(1)> biasa",
+			format:  "markdown",
+			keep:    []string{"Teks ", " biasa"},
+			drop:    []string{"onerror"},
+		},
+		{
+			name:    "HTML blocks in markdown are sanitized",
+			content: "<div>\n<script>alert(1)</script>\n</div>\n\nparagraf",
+			format:  "markdown",
+			keep:    []string{"paragraf"},
+			drop:    []string{"script", "alert"},
+		},
+		{
+			name:    "markdown javascript link is refused",
+			content: "[klik](javascript:alert(1))",
+			format:  "markdown",
+			wantErr: true,
+		},
+		{
+			name:    "markdown javascript link with entities is refused",
+			content: "[klik](jav&#x61;script:alert(1))",
+			format:  "markdown",
+			wantErr: true,
+		},
+		{
+			name:    "markdown reference to a data URL is refused",
+			content: "![gambar][g]\n\n[g]: data:text/html;base64,PHNjcmlwdD4=",
+			format:  "markdown",
+			wantErr: true,
+		},
+		{
+			name:    "markdown relative and mailto links are fine",
+			content: "[bab 2](#bab-2) atau [email](mailto:guru@example.com)",
+			format:  "markdown",
+			keep:    []string{"(#bab-2)", "(mailto:guru@example.com)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeRichText(tt.content, tt.format)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sanitizeRichText() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeRichText() error = %v", err)
+			}
+			for _, s := range tt.keep {
+				if !strings.Contains(got, s) {
+					t.Errorf("sanitizeRichText() = %q, want it to contain %q", got, s)
+				}
+			}
+			for _, s := range tt.drop {
+				if strings.Contains(strings.ToLower(got), s) {
+					t.Errorf("sanitizeRichText() = %q, want no %q", got, s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A material counts as completed once this much of it has been seen
+const materialCompletionPercent = 90.0
+
+// maxHeartbeatSeconds caps how much time a single heartbeat may add, so a tab
+// left open overnight does not count as hours of study
+const maxHeartbeatSeconds = 60
+
+// MaterialProgress is a student's progress on one material
+type MaterialProgress struct {
+	MaterialID       int        `json:"material_id"`
+	StudentID        int        `json:"student_id"`
+	OpenCount        int        `json:"open_count"`
+	ProgressPercent  float64    `json:"progress_percent"`
+	PositionSeconds  *int       `json:"position_seconds,omitempty"`
+	DurationSeconds  *int       `json:"duration_seconds,omitempty"`
+	CurrentPage      *int       `json:"current_page,omitempty"`
+	TotalPages       *int       `json:"total_pages,omitempty"`
+	TimeSpentSeconds int        `json:"time_spent_seconds"`
+	FirstOpenedAt    time.Time  `json:"first_opened_at"`
+	LastActivityAt   time.Time  `json:"last_activity_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+}
+
+// MaterialProgressRequest is sent by the student client when a material is
+// opened and periodically while a video plays or a PDF is being read
+type MaterialProgressRequest struct {
+	Event           string   `json:"event"` // "open" or "heartbeat"
+	PositionSeconds *int     `json:"position_seconds"`
+	DurationSeconds *int     `json:"duration_seconds"`
+	CurrentPage     *int     `json:"current_page"`
+	TotalPages      *int     `json:"total_pages"`
+	ProgressPercent *float64 `json:"progress_percent"`
+	ElapsedSeconds  int      `json:"elapsed_seconds"`
+}
+
+// createMaterialProgressTable creates the material_progress table if it doesn't exist
+func createMaterialProgressTable() error {
+	query := `
+		CREATE TABLE IF NOT EXISTS material_progress (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			material_id INT NOT NULL,
+			student_id INT NOT NULL,
+			open_count INT NOT NULL DEFAULT 0,
+			progress_percent DECIMAL(5,2) NOT NULL DEFAULT 0,
+			position_seconds INT NULL,
+			duration_seconds INT NULL,
+			current_page INT NULL,
+			total_pages INT NULL,
+			time_spent_seconds INT NOT NULL DEFAULT 0,
+			first_opened_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_activity_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			completed_at TIMESTAMP NULL,
+			UNIQUE KEY unique_material_progress (material_id, student_id),
+			FOREIGN KEY (material_id) REFERENCES course_materials(id) ON DELETE CASCADE,
+			FOREIGN KEY (student_id) REFERENCES students(id) ON DELETE CASCADE
+		)
+	`
+	if _, err := DB.Exec(query); err != nil {
+		return fmt.Errorf("failed to create material_progress table: %v", err)
+	}
+
+	log.Println("✅ Material progress table created/verified successfully!")
+	return nil
+}
+
+// computeProgressPercent derives progress from the reported position. Pages
+// and playback position win over a client-computed percentage.
+func computeProgressPercent(materialType string, req MaterialProgressRequest) float64 {
+	var percent float64
+	switch {
+	case req.PositionSeconds != nil && req.DurationSeconds != nil && *req.DurationSeconds > 0:
+		percent = float64(*req.PositionSeconds) / float64(*req.DurationSeconds) * 100
+	case req.CurrentPage != nil && req.TotalPages != nil && *req.TotalPages > 0:
+		percent = float64(*req.CurrentPage) / float64(*req.TotalPages) * 100
+	case req.ProgressPercent != nil:
+		percent = *req.ProgressPercent
+	case req.Event == "open" && materialType != "video" && materialType != "pdf" && materialType != "youtube":
+		// Images, links, documents and rich text pages have nothing to track
+		// beyond being opened
+		percent = 100
+	}
+
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// recordMaterialProgressHandler records a material open or progress heartbeat
+// from the student client
+func recordMaterialProgressHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get student ID from context
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	materialID, err := strconv.Atoi(vars["materialId"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+
+	var req MaterialProgressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Event != "open" && req.Event != "heartbeat" {
+		http.Error(w, "Event must be open or heartbeat", http.StatusBadRequest)
+		return
+	}
+
+	var courseID int
+	var materialType string
+	err = DB.QueryRow("SELECT course_id, type FROM course_materials WHERE id = ?", materialID).Scan(&courseID, &materialType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Material not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting material: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !isStudentEnrolled(courseID, studentID) {
+		http.Error(w, "You are not enrolled in this course", http.StatusForbidden)
+		return
+	}
+
+	elapsed := req.ElapsedSeconds
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if elapsed > maxHeartbeatSeconds {
+		elapsed = maxHeartbeatSeconds
+	}
+
+	openIncrement := 0
+	if req.Event == "open" {
+		openIncrement = 1
+	}
+
+	percent := computeProgressPercent(materialType, req)
+	now := time.Now()
+	var completedAt interface{}
+	if percent >= materialCompletionPercent {
+		completedAt = now
+	}
+
+	// Progress never goes backwards: re-watching the start of a video keeps
+	// the furthest point reached, while the position follows the student
+	_, err = DB.Exec(`
+		INSERT INTO material_progress (material_id, student_id, open_count, progress_percent, position_seconds,
+			duration_seconds, current_page, total_pages, time_spent_seconds, first_opened_at, last_activity_at, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			open_count = open_count + VALUES(open_count),
+			progress_percent = GREATEST(progress_percent, VALUES(progress_percent)),
+			position_seconds = IFNULL(VALUES(position_seconds), position_seconds),
+			duration_seconds = IFNULL(VALUES(duration_seconds), duration_seconds),
+			current_page = IFNULL(VALUES(current_page), current_page),
+			total_pages = IFNULL(VALUES(total_pages), total_pages),
+			time_spent_seconds = time_spent_seconds + VALUES(time_spent_seconds),
+			last_activity_at = VALUES(last_activity_at),
+			completed_at = IFNULL(completed_at, VALUES(completed_at))
+	`, materialID, studentID, openIncrement, percent, req.PositionSeconds, req.DurationSeconds,
+		req.CurrentPage, req.TotalPages, elapsed, now, now, completedAt)
+	if err != nil {
+		log.Printf("Error recording material progress: %v", err)
+		http.Error(w, "Failed to record progress", http.StatusInternalServerError)
+		return
+	}
+
+	progress, err := getMaterialProgress(materialID, studentID)
+	if err != nil {
+		log.Printf("Error reading material progress: %v", err)
+		http.Error(w, "Failed to record progress", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"progress": progress,
+	})
+}
+
+const materialProgressColumns = `
+	material_id, student_id, open_count, progress_percent, position_seconds, duration_seconds,
+	current_page, total_pages, time_spent_seconds, first_opened_at, last_activity_at, completed_at`
+
+func scanMaterialProgress(row rowScanner) (*MaterialProgress, error) {
+	var p MaterialProgress
+	var position, duration, page, pages sql.NullInt64
+	var completedAt sql.NullTime
+	err := row.Scan(&p.MaterialID, &p.StudentID, &p.OpenCount, &p.ProgressPercent, &position, &duration,
+		&page, &pages, &p.TimeSpentSeconds, &p.FirstOpenedAt, &p.LastActivityAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.PositionSeconds = nullIntPtr(position)
+	p.DurationSeconds = nullIntPtr(duration)
+	p.CurrentPage = nullIntPtr(page)
+	p.TotalPages = nullIntPtr(pages)
+	if completedAt.Valid {
+		p.CompletedAt = &completedAt.Time
+	}
+	return &p, nil
+}
+
+func getMaterialProgress(materialID, studentID int) (*MaterialProgress, error) {
+	row := DB.QueryRow(`SELECT `+materialProgressColumns+` FROM material_progress WHERE material_id = ? AND student_id = ?`,
+		materialID, studentID)
+	return scanMaterialProgress(row)
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	i := int(v.Int64)
+	return &i
+}
+
+// getStudentSyllabusHandler returns a course's materials together with the
+// student's own progress on each one
+func getStudentSyllabusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get student ID from context
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	courseID, err := strconv.Atoi(vars["courseId"])
+	if err != nil {
+		http.Error(w, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+
+	if !isStudentEnrolled(courseID, studentID) {
+		http.Error(w, "You are not enrolled in this course", http.StatusForbidden)
+		return
+	}
+
+	materials, err := GetMaterialsByCourse(courseID)
+	if err != nil {
+		log.Printf("Error getting course materials: %v", err)
+		http.Error(w, "Failed to get course materials", http.StatusInternalServerError)
+		return
+	}
+	signMaterialFiles(materials)
+
+	rows, err := DB.Query(`
+		SELECT `+materialProgressColumns+`
+		FROM material_progress
+		WHERE student_id = ? AND material_id IN (SELECT id FROM course_materials WHERE course_id = ?)
+	`, studentID, courseID)
+	if err != nil {
+		log.Printf("Error getting material progress: %v", err)
+		http.Error(w, "Failed to get progress", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	progressByMaterial := make(map[int]*MaterialProgress)
+	for rows.Next() {
+		p, err := scanMaterialProgress(rows)
+		if err != nil {
+			log.Printf("Error scanning material progress: %v", err)
+			continue
+		}
+		progressByMaterial[p.MaterialID] = p
+	}
+
+	type syllabusItem struct {
+		CourseMaterial
+		Progress *MaterialProgress `json:"progress"`
+	}
+
+	items := []syllabusItem{}
+	completed := 0
+	for _, m := range materials {
+		p := progressByMaterial[m.ID]
+		if p != nil && p.CompletedAt != nil {
+			completed++
+		}
+		items = append(items, syllabusItem{CourseMaterial: m, Progress: p})
+	}
+
+	var coursePercent float64
+	if len(items) > 0 {
+		coursePercent = float64(completed) / float64(len(items)) * 100
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":             true,
+		"materials":           items,
+		"completed_materials": completed,
+		"total_materials":     len(items),
+		"progress_percent":    coursePercent,
+	})
+}
+
+// getMaterialEngagementHandler summarizes how the enrolled students of a
+// course have engaged with one material
+func getMaterialEngagementHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get teacher ID from context
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	materialID, err := strconv.Atoi(vars["materialId"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+
+	if !materialOwnedByTeacher(materialID, teacherID) {
+		http.Error(w, "Material not found or access denied", http.StatusForbidden)
+		return
+	}
+
+	// One row per enrolled student, with or without progress
+	rows, err := DB.Query(`
+		SELECT s.id, s.name, s.email,
+		       IFNULL(mp.open_count, 0), IFNULL(mp.progress_percent, 0), IFNULL(mp.time_spent_seconds, 0),
+		       mp.last_activity_at, mp.completed_at
+		FROM course_materials cm
+		JOIN course_enrollments e ON e.course_id = cm.course_id
+		JOIN students s ON s.id = e.student_id
+		LEFT JOIN material_progress mp ON mp.material_id = cm.id AND mp.student_id = s.id
+		WHERE cm.id = ?
+		ORDER BY s.name
+	`, materialID)
+	if err != nil {
+		log.Printf("Error getting material engagement: %v", err)
+		http.Error(w, "Failed to get engagement", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type studentEngagement struct {
+		StudentID        int        `json:"student_id"`
+		StudentName      string     `json:"student_name"`
+		StudentEmail     string     `json:"student_email"`
+		OpenCount        int        `json:"open_count"`
+		ProgressPercent  float64    `json:"progress_percent"`
+		TimeSpentSeconds int        `json:"time_spent_seconds"`
+		LastActivityAt   *time.Time `json:"last_activity_at,omitempty"`
+		CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	}
+
+	students := []studentEngagement{}
+	var opened, completed, totalTime int
+	var totalProgress float64
+	for rows.Next() {
+		var s studentEngagement
+		var lastActivity, completedAt sql.NullTime
+		err := rows.Scan(&s.StudentID, &s.StudentName, &s.StudentEmail, &s.OpenCount, &s.ProgressPercent,
+			&s.TimeSpentSeconds, &lastActivity, &completedAt)
+		if err != nil {
+			log.Printf("Error scanning engagement row: %v", err)
+			continue
+		}
+		if lastActivity.Valid {
+			s.LastActivityAt = &lastActivity.Time
+		}
+		if completedAt.Valid {
+			s.CompletedAt = &completedAt.Time
+			completed++
+		}
+		if s.OpenCount > 0 {
+			opened++
+		}
+		totalProgress += s.ProgressPercent
+		totalTime += s.TimeSpentSeconds
+		students = append(students, s)
+	}
+
+	summary := map[string]interface{}{
+		"enrolled_students":      len(students),
+		"opened_count":           opened,
+		"completed_count":        completed,
+		"average_progress":       0.0,
+		"average_time_spent_sec": 0,
+	}
+	if len(students) > 0 {
+		summary["average_progress"] = totalProgress / float64(len(students))
+		summary["average_time_spent_sec"] = totalTime / len(students)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"material_id": materialID,
+		"summary":     summary,
+		"students":    students,
+	})
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMaterialVersions is how many previous versions are kept per material.
+// Files only used by older versions are queued for deletion.
+const maxMaterialVersions = 20
+
+// MaterialVersion is a snapshot of a material before it was edited or restored
+type MaterialVersion struct {
+	ID            int           `json:"id"`
+	MaterialID    int           `json:"material_id"`
+	VersionNumber int           `json:"version_number"`
+	Title         string        `json:"title"`
+	Description   string        `json:"description"`
+	Type          string        `json:"type"`
+	FilePath      string        `json:"file_path"`
+	YouTubeURL    string        `json:"youtube_url"`
+	Content       string        `json:"content,omitempty"`
+	ContentFormat string        `json:"content_format,omitempty"`
+	LinkURL       string        `json:"link_url,omitempty"`
+	LinkMetadata  *LinkMetadata `json:"link_metadata,omitempty"`
+	ReplacedBy    *int          `json:"replaced_by,omitempty"`
+	ReplacedAt    time.Time     `json:"replaced_at"`
+}
+
+// createMaterialVersionsTable creates the material_versions table if it doesn't exist
+func createMaterialVersionsTable() error {
+	if err := ensureColumn(DB, "course_materials", "version", "INT NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	query := `
+		CREATE TABLE IF NOT EXISTS material_versions (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			material_id INT NOT NULL,
+			version_number INT NOT NULL,
+			title VARCHAR(255) NOT NULL,
+			description TEXT,
+			type VARCHAR(20) NOT NULL,
+			file_path VARCHAR(500),
+			youtube_url VARCHAR(500),
+			content LONGTEXT NULL,
+			content_format VARCHAR(20) NULL,
+			link_url VARCHAR(1000) NULL,
+			link_metadata JSON NULL,
+			replaced_by INT NULL COMMENT 'Teacher ID who replaced this version',
+			replaced_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_material_version (material_id, version_number),
+			FOREIGN KEY (material_id) REFERENCES course_materials(id) ON DELETE CASCADE,
+			FOREIGN KEY (replaced_by) REFERENCES teachers(id) ON DELETE SET NULL
+		)
+	`
+	if _, err := DB.Exec(query); err != nil {
+		return fmt.Errorf("failed to create material_versions table: %v", err)
+	}
+
+	log.Println("✅ Material versions table created/verified successfully!")
+	return nil
+}
+
+// snapshotMaterial copies the current state of a material into material_versions
+func snapshotMaterial(tx *sql.Tx, materialID, teacherID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO material_versions (material_id, version_number, title, description, type, file_path, youtube_url,
+			content, content_format, link_url, link_metadata, replaced_by)
+		SELECT id, version, title, description, type, file_path, youtube_url,
+			content, content_format, link_url, link_metadata, ?
+		FROM course_materials WHERE id = ?
+	`, teacherID, materialID)
+	return err
+}
+
+// pruneMaterialVersions drops versions beyond maxMaterialVersions. Callers
+// refresh upload references for the material's files after committing.
+func pruneMaterialVersions(tx *sql.Tx, materialID int) error {
+	rows, err := tx.Query(`
+		SELECT id FROM material_versions
+		WHERE material_id = ?
+		ORDER BY version_number DESC
+		LIMIT 18446744073709551615 OFFSET ?
+	`, materialID, maxMaterialVersions)
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := tx.Exec("DELETE FROM material_versions WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materialFilePaths returns every file used by a material and its versions
+func materialFilePaths(materialID int) ([]string, error) {
+	rows, err := DB.Query(`
+		SELECT file_path FROM course_materials WHERE id = ? AND file_path IS NOT NULL AND file_path != ''
+		UNION
+		SELECT file_path FROM material_versions WHERE material_id = ? AND file_path IS NOT NULL AND file_path != ''
+	`, materialID, materialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// materialOwnedByTeacher checks that a material belongs to one of the teacher's courses
+func materialOwnedByTeacher(materialID, teacherID int) bool {
+	var exists bool
+	err := DB.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM course_materials cm
+			JOIN courses c ON cm.course_id = c.id
+			WHERE cm.id = ? AND c.teacher_id = ?
+		)
+	`, materialID, teacherID).Scan(&exists)
+	return err == nil && exists
+}
+
+// updateMaterialHandler handles editing an existing course material. The
+// previous state is kept in material_versions so it can be restored.
+func updateMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get teacher ID from context
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get material ID from URL
+	vars := mux.Vars(r)
+	materialID, err := strconv.Atoi(vars["materialId"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+
+	if !materialOwnedByTeacher(materialID, teacherID) {
+		http.Error(w, "Material not found or access denied", http.StatusForbidden)
+		return
+	}
+
+	// The update body has the same shape as the create body
+	var req CreateMaterialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request body: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Title == "" || req.Type == "" {
+		http.Error(w, "Title and type are required", http.StatusBadRequest)
+		return
+	}
+
+	linkMetadata, err := validateMaterialRequest(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var courseID int
+	if err := DB.QueryRow("SELECT course_id FROM course_materials WHERE id = ?", materialID).Scan(&courseID); err != nil {
+		log.Printf("Error fetching course of material %d: %v", materialID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkMaterialFile(courseID, teacherID, &req); err != nil {
+		writeMaterialFileError(w, err)
+		return
+	}
+
+	var linkMetadataJSON interface{}
+	if linkMetadata != nil {
+		encoded, _ := json.Marshal(linkMetadata)
+		linkMetadataJSON = string(encoded)
+	}
+
+	// Files the material used before this change, to recount afterwards
+	previousFiles, err := materialFilePaths(materialID)
+	if err != nil {
+		log.Printf("Error collecting material files: %v", err)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := snapshotMaterial(tx, materialID, teacherID); err != nil {
+		log.Printf("Error saving material version: %v", err)
+		http.Error(w, "Failed to update material", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE course_materials
+		SET title = ?, description = ?, type = ?, file_path = ?, youtube_url = ?,
+		    content = ?, content_format = ?, link_url = ?, link_metadata = ?, version = version + 1
+		WHERE id = ?
+	`, req.Title, req.Description, req.Type, req.FilePath, req.YouTubeURL,
+		nullIfEmpty(req.Content), nullIfEmpty(req.ContentFormat), nullIfEmpty(req.LinkURL), linkMetadataJSON, materialID)
+	if err != nil {
+		log.Printf("Error updating material: %v", err)
+		http.Error(w, "Failed to update material", http.StatusInternalServerError)
+		return
+	}
+
+	if err := pruneMaterialVersions(tx, materialID); err != nil {
+		log.Printf("Error pruning material versions: %v", err)
+		http.Error(w, "Failed to update material", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, "Failed to update material", http.StatusInternalServerError)
+		return
+	}
+
+	currentFiles, _ := materialFilePaths(materialID)
+	refreshUploadReferences(append(previousFiles, currentFiles...)...)
+	syncMaterialProcessing(materialID)
+
+	material, err := GetMaterialByID(materialID)
+	if err != nil {
+		log.Printf("Error getting updated material: %v", err)
+		http.Error(w, "Material updated but failed to retrieve updated data", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  "Material updated successfully",
+		"material": material,
+	})
+}
+
+// getMaterialVersionsHandler lists the saved versions of a material, newest first
+func getMaterialVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get teacher ID from context
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	materialID, err := strconv.Atoi(vars["materialId"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+
+	if !materialOwnedByTeacher(materialID, teacherID) {
+		http.Error(w, "Material not found or access denied", http.StatusForbidden)
+		return
+	}
+
+	var currentVersion int
+	if err := DB.QueryRow("SELECT version FROM course_materials WHERE id = ?", materialID).Scan(&currentVersion); err != nil {
+		log.Printf("Error getting material version: %v", err)
+		http.Error(w, "Failed to get material versions", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, material_id, version_number, title, IFNULL(description, ''), type,
+		       IFNULL(file_path, ''), IFNULL(youtube_url, ''), IFNULL(content, ''),
+		       IFNULL(content_format, ''), IFNULL(link_url, ''), link_metadata,
+		       replaced_by, replaced_at
+		FROM material_versions
+		WHERE material_id = ?
+		ORDER BY version_number DESC
+	`, materialID)
+	if err != nil {
+		log.Printf("Error querying material versions: %v", err)
+		http.Error(w, "Failed to get material versions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	versions := []MaterialVersion{}
+	for rows.Next() {
+		var v MaterialVersion
+		var linkMetadata sql.NullString
+		var replacedBy sql.NullInt64
+		err := rows.Scan(&v.ID, &v.MaterialID, &v.VersionNumber, &v.Title, &v.Description, &v.Type,
+			&v.FilePath, &v.YouTubeURL, &v.Content, &v.ContentFormat, &v.LinkURL, &linkMetadata,
+			&replacedBy, &v.ReplacedAt)
+		if err != nil {
+			log.Printf("Error scanning material version: %v", err)
+			continue
+		}
+		if linkMetadata.Valid && linkMetadata.String != "" {
+			var meta LinkMetadata
+			if err := json.Unmarshal([]byte(linkMetadata.String), &meta); err == nil {
+				v.LinkMetadata = &meta
+			}
+		}
+		if replacedBy.Valid {
+			id := int(replacedBy.Int64)
+			v.ReplacedBy = &id
+		}
+		versions = append(versions, v)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"current_version": currentVersion,
+		"versions":        versions,
+	})
+}
+
+// restoreMaterialVersionHandler makes a saved version the current state of
+// the material. The state being replaced is itself saved as a new version.
+func restoreMaterialVersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get teacher ID from context
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	materialID, err := strconv.Atoi(vars["materialId"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+	versionID, err := strconv.Atoi(vars["versionId"])
+	if err != nil {
+		http.Error(w, "Invalid version ID", http.StatusBadRequest)
+		return
+	}
+
+	if !materialOwnedByTeacher(materialID, teacherID) {
+		http.Error(w, "Material not found or access denied", http.StatusForbidden)
+		return
+	}
+
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM material_versions WHERE id = ? AND material_id = ?)", versionID, materialID).Scan(&exists)
+	if err != nil || !exists {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	// Files the material used before this change, to recount afterwards
+	previousFiles, err := materialFilePaths(materialID)
+	if err != nil {
+		log.Printf("Error collecting material files: %v", err)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := snapshotMaterial(tx, materialID, teacherID); err != nil {
+		log.Printf("Error saving material version: %v", err)
+		http.Error(w, "Failed to restore material", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE course_materials cm
+		JOIN material_versions mv ON mv.id = ? AND mv.material_id = cm.id
+		SET cm.title = mv.title, cm.description = mv.description, cm.type = mv.type,
+		    cm.file_path = mv.file_path, cm.youtube_url = mv.youtube_url, cm.content = mv.content,
+		    cm.content_format = mv.content_format, cm.link_url = mv.link_url,
+		    cm.link_metadata = mv.link_metadata, cm.version = cm.version + 1
+		WHERE cm.id = ?
+	`, versionID, materialID)
+	if err != nil {
+		log.Printf("Error restoring material version: %v", err)
+		http.Error(w, "Failed to restore material", http.StatusInternalServerError)
+		return
+	}
+
+	if err := pruneMaterialVersions(tx, materialID); err != nil {
+		log.Printf("Error pruning material versions: %v", err)
+		http.Error(w, "Failed to restore material", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, "Failed to restore material", http.StatusInternalServerError)
+		return
+	}
+
+	currentFiles, _ := materialFilePaths(materialID)
+	refreshUploadReferences(append(previousFiles, currentFiles...)...)
+	syncMaterialProcessing(materialID)
+
+	material, err := GetMaterialByID(materialID)
+	if err != nil {
+		log.Printf("Error getting restored material: %v", err)
+		http.Error(w, "Material restored but failed to retrieve updated data", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  "Material restored successfully",
+		"material": material,
+	})
+}
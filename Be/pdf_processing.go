@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Uploaded PDFs get their page count, a first-page thumbnail and their text
+// extracted in the background with poppler-utils (pdfinfo, pdftoppm,
+// pdftotext). Results are keyed by file path, so materials and quizzes using
+// the same PDF share them. Thumbnails are stored as pdf/<hash>/thumbnail.jpg.
+
+const (
+	processPDFJob    = "process_pdf"
+	pdfPreviewPrefix = "pdf/"
+	pdfToolTimeout   = 2 * time.Minute
+	pdfThumbnailSize = 480
+	// maxPDFTextBytes caps the text kept for search
+	maxPDFTextBytes = 2 << 20
+)
+
+// PDFPreview is the processed state of a PDF shown in listings
+type PDFPreview struct {
+	Status       string `json:"status"` // queued, processing, ready or failed
+	PageCount    *int   `json:"page_count,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// createPDFDocumentsTable creates the table of processed PDFs and the PDF
+// columns on course_materials
+func createPDFDocumentsTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS pdf_documents (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			file_path VARCHAR(500) NOT NULL,
+			status ENUM('queued', 'processing', 'ready', 'failed') NOT NULL DEFAULT 'queued',
+			page_count INT NULL,
+			thumbnail_path VARCHAR(500) NULL,
+			text_content LONGTEXT NULL,
+			job_id BIGINT NULL,
+			error_message TEXT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_pdf_path (file_path)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	newColumns := []struct{ name, definition string }{
+		{"page_count", "INT NULL"},
+		{"thumbnail_path", "VARCHAR(500) NULL"},
+	}
+	for _, col := range newColumns {
+		if err := ensureColumn(DB, "course_materials", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	log.Println("✅ PDF documents table created/verified successfully!")
+	return nil
+}
+
+func init() {
+	registerJobHandler(processPDFJob, processPDFHandler)
+}
+
+// queuePDFProcessing makes sure a PDF has been or will be processed and
+// copies its state onto the materials using it
+func queuePDFProcessing(filePath string) (string, error) {
+	var status string
+	err := DB.QueryRow("SELECT status FROM pdf_documents WHERE file_path = ?", filePath).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if err == sql.ErrNoRows || status == "failed" {
+		jobID, err := enqueueJob(processPDFJob, map[string]string{"file_path": filePath})
+		if err != nil {
+			return "", err
+		}
+		status = "queued"
+		if _, err := DB.Exec(`
+			INSERT INTO pdf_documents (file_path, status, job_id) VALUES (?, 'queued', ?)
+			ON DUPLICATE KEY UPDATE status = 'queued', job_id = VALUES(job_id), error_message = NULL
+		`, filePath, jobID); err != nil {
+			return "", err
+		}
+		log.Printf("Queued processing of %s as job %d", filePath, jobID)
+	}
+
+	return status, syncPDFToMaterials(filePath)
+}
+
+// queueUploadedPDF starts processing a freshly uploaded file if it is a PDF,
+// so its preview is usually ready by the time it is attached to a material
+// or quiz. It returns the processing status, or "" for other files.
+func queueUploadedPDF(stored *StoredUpload) string {
+	if !strings.EqualFold(path.Ext(stored.URLPath), ".pdf") {
+		return ""
+	}
+	status, err := queuePDFProcessing(stored.URLPath)
+	if err != nil {
+		log.Printf("Warning: Failed to queue processing of %s: %v", stored.URLPath, err)
+	}
+	return status
+}
+
+// syncPDFToMaterials copies a PDF's status, page count and thumbnail onto
+// every PDF material that uses it
+func syncPDFToMaterials(filePath string) error {
+	_, err := DB.Exec(`
+		UPDATE course_materials cm
+		JOIN pdf_documents pd ON pd.file_path = cm.file_path
+		SET cm.processing_status = pd.status, cm.page_count = pd.page_count, cm.thumbnail_path = pd.thumbnail_path
+		WHERE cm.file_path = ? AND cm.type = 'pdf'
+	`, filePath)
+	return err
+}
+
+func setPDFStatus(filePath, status string, errorMessage interface{}) {
+	if _, err := DB.Exec(`
+		UPDATE pdf_documents SET status = ?, error_message = ? WHERE file_path = ?
+	`, status, errorMessage, filePath); err != nil {
+		log.Printf("Warning: Failed to update PDF status of %s: %v", filePath, err)
+	}
+	if err := syncPDFToMaterials(filePath); err != nil {
+		log.Printf("Warning: Failed to update material processing status for %s: %v", filePath, err)
+	}
+}
+
+// loadPDFPreview returns the processed state of a PDF, or nil if it has
+// not been queued
+func loadPDFPreview(filePath string) *PDFPreview {
+	if filePath == "" {
+		return nil
+	}
+	var preview PDFPreview
+	var pageCount sql.NullInt64
+	var thumbnail sql.NullString
+	err := DB.QueryRow(`
+		SELECT status, page_count, thumbnail_path FROM pdf_documents WHERE file_path = ?
+	`, filePath).Scan(&preview.Status, &pageCount, &thumbnail)
+	if err != nil {
+		return nil
+	}
+	if pageCount.Valid {
+		n := int(pageCount.Int64)
+		preview.PageCount = &n
+	}
+	if thumbnail.Valid {
+		preview.ThumbnailURL = signFileURL(thumbnail.String)
+	}
+	return &preview
+}
+
+// pdfThumbnailSource returns the PDF a thumbnail was made from
+func pdfThumbnailSource(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, blobURL(pdfPreviewPrefix)) {
+		return "", false
+	}
+	var source string
+	err := DB.QueryRow("SELECT file_path FROM pdf_documents WHERE thumbnail_path = ?", urlPath).Scan(&source)
+	return source, err == nil
+}
+
+// popplerTool returns the path of a poppler-utils binary, from the
+// POPPLER_BIN_DIR directory when it is set
+func popplerTool(name string) string {
+	if dir := os.Getenv("POPPLER_BIN_DIR"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return name
+}
+
+func runPopplerTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, pdfToolTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, popplerTool(name), args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+var pdfPagesPattern = regexp.MustCompile(`(?m)^Pages:\s+(\d+)`)
+
+// processPDFHandler runs a process_pdf job
+func processPDFHandler(ctx context.Context, job *Job) (err error) {
+	var payload struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	filePath := payload.FilePath
+
+	setPDFStatus(filePath, "processing", nil)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if job.FinalAttempt() {
+			setPDFStatus(filePath, "failed", err.Error())
+		} else {
+			setPDFStatus(filePath, "queued", err.Error())
+		}
+	}()
+
+	key, ok := blobKeyFromURL(filePath)
+	if !ok {
+		return fmt.Errorf("invalid file path %s", filePath)
+	}
+	workDir, err := os.MkdirTemp("", "pdf-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	input := filepath.Join(workDir, "document.pdf")
+	if err := downloadBlob(ctx, key, input); err != nil {
+		return fmt.Errorf("failed to fetch PDF: %w", err)
+	}
+
+	info, err := runPopplerTool(ctx, "pdfinfo", input)
+	if err != nil {
+		return err
+	}
+	match := pdfPagesPattern.FindSubmatch(info)
+	if match == nil {
+		return fmt.Errorf("pdfinfo did not report a page count")
+	}
+	pageCount, _ := strconv.Atoi(string(match[1]))
+
+	thumbnailBase := filepath.Join(workDir, "thumbnail")
+	if _, err := runPopplerTool(ctx, "pdftoppm", "-f", "1", "-l", "1", "-singlefile",
+		"-jpeg", "-jpegopt", "quality=80", "-scale-to", strconv.Itoa(pdfThumbnailSize), input, thumbnailBase); err != nil {
+		return err
+	}
+	thumbnailKey := pdfOutputPrefix(key) + "thumbnail.jpg"
+	if err := uploadBlobFile(ctx, thumbnailBase+".jpg", thumbnailKey); err != nil {
+		return fmt.Errorf("failed to store thumbnail: %w", err)
+	}
+
+	text, err := runPopplerTool(ctx, "pdftotext", "-enc", "UTF-8", "-q", input, "-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := DB.Exec(`
+		UPDATE pdf_documents
+		SET status = 'ready', page_count = ?, thumbnail_path = ?, text_content = ?, error_message = NULL
+		WHERE file_path = ?
+	`, pageCount, blobURL(thumbnailKey), normalizePDFText(text), filePath); err != nil {
+		return err
+	}
+	if err := syncPDFToMaterials(filePath); err != nil {
+		return err
+	}
+	log.Printf("Processed PDF %s (%d pages)", filePath, pageCount)
+	return nil
+}
+
+// pdfOutputPrefix is where the derived files of a PDF are stored
+func pdfOutputPrefix(key string) string {
+	name := path.Base(key)
+	return pdfPreviewPrefix + strings.TrimSuffix(name, path.Ext(name)) + "/"
+}
+
+// normalizePDFText turns page breaks into blank lines, drops trailing spaces
+// and repeated blank lines, and caps the length at maxPDFTextBytes
+func normalizePDFText(raw []byte) string {
+	text := strings.ToValidUTF8(string(raw), "")
+	text = strings.ReplaceAll(text, "\f", "\n\n")
+
+	var b strings.Builder
+	blank := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	text = strings.TrimSpace(b.String())
+
+	if len(text) > maxPDFTextBytes {
+		text = text[:maxPDFTextBytes]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text
+}
+
+// deletePDFDocument removes the derived files of a PDF that is being deleted
+func deletePDFDocument(ctx context.Context, filePath string) {
+	key, ok := blobKeyFromURL(filePath)
+	if !ok {
+		return
+	}
+	blobs, err := Storage.List(ctx, pdfOutputPrefix(key))
+	if err != nil {
+		log.Printf("Warning: Failed to list PDF previews of %s: %v", filePath, err)
+		return
+	}
+	for _, blob := range blobs {
+		if err := Storage.Delete(ctx, blob.Key); err != nil && err != ErrBlobNotFound {
+			log.Printf("Warning: Failed to delete %s: %v", blob.Key, err)
+		}
+	}
+	DB.Exec("DELETE FROM pdf_documents WHERE file_path = ?", filePath)
+}
@@ -0,0 +1,959 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Teachers keep reusable questions in a question bank, tagged by subject,
+// topic, difficulty and learning objective. A quiz gets bank questions in
+// two ways:
+//
+//   - picked: the question is copied into quiz_questions_new and every
+//     student answers it;
+//   - drawn: the quiz has draw rules ("10 random easy algebra questions")
+//     and each student gets their own random selection the first time they
+//     open the quiz, and a new one for every further attempt.
+//
+// Both are copies (bank_question_id points back at the source), so editing
+// the bank never changes a quiz that is already in use. Drawn copies are
+// marked is_pool and shared by every student who drew the same question.
+// A student's draw is recorded in quiz_variants together with its seed and
+// copied onto the submission, so grading always uses the same questions.
+
+var questionDifficulties = []string{"easy", "medium", "hard"}
+
+// BankQuestion is a question in a teacher's question bank
+type BankQuestion struct {
+	ID                int              `json:"id"`
+	TeacherID         int              `json:"teacher_id"`
+	Subject           string           `json:"subject,omitempty"`
+	Topic             string           `json:"topic,omitempty"`
+	Difficulty        string           `json:"difficulty,omitempty"`
+	LearningObjective string           `json:"learning_objective,omitempty"`
+	QuestionType      string           `json:"question_type"`
+	Points            int              `json:"points"`
+	QuestionText      string           `json:"question"`
+	EssayAnswerKey    string           `json:"essay_answer_key,omitempty"`
+	Options           *QuestionOptions `json:"options,omitempty"`
+	AnswerKey         *AnswerKey       `json:"answer_key,omitempty"`
+	CreatedAt         time.Time        `json:"created_at"`
+	UpdatedAt         time.Time        `json:"updated_at"`
+}
+
+// BankQuestionRequest is the payload for creating or editing a bank question
+type BankQuestionRequest struct {
+	CreateQuestionRequest
+	Subject           string `json:"subject"`
+	Topic             string `json:"topic"`
+	Difficulty        string `json:"difficulty"`
+	LearningObjective string `json:"learning_objective"`
+}
+
+// QuestionBankFilter selects bank questions by their tags. Empty fields
+// match everything.
+type QuestionBankFilter struct {
+	Subject           string `json:"subject,omitempty"`
+	Topic             string `json:"topic,omitempty"`
+	Difficulty        string `json:"difficulty,omitempty"`
+	LearningObjective string `json:"learning_objective,omitempty"`
+	QuestionType      string `json:"question_type,omitempty"`
+	Search            string `json:"-"` // substring of the question text
+}
+
+// DrawRule asks for Count random bank questions matching its filter
+type DrawRule struct {
+	ID    int `json:"id,omitempty"`
+	Count int `json:"count"`
+	QuestionBankFilter
+	Available *int `json:"available,omitempty"` // matching bank questions, shown to teachers
+}
+
+// createQuestionBankTables creates the question bank, draw rule and draw
+// tables and links quiz questions and submissions to them
+func createQuestionBankTables(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS question_bank (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			teacher_id INT NOT NULL,
+			subject VARCHAR(100) NULL,
+			topic VARCHAR(100) NULL,
+			difficulty ENUM('easy', 'medium', 'hard') NULL,
+			learning_objective VARCHAR(255) NULL,
+			question_type ` + questionTypeEnum() + ` NOT NULL DEFAULT 'multiple_choice',
+			points INT NOT NULL DEFAULT 10,
+			question TEXT NOT NULL,
+			essay_answer_key TEXT NULL,
+			options JSON NULL,
+			answer_key JSON NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_bank_subject (teacher_id, subject),
+			INDEX idx_bank_tags (teacher_id, topic, difficulty),
+			FOREIGN KEY (teacher_id) REFERENCES teachers(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci`,
+		`CREATE TABLE IF NOT EXISTS quiz_draw_rules (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			quiz_id INT NOT NULL,
+			position INT NOT NULL,
+			draw_count INT NOT NULL,
+			subject VARCHAR(100) NULL,
+			topic VARCHAR(100) NULL,
+			difficulty ENUM('easy', 'medium', 'hard') NULL,
+			learning_objective VARCHAR(255) NULL,
+			question_type VARCHAR(50) NULL,
+			INDEX idx_draw_rules_quiz (quiz_id, position),
+			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci`,
+		`CREATE TABLE IF NOT EXISTS quiz_variants (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			quiz_id INT NOT NULL,
+			student_id INT NOT NULL,
+			attempt_number INT NOT NULL DEFAULT 1,
+			seed BIGINT NOT NULL,
+			question_ids JSON NOT NULL COMMENT 'Drawn quiz_questions_new IDs in order',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_variant_attempt (quiz_id, student_id, attempt_number),
+			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE,
+			FOREIGN KEY (student_id) REFERENCES students(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	if err := ensureColumn(db, "quiz_questions_new", "bank_question_id", "INT NULL"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "quiz_questions_new", "is_pool", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return err
+	}
+	if err := ensureIndex(db, "quiz_questions_new", "unique_bank_question", "UNIQUE INDEX", "quiz_id, bank_question_id"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "quiz_submissions", "question_ids", "JSON NULL"); err != nil {
+		return err
+	}
+	log.Println("✅ Question bank tables created/verified successfully!")
+	return nil
+}
+
+// validate checks the tags of a bank question or draw rule
+func (f *QuestionBankFilter) validate() error {
+	f.Subject = strings.TrimSpace(f.Subject)
+	f.Topic = strings.TrimSpace(f.Topic)
+	f.LearningObjective = strings.TrimSpace(f.LearningObjective)
+	f.Difficulty = strings.ToLower(strings.TrimSpace(f.Difficulty))
+	if f.Difficulty != "" && !containsString(questionDifficulties, f.Difficulty) {
+		return fmt.Errorf("difficulty must be one of %s", strings.Join(questionDifficulties, ", "))
+	}
+	if f.QuestionType != "" && !containsString(questionTypes, f.QuestionType) {
+		return fmt.Errorf("unknown question type %q", f.QuestionType)
+	}
+	if len(f.Subject) > 100 || len(f.Topic) > 100 || len(f.LearningObjective) > 255 {
+		return fmt.Errorf("subject and topic are limited to 100 characters, learning_objective to 255")
+	}
+	return nil
+}
+
+// where returns the conditions selecting a teacher's matching bank questions
+func (f QuestionBankFilter) where(teacherID int) (string, []interface{}) {
+	conditions := []string{"teacher_id = ?"}
+	args := []interface{}{teacherID}
+	add := func(column, value string) {
+		if value != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	add("subject", f.Subject)
+	add("topic", f.Topic)
+	add("difficulty", f.Difficulty)
+	add("learning_objective", f.LearningObjective)
+	add("question_type", f.QuestionType)
+	if f.Search != "" {
+		conditions = append(conditions, "question LIKE ?")
+		args = append(args, "%"+escapeLike(f.Search)+"%")
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+const bankSelectColumns = `
+	id, teacher_id, subject, topic, difficulty, learning_objective, question_type, points, question,
+	essay_answer_key, options, answer_key, created_at, updated_at`
+
+func scanBankQuestion(row rowScanner) (*BankQuestion, error) {
+	var b BankQuestion
+	var subject, topic, difficulty, objective, essayAnswerKey, options, answerKey sql.NullString
+	err := row.Scan(&b.ID, &b.TeacherID, &subject, &topic, &difficulty, &objective, &b.QuestionType, &b.Points,
+		&b.QuestionText, &essayAnswerKey, &options, &answerKey, &b.CreatedAt, &b.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	b.Subject = subject.String
+	b.Topic = topic.String
+	b.Difficulty = difficulty.String
+	b.LearningObjective = objective.String
+	b.EssayAnswerKey = essayAnswerKey.String
+	if options.Valid && options.String != "" {
+		var opts QuestionOptions
+		if json.Unmarshal([]byte(options.String), &opts) == nil {
+			b.Options = &opts
+		}
+	}
+	if answerKey.Valid && answerKey.String != "" {
+		var key AnswerKey
+		if json.Unmarshal([]byte(answerKey.String), &key) == nil {
+			b.AnswerKey = &key
+		}
+	}
+	return &b, nil
+}
+
+// question converts a bank question into a quiz question, filling the
+// legacy option columns where they apply
+func (b *BankQuestion) question() Question {
+	q := Question{
+		QuestionType:   b.QuestionType,
+		Points:         b.Points,
+		QuestionText:   b.QuestionText,
+		EssayAnswerKey: b.EssayAnswerKey,
+		Options:        b.Options,
+		AnswerKey:      b.AnswerKey,
+	}
+	normalizeQuestion(&q)
+	return q
+}
+
+// bankQuestionFromRequest validates a create or edit payload
+func bankQuestionFromRequest(req BankQuestionRequest) (*BankQuestion, error) {
+	q := questionFromRequest(req.CreateQuestionRequest)
+	if err := validateQuestion(&q); err != nil {
+		return nil, err
+	}
+	tags := QuestionBankFilter{
+		Subject:           req.Subject,
+		Topic:             req.Topic,
+		Difficulty:        req.Difficulty,
+		LearningObjective: req.LearningObjective,
+	}
+	if err := tags.validate(); err != nil {
+		return nil, err
+	}
+	return &BankQuestion{
+		Subject:           tags.Subject,
+		Topic:             tags.Topic,
+		Difficulty:        tags.Difficulty,
+		LearningObjective: tags.LearningObjective,
+		QuestionType:      q.QuestionType,
+		Points:            q.Points,
+		QuestionText:      q.QuestionText,
+		EssayAnswerKey:    q.EssayAnswerKey,
+		Options:           q.Options,
+		AnswerKey:         q.AnswerKey,
+	}, nil
+}
+
+// bankWriteArgs returns the values written by the create and edit handlers
+func bankWriteArgs(b *BankQuestion) []interface{} {
+	var options, answerKey interface{}
+	if b.Options != nil {
+		encoded, _ := json.Marshal(b.Options)
+		options = string(encoded)
+	}
+	if b.AnswerKey != nil {
+		encoded, _ := json.Marshal(b.AnswerKey)
+		answerKey = string(encoded)
+	}
+	return []interface{}{
+		nullIfEmpty(b.Subject), nullIfEmpty(b.Topic), nullIfEmpty(b.Difficulty), nullIfEmpty(b.LearningObjective),
+		b.QuestionType, b.Points, b.QuestionText, nullIfEmpty(b.EssayAnswerKey), options, answerKey,
+	}
+}
+
+// teacherOwnsQuiz checks that a quiz belongs to one of the teacher's courses
+func teacherOwnsQuiz(quizID, teacherID int) bool {
+	var exists bool
+	err := DB.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM quizzes_new q
+			JOIN courses c ON q.course_id = c.id
+			WHERE q.id = ? AND c.teacher_id = ?
+		)
+	`, quizID, teacherID).Scan(&exists)
+	return err == nil && exists
+}
+
+// getQuestionBankHandler lists the teacher's bank questions. The subject,
+// topic, difficulty, objective and type query parameters filter by tag and
+// q searches the question text.
+func getQuestionBankHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	filter := QuestionBankFilter{
+		Subject:           params.Get("subject"),
+		Topic:             params.Get("topic"),
+		Difficulty:        params.Get("difficulty"),
+		LearningObjective: params.Get("objective"),
+		QuestionType:      params.Get("type"),
+		Search:            strings.TrimSpace(params.Get("q")),
+	}
+	if err := filter.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, args := filter.where(teacherID)
+	rows, err := DB.Query(`SELECT `+bankSelectColumns+` FROM question_bank WHERE `+where+` ORDER BY subject, topic, id`, args...)
+	if err != nil {
+		log.Printf("Error fetching question bank: %v", err)
+		http.Error(w, "Failed to fetch question bank", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	questions := []BankQuestion{}
+	for rows.Next() {
+		b, err := scanBankQuestion(rows)
+		if err != nil {
+			log.Printf("Error scanning bank question: %v", err)
+			continue
+		}
+		questions = append(questions, *b)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"questions": questions,
+	})
+}
+
+// getQuestionBankTagsHandler lists the subjects, topics and learning
+// objectives used in the teacher's bank with their question counts
+func getQuestionBankTagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	type tagCount struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	response := map[string]interface{}{"success": true}
+	for key, column := range map[string]string{
+		"subjects":            "subject",
+		"topics":              "topic",
+		"difficulties":        "difficulty",
+		"learning_objectives": "learning_objective",
+	} {
+		rows, err := DB.Query(`
+			SELECT `+column+`, COUNT(*) FROM question_bank
+			WHERE teacher_id = ? AND `+column+` IS NOT NULL
+			GROUP BY `+column+` ORDER BY `+column, teacherID)
+		if err != nil {
+			log.Printf("Error fetching question bank %s: %v", key, err)
+			http.Error(w, "Failed to fetch question bank tags", http.StatusInternalServerError)
+			return
+		}
+		tags := []tagCount{}
+		for rows.Next() {
+			var tag tagCount
+			if rows.Scan(&tag.Name, &tag.Count) == nil {
+				tags = append(tags, tag)
+			}
+		}
+		rows.Close()
+		response[key] = tags
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// createBankQuestionHandler adds a question to the teacher's bank
+func createBankQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req BankQuestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	b, err := bankQuestionFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := append([]interface{}{teacherID}, bankWriteArgs(b)...)
+	result, err := DB.Exec(`
+		INSERT INTO question_bank (teacher_id, subject, topic, difficulty, learning_objective,
+		                           question_type, points, question, essay_answer_key, options, answer_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, args...)
+	if err != nil {
+		log.Printf("Error creating bank question: %v", err)
+		http.Error(w, "Failed to create question", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"question_id": id,
+		"message":     "Question added to the bank",
+	})
+}
+
+// updateBankQuestionHandler edits a bank question. Quizzes that already
+// use it keep their own copy.
+func updateBankQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	questionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid question ID", http.StatusBadRequest)
+		return
+	}
+
+	var req BankQuestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	b, err := bankQuestionFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := append(bankWriteArgs(b), questionID, teacherID)
+	result, err := DB.Exec(`
+		UPDATE question_bank
+		SET subject = ?, topic = ?, difficulty = ?, learning_objective = ?,
+		    question_type = ?, points = ?, question = ?, essay_answer_key = ?, options = ?, answer_key = ?
+		WHERE id = ? AND teacher_id = ?
+	`, args...)
+	if err != nil {
+		log.Printf("Error updating bank question %d: %v", questionID, err)
+		http.Error(w, "Failed to update question", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var exists bool
+		DB.QueryRow("SELECT EXISTS(SELECT 1 FROM question_bank WHERE id = ? AND teacher_id = ?)", questionID, teacherID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Question not found or access denied", http.StatusNotFound)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Question updated",
+	})
+}
+
+// deleteBankQuestionHandler removes a question from the bank. Copies in
+// quizzes stay; it is just no longer drawn for new students.
+func deleteBankQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	questionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid question ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM question_bank WHERE id = ? AND teacher_id = ?", questionID, teacherID)
+	if err != nil {
+		log.Printf("Error deleting bank question %d: %v", questionID, err)
+		http.Error(w, "Failed to delete question", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Question not found or access denied", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Question deleted",
+	})
+}
+
+// copyBankQuestion copies a bank question into a quiz and returns the quiz
+// question ID. A question already copied into the quiz is reused; picking a
+// question that was only drawn so far makes it a fixed question.
+func copyBankQuestion(tx *sql.Tx, quizID, bankQuestionID int, pool bool) (int64, error) {
+	b, err := scanBankQuestion(tx.QueryRow(`SELECT `+bankSelectColumns+` FROM question_bank WHERE id = ?`, bankQuestionID))
+	if err != nil {
+		return 0, err
+	}
+	q := b.question()
+	args := append([]interface{}{quizID}, questionWriteArgs(&q)...)
+	args = append(args, bankQuestionID, pool)
+	result, err := tx.Exec(`
+		INSERT INTO quiz_questions_new (quiz_id, question_type, points, question, option_a, option_b, option_c, option_d,
+		                                correct_answer, essay_answer_key, options, answer_key, rubric_id, full_credit,
+		                                bank_question_id, is_pool)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), is_pool = is_pool AND VALUES(is_pool)
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// addBankQuestionsHandler copies picked bank questions into a quiz
+func addBankQuestionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+	if !teacherOwnsQuiz(quizID, teacherID) {
+		http.Error(w, "Quiz not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		QuestionIDs []int `json:"question_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.QuestionIDs) == 0 {
+		http.Error(w, "question_ids is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	added := []int64{}
+	for _, bankID := range req.QuestionIDs {
+		var owned bool
+		tx.QueryRow("SELECT EXISTS(SELECT 1 FROM question_bank WHERE id = ? AND teacher_id = ?)", bankID, teacherID).Scan(&owned)
+		if !owned {
+			http.Error(w, fmt.Sprintf("Bank question %d not found", bankID), http.StatusBadRequest)
+			return
+		}
+		id, err := copyBankQuestion(tx, quizID, bankID, false)
+		if err != nil {
+			log.Printf("Error copying bank question %d into quiz %d: %v", bankID, quizID, err)
+			http.Error(w, "Failed to add questions", http.StatusInternalServerError)
+			return
+		}
+		added = append(added, id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"question_ids": added,
+		"message":      fmt.Sprintf("%d question(s) added to the quiz", len(added)),
+	})
+}
+
+// loadDrawRules returns a quiz's draw rules in order
+func loadDrawRules(quizID int) ([]DrawRule, error) {
+	rows, err := DB.Query(`
+		SELECT id, draw_count, subject, topic, difficulty, learning_objective, question_type
+		FROM quiz_draw_rules WHERE quiz_id = ? ORDER BY position
+	`, quizID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []DrawRule
+	for rows.Next() {
+		var rule DrawRule
+		var subject, topic, difficulty, objective, questionType sql.NullString
+		if err := rows.Scan(&rule.ID, &rule.Count, &subject, &topic, &difficulty, &objective, &questionType); err != nil {
+			return nil, err
+		}
+		rule.Subject = subject.String
+		rule.Topic = topic.String
+		rule.Difficulty = difficulty.String
+		rule.LearningObjective = objective.String
+		rule.QuestionType = questionType.String
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// drawCandidates returns the IDs of the teacher's bank questions matching a
+// rule, in ID order so a seed always shuffles them the same way
+func drawCandidates(q queryer, teacherID int, filter QuestionBankFilter) ([]int, error) {
+	where, args := filter.where(teacherID)
+	rows, err := q.Query(`SELECT id FROM question_bank WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// fixedBankQuestions returns the bank questions picked into a quiz, which
+// rules never draw again
+func fixedBankQuestions(quizID int) (map[int]bool, error) {
+	rows, err := DB.Query(`
+		SELECT bank_question_id FROM quiz_questions_new
+		WHERE quiz_id = ? AND is_pool = FALSE AND bank_question_id IS NOT NULL
+	`, quizID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	used := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		used[id] = true
+	}
+	return used, rows.Err()
+}
+
+// getDrawRulesHandler returns a quiz's draw rules with how many bank
+// questions currently match each one
+func getDrawRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+	if !teacherOwnsQuiz(quizID, teacherID) {
+		http.Error(w, "Quiz not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+
+	rules, err := loadDrawRules(quizID)
+	if err != nil {
+		log.Printf("Error fetching draw rules: %v", err)
+		http.Error(w, "Failed to fetch draw rules", http.StatusInternalServerError)
+		return
+	}
+	fixed, err := fixedBankQuestions(quizID)
+	if err != nil {
+		log.Printf("Error fetching quiz bank questions: %v", err)
+		http.Error(w, "Failed to fetch draw rules", http.StatusInternalServerError)
+		return
+	}
+	for i := range rules {
+		candidates, err := drawCandidates(DB, teacherID, rules[i].QuestionBankFilter)
+		if err != nil {
+			log.Printf("Error counting draw candidates: %v", err)
+			continue
+		}
+		available := 0
+		for _, id := range candidates {
+			if !fixed[id] {
+				available++
+			}
+		}
+		rules[i].Available = &available
+	}
+	if rules == nil {
+		rules = []DrawRule{}
+	}
+
+	var drawn int
+	DB.QueryRow("SELECT COUNT(DISTINCT student_id) FROM quiz_variants WHERE quiz_id = ?", quizID).Scan(&drawn)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"rules":          rules,
+		"students_drawn": drawn,
+	})
+}
+
+// updateDrawRulesHandler replaces a quiz's draw rules. Students who already
+// drew their questions keep them.
+func updateDrawRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+	if !teacherOwnsQuiz(quizID, teacherID) {
+		http.Error(w, "Quiz not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Rules []DrawRule `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	fixed, err := fixedBankQuestions(quizID)
+	if err != nil {
+		log.Printf("Error fetching quiz bank questions: %v", err)
+		http.Error(w, "Failed to save draw rules", http.StatusInternalServerError)
+		return
+	}
+	for i := range req.Rules {
+		rule := &req.Rules[i]
+		rule.Search = ""
+		if err := rule.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Rule %d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+		if rule.Count < 1 {
+			http.Error(w, fmt.Sprintf("Rule %d: count must be at least 1", i+1), http.StatusBadRequest)
+			return
+		}
+		candidates, err := drawCandidates(DB, teacherID, rule.QuestionBankFilter)
+		if err != nil {
+			log.Printf("Error counting draw candidates: %v", err)
+			http.Error(w, "Failed to save draw rules", http.StatusInternalServerError)
+			return
+		}
+		available := 0
+		for _, id := range candidates {
+			if !fixed[id] {
+				available++
+			}
+		}
+		if available < rule.Count {
+			http.Error(w, fmt.Sprintf("Rule %d asks for %d questions but only %d in the bank match", i+1, rule.Count, available), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM quiz_draw_rules WHERE quiz_id = ?", quizID); err != nil {
+		log.Printf("Error clearing draw rules: %v", err)
+		http.Error(w, "Failed to save draw rules", http.StatusInternalServerError)
+		return
+	}
+	for i, rule := range req.Rules {
+		if _, err := tx.Exec(`
+			INSERT INTO quiz_draw_rules (quiz_id, position, draw_count, subject, topic, difficulty, learning_objective, question_type)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, quizID, i, rule.Count, nullIfEmpty(rule.Subject), nullIfEmpty(rule.Topic), nullIfEmpty(rule.Difficulty),
+			nullIfEmpty(rule.LearningObjective), nullIfEmpty(rule.QuestionType)); err != nil {
+			log.Printf("Error saving draw rule: %v", err)
+			http.Error(w, "Failed to save draw rules", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Draw rules saved",
+	})
+}
+
+// loadQuestionsByID returns questions of a quiz by ID
+func loadQuestionsByID(quizID int, ids []int) (map[int]Question, error) {
+	byID := make(map[int]Question)
+	if len(ids) == 0 {
+		return byID, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := []interface{}{quizID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := DB.Query(`SELECT `+questionSelectColumns+` FROM quiz_questions_new WHERE quiz_id = ? AND id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			log.Printf("Error scanning question: %v", err)
+			continue
+		}
+		byID[q.ID] = *q
+	}
+	return byID, rows.Err()
+}
+
+// newVariantSeed returns a random seed for a student's draw and shuffle
+func newVariantSeed() (int64, error) {
+	var seedBytes [8]byte
+	if _, err := rand.Read(seedBytes[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(seedBytes[:]) >> 1), nil
+}
+
+// drawQuestions draws a student's questions for an attempt with the given
+// seed, copies them into the quiz and records the draw. When two requests
+// race, the draw recorded first wins.
+func drawQuestions(quizID, studentID, attemptNumber int, rules []DrawRule, seed int64) error {
+	var teacherID int
+	err := DB.QueryRow(`
+		SELECT c.teacher_id FROM quizzes_new q JOIN courses c ON q.course_id = c.id WHERE q.id = ?
+	`, quizID).Scan(&teacherID)
+	if err != nil {
+		return err
+	}
+	used, err := fixedBankQuestions(quizID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rng := mathrand.New(mathrand.NewSource(seed))
+	ids := []int{}
+	for _, rule := range rules {
+		candidates, err := drawCandidates(tx, teacherID, rule.QuestionBankFilter)
+		if err != nil {
+			return err
+		}
+		var pool []int
+		for _, id := range candidates {
+			if !used[id] {
+				pool = append(pool, id)
+			}
+		}
+		rng.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+		if len(pool) > rule.Count {
+			pool = pool[:rule.Count]
+		} else if len(pool) < rule.Count {
+			log.Printf("Warning: Draw rule %d of quiz %d wants %d questions, only %d available", rule.ID, quizID, rule.Count, len(pool))
+		}
+		for _, bankID := range pool {
+			used[bankID] = true
+			id, err := copyBankQuestion(tx, quizID, bankID, true)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, int(id))
+		}
+	}
+
+	encoded, _ := json.Marshal(ids)
+	if _, err := tx.Exec(`
+		INSERT IGNORE INTO quiz_variants (quiz_id, student_id, attempt_number, seed, question_ids) VALUES (?, ?, ?, ?, ?)
+	`, quizID, studentID, attemptNumber, seed, string(encoded)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Drew %d question(s) of quiz %d for student %d, attempt %d", len(ids), quizID, studentID, attemptNumber)
+	return nil
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Questions keep their choices in the options column and their answer key
+// in answer_key, both JSON. The option_a..option_d and correct_answer
+// columns are still filled for four-choice multiple choice questions so
+// older clients keep working, and questions written before the JSON columns
+// existed are read from them.
+
+// Question types
+const (
+	questionMultipleChoice = "multiple_choice"
+	questionMultipleSelect = "multiple_select"
+	questionTrueFalse      = "true_false"
+	questionShortAnswer    = "short_answer"
+	questionNumeric        = "numeric"
+	questionMatching       = "matching"
+	questionOrdering       = "ordering"
+	questionFillBlank      = "fill_blank"
+	questionEssay          = "essay"
+)
+
+var questionTypes = []string{
+	questionMultipleChoice, questionMultipleSelect, questionTrueFalse, questionShortAnswer,
+	questionNumeric, questionMatching, questionOrdering, questionFillBlank, questionEssay,
+}
+
+// fillBlankPattern marks the blanks in a fill_blank question, e.g. "Ibu kota
+// Jawa Barat adalah {{1}}", numbered from 1
+var fillBlankPattern = regexp.MustCompile(`\{\{\s*(\d+)\s*\}\}`)
+
+// QuestionOption is a choice, or one side of a matching pair
+type QuestionOption struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// QuestionOptions holds what a student chooses from
+type QuestionOptions struct {
+	Choices []QuestionOption `json:"choices,omitempty"` // multiple_choice, multiple_select and ordering
+	Left    []QuestionOption `json:"left,omitempty"`    // matching prompts
+	Right   []QuestionOption `json:"right,omitempty"`   // matching answers
+}
+
+// AnswerKey is the correct answer of an auto-graded question. Which fields
+// are used depends on the question type.
+type AnswerKey struct {
+	Correct       []string          `json:"correct,omitempty"`        // choice IDs for multiple_choice and multiple_select
+	Value         *bool             `json:"value,omitempty"`          // true_false
+	Accepted      []string          `json:"accepted,omitempty"`       // short_answer variants
+	Patterns      []string          `json:"patterns,omitempty"`       // short_answer regular expressions, matched in full
+	CaseSensitive bool              `json:"case_sensitive,omitempty"` // short_answer and fill_blank
+	Number        *float64          `json:"number,omitempty"`         // numeric
+	Tolerance     float64           `json:"tolerance,omitempty"`      // numeric, absolute
+	Pairs         map[string]string `json:"pairs,omitempty"`          // matching, left ID to right ID
+	Order         []string          `json:"order,omitempty"`          // ordering, choice IDs
+	Blanks        [][]string        `json:"blanks,omitempty"`         // fill_blank, accepted answers per blank
+	// PartialCredit gives a share of the points for partly correct
+	// multiple_select, matching, ordering and fill_blank answers
+	PartialCredit bool `json:"partial_credit,omitempty"`
+}
+
+// createQuestionTypeColumns widens question_type and adds the JSON columns
+// to quiz_questions_new tables created before they existed
+func createQuestionTypeColumns(db *sql.DB) error {
+	var columnType string
+	err := db.QueryRow(`
+		SELECT COLUMN_TYPE FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'quiz_questions_new' AND COLUMN_NAME = 'question_type'
+	`).Scan(&columnType)
+	if err != nil {
+		return fmt.Errorf("failed to check quiz_questions_new.question_type: %v", err)
+	}
+	if !strings.Contains(columnType, "'"+questionFillBlank+"'") {
+		if _, err := db.Exec(`
+			ALTER TABLE quiz_questions_new MODIFY COLUMN question_type ` + questionTypeEnum() + ` DEFAULT 'multiple_choice'
+		`); err != nil {
+			return fmt.Errorf("failed to widen quiz_questions_new.question_type: %v", err)
+		}
+		log.Println("✅ Widened quiz_questions_new.question_type")
+	}
+
+	for _, col := range []string{"options", "answer_key"} {
+		if err := ensureColumn(db, "quiz_questions_new", col, "JSON NULL"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func questionTypeEnum() string {
+	quoted := make([]string, len(questionTypes))
+	for i, t := range questionTypes {
+		quoted[i] = "'" + t + "'"
+	}
+	return "ENUM(" + strings.Join(quoted, ", ") + ")"
+}
+
+// questionSelectColumns is the column list scanned by scanQuestion
+const questionSelectColumns = `
+	id, quiz_id, question_type, points, question,
+	option_a, option_b, option_c, option_d, correct_answer, essay_answer_key,
+	options, answer_key, rubric_id, full_credit, created_at`
+
+// scanQuestion scans a row selected with questionSelectColumns
+func scanQuestion(row rowScanner) (*Question, error) {
+	var q Question
+	var optionA, optionB, optionC, optionD, correctAnswer, essayAnswerKey, options, answerKey sql.NullString
+	var rubricID sql.NullInt64
+	err := row.Scan(&q.ID, &q.QuizID, &q.QuestionType, &q.Points, &q.QuestionText,
+		&optionA, &optionB, &optionC, &optionD, &correctAnswer, &essayAnswerKey,
+		&options, &answerKey, &rubricID, &q.FullCredit, &q.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if rubricID.Valid {
+		id := int(rubricID.Int64)
+		q.RubricID = &id
+	}
+	q.OptionA = optionA.String
+	q.OptionB = optionB.String
+	q.OptionC = optionC.String
+	q.OptionD = optionD.String
+	q.CorrectAnswer = correctAnswer.String
+	q.EssayAnswerKey = essayAnswerKey.String
+	if options.Valid && options.String != "" {
+		var opts QuestionOptions
+		if err := json.Unmarshal([]byte(options.String), &opts); err == nil {
+			q.Options = &opts
+		}
+	}
+	if answerKey.Valid && answerKey.String != "" {
+		var key AnswerKey
+		if err := json.Unmarshal([]byte(answerKey.String), &key); err == nil {
+			q.AnswerKey = &key
+		}
+	}
+	normalizeQuestion(&q)
+	return &q, nil
+}
+
+// loadQuizQuestions returns the questions of a quiz every student answers,
+// in order. Questions drawn from the question bank are left out, see
+// loadStudentQuestions.
+func loadQuizQuestions(quizID int) ([]Question, error) {
+	rows, err := DB.Query(`SELECT `+questionSelectColumns+` FROM quiz_questions_new WHERE quiz_id = ? AND is_pool = FALSE ORDER BY id ASC`, quizID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var questions []Question
+	for rows.Next() {
+		q, err := scanQuestion(rows)
+		if err != nil {
+			log.Printf("Error scanning question: %v", err)
+			continue
+		}
+		questions = append(questions, *q)
+	}
+	return questions, rows.Err()
+}
+
+// questionFromRequest builds a question from the create or update payload
+func questionFromRequest(req CreateQuestionRequest) Question {
+	q := Question{
+		QuestionType:   req.QuestionType,
+		Points:         req.Points,
+		QuestionText:   req.QuestionText,
+		OptionA:        req.OptionA,
+		OptionB:        req.OptionB,
+		OptionC:        req.OptionC,
+		OptionD:        req.OptionD,
+		CorrectAnswer:  req.CorrectAnswer,
+		EssayAnswerKey: req.EssayAnswerKey,
+		Options:        req.Options,
+		AnswerKey:      req.AnswerKey,
+		RubricID:       req.RubricID,
+		FullCredit:     req.FullCredit,
+	}
+	if req.ID != nil {
+		q.ID = *req.ID
+	}
+	if q.QuestionType == "" {
+		q.QuestionType = questionMultipleChoice
+	}
+	normalizeQuestion(&q)
+	return q
+}
+
+// normalizeQuestion fills the JSON options and key from the legacy columns
+// and the other way round, so both representations agree
+func normalizeQuestion(q *Question) {
+	legacy := []QuestionOption{{"A", q.OptionA}, {"B", q.OptionB}, {"C", q.OptionC}, {"D", q.OptionD}}
+	// correct_answer only holds the letter of a lettered multiple choice
+	// question, set below once the key is known
+	correctAnswer := q.CorrectAnswer
+	q.CorrectAnswer = ""
+
+	switch q.QuestionType {
+	case questionMultipleChoice:
+		if q.Options == nil {
+			var choices []QuestionOption
+			for _, opt := range legacy {
+				if opt.Text != "" {
+					choices = append(choices, opt)
+				}
+			}
+			if len(choices) > 0 {
+				q.Options = &QuestionOptions{Choices: choices}
+			}
+		}
+		if q.AnswerKey == nil && correctAnswer != "" {
+			q.AnswerKey = &AnswerKey{Correct: []string{strings.ToUpper(correctAnswer)}}
+		}
+		// Mirror four lettered choices into the legacy columns
+		if q.Options != nil && len(q.Options.Choices) <= len(legacy) {
+			lettered := true
+			for i, choice := range q.Options.Choices {
+				lettered = lettered && choice.ID == legacy[i].ID
+			}
+			if lettered {
+				fields := []*string{&q.OptionA, &q.OptionB, &q.OptionC, &q.OptionD}
+				for i, choice := range q.Options.Choices {
+					*fields[i] = choice.Text
+				}
+				if q.AnswerKey != nil && len(q.AnswerKey.Correct) == 1 {
+					q.CorrectAnswer = legacyCorrectAnswer(q)
+				}
+			}
+		}
+	case questionTrueFalse:
+		if q.AnswerKey == nil {
+			if value, err := strconv.ParseBool(strings.ToLower(correctAnswer)); err == nil {
+				q.AnswerKey = &AnswerKey{Value: &value}
+			}
+		}
+	}
+}
+
+// validateQuestion checks that a question can be shown and graded
+func validateQuestion(q *Question) error {
+	known := false
+	for _, t := range questionTypes {
+		known = known || q.QuestionType == t
+	}
+	if !known {
+		return fmt.Errorf("unknown question type %q", q.QuestionType)
+	}
+	if strings.TrimSpace(q.QuestionText) == "" {
+		return fmt.Errorf("question text is required")
+	}
+	if q.Points < 0 {
+		return fmt.Errorf("points cannot be negative")
+	}
+	if q.RubricID != nil && q.QuestionType != questionEssay {
+		return fmt.Errorf("only essay questions can be graded with a rubric")
+	}
+	if q.QuestionType == questionEssay {
+		return nil
+	}
+
+	key := q.AnswerKey
+	if key == nil {
+		return fmt.Errorf("%s questions need an answer_key", q.QuestionType)
+	}
+
+	switch q.QuestionType {
+	case questionMultipleChoice, questionMultipleSelect, questionOrdering:
+		if q.Options == nil || len(q.Options.Choices) < 2 {
+			return fmt.Errorf("%s questions need at least two choices", q.QuestionType)
+		}
+		ids, err := optionIDs(q.Options.Choices)
+		if err != nil {
+			return err
+		}
+		switch q.QuestionType {
+		case questionMultipleChoice:
+			if len(key.Correct) != 1 || !ids[key.Correct[0]] {
+				return fmt.Errorf("multiple_choice questions need exactly one correct choice")
+			}
+		case questionMultipleSelect:
+			if len(key.Correct) == 0 {
+				return fmt.Errorf("multiple_select questions need at least one correct choice")
+			}
+			for _, id := range key.Correct {
+				if !ids[id] {
+					return fmt.Errorf("correct choice %q is not one of the choices", id)
+				}
+			}
+		case questionOrdering:
+			if len(key.Order) != len(q.Options.Choices) {
+				return fmt.Errorf("ordering questions need every choice in the order")
+			}
+			seen := make(map[string]bool)
+			for _, id := range key.Order {
+				if !ids[id] || seen[id] {
+					return fmt.Errorf("order must list each choice once")
+				}
+				seen[id] = true
+			}
+		}
+	case questionTrueFalse:
+		if key.Value == nil {
+			return fmt.Errorf("true_false questions need a value in the answer_key")
+		}
+	case questionShortAnswer:
+		if len(key.Accepted) == 0 && len(key.Patterns) == 0 {
+			return fmt.Errorf("short_answer questions need accepted answers or patterns")
+		}
+		for _, pattern := range key.Patterns {
+			if _, err := compileAnswerPattern(pattern, key.CaseSensitive); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	case questionNumeric:
+		if key.Number == nil || math.IsNaN(*key.Number) || math.IsInf(*key.Number, 0) {
+			return fmt.Errorf("numeric questions need a number in the answer_key")
+		}
+		if key.Tolerance < 0 {
+			return fmt.Errorf("tolerance cannot be negative")
+		}
+	case questionMatching:
+		if q.Options == nil || len(q.Options.Left) == 0 || len(q.Options.Right) == 0 {
+			return fmt.Errorf("matching questions need left and right options")
+		}
+		left, err := optionIDs(q.Options.Left)
+		if err != nil {
+			return err
+		}
+		right, err := optionIDs(q.Options.Right)
+		if err != nil {
+			return err
+		}
+		if len(key.Pairs) != len(left) {
+			return fmt.Errorf("matching questions need a pair for every left option")
+		}
+		for l, r := range key.Pairs {
+			if !left[l] || !right[r] {
+				return fmt.Errorf("pair %q → %q refers to an unknown option", l, r)
+			}
+		}
+	case questionFillBlank:
+		blanks := len(fillBlankPattern.FindAllString(q.QuestionText, -1))
+		if blanks == 0 {
+			return fmt.Errorf("fill_blank questions mark blanks as {{1}}, {{2}}, ...")
+		}
+		if len(key.Blanks) != blanks {
+			return fmt.Errorf("the answer_key has %d blanks but the question has %d", len(key.Blanks), blanks)
+		}
+		for i, accepted := range key.Blanks {
+			if len(accepted) == 0 {
+				return fmt.Errorf("blank %d has no accepted answers", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+func optionIDs(options []QuestionOption) (map[string]bool, error) {
+	ids := make(map[string]bool, len(options))
+	for _, opt := range options {
+		if opt.ID == "" || strings.TrimSpace(opt.Text) == "" {
+			return nil, fmt.Errorf("every option needs an id and text")
+		}
+		if ids[opt.ID] {
+			return nil, fmt.Errorf("option id %q is used twice", opt.ID)
+		}
+		ids[opt.ID] = true
+	}
+	return ids, nil
+}
+
+// legacyCorrectAnswer is the correct_answer column of a question. The
+// column is an ENUM of the four letters, so it stays NULL for every other
+// question.
+func legacyCorrectAnswer(q *Question) string {
+	if q.QuestionType != questionMultipleChoice || q.AnswerKey == nil || len(q.AnswerKey.Correct) != 1 {
+		return ""
+	}
+	switch correct := q.AnswerKey.Correct[0]; correct {
+	case "A", "B", "C", "D":
+		return correct
+	}
+	return ""
+}
+
+// questionWriteArgs returns the values for the question columns written by
+// insertQuestion and updateQuestion
+func questionWriteArgs(q *Question) []interface{} {
+	nullable := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	jsonOrNull := func(v interface{}, present bool) interface{} {
+		if !present {
+			return nil
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(encoded)
+	}
+	return []interface{}{
+		q.QuestionType, q.Points, q.QuestionText,
+		nullable(q.OptionA), nullable(q.OptionB), nullable(q.OptionC), nullable(q.OptionD),
+		nullable(legacyCorrectAnswer(q)), nullable(q.EssayAnswerKey),
+		jsonOrNull(q.Options, q.Options != nil), jsonOrNull(q.AnswerKey, q.AnswerKey != nil),
+		q.RubricID, q.FullCredit,
+	}
+}
+
+// insertQuestion adds a question to a quiz
+func insertQuestion(tx *sql.Tx, quizID int64, q *Question) error {
+	args := append([]interface{}{quizID}, questionWriteArgs(q)...)
+	_, err := tx.Exec(`
+		INSERT INTO quiz_questions_new (quiz_id, question_type, points, question, option_a, option_b, option_c, option_d,
+		                                correct_answer, essay_answer_key, options, answer_key, rubric_id, full_credit)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, args...)
+	return err
+}
+
+// updateQuestion rewrites an existing question of a quiz
+func updateQuestion(tx *sql.Tx, quizID int64, q *Question) error {
+	args := append(questionWriteArgs(q), q.ID, quizID)
+	_, err := tx.Exec(`
+		UPDATE quiz_questions_new
+		SET question_type = ?, points = ?, question = ?, option_a = ?, option_b = ?, option_c = ?, option_d = ?,
+		    correct_answer = ?, essay_answer_key = ?, options = ?, answer_key = ?, rubric_id = ?,
+		    full_credit = ?
+		WHERE id = ? AND quiz_id = ?
+	`, args...)
+	return err
+}
+
+// hideQuestionKey removes what would give a question's answer away before
+// it is sent to a student
+func hideQuestionKey(q *Question) {
+	q.CorrectAnswer = ""
+	q.EssayAnswerKey = ""
+	q.AnswerKey = nil
+	if q.Options == nil {
+		return
+	}
+	// Teachers usually enter the items in the correct order, and the
+	// matching answers next to their prompts
+	switch q.QuestionType {
+	case questionOrdering:
+		q.Options = &QuestionOptions{Choices: sortedOptions(q.Options.Choices)}
+	case questionMatching:
+		q.Options = &QuestionOptions{Left: q.Options.Left, Right: sortedOptions(q.Options.Right)}
+	}
+}
+
+// sortedOptions returns a copy of the options in alphabetical order
+func sortedOptions(options []QuestionOption) []QuestionOption {
+	sorted := append([]QuestionOption(nil), options...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].Text) < strings.ToLower(sorted[j].Text)
+	})
+	return sorted
+}
+
+// encodeAnswer turns a submitted answer into the text stored in
+// quiz_answers. Plain strings are stored as-is, other values as JSON.
+func encodeAnswer(answer interface{}) string {
+	switch v := answer.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	encoded, err := json.Marshal(answer)
+	if err != nil {
+		return fmt.Sprintf("%v", answer)
+	}
+	return string(encoded)
+}
+
+// gradeAnswer scores an answer as a fraction of the question's points.
+// ok is false for questions that are graded by hand.
+func gradeAnswer(q *Question, answer interface{}) (fraction float64, ok bool) {
+	if q.FullCredit {
+		return 1, true
+	}
+	key := q.AnswerKey
+	if q.QuestionType == questionEssay || key == nil {
+		return 0, false
+	}
+
+	switch q.QuestionType {
+	case questionMultipleChoice:
+		s, _ := answer.(string)
+		if len(key.Correct) == 1 && strings.EqualFold(strings.TrimSpace(s), key.Correct[0]) {
+			return 1, true
+		}
+		return 0, true
+
+	case questionMultipleSelect:
+		selected := make(map[string]bool)
+		for _, id := range answerStrings(answer) {
+			selected[id] = true
+		}
+		correct := make(map[string]bool)
+		for _, id := range key.Correct {
+			correct[id] = true
+		}
+		hits, misses := 0, 0
+		for id := range selected {
+			if correct[id] {
+				hits++
+			} else {
+				misses++
+			}
+		}
+		if hits == len(correct) && misses == 0 {
+			return 1, true
+		}
+		if !key.PartialCredit {
+			return 0, true
+		}
+		// Each wrong choice cancels a right one
+		return math.Max(0, float64(hits-misses)/float64(len(correct))), true
+
+	case questionTrueFalse:
+		var value bool
+		switch v := answer.(type) {
+		case bool:
+			value = v
+		case string:
+			parsed, err := strconv.ParseBool(strings.ToLower(strings.TrimSpace(v)))
+			if err != nil {
+				return 0, true
+			}
+			value = parsed
+		default:
+			return 0, true
+		}
+		if key.Value != nil && value == *key.Value {
+			return 1, true
+		}
+		return 0, true
+
+	case questionShortAnswer:
+		s, _ := answer.(string)
+		if matchesTextAnswer(s, key.Accepted, key.Patterns, key.CaseSensitive) {
+			return 1, true
+		}
+		return 0, true
+
+	case questionNumeric:
+		value, valid := answerNumber(answer)
+		if valid && key.Number != nil && math.Abs(value-*key.Number) <= key.Tolerance+1e-9 {
+			return 1, true
+		}
+		return 0, true
+
+	case questionMatching:
+		given, _ := answer.(map[string]interface{})
+		right := 0
+		for l, r := range key.Pairs {
+			if s, _ := given[l].(string); s == r {
+				right++
+			}
+		}
+		return partialScore(right, len(key.Pairs), key.PartialCredit), true
+
+	case questionOrdering:
+		given := answerStrings(answer)
+		right := 0
+		for i, id := range key.Order {
+			if i < len(given) && given[i] == id {
+				right++
+			}
+		}
+		return partialScore(right, len(key.Order), key.PartialCredit), true
+
+	case questionFillBlank:
+		given := answerStrings(answer)
+		right := 0
+		for i, accepted := range key.Blanks {
+			if i < len(given) && matchesTextAnswer(given[i], accepted, nil, key.CaseSensitive) {
+				right++
+			}
+		}
+		return partialScore(right, len(key.Blanks), key.PartialCredit), true
+	}
+	return 0, false
+}
+
+func partialScore(right, total int, partial bool) float64 {
+	if total == 0 {
+		return 0
+	}
+	if right == total {
+		return 1
+	}
+	if !partial {
+		return 0
+	}
+	return float64(right) / float64(total)
+}
+
+// answerStrings reads a list answer, accepting a JSON array or a
+// comma-separated string
+func answerStrings(answer interface{}) []string {
+	switch v := answer.(type) {
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, _ := item.(string)
+			out = append(out, strings.TrimSpace(s))
+		}
+		return out
+	case []string:
+		return v
+	case string:
+		if v == "" {
+			return nil
+		}
+		parts := strings.Split(v, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return parts
+	}
+	return nil
+}
+
+// answerNumber reads a numeric answer, accepting a decimal comma
+func answerNumber(answer interface{}) (float64, bool) {
+	switch v := answer.(type) {
+	case float64:
+		return v, true
+	case string:
+		s := strings.ReplaceAll(strings.TrimSpace(v), " ", "")
+		if strings.Count(s, ",") == 1 && !strings.Contains(s, ".") {
+			s = strings.Replace(s, ",", ".", 1)
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+// normalizeTextAnswer trims and collapses whitespace, and lowercases unless
+// the comparison is case sensitive
+func normalizeTextAnswer(s string, caseSensitive bool) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if !caseSensitive {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+func matchesTextAnswer(answer string, accepted, patterns []string, caseSensitive bool) bool {
+	normalized := normalizeTextAnswer(answer, caseSensitive)
+	if normalized == "" {
+		return false
+	}
+	for _, a := range accepted {
+		if normalized == normalizeTextAnswer(a, caseSensitive) {
+			return true
+		}
+	}
+	for _, pattern := range patterns {
+		re, err := compileAnswerPattern(pattern, caseSensitive)
+		if err == nil && re.MatchString(normalized) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileAnswerPattern compiles a short answer pattern so it must match the
+// whole answer
+func compileAnswerPattern(pattern string, caseSensitive bool) (*regexp.Regexp, error) {
+	prefix := "(?i)"
+	if caseSensitive {
+		prefix = ""
+	}
+	return regexp.Compile(prefix + `^(?:` + pattern + `)$`)
+}
+
+// awardedPoints converts a graded fraction to points, rounded to hundredths
+func awardedPoints(points int, fraction float64) float64 {
+	return math.Round(float64(points)*fraction*100) / 100
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGradeAnswer(t *testing.T) {
+	yes := true
+	number := 9.81
+	tests := []struct {
+		name     string
+		question Question
+		answer   interface{}
+		fraction float64
+		auto     bool
+	}{
+		{
+			name:     "multiple choice right, ignoring case",
+			question: Question{QuestionType: questionMultipleChoice, AnswerKey: &AnswerKey{Correct: []string{"B"}}},
+			answer:   " b ",
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "multiple choice wrong",
+			question: Question{QuestionType: questionMultipleChoice, AnswerKey: &AnswerKey{Correct: []string{"B"}}},
+			answer:   "C",
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "multiple select all right",
+			question: Question{QuestionType: questionMultipleSelect, AnswerKey: &AnswerKey{Correct: []string{"A", "C"}}},
+			answer:   []interface{}{"C", "A"},
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "multiple select as a comma-separated string",
+			question: Question{QuestionType: questionMultipleSelect, AnswerKey: &AnswerKey{Correct: []string{"A", "C"}}},
+			answer:   "A, C",
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "multiple select partly right without partial credit",
+			question: Question{QuestionType: questionMultipleSelect, AnswerKey: &AnswerKey{Correct: []string{"A", "C"}}},
+			answer:   []interface{}{"A"},
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "multiple select partial credit",
+			question: Question{QuestionType: questionMultipleSelect, AnswerKey: &AnswerKey{Correct: []string{"A", "B", "C", "D"}, PartialCredit: true}},
+			answer:   []interface{}{"A", "B", "C", "E"},
+			fraction: 0.5, auto: true,
+		},
+		{
+			name:     "multiple select wrong choices never go below zero",
+			question: Question{QuestionType: questionMultipleSelect, AnswerKey: &AnswerKey{Correct: []string{"A"}, PartialCredit: true}},
+			answer:   []interface{}{"B", "C"},
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "true false as a bool",
+			question: Question{QuestionType: questionTrueFalse, AnswerKey: &AnswerKey{Value: &yes}},
+			answer:   true,
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "true false as a string",
+			question: Question{QuestionType: questionTrueFalse, AnswerKey: &AnswerKey{Value: &yes}},
+			answer:   "false",
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "true false unreadable",
+			question: Question{QuestionType: questionTrueFalse, AnswerKey: &AnswerKey{Value: &yes}},
+			answer:   "maybe",
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "short answer accepted variant",
+			question: Question{QuestionType: questionShortAnswer, AnswerKey: &AnswerKey{Accepted: []string{"Bandung"}}},
+			answer:   "bandung",
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "short answer case sensitive",
+			question: Question{QuestionType: questionShortAnswer, AnswerKey: &AnswerKey{Accepted: []string{"Bandung"}, CaseSensitive: true}},
+			answer:   "bandung",
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "short answer pattern",
+			question: Question{QuestionType: questionShortAnswer, AnswerKey: &AnswerKey{Patterns: []string{"h2o|air"}}},
+			answer:   "H2O",
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "numeric within tolerance with a decimal comma",
+			question: Question{QuestionType: questionNumeric, AnswerKey: &AnswerKey{Number: &number, Tolerance: 0.05}},
+			answer:   "9,8",
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "numeric outside tolerance",
+			question: Question{QuestionType: questionNumeric, AnswerKey: &AnswerKey{Number: &number, Tolerance: 0.05}},
+			answer:   9.7,
+			fraction: 0, auto: true,
+		},
+		{
+			name:     "matching all right",
+			question: Question{QuestionType: questionMatching, AnswerKey: &AnswerKey{Pairs: map[string]string{"1": "A", "2": "B"}}},
+			answer:   map[string]interface{}{"1": "A", "2": "B"},
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "matching partial credit",
+			question: Question{QuestionType: questionMatching, AnswerKey: &AnswerKey{Pairs: map[string]string{"1": "A", "2": "B"}, PartialCredit: true}},
+			answer:   map[string]interface{}{"1": "A", "2": "A"},
+			fraction: 0.5, auto: true,
+		},
+		{
+			name:     "ordering right",
+			question: Question{QuestionType: questionOrdering, AnswerKey: &AnswerKey{Order: []string{"C", "A", "B"}}},
+			answer:   []interface{}{"C", "A", "B"},
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "ordering partial credit by position",
+			question: Question{QuestionType: questionOrdering, AnswerKey: &AnswerKey{Order: []string{"C", "A", "B"}, PartialCredit: true}},
+			answer:   "C,B,A",
+			fraction: 1.0 / 3, auto: true,
+		},
+		{
+			name:     "fill blank right",
+			question: Question{QuestionType: questionFillBlank, AnswerKey: &AnswerKey{Blanks: [][]string{{"Bandung"}, {"Jakarta", "DKI Jakarta"}}}},
+			answer:   []interface{}{"bandung", "DKI Jakarta"},
+			fraction: 1, auto: true,
+		},
+		{
+			name:     "fill blank partial credit",
+			question: Question{QuestionType: questionFillBlank, AnswerKey: &AnswerKey{Blanks: [][]string{{"Bandung"}, {"Jakarta"}}, PartialCredit: true}},
+			answer:   []interface{}{"Bandung"},
+			fraction: 0.5, auto: true,
+		},
+		{
+			name:     "essay is graded by hand",
+			question: Question{QuestionType: questionEssay},
+			answer:   "An essay",
+			fraction: 0, auto: false,
+		},
+		{
+			name:     "no answer key is graded by hand",
+			question: Question{QuestionType: questionMultipleChoice},
+			answer:   "A",
+			fraction: 0, auto: false,
+		},
+		{
+			name:     "full credit",
+			question: Question{QuestionType: questionMultipleChoice, AnswerKey: &AnswerKey{Correct: []string{"B"}}, FullCredit: true},
+			answer:   nil,
+			fraction: 1, auto: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fraction, auto := gradeAnswer(&tt.question, tt.answer)
+			if auto != tt.auto || math.Abs(fraction-tt.fraction) > 1e-9 {
+				t.Errorf("gradeAnswer() = %v, %v; want %v, %v", fraction, auto, tt.fraction, tt.auto)
+			}
+		})
+	}
+}
@@ -3,12 +3,11 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,34 +19,73 @@ import (
 
 // Quiz structures
 type Quiz struct {
-	ID          int        `json:"id"`
-	Title       string     `json:"title"`
-	Description string     `json:"description"`
-	CourseID    int        `json:"course_id"`
-	QuizType    string     `json:"quiz_type"`
-	PDFFilePath string     `json:"pdf_file_path,omitempty"`
-	TimeLimit   *int       `json:"time_limit,omitempty"`
-	TotalPoints int        `json:"total_points"`
-	IsActive    bool       `json:"is_active"`
-	DueDate     *time.Time `json:"due_date,omitempty"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   time.Time  `json:"updated_at"`
-	Questions   []Question `json:"questions,omitempty"`
+	ID          int         `json:"id"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	CourseID    int         `json:"course_id"`
+	QuizType    string      `json:"quiz_type"`
+	PDFFilePath string      `json:"pdf_file_path,omitempty"`
+	PDFFileURL  string      `json:"pdf_file_url,omitempty"` // Short-lived signed URL for pdf_file_path
+	PDFPreview  *PDFPreview `json:"pdf_preview,omitempty"`  // Page count and first-page thumbnail
+	TimeLimit   *int        `json:"time_limit,omitempty"`
+	TotalPoints int         `json:"total_points"`
+	IsActive    bool        `json:"is_active"`
+	DueDate     *time.Time  `json:"due_date,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	Questions   []Question  `json:"questions,omitempty"`
+	DrawRules   []DrawRule  `json:"draw_rules,omitempty"` // Random bank questions added per student, shown to teachers
+
+	// Shuffle question and option order per student
+	ShuffleQuestions bool `json:"shuffle_questions"`
+	ShuffleOptions   bool `json:"shuffle_options"`
+	// Seconds after the deadline a timed attempt can still be submitted
+	GracePeriodSeconds int `json:"grace_period_seconds"`
+	// Attempts allowed (0 = unlimited), wait between them and the score that counts
+	MaxAttempts            int                  `json:"max_attempts"`
+	AttemptCooldownMinutes int                  `json:"attempt_cooldown_minutes"`
+	ScoringPolicy          string               `json:"scoring_policy"`
+	Attempts               *AttemptAvailability `json:"attempts,omitempty"` // The requesting student's attempts
+	// What happens to work handed in after the due date
+	LatePolicy            string     `json:"late_policy"`
+	LatePenaltyPerDay     float64    `json:"late_penalty_per_day"`
+	LatePenaltyMaxPercent float64    `json:"late_penalty_max_percent"`
+	ExtendedDueDate       *time.Time `json:"extended_due_date,omitempty"` // The requesting student's extension
+	// Availability window and proctoring; the code and allowlist are only shown to teachers
+	OpensAt            *time.Time `json:"opens_at,omitempty"`
+	ClosesAt           *time.Time `json:"closes_at,omitempty"`
+	AccessCode         string     `json:"access_code,omitempty"`
+	AccessCodeRequired bool       `json:"access_code_required"`
+	IPAllowlist        []string   `json:"ip_allowlist,omitempty"`
+	IPRestricted       bool       `json:"ip_restricted"`
+	SingleDevice       bool       `json:"single_device"`
+	LockedReason       string     `json:"locked_reason,omitempty"` // Why the requesting student can't see the questions
+}
+
+// hideAnswerKeys removes correct answers from a quiz before it is sent to a student
+func hideAnswerKeys(quiz *Quiz) {
+	for i := range quiz.Questions {
+		hideQuestionKey(&quiz.Questions[i])
+	}
 }
 
 type Question struct {
-	ID             int       `json:"id"`
-	QuizID         int       `json:"quiz_id"`
-	QuestionType   string    `json:"question_type"`
-	Points         int       `json:"points"`
-	QuestionText   string    `json:"question"`
-	OptionA        string    `json:"option_a,omitempty"`
-	OptionB        string    `json:"option_b,omitempty"`
-	OptionC        string    `json:"option_c,omitempty"`
-	OptionD        string    `json:"option_d,omitempty"`
-	CorrectAnswer  string    `json:"correct_answer,omitempty"`
-	EssayAnswerKey string    `json:"essay_answer_key,omitempty"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID             int              `json:"id"`
+	QuizID         int              `json:"quiz_id"`
+	QuestionType   string           `json:"question_type"`
+	Points         int              `json:"points"`
+	QuestionText   string           `json:"question"`
+	OptionA        string           `json:"option_a,omitempty"`
+	OptionB        string           `json:"option_b,omitempty"`
+	OptionC        string           `json:"option_c,omitempty"`
+	OptionD        string           `json:"option_d,omitempty"`
+	CorrectAnswer  string           `json:"correct_answer,omitempty"`
+	EssayAnswerKey string           `json:"essay_answer_key,omitempty"`
+	Options        *QuestionOptions `json:"options,omitempty"`
+	AnswerKey      *AnswerKey       `json:"answer_key,omitempty"`
+	RubricID       *int             `json:"rubric_id,omitempty"` // Essay questions graded with a rubric
+	FullCredit     bool             `json:"full_credit,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
 }
 
 type QuizSubmission struct {
@@ -75,18 +113,39 @@ type CreateQuizRequest struct {
 	TotalPoints int                     `json:"total_points"`
 	DueDate     *time.Time              `json:"due_date"`
 	Questions   []CreateQuestionRequest `json:"questions"`
+	// Shuffle question and option order per student
+	ShuffleQuestions bool `json:"shuffle_questions"`
+	ShuffleOptions   bool `json:"shuffle_options"`
+	// Seconds after the deadline a timed attempt can still be submitted
+	GracePeriodSeconds int `json:"grace_period_seconds"`
+	// Attempts allowed (0 = unlimited), wait between them and the score that counts
+	MaxAttempts            int    `json:"max_attempts"`
+	AttemptCooldownMinutes int    `json:"attempt_cooldown_minutes"`
+	ScoringPolicy          string `json:"scoring_policy"`
+	// What happens to work handed in after the due date
+	LatePolicy            string  `json:"late_policy"`
+	LatePenaltyPerDay     float64 `json:"late_penalty_per_day"`
+	LatePenaltyMaxPercent float64 `json:"late_penalty_max_percent"`
+	// Availability window and proctoring
+	QuizAccessSettings
 }
 
 type CreateQuestionRequest struct {
-	QuestionType   string `json:"question_type"`
-	Points         int    `json:"points"`
-	QuestionText   string `json:"question"`
-	OptionA        string `json:"option_a,omitempty"`
-	OptionB        string `json:"option_b,omitempty"`
-	OptionC        string `json:"option_c,omitempty"`
-	OptionD        string `json:"option_d,omitempty"`
-	CorrectAnswer  string `json:"correct_answer,omitempty"`
-	EssayAnswerKey string `json:"essay_answer_key,omitempty"`
+	ID             *int             `json:"id,omitempty"` // Existing question, when updating a quiz
+	QuestionType   string           `json:"question_type"`
+	Points         int              `json:"points"`
+	QuestionText   string           `json:"question"`
+	OptionA        string           `json:"option_a,omitempty"`
+	OptionB        string           `json:"option_b,omitempty"`
+	OptionC        string           `json:"option_c,omitempty"`
+	OptionD        string           `json:"option_d,omitempty"`
+	CorrectAnswer  string           `json:"correct_answer,omitempty"`
+	EssayAnswerKey string           `json:"essay_answer_key,omitempty"`
+	Options        *QuestionOptions `json:"options,omitempty"`
+	AnswerKey      *AnswerKey       `json:"answer_key,omitempty"`
+	RubricID       *int             `json:"rubric_id,omitempty"`
+	// Everyone gets the question's points, for questions that turned out broken
+	FullCredit bool `json:"full_credit,omitempty"`
 }
 
 // createQuizHandler handles quiz creation
@@ -116,30 +175,9 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Parse due_date flexibly
-	var dueDatePtr *time.Time
-	if rawDue, ok := raw["due_date"]; ok && rawDue != nil {
-		switch v := rawDue.(type) {
-		case string:
-			var parsed time.Time
-			layouts := []string{
-				time.RFC3339,
-				"2006-01-02T15:04",
-				"2006-01-02T15:04:05",
-				"2006-01-02 15:04:05",
-				"2006-01-02 15:04",
-			}
-			for _, layout := range layouts {
-				t, err := time.Parse(layout, v)
-				if err == nil {
-					parsed = t
-					dueDatePtr = &parsed
-					break
-				}
-			}
-			if dueDatePtr == nil {
-				log.Printf("Error parsing due_date: %v", v)
-			}
-		}
+	dueDatePtr := getTimePtr(raw["due_date"])
+	if v, ok := raw["due_date"].(string); ok && dueDatePtr == nil {
+		log.Printf("Error parsing due_date: %v", v)
 	}
 	// Build CreateQuizRequest from raw
 	req := CreateQuizRequest{
@@ -152,6 +190,38 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 		TotalPoints: getInt(raw["total_points"]),
 		DueDate:     dueDatePtr,
 		Questions:   parseQuestions(raw["questions"]),
+
+		ShuffleQuestions: getBool(raw["shuffle_questions"]),
+		ShuffleOptions:   getBool(raw["shuffle_options"]),
+
+		GracePeriodSeconds: defaultGracePeriodSeconds,
+
+		MaxAttempts:            defaultMaxAttempts,
+		AttemptCooldownMinutes: getInt(raw["attempt_cooldown_minutes"]),
+		ScoringPolicy:          getString(raw["scoring_policy"]),
+	}
+	if rawGrace, ok := raw["grace_period_seconds"]; ok && rawGrace != nil {
+		req.GracePeriodSeconds = getInt(rawGrace)
+	}
+	if rawMax, ok := raw["max_attempts"]; ok && rawMax != nil {
+		req.MaxAttempts = getInt(rawMax)
+	}
+	if req.ScoringPolicy == "" {
+		req.ScoringPolicy = scoringHighest
+	}
+	req.LatePolicy, req.LatePenaltyMaxPercent = latePolicyReject, 100
+	if policy := getString(raw["late_policy"]); policy != "" {
+		req.LatePolicy = policy
+	}
+	if perDay, ok := raw["late_penalty_per_day"].(float64); ok {
+		req.LatePenaltyPerDay = perDay
+	}
+	if maxPenalty, ok := raw["late_penalty_max_percent"].(float64); ok {
+		req.LatePenaltyMaxPercent = maxPenalty
+	}
+	if !decodeInto(raw, &req.QuizAccessSettings) {
+		http.Error(w, "Invalid access settings", http.StatusBadRequest)
+		return
 	}
 	log.Printf("Request decoded successfully: %+v", req)
 	// Helper functions for flexible JSON parsing
@@ -162,6 +232,23 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Title and course_id are required", http.StatusBadRequest)
 		return
 	}
+	if req.GracePeriodSeconds < 0 || req.GracePeriodSeconds > maxGracePeriodSeconds {
+		http.Error(w, fmt.Sprintf("grace_period_seconds must be between 0 and %d", maxGracePeriodSeconds), http.StatusBadRequest)
+		return
+	}
+	if err := validateAttemptPolicy(&req.MaxAttempts, &req.AttemptCooldownMinutes, &req.ScoringPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateLatePolicy(&req.LatePolicy, &req.LatePenaltyPerDay, &req.LatePenaltyMaxPercent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access := &QuizAccess{}
+	if err := req.QuizAccessSettings.applyTo(access); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Verify teacher owns the course
 	var courseTeacherID int
@@ -181,6 +268,19 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	questions := make([]Question, len(req.Questions))
+	for i, q := range req.Questions {
+		questions[i] = questionFromRequest(q)
+		if err := validateQuestion(&questions[i]); err != nil {
+			http.Error(w, fmt.Sprintf("Question %d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkQuestionRubrics(questions, teacherID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Begin transaction
 	tx, err := DB.Begin()
 	if err != nil {
@@ -192,8 +292,12 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Insert quiz
 	quizQuery := `
-		INSERT INTO quizzes_new (title, description, course_id, quiz_type, pdf_file_path, time_limit, total_points, due_date)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO quizzes_new (title, description, course_id, quiz_type, pdf_file_path, time_limit, total_points, due_date,
+		                         shuffle_questions, shuffle_options, grace_period_seconds,
+		                         max_attempts, attempt_cooldown_minutes, scoring_policy,
+		                         late_policy, late_penalty_per_day, late_penalty_max_percent,
+		                         opens_at, closes_at, access_code, ip_allowlist, single_device)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	// Handle nil values for optional fields
@@ -209,7 +313,11 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 	if dueDate == nil {
 		dueDate = nil
 	}
-	result, err := tx.Exec(quizQuery, req.Title, req.Description, req.CourseID, req.QuizType, pdfFilePath, timeLimit, req.TotalPoints, dueDate)
+	args := []interface{}{req.Title, req.Description, req.CourseID, req.QuizType, pdfFilePath, timeLimit, req.TotalPoints, dueDate,
+		req.ShuffleQuestions, req.ShuffleOptions, req.GracePeriodSeconds,
+		req.MaxAttempts, req.AttemptCooldownMinutes, req.ScoringPolicy,
+		req.LatePolicy, req.LatePenaltyPerDay, req.LatePenaltyMaxPercent}
+	result, err := tx.Exec(quizQuery, append(args, access.columnValues()...)...)
 	if err != nil {
 		log.Printf("Error creating quiz: %v", err)
 		http.Error(w, "Error creating quiz", http.StatusInternalServerError)
@@ -224,43 +332,11 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert questions if provided
-	if req.Questions != nil && len(req.Questions) > 0 {
-		for _, q := range req.Questions {
-			questionQuery := `
-			       INSERT INTO quiz_questions_new (quiz_id, question_type, points, question, option_a, option_b, option_c, option_d, correct_answer, essay_answer_key)
-			       VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		       `
-			var optionA, optionB, optionC, optionD, correctAnswer, essayAnswerKey interface{}
-			optionA = q.OptionA
-			if optionA == "" {
-				optionA = nil
-			}
-			optionB = q.OptionB
-			if optionB == "" {
-				optionB = nil
-			}
-			optionC = q.OptionC
-			if optionC == "" {
-				optionC = nil
-			}
-			optionD = q.OptionD
-			if optionD == "" {
-				optionD = nil
-			}
-			correctAnswer = q.CorrectAnswer
-			if correctAnswer == "" {
-				correctAnswer = nil
-			}
-			essayAnswerKey = q.EssayAnswerKey
-			if essayAnswerKey == "" {
-				essayAnswerKey = nil
-			}
-			_, err := tx.Exec(questionQuery, quizID, q.QuestionType, q.Points, q.QuestionText, optionA, optionB, optionC, optionD, correctAnswer, essayAnswerKey)
-			if err != nil {
-				log.Printf("Error creating question: %v, payload: %+v", err, q)
-				http.Error(w, "Error creating questions", http.StatusInternalServerError)
-				return
-			}
+	for i := range questions {
+		if err := insertQuestion(tx, quizID, &questions[i]); err != nil {
+			log.Printf("Error creating question: %v, payload: %+v", err, questions[i])
+			http.Error(w, "Error creating questions", http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -270,6 +346,12 @@ func createQuizHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error creating quiz", http.StatusInternalServerError)
 		return
 	}
+	refreshUploadReferences(req.PDFFilePath)
+	if strings.HasPrefix(req.PDFFilePath, "/uploads/") {
+		if _, err := queuePDFProcessing(req.PDFFilePath); err != nil {
+			log.Printf("Warning: Failed to queue processing of %s: %v", req.PDFFilePath, err)
+		}
+	}
 
 	response := map[string]interface{}{
 		"success": true,
@@ -289,6 +371,12 @@ func getQuizzesByCourseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
 	w.Header().Set("Content-Type", "application/json")
 
+	role, userID, ok := requestUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	vars := mux.Vars(r)
 	courseID, err := strconv.Atoi(vars["courseId"])
 	if err != nil {
@@ -296,11 +384,20 @@ func getQuizzesByCourseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only course staff and enrolled students may see the quizzes
+	if !canAccessCourse(role, userID, courseID) {
+		http.Error(w, "Course not found or access denied", http.StatusForbidden)
+		return
+	}
+
 	log.Printf("Fetching quizzes for course ID: %d", courseID)
 
 	// Ambil quiz dari database
 	quizRows, err := DB.Query(`
-	       SELECT id, title, description, course_id, quiz_type, pdf_file_path, time_limit, total_points, is_active, due_date, created_at, updated_at
+	       SELECT id, title, description, course_id, quiz_type, pdf_file_path, time_limit, total_points, is_active, shuffle_questions, shuffle_options, grace_period_seconds,
+	       max_attempts, attempt_cooldown_minutes, scoring_policy,
+	       late_policy, late_penalty_per_day, late_penalty_max_percent,
+	       opens_at, closes_at, access_code, ip_allowlist, single_device, due_date, created_at, updated_at
 	       FROM quizzes_new WHERE course_id = ? ORDER BY id ASC`, courseID)
 	if err != nil {
 		log.Printf("Error fetching quizzes: %v", err)
@@ -310,18 +407,25 @@ func getQuizzesByCourseHandler(w http.ResponseWriter, r *http.Request) {
 	defer quizRows.Close()
 
 	quizzes := []Quiz{}
+	now := time.Now()
 	for quizRows.Next() {
 		var quiz Quiz
 		var dueDate sql.NullTime
 		var timeLimit sql.NullInt32
 		var pdfFilePath sql.NullString
+		var acc quizAccessScan
 		err := quizRows.Scan(&quiz.ID, &quiz.Title, &quiz.Description, &quiz.CourseID, &quiz.QuizType,
-			&pdfFilePath, &timeLimit, &quiz.TotalPoints, &quiz.IsActive, &dueDate,
+			&pdfFilePath, &timeLimit, &quiz.TotalPoints, &quiz.IsActive, &quiz.ShuffleQuestions, &quiz.ShuffleOptions, &quiz.GracePeriodSeconds,
+			&quiz.MaxAttempts, &quiz.AttemptCooldownMinutes, &quiz.ScoringPolicy,
+			&quiz.LatePolicy, &quiz.LatePenaltyPerDay, &quiz.LatePenaltyMaxPercent,
+			&acc.OpensAt, &acc.ClosesAt, &acc.AccessCode, &acc.IPAllowlist, &acc.SingleDevice, &dueDate,
 			&quiz.CreatedAt, &quiz.UpdatedAt)
 		if err != nil {
 			log.Printf("Error scanning quiz: %v", err)
 			continue
 		}
+		access := acc.access(quiz.GracePeriodSeconds)
+		setQuizAccess(&quiz, access, role != "student")
 		if dueDate.Valid {
 			quiz.DueDate = &dueDate.Time
 		}
@@ -332,45 +436,26 @@ func getQuizzesByCourseHandler(w http.ResponseWriter, r *http.Request) {
 		if pdfFilePath.Valid {
 			quiz.PDFFilePath = pdfFilePath.String
 		}
-		// Ambil questions untuk quiz ini
-		questionsQuery := `SELECT id, quiz_id, question_type, points, question, option_a, option_b, option_c, option_d, correct_answer, essay_answer_key, created_at FROM quiz_questions_new WHERE quiz_id = ? ORDER BY id ASC`
-		rows, err := DB.Query(questionsQuery, quiz.ID)
+		// Ambil questions untuk quiz ini. Students get theirs when they
+		// open the quiz, which is also when their draw is made.
+		questions := []Question{}
+		if role == "student" {
+			if deadline, err := loadQuizDeadline(quiz.ID, userID); err == nil && deadline.Extended {
+				quiz.ExtendedDueDate = deadline.DueDate
+			}
+		} else {
+			questions, err = loadQuizQuestions(quiz.ID)
+		}
 		if err != nil {
 			log.Printf("Error fetching questions for quiz %d: %v", quiz.ID, err)
-			quiz.Questions = []Question{}
-		} else {
-			var questions []Question
-			for rows.Next() {
-				var q Question
-				var optionA, optionB, optionC, optionD, correctAnswer, essayAnswerKey sql.NullString
-				err := rows.Scan(&q.ID, &q.QuizID, &q.QuestionType, &q.Points, &q.QuestionText,
-					&optionA, &optionB, &optionC, &optionD, &correctAnswer, &essayAnswerKey, &q.CreatedAt)
-				if err != nil {
-					log.Printf("Error scanning question: %v", err)
-					continue
-				}
-				if optionA.Valid {
-					q.OptionA = optionA.String
-				}
-				if optionB.Valid {
-					q.OptionB = optionB.String
-				}
-				if optionC.Valid {
-					q.OptionC = optionC.String
-				}
-				if optionD.Valid {
-					q.OptionD = optionD.String
-				}
-				if correctAnswer.Valid {
-					q.CorrectAnswer = correctAnswer.String
-				}
-				if essayAnswerKey.Valid {
-					q.EssayAnswerKey = essayAnswerKey.String
-				}
-				questions = append(questions, q)
-			}
-			quiz.Questions = questions
-			rows.Close()
+			questions = []Question{}
+		}
+		quiz.Questions = questions
+		quiz.PDFFileURL = signFileURL(quiz.PDFFilePath)
+		quiz.PDFPreview = loadPDFPreview(quiz.PDFFilePath)
+		if role == "student" {
+			hideAnswerKeys(&quiz)
+			hideLockedQuiz(&quiz, access, userID, now)
 		}
 		quizzes = append(quizzes, quiz)
 	}
@@ -388,6 +473,12 @@ func getQuizByIDHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
 	w.Header().Set("Content-Type", "application/json")
 
+	role, userID, ok := requestUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	vars := mux.Vars(r)
 	quizID, err := strconv.Atoi(vars["quizId"])
 	if err != nil {
@@ -397,7 +488,10 @@ func getQuizByIDHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get quiz details
 	quizQuery := `
-		SELECT id, title, description, course_id, quiz_type, pdf_file_path, time_limit, total_points, is_active, due_date, created_at, updated_at
+		SELECT id, title, description, course_id, quiz_type, pdf_file_path, time_limit, total_points, is_active, shuffle_questions, shuffle_options, grace_period_seconds,
+		       max_attempts, attempt_cooldown_minutes, scoring_policy,
+		       late_policy, late_penalty_per_day, late_penalty_max_percent,
+		       opens_at, closes_at, access_code, ip_allowlist, single_device, due_date, created_at, updated_at
 		FROM quizzes_new
 		WHERE id = ?
 	`
@@ -406,9 +500,13 @@ func getQuizByIDHandler(w http.ResponseWriter, r *http.Request) {
 	var dueDate sql.NullTime
 	var timeLimit sql.NullInt32
 	var pdfFilePath sql.NullString
+	var acc quizAccessScan
 
 	err = DB.QueryRow(quizQuery, quizID).Scan(&quiz.ID, &quiz.Title, &quiz.Description, &quiz.CourseID, &quiz.QuizType,
-		&pdfFilePath, &timeLimit, &quiz.TotalPoints, &quiz.IsActive, &dueDate,
+		&pdfFilePath, &timeLimit, &quiz.TotalPoints, &quiz.IsActive, &quiz.ShuffleQuestions, &quiz.ShuffleOptions, &quiz.GracePeriodSeconds,
+		&quiz.MaxAttempts, &quiz.AttemptCooldownMinutes, &quiz.ScoringPolicy,
+		&quiz.LatePolicy, &quiz.LatePenaltyPerDay, &quiz.LatePenaltyMaxPercent,
+		&acc.OpensAt, &acc.ClosesAt, &acc.AccessCode, &acc.IPAllowlist, &acc.SingleDevice, &dueDate,
 		&quiz.CreatedAt, &quiz.UpdatedAt)
 
 	if err != nil {
@@ -432,57 +530,51 @@ func getQuizByIDHandler(w http.ResponseWriter, r *http.Request) {
 		quiz.PDFFilePath = pdfFilePath.String
 	}
 
-	// Get questions for the quiz
-	questionsQuery := `
-		SELECT id, quiz_id, question_type, points, question, option_a, option_b, option_c, option_d, correct_answer, essay_answer_key, created_at
-		FROM quiz_questions_new
-		WHERE quiz_id = ?
-		ORDER BY id ASC
-	`
-
-	rows, err := DB.Query(questionsQuery, quizID)
+	// Only course staff and enrolled students may open the quiz
+	if !canAccessCourse(role, userID, quiz.CourseID) {
+		http.Error(w, "Quiz not found or access denied", http.StatusForbidden)
+		return
+	}
+	quiz.PDFFileURL = signFileURL(quiz.PDFFilePath)
+	quiz.PDFPreview = loadPDFPreview(quiz.PDFFilePath)
+	access := acc.access(quiz.GracePeriodSeconds)
+	setQuizAccess(&quiz, access, role != "student")
+
+	// Get questions for the quiz; students get their own draw from the
+	// question bank for their current attempt, in their own order. The
+	// draw is only made once the quiz is unlocked for them.
+	questions := []Question{}
+	if role == "student" {
+		hideLockedQuiz(&quiz, access, userID, time.Now())
+		if quiz.LockedReason == "" {
+			var layout *QuizLayout
+			var attemptNumber int
+			if attemptNumber, err = currentAttemptNumber(quizID, userID); err == nil {
+				questions, layout, err = loadStudentQuestions(quizID, userID, attemptNumber)
+				questions = layout.apply(questions)
+			}
+		}
+		if err == nil {
+			quiz.Attempts, err = loadAttemptAvailability(quizID, userID, time.Now())
+		}
+		if deadline, err := loadQuizDeadline(quizID, userID); err == nil && deadline.Extended {
+			quiz.ExtendedDueDate = deadline.DueDate
+		}
+	} else {
+		questions, err = loadQuizQuestions(quizID)
+	}
 	if err != nil {
 		log.Printf("Error fetching questions: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var questions []Question
-	for rows.Next() {
-		var q Question
-		var optionA, optionB, optionC, optionD, correctAnswer, essayAnswerKey sql.NullString
-
-		err := rows.Scan(&q.ID, &q.QuizID, &q.QuestionType, &q.Points, &q.QuestionText,
-			&optionA, &optionB, &optionC, &optionD, &correctAnswer, &essayAnswerKey, &q.CreatedAt)
-		if err != nil {
-			log.Printf("Error scanning question: %v", err)
-			continue
-		}
-
-		if optionA.Valid {
-			q.OptionA = optionA.String
-		}
-		if optionB.Valid {
-			q.OptionB = optionB.String
-		}
-		if optionC.Valid {
-			q.OptionC = optionC.String
-		}
-		if optionD.Valid {
-			q.OptionD = optionD.String
-		}
-		if correctAnswer.Valid {
-			q.CorrectAnswer = correctAnswer.String
-		}
-		if essayAnswerKey.Valid {
-			q.EssayAnswerKey = essayAnswerKey.String
-		}
-
-		questions = append(questions, q)
-	}
 
 	quiz.Questions = questions
+	if role == "student" {
+		hideAnswerKeys(&quiz)
+	} else if quiz.DrawRules, err = loadDrawRules(quizID); err != nil {
+		log.Printf("Error fetching draw rules: %v", err)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(quiz)
@@ -520,48 +612,14 @@ func uploadQuizPDFHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file type (PDF only)
-	fileExt := strings.ToLower(filepath.Ext(handler.Filename))
-	if fileExt != ".pdf" {
-		http.Error(w, "Only PDF files are allowed", http.StatusBadRequest)
-		return
-	}
-
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads/quiz-pdfs"
-	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
-		err = os.MkdirAll(uploadsDir, 0755)
-		if err != nil {
-			log.Printf("Error creating uploads directory: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Generate a unique filename
-	cleanFilename := strings.ReplaceAll(handler.Filename, " ", "_")
-	filename := fmt.Sprintf("%d_%d_%s", teacherID, time.Now().UnixNano(), cleanFilename)
-
-	// Create the file
-	filePath := filepath.Join(uploadsDir, filename)
-	dst, err := os.Create(filePath)
+	// Validate, scan and save the uploaded PDF
+	stored, err := processUpload(r.Context(), quizPDFUploads, file, handler, uploadOwner{Role: "teacher", ID: teacherID})
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		log.Printf("Quiz PDF upload %s from teacher %d failed: %v", handler.Filename, teacherID, err)
+		writeUploadError(w, err)
 		return
 	}
-	defer dst.Close()
-
-	// Copy the file content
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		log.Printf("Error copying file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
-		return
-	}
-
-	// Create the URL path for the file
-	urlPath := "/uploads/quiz-pdfs/" + filename
+	urlPath := stored.URLPath
 	log.Printf("PDF uploaded successfully. Path: %s", urlPath)
 
 	response := map[string]interface{}{
@@ -569,6 +627,9 @@ func uploadQuizPDFHandler(w http.ResponseWriter, r *http.Request) {
 		"file_path": urlPath,
 		"message":   "PDF uploaded successfully",
 	}
+	if status := queueUploadedPDF(stored); status != "" {
+		response["processing_status"] = status
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -582,27 +643,43 @@ func updateQuizHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
 	w.Header().Set("Content-Type", "application/json")
 
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	vars := mux.Vars(r)
-	quizID := vars["quizId"]
+	quizID, err := strconv.Atoi(vars["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
 
 	var req struct {
-		Title       string `json:"title"`
-		Description string `json:"description"`
-		QuizType    string `json:"quiz_type"`
-		TimeLimit   *int   `json:"time_limit"`
-		DueDate     string `json:"due_date"`
-		IsActive    bool   `json:"is_active"`
-		Questions   []struct {
-			ID            *int   `json:"id"`
-			QuestionType  string `json:"question_type"`
-			Question      string `json:"question"`
-			Points        int    `json:"points"`
-			OptionA       string `json:"option_a"`
-			OptionB       string `json:"option_b"`
-			OptionC       string `json:"option_c"`
-			OptionD       string `json:"option_d"`
-			CorrectAnswer string `json:"correct_answer"`
-		} `json:"questions"`
+		Title       string                  `json:"title"`
+		Description string                  `json:"description"`
+		QuizType    string                  `json:"quiz_type"`
+		TimeLimit   *int                    `json:"time_limit"`
+		DueDate     string                  `json:"due_date"`
+		IsActive    bool                    `json:"is_active"`
+		Questions   []CreateQuestionRequest `json:"questions"`
+		// Left unchanged when omitted
+		ShuffleQuestions   *bool `json:"shuffle_questions"`
+		ShuffleOptions     *bool `json:"shuffle_options"`
+		GracePeriodSeconds *int  `json:"grace_period_seconds"`
+		// Attempt policy, left unchanged when omitted
+		MaxAttempts            *int    `json:"max_attempts"`
+		AttemptCooldownMinutes *int    `json:"attempt_cooldown_minutes"`
+		ScoringPolicy          *string `json:"scoring_policy"`
+		// Late policy, left unchanged when omitted
+		LatePolicy            *string  `json:"late_policy"`
+		LatePenaltyPerDay     *float64 `json:"late_penalty_per_day"`
+		LatePenaltyMaxPercent *float64 `json:"late_penalty_max_percent"`
+		// Availability window and proctoring, left unchanged when omitted
+		QuizAccessSettings
+		// Only report how regrading would change scores, nothing is saved
+		PreviewRegrade bool `json:"preview_regrade"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -611,6 +688,66 @@ func updateQuizHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if g := req.GracePeriodSeconds; g != nil && (*g < 0 || *g > maxGracePeriodSeconds) {
+		http.Error(w, fmt.Sprintf("grace_period_seconds must be between 0 and %d", maxGracePeriodSeconds), http.StatusBadRequest)
+		return
+	}
+	if err := validateAttemptPolicy(req.MaxAttempts, req.AttemptCooldownMinutes, req.ScoringPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateLatePolicy(req.LatePolicy, req.LatePenaltyPerDay, req.LatePenaltyMaxPercent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Verify teacher owns the quiz
+	var ownerID int
+	err = DB.QueryRow(`
+		SELECT c.teacher_id FROM quizzes_new q JOIN courses c ON c.id = q.course_id WHERE q.id = ?
+	`, quizID).Scan(&ownerID)
+	if err != nil || ownerID != teacherID {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error checking quiz ownership: %v", err)
+		}
+		http.Error(w, "Quiz not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+	access, err := loadQuizAccess(quizID)
+	if err != nil {
+		log.Printf("Error fetching access settings of quiz %d: %v", quizID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := req.QuizAccessSettings.applyTo(access); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	questions := make([]Question, len(req.Questions))
+	for i, q := range req.Questions {
+		questions[i] = questionFromRequest(q)
+		if err := validateQuestion(&questions[i]); err != nil {
+			http.Error(w, fmt.Sprintf("Question %d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkQuestionRubrics(questions, teacherID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Submitted answers are regraded when a question is graded differently
+	regraded := []RegradedQuestion{}
+	if req.QuizType == "interactive" {
+		before, err := loadQuizQuestions(quizID)
+		if err != nil {
+			log.Printf("Error loading questions of quiz %d: %v", quizID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		regraded = changedGrading(before, questions)
+	}
+
 	// Start transaction
 	tx, err := DB.Begin()
 	if err != nil {
@@ -627,53 +764,132 @@ func updateQuizHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_, err = tx.Exec(`
-		UPDATE quizzes 
-		SET title = ?, description = ?, quiz_type = ?, time_limit = ?, due_date = ?, is_active = ?, updated_at = CURRENT_TIMESTAMP
+		UPDATE quizzes_new 
+		SET title = ?, description = ?, quiz_type = ?, time_limit = ?, due_date = ?, is_active = ?,
+		    shuffle_questions = COALESCE(?, shuffle_questions), shuffle_options = COALESCE(?, shuffle_options),
+		    grace_period_seconds = COALESCE(?, grace_period_seconds),
+		    max_attempts = COALESCE(?, max_attempts), attempt_cooldown_minutes = COALESCE(?, attempt_cooldown_minutes),
+		    scoring_policy = COALESCE(?, scoring_policy), late_policy = COALESCE(?, late_policy),
+		    late_penalty_per_day = COALESCE(?, late_penalty_per_day), late_penalty_max_percent = COALESCE(?, late_penalty_max_percent),
+		    updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?`,
-		req.Title, req.Description, req.QuizType, req.TimeLimit, dueDate, req.IsActive, quizID)
+		req.Title, req.Description, req.QuizType, req.TimeLimit, dueDate, req.IsActive,
+		req.ShuffleQuestions, req.ShuffleOptions, req.GracePeriodSeconds,
+		req.MaxAttempts, req.AttemptCooldownMinutes, req.ScoringPolicy,
+		req.LatePolicy, req.LatePenaltyPerDay, req.LatePenaltyMaxPercent, quizID)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE quizzes_new SET opens_at = ?, closes_at = ?, access_code = ?, ip_allowlist = ?, single_device = ?
+			WHERE id = ?`, append(access.columnValues(), quizID)...)
+	}
 	if err != nil {
 		log.Printf("Error updating quiz: %v", err)
 		http.Error(w, "Failed to update quiz", http.StatusInternalServerError)
 		return
 	}
 
-	// Update questions for interactive quizzes
+	// Update questions for interactive quizzes. Questions sent with their ID
+	// are updated in place so submitted answers stay attached; questions
+	// left out are removed.
 	if req.QuizType == "interactive" {
-		// Delete existing questions
-		_, err = tx.Exec("DELETE FROM quiz_questions WHERE quiz_id = ?", quizID)
+		existing := make(map[int]bool)
+		rows, err := tx.Query("SELECT id FROM quiz_questions_new WHERE quiz_id = ? AND is_pool = FALSE", quizID)
 		if err != nil {
-			log.Printf("Error deleting existing questions: %v", err)
+			log.Printf("Error loading existing questions: %v", err)
 			http.Error(w, "Failed to update questions", http.StatusInternalServerError)
 			return
 		}
-
-		// Insert updated questions
-		for _, q := range req.Questions {
-			_, err = tx.Exec(`
-				INSERT INTO quiz_questions (quiz_id, question_type, question, points, option_a, option_b, option_c, option_d, correct_answer)
-				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				quizID, q.QuestionType, q.Question, q.Points, q.OptionA, q.OptionB, q.OptionC, q.OptionD, q.CorrectAnswer)
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				existing[id] = true
+			}
+		}
+		rows.Close()
+
+		kept := make(map[int]bool)
+		for i := range questions {
+			q := &questions[i]
+			if existing[q.ID] && !kept[q.ID] {
+				err = updateQuestion(tx, int64(quizID), q)
+				kept[q.ID] = true
+			} else {
+				err = insertQuestion(tx, int64(quizID), q)
+			}
 			if err != nil {
-				log.Printf("Error inserting question: %v", err)
+				log.Printf("Error saving question: %v", err)
+				http.Error(w, "Failed to update questions", http.StatusInternalServerError)
+				return
+			}
+		}
+		for id := range existing {
+			if kept[id] {
+				continue
+			}
+			if _, err := tx.Exec("DELETE FROM quiz_questions_new WHERE id = ?", id); err != nil {
+				log.Printf("Error deleting question %d: %v", id, err)
 				http.Error(w, "Failed to update questions", http.StatusInternalServerError)
 				return
 			}
 		}
 	}
 
+	scoreChanges := []ScoreChange{}
+	overridden := []OverriddenAnswer{}
+	if len(regraded) > 0 {
+		byID := make(map[int]Question, len(questions))
+		for _, q := range questions {
+			if _, seen := byID[q.ID]; !seen {
+				byID[q.ID] = q
+			}
+		}
+		changed := make([]Question, len(regraded))
+		for i, rq := range regraded {
+			changed[i] = byID[rq.QuestionID]
+		}
+		scoreChanges, overridden, err = regradeQuestions(tx, quizID, changed)
+		if err == nil && !req.PreviewRegrade {
+			err = logQuizRegrade(tx, quizID, teacherID, regraded, scoreChanges)
+		}
+		if err != nil {
+			log.Printf("Error regrading quiz %d: %v", quizID, err)
+			http.Error(w, "Failed to regrade submissions", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.PreviewRegrade {
+		// Rolled back by the deferred Rollback
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":            true,
+			"preview":            true,
+			"regraded_questions": regraded,
+			"score_changes":      scoreChanges,
+			"manual_overrides":   overridden,
+		})
+		return
+	}
+
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
 		log.Printf("Error committing transaction: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	// Attempts in progress follow a moved due date, closing time or time limit
+	if err := refreshQuizAttemptDeadlines(quizID); err != nil {
+		log.Printf("Warning: Failed to move attempt deadlines of quiz %d: %v", quizID, err)
+	}
 
 	response := map[string]interface{}{
 		"success": true,
 		"message": "Quiz updated successfully",
 	}
+	if len(regraded) > 0 {
+		response["regraded_questions"] = regraded
+		response["score_changes"] = scoreChanges
+		response["manual_overrides"] = overridden
+	}
 
-	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -765,6 +981,11 @@ func checkQuizSubmissionHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"has_submitted": count > 0,
 	}
+	if id, err := strconv.Atoi(quizID); err == nil {
+		if availability, err := loadAttemptAvailability(id, userID, time.Now()); err == nil {
+			response["attempts"] = availability
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -796,191 +1017,314 @@ func submitQuizHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if student already submitted this quiz
-	var existingSubmissionID int
-	err := DB.QueryRow("SELECT id FROM quiz_submissions WHERE quiz_id = ? AND student_id = ?", req.QuizID, studentID).Scan(&existingSubmissionID)
-	if err == nil {
-		http.Error(w, "You have already submitted this quiz", http.StatusBadRequest)
+	// Timed quizzes have to be started first so the server knows when
+	// time runs out
+	attempt, err := loadQuizAttempt(req.QuizID, studentID)
+	if err != nil {
+		log.Printf("Error fetching quiz attempt: %v", err)
+		http.Error(w, "Error processing quiz", http.StatusInternalServerError)
 		return
 	}
-
-	// Convert answers to JSON string
-	answersJSON, err := json.Marshal(req.Answers)
-	if err != nil {
-		log.Printf("Error marshaling answers: %v", err)
-		http.Error(w, "Error processing answers", http.StatusInternalServerError)
+	if attempt != nil && attempt.Status != attemptInProgress {
+		attempt = nil
+	}
+	if attempt != nil && !checkAttemptAccess(w, r, attempt) {
 		return
 	}
+	if attempt == nil {
+		var timeLimit sql.NullInt32
+		err := DB.QueryRow("SELECT time_limit FROM quizzes_new WHERE id = ?", req.QuizID).Scan(&timeLimit)
+		if err == nil && timeLimit.Valid && timeLimit.Int32 > 0 {
+			http.Error(w, "Start the quiz before submitting it", http.StatusBadRequest)
+			return
+		}
+		// Proctored quizzes are only taken in attempts, and work outside
+		// the window is refused
+		if access, err := loadQuizAccess(req.QuizID); err == nil {
+			if access.proctored() {
+				http.Error(w, "Start the quiz before submitting it", http.StatusBadRequest)
+				return
+			}
+			if !access.acceptsWork(time.Now()) {
+				http.Error(w, "This quiz is not open", http.StatusForbidden)
+				return
+			}
+		}
+	}
 
-	// Get quiz details and questions
-	var totalPoints int
-	err = DB.QueryRow("SELECT total_points FROM quizzes WHERE id = ?", req.QuizID).Scan(&totalPoints)
-	if err != nil {
-		log.Printf("Error fetching quiz details: %v", err)
+	writeQuizSubmission(w, req.QuizID, studentID, req.Answers, attempt)
+}
+
+var (
+	errQuizNotFound         = errors.New("quiz not found")
+	errQuizAlreadySubmitted = errors.New("quiz already submitted")
+)
+
+// quizSubmissionResult is the outcome of grading a submission
+type quizSubmissionResult struct {
+	SubmissionID    int64
+	Score           *float64 // nil while questions wait for the teacher; after any late penalty
+	AutoGradedScore float64
+	TotalPoints     int
+	Late            Lateness
+}
+
+// submissionAttempt says which attempt a submission is
+type submissionAttempt struct {
+	Number     int       // attempt_number of the submission
+	ID         int       // Timed attempt to close, 0 if there is none
+	Status     string    // Status the timed attempt is closed with
+	HandedInAt time.Time // When the answers count as handed in, for lateness
+}
+
+// writeQuizSubmission grades and stores a student's answers and writes the
+// response. Without an attempt the submission is the student's next
+// attempt, if the quiz allows one. A submission after the attempt's grace
+// window is refused and the saved answers are submitted instead.
+func writeQuizSubmission(w http.ResponseWriter, quizID, studentID int, answers map[string]interface{}, attempt *QuizAttempt) {
+	submission := submissionAttempt{HandedInAt: time.Now()}
+	if attempt == nil {
+		availability, err := loadAttemptAvailability(quizID, studentID, time.Now())
+		if err == errQuizNotFound {
+			http.Error(w, "Quiz not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking attempts of quiz %d: %v", quizID, err)
+			http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
+			return
+		}
+		if !availability.CanAttempt {
+			http.Error(w, availability.Reason, http.StatusBadRequest)
+			return
+		}
+		submission.Number = availability.NextAttempt
+	} else {
+		if attempt.pastGrace(time.Now()) {
+			if err := finalizeQuizAttempt(attempt); err != nil && err != errQuizAlreadySubmitted {
+				log.Printf("Error auto-submitting attempt %d: %v", attempt.ID, err)
+			}
+			http.Error(w, "Time is up for this quiz. Your saved answers have been submitted.", http.StatusForbidden)
+			return
+		}
+		submission.Number, submission.ID, submission.Status = attempt.AttemptNumber, attempt.ID, attemptSubmitted
+		answers = mergeAnswers(attempt.SavedAnswers, answers)
+	}
+
+	result, err := saveQuizSubmission(quizID, studentID, answers, submission)
+	switch err {
+	case nil:
+	case errQuizAlreadySubmitted:
+		http.Error(w, "You have already submitted this quiz", http.StatusBadRequest)
+		return
+	case errQuizPastDue:
+		http.Error(w, "The due date for this quiz has passed", http.StatusForbidden)
+		return
+	case errQuizNotFound:
 		http.Error(w, "Quiz not found", http.StatusNotFound)
 		return
+	default:
+		log.Printf("Error submitting quiz %d: %v", quizID, err)
+		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
+		return
 	}
 
-	// Get all questions for this quiz
-	questionsQuery := `
-		SELECT id, question_type, points, correct_answer 
-		FROM quiz_questions 
-		WHERE quiz_id = ?
-	`
-	rows, err := DB.Query(questionsQuery, req.QuizID)
+	response := map[string]interface{}{
+		"success":        true,
+		"message":        "Quiz submitted successfully",
+		"submission_id":  result.SubmissionID,
+		"attempt_number": submission.Number,
+		"is_late":        result.Late.Late,
+	}
+	if result.Late.PenaltyPercent > 0 {
+		response["late_penalty_percent"] = result.Late.PenaltyPercent
+	}
+
+	if result.Score != nil {
+		response["score"] = *result.Score
+		response["total_points"] = result.TotalPoints
+		response["auto_graded"] = true
+	} else {
+		response["message"] = "Quiz submitted successfully. Waiting for teacher to grade essay questions."
+		response["auto_graded_score"] = result.AutoGradedScore
+		response["auto_graded"] = false
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// saveQuizSubmission auto-grades a student's answers and stores them as
+// the given attempt. A timed attempt is closed in the same transaction.
+// Late work is refused or penalized according to the quiz's late policy;
+// auto-submitted attempts are never refused.
+func saveQuizSubmission(quizID, studentID int, answers map[string]interface{}, attempt submissionAttempt) (*quizSubmissionResult, error) {
+	// Check if student already submitted this attempt
+	var existingSubmissionID int
+	err := DB.QueryRow(`
+		SELECT id FROM quiz_submissions WHERE quiz_id = ? AND student_id = ? AND attempt_number = ?
+	`, quizID, studentID, attempt.Number).Scan(&existingSubmissionID)
+	if err == nil {
+		return nil, errQuizAlreadySubmitted
+	}
+
+	deadline, err := loadQuizDeadline(quizID, studentID)
 	if err != nil {
-		log.Printf("Error fetching questions: %v", err)
-		http.Error(w, "Error processing quiz", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	late := deadline.lateness(attempt.HandedInAt)
+	if late.Rejected && attempt.Status != attemptAutoSubmitted {
+		return nil, errQuizPastDue
 	}
-	defer rows.Close()
 
-	// Calculate score for multiple choice questions
-	var autoGradedScore float64
-	var hasEssayQuestions bool
-	var mcQuestions []Question
+	if answers == nil {
+		answers = map[string]interface{}{}
+	}
+	// Convert answers to JSON string
+	answersJSON, err := json.Marshal(answers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode answers: %v", err)
+	}
 
-	for rows.Next() {
-		var q Question
-		var correctAnswer sql.NullString
-		err := rows.Scan(&q.ID, &q.QuestionType, &q.Points, &correctAnswer)
-		if err != nil {
-			log.Printf("Error scanning question: %v", err)
-			continue
-		}
+	// Get quiz details and questions
+	result := &quizSubmissionResult{Late: late}
+	err = DB.QueryRow("SELECT total_points FROM quizzes_new WHERE id = ?", quizID).Scan(&result.TotalPoints)
+	if err == sql.ErrNoRows {
+		return nil, errQuizNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if correctAnswer.Valid {
-			q.CorrectAnswer = correctAnswer.String
+	// Grade against the questions this student was given, and keep them
+	// and the order they were shown in so the submission can be regraded
+	// and reviewed the same way
+	questions, layout, err := loadStudentQuestions(quizID, studentID, attempt.Number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load questions: %v", err)
+	}
+	var questionIDs []int
+	for _, q := range layout.apply(questions) {
+		questionIDs = append(questionIDs, q.ID)
+	}
+	questionIDsJSON, _ := json.Marshal(questionIDs)
+	var optionOrdersJSON interface{}
+	if layout != nil && len(layout.OptionOrders) > 0 {
+		encoded, _ := json.Marshal(layout.OptionOrders)
+		optionOrdersJSON = string(encoded)
+	}
+
+	// Auto-grade every question that has an answer key; essays wait for
+	// the teacher
+	type gradedAnswer struct {
+		questionID    int
+		answer        string
+		isCorrect     *bool
+		pointsAwarded *float64
+	}
+	var graded []gradedAnswer
+	var hasManualQuestions bool
+
+	for i := range questions {
+		q := &questions[i]
+		answer, answered := answers[strconv.Itoa(q.ID)]
+		if layout != nil {
+			// Shuffled options were labelled in the order shown
+			answer = originalAnswer(q, layout.OptionOrders[q.ID], answer)
 		}
-
-		if q.QuestionType == "multiple_choice" {
-			mcQuestions = append(mcQuestions, q)
-		} else if q.QuestionType == "essay" {
-			hasEssayQuestions = true
+		fraction, auto := gradeAnswer(q, answer)
+		if !auto {
+			hasManualQuestions = true
+		}
+		if !answered && !q.FullCredit {
+			continue
 		}
-	}
 
-	// Auto-grade multiple choice questions
-	for _, q := range mcQuestions {
-		questionIDStr := strconv.Itoa(q.ID)
-		if studentAnswer, exists := req.Answers[questionIDStr]; exists {
-			if studentAnswerStr, ok := studentAnswer.(string); ok {
-				if strings.ToUpper(studentAnswerStr) == strings.ToUpper(q.CorrectAnswer) {
-					autoGradedScore += float64(q.Points)
-				}
-			}
+		ga := gradedAnswer{questionID: q.ID, answer: encodeAnswer(answer)}
+		if auto {
+			correct := fraction >= 1
+			awarded := awardedPoints(q.Points, fraction)
+			ga.isCorrect, ga.pointsAwarded = &correct, &awarded
+			result.AutoGradedScore += awarded
 		}
+		graded = append(graded, ga)
 	}
 
 	// Begin transaction
 	tx, err := DB.Begin()
 	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer tx.Rollback()
 
 	// Insert submission
-	var finalScore *float64
 	var gradedAt *time.Time
+	now := time.Now()
 
-	if !hasEssayQuestions {
-		// If only multiple choice, set final score immediately
-		finalScore = &autoGradedScore
-		now := time.Now()
+	if !hasManualQuestions {
+		// If everything was auto-graded, set final score immediately
+		score := applyLatePenalty(result.AutoGradedScore, late.PenaltyPercent)
+		result.Score = &score
 		gradedAt = &now
 	}
 
+	var attemptID interface{}
+	if attempt.ID != 0 {
+		attemptID = attempt.ID
+	}
 	submissionQuery := `
-		INSERT INTO quiz_submissions (quiz_id, student_id, submission_type, answers, score, total_points, graded_at)
-		VALUES (?, ?, 'interactive', ?, ?, ?, ?)
+		INSERT INTO quiz_submissions (quiz_id, student_id, attempt_number, submission_type, answers, question_ids, option_orders, attempt_id, score, total_points, submitted_at, graded_at,
+		                              is_late, late_seconds, late_penalty_percent)
+		VALUES (?, ?, ?, 'interactive', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := tx.Exec(submissionQuery, req.QuizID, studentID, string(answersJSON), finalScore, totalPoints, gradedAt)
+	res, err := tx.Exec(submissionQuery, quizID, studentID, attempt.Number, string(answersJSON), string(questionIDsJSON), optionOrdersJSON, attemptID, result.Score, result.TotalPoints, now, gradedAt,
+		late.Late, late.Seconds, late.PenaltyPercent)
 	if err != nil {
-		log.Printf("Error inserting submission: %v", err)
-		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
-		return
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			// A concurrent submission of the same attempt got there first
+			return nil, errQuizAlreadySubmitted
+		}
+		return nil, fmt.Errorf("failed to insert submission: %v", err)
 	}
 
-	submissionID, err := result.LastInsertId()
+	result.SubmissionID, err = res.LastInsertId()
 	if err != nil {
-		log.Printf("Error getting submission ID: %v", err)
-		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Insert individual answers into quiz_answers table
-	for questionIDStr, answer := range req.Answers {
-		questionID, err := strconv.Atoi(questionIDStr)
-		if err != nil {
-			continue
-		}
-
-		answerStr := ""
-		if answer != nil {
-			answerStr = fmt.Sprintf("%v", answer)
-		}
-
-		// Find question details
-		var questionType string
-		var points int
-		var correctAnswer sql.NullString
-		err = DB.QueryRow("SELECT question_type, points, correct_answer FROM quiz_questions WHERE id = ?", questionID).Scan(&questionType, &points, &correctAnswer)
-		if err != nil {
-			log.Printf("Error fetching question details: %v", err)
-			continue
-		}
-
-		var isCorrect *bool
-		var pointsAwarded *float64
-
-		if questionType == "multiple_choice" && correctAnswer.Valid {
-			correct := strings.ToUpper(answerStr) == strings.ToUpper(correctAnswer.String)
-			isCorrect = &correct
-			if correct {
-				awarded := float64(points)
-				pointsAwarded = &awarded
-			} else {
-				awarded := 0.0
-				pointsAwarded = &awarded
-			}
-		}
-
+	for _, ga := range graded {
 		answerQuery := `
 			INSERT INTO quiz_answers (submission_id, question_id, answer, is_correct, points_awarded)
 			VALUES (?, ?, ?, ?, ?)
 		`
-		_, err = tx.Exec(answerQuery, submissionID, questionID, answerStr, isCorrect, pointsAwarded)
+		_, err = tx.Exec(answerQuery, result.SubmissionID, ga.questionID, ga.answer, ga.isCorrect, ga.pointsAwarded)
 		if err != nil {
 			log.Printf("Error inserting answer: %v", err)
 		}
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
-		return
-	}
-
-	response := map[string]interface{}{
-		"success": true,
-		"message": "Quiz submitted successfully",
+	// Close the attempt; if it was closed meanwhile (the sweeper got there
+	// first) this submission is dropped
+	if attempt.ID != 0 {
+		closed, err := tx.Exec(`
+			UPDATE quiz_attempts SET status = ?, submission_id = ?, submitted_at = ?
+			WHERE id = ? AND status = 'in_progress'
+		`, attempt.Status, result.SubmissionID, now, attempt.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to close attempt: %v", err)
+		}
+		if affected, _ := closed.RowsAffected(); affected == 0 {
+			return nil, errQuizAlreadySubmitted
+		}
 	}
 
-	if finalScore != nil {
-		response["score"] = *finalScore
-		response["total_points"] = totalPoints
-		response["auto_graded"] = true
-	} else {
-		response["message"] = "Quiz submitted successfully. Waiting for teacher to grade essay questions."
-		response["auto_graded"] = false
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	return result, nil
 }
 
 // submitQuizPDFHandler handles PDF quiz submissions from students
@@ -1019,47 +1363,94 @@ func submitQuizPDFHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the file from the form
-	file, handler, err := r.FormFile("file")
+	// Late uploads are refused or flagged according to the late policy
+	deadline, err := loadQuizDeadline(quizID, studentID)
+	if err == errQuizNotFound {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting file: %v", err)
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+		log.Printf("Error fetching due date of quiz %d: %v", quizID, err)
+		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	late := deadline.lateness(now)
+	if late.Rejected {
+		http.Error(w, "The due date for this quiz has passed", http.StatusForbidden)
+		return
+	}
+	access, err := loadQuizAccess(quizID)
+	if err != nil {
+		log.Printf("Error fetching access settings of quiz %d: %v", quizID, err)
+		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
+		return
+	}
+	if !access.acceptsWork(now) {
+		http.Error(w, "This quiz is not open", http.StatusForbidden)
+		return
+	}
+	if !access.allowsIP(clientIP(r)) {
+		http.Error(w, "This quiz can only be taken from an approved network", http.StatusForbidden)
 		return
 	}
-	defer file.Close()
 
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads/quiz-answers"
-	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
-		err = os.MkdirAll(uploadsDir, 0755)
+	// An upload hands in the attempt in progress. Proctored quizzes are only
+	// taken in attempts; otherwise every upload is a new attempt, within the
+	// quiz's attempt limit and cooldown.
+	attempt, err := loadQuizAttempt(quizID, studentID)
+	if err != nil {
+		log.Printf("Error fetching quiz attempt: %v", err)
+		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
+		return
+	}
+	var attemptNumber int
+	if attempt != nil && attempt.Status == attemptInProgress {
+		if !checkAttemptAccess(w, r, attempt) {
+			return
+		}
+		if attempt.pastGrace(now) {
+			if err := finalizeQuizAttempt(attempt); err != nil && err != errQuizAlreadySubmitted {
+				log.Printf("Error auto-submitting attempt %d: %v", attempt.ID, err)
+			}
+			http.Error(w, "Time is up for this quiz", http.StatusForbidden)
+			return
+		}
+		attemptNumber = attempt.AttemptNumber
+	} else if access.proctored() {
+		http.Error(w, "Start the quiz before uploading your answer", http.StatusForbidden)
+		return
+	} else {
+		availability, err := loadAttemptAvailability(quizID, studentID, now)
 		if err != nil {
-			log.Printf("Error creating uploads directory: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			log.Printf("Error checking attempts of quiz %d: %v", quizID, err)
+			http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
 			return
 		}
+		if !availability.CanAttempt {
+			http.Error(w, availability.Reason, http.StatusBadRequest)
+			return
+		}
+		attemptNumber, attempt = availability.NextAttempt, nil
 	}
 
-	// Generate a unique filename
-	cleanFilename := strings.ReplaceAll(handler.Filename, " ", "_")
-	filename := fmt.Sprintf("%d_%d_%d_%s", studentID, quizID, time.Now().UnixNano(), cleanFilename)
-
-	// Create the file
-	filePath := filepath.Join(uploadsDir, filename)
-	dst, err := os.Create(filePath)
+	// Get the file from the form
+	file, handler, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		log.Printf("Error getting file: %v", err)
+		http.Error(w, "Error retrieving file", http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
+	defer file.Close()
 
-	// Copy the file content
-	_, err = io.Copy(dst, file)
+	// Validate, scan and save the uploaded answer
+	stored, err := processUpload(r.Context(), quizAnswerUploads, file, handler, uploadOwner{Role: "student", ID: studentID})
 	if err != nil {
-		log.Printf("Error copying file: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		log.Printf("Quiz answer upload %s from student %d failed: %v", handler.Filename, studentID, err)
+		writeUploadError(w, err)
 		return
 	}
+	urlPath := stored.URLPath
 
 	// Get quiz details for points
 	var totalPoints int
@@ -1070,35 +1461,78 @@ func submitQuizPDFHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create the URL path for the file
-	urlPath := "/uploads/quiz-answers/" + filename
-
-	// Insert submission
-	submissionQuery := `
-		INSERT INTO quiz_submissions (quiz_id, student_id, submission_type, uploaded_file_path, total_points)
-		VALUES (?, ?, 'pdf_upload', ?, ?)
-		ON DUPLICATE KEY UPDATE 
-		uploaded_file_path = VALUES(uploaded_file_path), 
-		submitted_at = CURRENT_TIMESTAMP
-	`
-
-	_, err = DB.Exec(submissionQuery, quizID, studentID, urlPath, totalPoints)
-	if err != nil {
+	if err := savePDFSubmission(quizID, studentID, attemptNumber, attempt, urlPath, totalPoints, now, late); err != nil {
+		refreshUploadReferences(urlPath)
+		if err == errQuizAlreadySubmitted {
+			http.Error(w, "You have already submitted this attempt", http.StatusConflict)
+			return
+		}
 		log.Printf("Error inserting submission: %v", err)
 		http.Error(w, "Error submitting quiz", http.StatusInternalServerError)
 		return
 	}
+	refreshUploadReferences(urlPath)
 
 	response := map[string]interface{}{
-		"success":   true,
-		"file_path": urlPath,
-		"message":   "Quiz answer submitted successfully",
+		"success":        true,
+		"file_path":      urlPath,
+		"message":        "Quiz answer submitted successfully",
+		"attempt_number": attemptNumber,
+		"is_late":        late.Late,
+	}
+	if late.PenaltyPercent > 0 {
+		response["late_penalty_percent"] = late.PenaltyPercent
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
+// savePDFSubmission stores an uploaded answer as the given attempt and
+// closes the attempt in progress, if there is one
+func savePDFSubmission(quizID, studentID, attemptNumber int, attempt *QuizAttempt, urlPath string, totalPoints int, now time.Time, late Lateness) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var attemptID interface{}
+	if attempt != nil {
+		attemptID = attempt.ID
+	}
+	res, err := tx.Exec(`
+		INSERT INTO quiz_submissions (quiz_id, student_id, attempt_number, submission_type, uploaded_file_path, attempt_id, total_points,
+		                              submitted_at, is_late, late_seconds, late_penalty_percent)
+		VALUES (?, ?, ?, 'pdf_upload', ?, ?, ?, ?, ?, ?, ?)
+	`, quizID, studentID, attemptNumber, urlPath, attemptID, totalPoints, now, late.Late, late.Seconds, late.PenaltyPercent)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			// A concurrent upload took this attempt
+			return errQuizAlreadySubmitted
+		}
+		return err
+	}
+
+	if attempt != nil {
+		submissionID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		closed, err := tx.Exec(`
+			UPDATE quiz_attempts SET status = ?, submission_id = ?, submitted_at = ?
+			WHERE id = ? AND status = 'in_progress'
+		`, attemptSubmitted, submissionID, now, attempt.ID)
+		if err != nil {
+			return err
+		}
+		if affected, _ := closed.RowsAffected(); affected == 0 {
+			return errQuizAlreadySubmitted
+		}
+	}
+	return tx.Commit()
+}
+
 // debugQuizzesHandler untuk debug - melihat semua quiz di database
 func debugQuizzesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -1155,9 +1589,17 @@ type QuizSubmissionDetail struct {
 	StudentID        int                    `json:"student_id"`
 	StudentName      string                 `json:"student_name"`
 	StudentEmail     string                 `json:"student_email"`
+	AttemptNumber    int                    `json:"attempt_number"`
+	DueDate          *time.Time             `json:"due_date,omitempty"` // Effective due date, including any extension
+	Extended         bool                   `json:"extended"`
+	IsLate           bool                   `json:"is_late"`
+	LateSeconds      int                    `json:"late_seconds,omitempty"`
+	LatePenalty      float64                `json:"late_penalty_percent,omitempty"`
 	SubmissionType   string                 `json:"submission_type"`
 	Answers          map[string]interface{} `json:"answers,omitempty"`
+	QuestionIDs      []int                  `json:"question_ids,omitempty"` // Questions the student was given, in order
 	UploadedFilePath string                 `json:"uploaded_file_path,omitempty"`
+	UploadedFileURL  string                 `json:"uploaded_file_url,omitempty"`
 	Score            *float64               `json:"score,omitempty"`
 	TotalPoints      int                    `json:"total_points"`
 	SubmittedAt      time.Time              `json:"submitted_at"`
@@ -1165,17 +1607,26 @@ type QuizSubmissionDetail struct {
 	GradedBy         *int                   `json:"graded_by,omitempty"`
 	Feedback         string                 `json:"feedback,omitempty"`
 	QuestionDetails  []QuestionAnswer       `json:"question_details,omitempty"`
+	AttemptID        *int                   `json:"attempt_id,omitempty"`
+	Integrity        *IntegritySummary      `json:"integrity,omitempty"` // Integrity events and heuristic flags
+	RegradeRequests  []RegradeRequest       `json:"regrade_requests,omitempty"`
 }
 
 type QuestionAnswer struct {
-	QuestionID    int      `json:"question_id"`
-	QuestionText  string   `json:"question_text"`
-	QuestionType  string   `json:"question_type"`
-	Points        int      `json:"points"`
-	StudentAnswer string   `json:"student_answer"`
-	CorrectAnswer string   `json:"correct_answer,omitempty"`
-	IsCorrect     *bool    `json:"is_correct,omitempty"`
-	PointsAwarded *float64 `json:"points_awarded,omitempty"`
+	QuestionID    int        `json:"question_id"`
+	QuestionText  string     `json:"question_text"`
+	QuestionType  string     `json:"question_type"`
+	Points        int        `json:"points"`
+	StudentAnswer string     `json:"student_answer"`
+	CorrectAnswer string     `json:"correct_answer,omitempty"`
+	AnswerKey     *AnswerKey `json:"answer_key,omitempty"`
+	IsCorrect     *bool      `json:"is_correct,omitempty"`
+	PointsAwarded *float64   `json:"points_awarded,omitempty"`
+	// Rubric grading of essay questions
+	RubricID    *int         `json:"rubric_id,omitempty"`
+	Rubric      *Rubric      `json:"rubric,omitempty"`
+	RubricScore *RubricScore `json:"rubric_score,omitempty"`
+	Comment     string       `json:"comment,omitempty"`
 }
 
 // getQuizSubmissionsHandler - untuk guru melihat semua submission quiz
@@ -1204,7 +1655,7 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 	var courseID int
 	err = DB.QueryRow(`
 		SELECT c.id FROM courses c 
-		JOIN quizzes q ON c.id = q.course_id 
+		JOIN quizzes_new q ON c.id = q.course_id 
 		WHERE q.id = ? AND c.teacher_id = ?
 	`, quizID, teacherID).Scan(&courseID)
 	if err != nil {
@@ -1217,22 +1668,28 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all submissions for this quiz
+	// Get all submissions for this quiz, every attempt of every student;
+	// ?student_id= narrows it down to one student's attempt history
 	submissionsQuery := `
 		SELECT 
 			qs.id, qs.quiz_id, q.title as quiz_title, qs.student_id, 
 			s.name as student_name, s.email as student_email,
-			qs.submission_type, qs.answers, qs.uploaded_file_path,
+			qs.attempt_number, COALESCE(e.due_date, q.due_date), e.id IS NOT NULL,
+			qs.is_late, qs.late_seconds, qs.late_penalty_percent,
+			qs.submission_type, qs.answers, qs.question_ids, qs.uploaded_file_path,
 			qs.score, qs.total_points, qs.submitted_at, qs.graded_at,
-			qs.graded_by, qs.feedback
+			qs.graded_by, qs.feedback, qs.attempt_id, a.started_at, q.time_limit
 		FROM quiz_submissions qs
-		JOIN quizzes q ON qs.quiz_id = q.id
+		JOIN quizzes_new q ON qs.quiz_id = q.id
 		JOIN students s ON qs.student_id = s.id
-		WHERE qs.quiz_id = ?
+		LEFT JOIN quiz_extensions e ON e.quiz_id = qs.quiz_id AND e.student_id = qs.student_id
+		LEFT JOIN quiz_attempts a ON a.id = qs.attempt_id
+		WHERE qs.quiz_id = ? AND (? = 0 OR qs.student_id = ?)
 		ORDER BY qs.submitted_at DESC
 	`
 
-	rows, err := DB.Query(submissionsQuery, quizID)
+	studentFilter, _ := strconv.Atoi(r.URL.Query().Get("student_id"))
+	rows, err := DB.Query(submissionsQuery, quizID, studentFilter, studentFilter)
 	if err != nil {
 		log.Printf("Error fetching submissions: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
@@ -1240,22 +1697,34 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
+	integrity, err := loadIntegrityStats(quizID)
+	if err != nil {
+		log.Printf("Warning: Failed to load integrity events of quiz %d: %v", quizID, err)
+	}
+	rubrics := make(map[int]*Rubric)
+
 	var submissions []QuizSubmissionDetail
 	for rows.Next() {
 		var submission QuizSubmissionDetail
-		var answersJSON sql.NullString
+		var answersJSON, questionIDsJSON sql.NullString
 		var uploadedFilePath sql.NullString
 		var score sql.NullFloat64
 		var gradedAt sql.NullTime
 		var gradedBy sql.NullInt32
 		var feedback sql.NullString
+		var dueDate sql.NullTime
+		var attemptID sql.NullInt64
+		var startedAt sql.NullTime
+		var timeLimit sql.NullInt32
 
 		err := rows.Scan(
 			&submission.ID, &submission.QuizID, &submission.QuizTitle,
 			&submission.StudentID, &submission.StudentName, &submission.StudentEmail,
-			&submission.SubmissionType, &answersJSON, &uploadedFilePath,
+			&submission.AttemptNumber, &dueDate, &submission.Extended,
+			&submission.IsLate, &submission.LateSeconds, &submission.LatePenalty,
+			&submission.SubmissionType, &answersJSON, &questionIDsJSON, &uploadedFilePath,
 			&score, &submission.TotalPoints, &submission.SubmittedAt,
-			&gradedAt, &gradedBy, &feedback,
+			&gradedAt, &gradedBy, &feedback, &attemptID, &startedAt, &timeLimit,
 		)
 		if err != nil {
 			log.Printf("Error scanning submission: %v", err)
@@ -1269,9 +1738,16 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 				submission.Answers = answers
 			}
 		}
+		if questionIDsJSON.Valid {
+			json.Unmarshal([]byte(questionIDsJSON.String), &submission.QuestionIDs)
+		}
+		if dueDate.Valid {
+			submission.DueDate = &dueDate.Time
+		}
 
 		if uploadedFilePath.Valid {
 			submission.UploadedFilePath = uploadedFilePath.String
+			submission.UploadedFileURL = signFileURL(uploadedFilePath.String)
 		}
 		if score.Valid {
 			submission.Score = &score.Float64
@@ -1286,15 +1762,33 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 		if feedback.Valid {
 			submission.Feedback = feedback.String
 		}
+		if submission.SubmissionType == "interactive" {
+			var stats *integrityEventStats
+			var duration *time.Duration
+			if attemptID.Valid {
+				id := int(attemptID.Int64)
+				submission.AttemptID = &id
+				stats = integrity[id]
+			}
+			if startedAt.Valid {
+				d := submission.SubmittedAt.Sub(startedAt.Time)
+				duration = &d
+			}
+			submission.Integrity = summarizeIntegrity(stats, duration, timeLimit, len(submission.QuestionIDs))
+		}
+		if submission.RegradeRequests, err = loadRegradeRequests(submission.ID); err != nil {
+			log.Printf("Error fetching regrade requests of submission %d: %v", submission.ID, err)
+		}
 
 		// Get question details with answers
 		questionDetailsQuery := `
 			SELECT 
 				qa.question_id, qq.question as question_text, qq.question_type,
 				qq.points, qa.answer as student_answer, qq.correct_answer,
-				qa.is_correct, qa.points_awarded
+				qa.is_correct, qa.points_awarded, qq.answer_key,
+				qq.rubric_id, qa.rubric_scores, qa.comment
 			FROM quiz_answers qa
-			JOIN quiz_questions qq ON qa.question_id = qq.id
+			JOIN quiz_questions_new qq ON qa.question_id = qq.id
 			WHERE qa.submission_id = ?
 			ORDER BY qa.question_id
 		`
@@ -1309,11 +1803,15 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 				var correctAnswer sql.NullString
 				var isCorrect sql.NullBool
 				var pointsAwarded sql.NullFloat64
+				var answerKey sql.NullString
+				var rubricID sql.NullInt64
+				var rubricScores, comment sql.NullString
 
 				err := questionRows.Scan(
 					&qa.QuestionID, &qa.QuestionText, &qa.QuestionType,
 					&qa.Points, &qa.StudentAnswer, &correctAnswer,
-					&isCorrect, &pointsAwarded,
+					&isCorrect, &pointsAwarded, &answerKey,
+					&rubricID, &rubricScores, &comment,
 				)
 				if err != nil {
 					log.Printf("Error scanning question answer: %v", err)
@@ -1329,6 +1827,31 @@ func getQuizSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 				if pointsAwarded.Valid {
 					qa.PointsAwarded = &pointsAwarded.Float64
 				}
+				if answerKey.Valid && answerKey.String != "" {
+					var key AnswerKey
+					if json.Unmarshal([]byte(answerKey.String), &key) == nil {
+						qa.AnswerKey = &key
+					}
+				}
+				if rubricID.Valid {
+					id := int(rubricID.Int64)
+					qa.RubricID = &id
+					rb, cached := rubrics[id]
+					if !cached {
+						if rb, err = loadRubric(id); err != nil {
+							log.Printf("Error fetching rubric %d: %v", id, err)
+						}
+						rubrics[id] = rb
+					}
+					qa.Rubric = rb
+				}
+				if rubricScores.Valid && rubricScores.String != "" {
+					var score RubricScore
+					if json.Unmarshal([]byte(rubricScores.String), &score) == nil {
+						qa.RubricScore = &score
+					}
+				}
+				qa.Comment = comment.String
 
 				questionDetails = append(questionDetails, qa)
 			}
@@ -1366,6 +1889,9 @@ func gradeEssayHandler(w http.ResponseWriter, r *http.Request) {
 		Grades       []struct {
 			QuestionID    int     `json:"question_id"`
 			PointsAwarded float64 `json:"points_awarded"`
+			// Levels picked on questions graded with a rubric, instead of points
+			Criteria []CriterionScore `json:"criteria"`
+			Comment  *string          `json:"comment"`
 		} `json:"grades"`
 		Feedback string `json:"feedback"`
 	}
@@ -1381,7 +1907,7 @@ func gradeEssayHandler(w http.ResponseWriter, r *http.Request) {
 	// Verify teacher has permission to grade this submission
 	var quizID int
 	err := DB.QueryRow(`
-		SELECT q.id FROM quizzes q
+		SELECT q.id FROM quizzes_new q
 		JOIN quiz_submissions qs ON q.id = qs.quiz_id
 		JOIN courses c ON q.course_id = c.id
 		WHERE qs.id = ? AND c.teacher_id = ?
@@ -1396,6 +1922,35 @@ func gradeEssayHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Questions graded with a rubric get their points from the levels picked
+	rubricScores := make(map[int]*RubricScore)
+	for i, grade := range req.Grades {
+		points, rubric, err := questionRubric(quizID, grade.QuestionID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, fmt.Sprintf("Question %d is not part of this quiz", grade.QuestionID), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error fetching rubric of question %d: %v", grade.QuestionID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if rubric == nil {
+			if len(grade.Criteria) > 0 {
+				http.Error(w, fmt.Sprintf("Question %d is not graded with a rubric", grade.QuestionID), http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		score, err := rubric.score(grade.Criteria)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Question %d: %v", grade.QuestionID, err), http.StatusBadRequest)
+			return
+		}
+		rubricScores[grade.QuestionID] = score
+		req.Grades[i].PointsAwarded = score.points(points)
+	}
+
 	// Begin transaction
 	tx, err := DB.Begin()
 	if err != nil {
@@ -1407,12 +1962,26 @@ func gradeEssayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Update individual question grades
 	for _, grade := range req.Grades {
+		var scores interface{}
+		if score, ok := rubricScores[grade.QuestionID]; ok {
+			encoded, _ := json.Marshal(score)
+			scores = string(encoded)
+		}
+		var comment interface{}
+		if grade.Comment != nil {
+			comment = nullIfEmpty(strings.TrimSpace(*grade.Comment))
+		}
+		// Points the teacher changed are kept by later regrades; MySQL sets
+		// the columns in order, so manual_override still sees the old points
 		updateGradeQuery := `
 			UPDATE quiz_answers 
-			SET points_awarded = ?, is_correct = CASE WHEN ? > 0 THEN TRUE ELSE FALSE END
+			SET manual_override = manual_override OR NOT (points_awarded <=> ?),
+			    points_awarded = ?, is_correct = CASE WHEN ? > 0 THEN TRUE ELSE FALSE END,
+			    rubric_scores = ?, comment = IF(?, ?, comment)
 			WHERE submission_id = ? AND question_id = ?
 		`
-		_, err := tx.Exec(updateGradeQuery, grade.PointsAwarded, grade.PointsAwarded, req.SubmissionID, grade.QuestionID)
+		_, err := tx.Exec(updateGradeQuery, grade.PointsAwarded, grade.PointsAwarded, grade.PointsAwarded, scores,
+			grade.Comment != nil, comment, req.SubmissionID, grade.QuestionID)
 		if err != nil {
 			log.Printf("Error updating grade: %v", err)
 			http.Error(w, "Error updating grades", http.StatusInternalServerError)
@@ -1420,18 +1989,21 @@ func gradeEssayHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Calculate total score
-	var totalScore float64
+	// Calculate total score, less any late penalty
+	var totalScore, latePenalty float64
 	err = tx.QueryRow(`
-		SELECT COALESCE(SUM(points_awarded), 0) 
-		FROM quiz_answers 
-		WHERE submission_id = ?
-	`, req.SubmissionID).Scan(&totalScore)
+		SELECT COALESCE(SUM(qa.points_awarded), 0), qs.late_penalty_percent
+		FROM quiz_submissions qs
+		LEFT JOIN quiz_answers qa ON qa.submission_id = qs.id
+		WHERE qs.id = ?
+		GROUP BY qs.id, qs.late_penalty_percent
+	`, req.SubmissionID).Scan(&totalScore, &latePenalty)
 	if err != nil {
 		log.Printf("Error calculating total score: %v", err)
 		http.Error(w, "Error calculating score", http.StatusInternalServerError)
 		return
 	}
+	totalScore = applyLatePenalty(totalScore, latePenalty)
 
 	// Update submission with final score
 	updateSubmissionQuery := `
@@ -1455,9 +2027,11 @@ func gradeEssayHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":     true,
-		"message":     "Grades saved successfully",
-		"total_score": totalScore,
+		"success":              true,
+		"message":              "Grades saved successfully",
+		"total_score":          totalScore,
+		"late_penalty_percent": latePenalty,
+		"rubric_scores":        rubricScores,
 	})
 }
 
@@ -1480,8 +2054,8 @@ func getStudentQuizResultsHandler(w http.ResponseWriter, r *http.Request) {
 	resultsQuery := `
 		SELECT 
 			qs.id, qs.quiz_id, q.title as quiz_title, c.name as course_name,
-			qs.score, qs.total_points, qs.submitted_at, qs.graded_at,
-			qs.feedback
+			qs.attempt_number, qs.score, qs.total_points, qs.submitted_at, qs.graded_at,
+			qs.feedback, qs.is_late, qs.late_penalty_percent
 		FROM quiz_submissions qs
 		JOIN quizzes_new q ON qs.quiz_id = q.id
 		JOIN courses c ON q.course_id = c.id
@@ -1499,16 +2073,19 @@ func getStudentQuizResultsHandler(w http.ResponseWriter, r *http.Request) {
 
 	var results []map[string]interface{}
 	for rows.Next() {
-		var submissionID, quizID, totalPoints int
+		var submissionID, quizID, attemptNumber, totalPoints int
 		var quizTitle, courseName string
 		var score sql.NullFloat64
 		var submittedAt time.Time
 		var gradedAt sql.NullTime
 		var feedback sql.NullString
+		var isLate bool
+		var latePenalty float64
 
 		err := rows.Scan(
 			&submissionID, &quizID, &quizTitle, &courseName,
-			&score, &totalPoints, &submittedAt, &gradedAt, &feedback,
+			&attemptNumber, &score, &totalPoints, &submittedAt, &gradedAt, &feedback,
+			&isLate, &latePenalty,
 		)
 		if err != nil {
 			log.Printf("Error scanning result: %v", err)
@@ -1516,12 +2093,15 @@ func getStudentQuizResultsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		result := map[string]interface{}{
-			"submission_id": submissionID,
-			"quiz_id":       quizID,
-			"quiz_title":    quizTitle,
-			"course_name":   courseName,
-			"total_points":  totalPoints,
-			"submitted_at":  submittedAt,
+			"submission_id":        submissionID,
+			"quiz_id":              quizID,
+			"quiz_title":           quizTitle,
+			"course_name":          courseName,
+			"attempt_number":       attemptNumber,
+			"total_points":         totalPoints,
+			"submitted_at":         submittedAt,
+			"is_late":              isLate,
+			"late_penalty_percent": latePenalty,
 		}
 
 		if score.Valid {
@@ -1590,9 +2170,9 @@ func getStudentQuizDetailHandler(w http.ResponseWriter, r *http.Request) {
 	// Get submission details with question answers
 	detailQuery := `
 		SELECT 
-			qs.id, qs.quiz_id, q.title as quiz_title,
+			qs.id, qs.quiz_id, q.title as quiz_title, qs.attempt_number,
 			qs.score, qs.total_points, qs.submitted_at, qs.graded_at,
-			qs.feedback
+			qs.feedback, qs.is_late, qs.late_penalty_percent
 		FROM quiz_submissions qs
 		JOIN quizzes_new q ON qs.quiz_id = q.id
 		WHERE qs.id = ?
@@ -1602,13 +2182,16 @@ func getStudentQuizDetailHandler(w http.ResponseWriter, r *http.Request) {
 	var score sql.NullFloat64
 	var gradedAt sql.NullTime
 	var feedback sql.NullString
-	var submissionIDResult, quizIDResult, totalPoints int
+	var submissionIDResult, quizIDResult, attemptNumber, totalPoints int
 	var quizTitle string
 	var submittedAt time.Time
+	var isLate bool
+	var latePenalty float64
 
 	err = DB.QueryRow(detailQuery, submissionID).Scan(
-		&submissionIDResult, &quizIDResult, &quizTitle,
+		&submissionIDResult, &quizIDResult, &quizTitle, &attemptNumber,
 		&score, &totalPoints, &submittedAt, &gradedAt, &feedback,
+		&isLate, &latePenalty,
 	)
 	if err != nil {
 		log.Printf("Error fetching submission detail: %v", err)
@@ -1617,11 +2200,14 @@ func getStudentQuizDetailHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	submission = map[string]interface{}{
-		"submission_id": submissionIDResult,
-		"quiz_id":       quizIDResult,
-		"quiz_title":    quizTitle,
-		"total_points":  totalPoints,
-		"submitted_at":  submittedAt,
+		"submission_id":        submissionIDResult,
+		"quiz_id":              quizIDResult,
+		"quiz_title":           quizTitle,
+		"attempt_number":       attemptNumber,
+		"total_points":         totalPoints,
+		"submitted_at":         submittedAt,
+		"is_late":              isLate,
+		"late_penalty_percent": latePenalty,
 	}
 
 	if score.Valid {
@@ -1642,79 +2228,113 @@ func getStudentQuizDetailHandler(w http.ResponseWriter, r *http.Request) {
 		submission["feedback"] = feedback.String
 	}
 
-	// Get question details with student answers
-	questionDetailsQuery := `
-		SELECT 
-			qa.question_id, qq.question as question_text, qq.question_type,
-			qq.points, qa.answer as student_answer, qq.correct_answer,
-			qa.is_correct, qa.points_awarded,
-			qq.option_a, qq.option_b, qq.option_c, qq.option_d
-		FROM quiz_answers qa
-		JOIN quiz_questions_new qq ON qa.question_id = qq.id
-		WHERE qa.submission_id = ?
-		ORDER BY qa.question_id
-	`
+	// Get the student's answers
+	type storedAnswer struct {
+		answer        string
+		isCorrect     sql.NullBool
+		pointsAwarded sql.NullFloat64
+		rubricScores  sql.NullString
+		comment       sql.NullString
+	}
+	answerRows, err := DB.Query(`
+		SELECT question_id, answer, is_correct, points_awarded, rubric_scores, comment
+		FROM quiz_answers WHERE submission_id = ?
+	`, submissionID)
+	if err != nil {
+		log.Printf("Error fetching question details: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	answers := make(map[int]storedAnswer)
+	var answeredIDs []int
+	for answerRows.Next() {
+		var questionID int
+		var a storedAnswer
+		if err := answerRows.Scan(&questionID, &a.answer, &a.isCorrect, &a.pointsAwarded, &a.rubricScores, &a.comment); err != nil {
+			log.Printf("Error scanning question detail: %v", err)
+			continue
+		}
+		answers[questionID] = a
+		answeredIDs = append(answeredIDs, questionID)
+	}
+	answerRows.Close()
 
-	questionRows, err := DB.Query(questionDetailsQuery, submissionID)
+	byID, err := loadQuestionsByID(quizID, answeredIDs)
 	if err != nil {
 		log.Printf("Error fetching question details: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	defer questionRows.Close()
+	answered := make([]Question, 0, len(byID))
+	for _, id := range answeredIDs {
+		if q, ok := byID[id]; ok {
+			answered = append(answered, q)
+		}
+	}
+	sort.Slice(answered, func(i, j int) bool { return answered[i].ID < answered[j].ID })
 
+	// Show questions, options and answers the way the student saw them.
+	// Answers are stored with the original option IDs.
+	layout := loadSubmissionLayout(submissionID)
 	var questionDetails []map[string]interface{}
-	for questionRows.Next() {
-		var questionID, points int
-		var questionText, questionType, studentAnswer string
-		var correctAnswer sql.NullString
-		var isCorrect sql.NullBool
-		var pointsAwarded sql.NullFloat64
-		var optionA, optionB, optionC, optionD sql.NullString
-
-		err := questionRows.Scan(
-			&questionID, &questionText, &questionType,
-			&points, &studentAnswer, &correctAnswer,
-			&isCorrect, &pointsAwarded,
-			&optionA, &optionB, &optionC, &optionD,
-		)
-		if err != nil {
-			log.Printf("Error scanning question detail: %v", err)
-			continue
+	for _, q := range layout.apply(answered) {
+		a := answers[q.ID]
+		studentAnswer := a.answer
+		if layout != nil {
+			original := byID[q.ID]
+			shown := shownAnswer(&original, layout.OptionOrders[q.ID], decodeAnswer(q.QuestionType, a.answer))
+			studentAnswer = encodeAnswer(shown)
 		}
 
 		question := map[string]interface{}{
-			"question_id":    questionID,
-			"question_text":  questionText,
-			"question_type":  questionType,
-			"points":         points,
+			"question_id":    q.ID,
+			"question_text":  q.QuestionText,
+			"question_type":  q.QuestionType,
+			"points":         q.Points,
 			"student_answer": studentAnswer,
 		}
 
-		if correctAnswer.Valid {
-			question["correct_answer"] = correctAnswer.String
+		if q.CorrectAnswer != "" {
+			question["correct_answer"] = q.CorrectAnswer
+		}
+		if a.isCorrect.Valid {
+			question["is_correct"] = a.isCorrect.Bool
+		}
+		if a.pointsAwarded.Valid {
+			question["points_awarded"] = a.pointsAwarded.Float64
+		}
+		if a.rubricScores.Valid && a.rubricScores.String != "" {
+			var score RubricScore
+			if json.Unmarshal([]byte(a.rubricScores.String), &score) == nil {
+				question["rubric_score"] = score
+			}
+		}
+		if a.comment.Valid {
+			question["comment"] = a.comment.String
 		}
-		if isCorrect.Valid {
-			question["is_correct"] = isCorrect.Bool
+
+		// Structured choices and key of the richer question types
+		if q.Options != nil {
+			question["structured_options"] = q.Options
 		}
-		if pointsAwarded.Valid {
-			question["points_awarded"] = pointsAwarded.Float64
+		if q.AnswerKey != nil {
+			question["answer_key"] = q.AnswerKey
 		}
 
 		// Add options for multiple choice questions
-		if questionType == "multiple_choice" {
+		if q.QuestionType == "multiple_choice" {
 			options := map[string]interface{}{}
-			if optionA.Valid {
-				options["A"] = optionA.String
+			if q.OptionA != "" {
+				options["A"] = q.OptionA
 			}
-			if optionB.Valid {
-				options["B"] = optionB.String
+			if q.OptionB != "" {
+				options["B"] = q.OptionB
 			}
-			if optionC.Valid {
-				options["C"] = optionC.String
+			if q.OptionC != "" {
+				options["C"] = q.OptionC
 			}
-			if optionD.Valid {
-				options["D"] = optionD.String
+			if q.OptionD != "" {
+				options["D"] = q.OptionD
 			}
 			question["options"] = options
 		}
@@ -1724,6 +2344,12 @@ func getStudentQuizDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 	submission["question_details"] = questionDetails
 
+	regradeRequests, err := loadRegradeRequests(submissionID)
+	if err != nil {
+		log.Printf("Error fetching regrade requests of submission %d: %v", submissionID, err)
+	}
+	submission["regrade_requests"] = regradeRequests
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":    true,
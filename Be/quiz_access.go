@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Besides is_active, a quiz can be limited to an availability window
+// (opens_at to closes_at), to students who know its access code, which the
+// teacher announces in class, and to the networks on its IP allowlist, e.g.
+// a school lab. With single_device set an attempt can only be worked on
+// from the device that started it, identified by the attempt token it was
+// given; another device can take the attempt over once the first has been
+// quiet for deviceTakeoverAfter.
+//
+// Attempts are cut off when the window closes. On quizzes with an access
+// code, an allowlist or single_device students only see the questions, or
+// the PDF of a PDF quiz, inside an attempt.
+
+const (
+	// attemptTokenHeader carries the attempt token on attempt requests
+	attemptTokenHeader  = "X-Attempt-Token"
+	deviceTakeoverAfter = 2 * time.Minute
+	maxAccessCodeLength = 64
+	maxIPAllowlistSize  = 100
+)
+
+var errAttemptTakenOver = errors.New("attempt was taken over by another device")
+
+// createQuizAccessColumns adds the availability and proctoring settings to
+// quizzes and the device of an attempt
+func createQuizAccessColumns(db *sql.DB) error {
+	columns := []struct{ table, name, definition string }{
+		{"quizzes_new", "opens_at", "DATETIME NULL"},
+		{"quizzes_new", "closes_at", "DATETIME NULL"},
+		{"quizzes_new", "access_code", "VARCHAR(64) NULL"},
+		{"quizzes_new", "ip_allowlist", "JSON NULL COMMENT 'CIDR ranges'"},
+		{"quizzes_new", "single_device", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"quiz_attempts", "device_token", "CHAR(32) NULL"},
+		{"quiz_attempts", "client_ip", "VARCHAR(45) NULL"},
+	}
+	for _, col := range columns {
+		if err := ensureColumn(db, col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuizAccess is who can take a quiz, when and where
+type QuizAccess struct {
+	OpensAt      *time.Time
+	ClosesAt     *time.Time
+	AccessCode   string
+	IPAllowlist  []string // CIDR ranges
+	SingleDevice bool
+	Grace        time.Duration // Work is still accepted this long after closing
+}
+
+// quizAccessScan receives the access columns of a quiz row
+type quizAccessScan struct {
+	OpensAt, ClosesAt sql.NullTime
+	AccessCode        sql.NullString
+	IPAllowlist       sql.NullString
+	SingleDevice      bool
+}
+
+func (s *quizAccessScan) access(graceSeconds int) *QuizAccess {
+	a := &QuizAccess{
+		AccessCode:   s.AccessCode.String,
+		SingleDevice: s.SingleDevice,
+		Grace:        time.Duration(graceSeconds) * time.Second,
+	}
+	if s.OpensAt.Valid {
+		a.OpensAt = &s.OpensAt.Time
+	}
+	if s.ClosesAt.Valid {
+		a.ClosesAt = &s.ClosesAt.Time
+	}
+	if s.IPAllowlist.Valid && s.IPAllowlist.String != "" {
+		json.Unmarshal([]byte(s.IPAllowlist.String), &a.IPAllowlist)
+	}
+	return a
+}
+
+// loadQuizAccess returns the access settings of a quiz
+func loadQuizAccess(quizID int) (*QuizAccess, error) {
+	var s quizAccessScan
+	var graceSeconds int
+	err := DB.QueryRow(`
+		SELECT opens_at, closes_at, access_code, ip_allowlist, single_device, grace_period_seconds
+		FROM quizzes_new WHERE id = ?
+	`, quizID).Scan(&s.OpensAt, &s.ClosesAt, &s.AccessCode, &s.IPAllowlist, &s.SingleDevice, &graceSeconds)
+	if err == sql.ErrNoRows {
+		return nil, errQuizNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.access(graceSeconds), nil
+}
+
+// columnValues are the access settings in the order of
+// opens_at, closes_at, access_code, ip_allowlist, single_device
+func (a *QuizAccess) columnValues() []interface{} {
+	var allowlist interface{}
+	if len(a.IPAllowlist) > 0 {
+		encoded, _ := json.Marshal(a.IPAllowlist)
+		allowlist = string(encoded)
+	}
+	return []interface{}{a.OpensAt, a.ClosesAt, nullIfEmpty(a.AccessCode), allowlist, a.SingleDevice}
+}
+
+// proctored reports whether the questions are only shown inside an attempt
+func (a *QuizAccess) proctored() bool {
+	return a.AccessCode != "" || len(a.IPAllowlist) > 0 || a.SingleDevice
+}
+
+// windowError says why the quiz can't be started at the given time, or ""
+// while it is open
+func (a *QuizAccess) windowError(now time.Time) string {
+	if a.OpensAt != nil && now.Before(*a.OpensAt) {
+		return "This quiz opens at " + a.OpensAt.Format("2006-01-02 15:04")
+	}
+	if a.ClosesAt != nil && !now.Before(*a.ClosesAt) {
+		return "This quiz is closed"
+	}
+	return ""
+}
+
+// acceptsWork reports whether work handed in at the given time falls in
+// the window, allowing for the grace period after it closes
+func (a *QuizAccess) acceptsWork(at time.Time) bool {
+	if a.OpensAt != nil && at.Before(*a.OpensAt) {
+		return false
+	}
+	return a.ClosesAt == nil || !at.After(a.ClosesAt.Add(a.Grace))
+}
+
+// checkAccessCode compares a code given by a student with the quiz's
+func (a *QuizAccess) checkAccessCode(code string) bool {
+	if a.AccessCode == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(code)), []byte(a.AccessCode)) == 1
+}
+
+// allowsIP reports whether the quiz can be taken from an address
+func (a *QuizAccess) allowsIP(ip net.IP) bool {
+	if len(a.IPAllowlist) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range a.IPAllowlist {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuizAccessSettings are the access settings in a quiz create or update
+// request. Settings left out of an update are nil and stay unchanged; an
+// empty string or list clears a setting.
+type QuizAccessSettings struct {
+	OpensAt      *string   `json:"opens_at"`
+	ClosesAt     *string   `json:"closes_at"`
+	AccessCode   *string   `json:"access_code"`
+	IPAllowlist  *[]string `json:"ip_allowlist"`
+	SingleDevice *bool     `json:"single_device"`
+}
+
+// applyTo validates the settings and applies them to a quiz's access
+func (s *QuizAccessSettings) applyTo(a *QuizAccess) error {
+	parseTime := func(name string, v *string, dst **time.Time) error {
+		if v == nil {
+			return nil
+		}
+		if *v == "" {
+			*dst = nil
+			return nil
+		}
+		t := getTimePtr(*v)
+		if t == nil {
+			return fmt.Errorf("%s is not a valid date", name)
+		}
+		*dst = t
+		return nil
+	}
+	if err := parseTime("opens_at", s.OpensAt, &a.OpensAt); err != nil {
+		return err
+	}
+	if err := parseTime("closes_at", s.ClosesAt, &a.ClosesAt); err != nil {
+		return err
+	}
+	if a.OpensAt != nil && a.ClosesAt != nil && !a.ClosesAt.After(*a.OpensAt) {
+		return fmt.Errorf("closes_at must be after opens_at")
+	}
+	if s.AccessCode != nil {
+		code := strings.TrimSpace(*s.AccessCode)
+		if len(code) > maxAccessCodeLength {
+			return fmt.Errorf("access_code can be at most %d characters", maxAccessCodeLength)
+		}
+		a.AccessCode = code
+	}
+	if s.IPAllowlist != nil {
+		if len(*s.IPAllowlist) > maxIPAllowlistSize {
+			return fmt.Errorf("ip_allowlist can have at most %d entries", maxIPAllowlistSize)
+		}
+		allowlist := []string{}
+		for _, entry := range *s.IPAllowlist {
+			cidr, err := normalizeCIDR(entry)
+			if err != nil {
+				return err
+			}
+			if !containsString(allowlist, cidr) {
+				allowlist = append(allowlist, cidr)
+			}
+		}
+		a.IPAllowlist = allowlist
+	}
+	if s.SingleDevice != nil {
+		a.SingleDevice = *s.SingleDevice
+	}
+	return nil
+}
+
+// normalizeCIDR turns an IP address or CIDR range into a CIDR range
+func normalizeCIDR(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if ip := net.ParseIP(entry); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return "", fmt.Errorf("ip_allowlist: %q is not an IP address or CIDR range", entry)
+	}
+	return network.String(), nil
+}
+
+// trustedProxies are the networks of reverse proxies whose
+// X-Forwarded-For header is believed, TRUSTED_PROXIES as comma-separated
+// CIDR ranges
+func trustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if cidr, err := normalizeCIDR(entry); err == nil {
+			_, network, _ := net.ParseCIDR(cidr)
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// clientIP returns the address a request came from. Behind a trusted proxy
+// it is the last address in X-Forwarded-For that isn't a trusted proxy.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	proxies := trustedProxies()
+	trusted := func(ip net.IP) bool {
+		for _, network := range proxies {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if ip == nil || !trusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// newAttemptToken returns a random token identifying the device an
+// attempt is taken on
+func newAttemptToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ipString formats an address, "" for none
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// takeOverAttempt gives an attempt a new token, moving it to the device
+// asking for it. It fails with errAttemptTakenOver when another device got
+// there first.
+func takeOverAttempt(attempt *QuizAttempt, ip net.IP) error {
+	token, err := newAttemptToken()
+	if err != nil {
+		return err
+	}
+	result, err := DB.Exec(`
+		UPDATE quiz_attempts SET device_token = ?, client_ip = ?
+		WHERE id = ? AND status = 'in_progress' AND device_token <=> ?
+	`, token, nullIfEmpty(ipString(ip)), attempt.ID, nullIfEmpty(attempt.DeviceToken))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errAttemptTakenOver
+	}
+	if attempt.DeviceToken != "" {
+		recordIntegrityEvent(attempt, eventDeviceTakeover, time.Now())
+	}
+	attempt.DeviceToken = token
+	return nil
+}
+
+// lastActive is when an attempt was last heard from
+func (a *QuizAttempt) lastActive() time.Time {
+	last := a.StartedAt
+	for _, t := range []*time.Time{a.LastHeartbeatAt, a.AnswersSavedAt} {
+		if t != nil && t.After(last) {
+			last = *t
+		}
+	}
+	return last
+}
+
+// checkAttemptAccess refuses attempt requests from outside the quiz's IP
+// allowlist and, on single device quizzes, from other devices than the one
+// holding the attempt
+func checkAttemptAccess(w http.ResponseWriter, r *http.Request, attempt *QuizAttempt) bool {
+	access, err := loadQuizAccess(attempt.QuizID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if !access.allowsIP(clientIP(r)) {
+		http.Error(w, "This quiz can only be taken from an approved network", http.StatusForbidden)
+		return false
+	}
+	token := r.Header.Get(attemptTokenHeader)
+	if access.SingleDevice && attempt.Status == attemptInProgress &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(attempt.DeviceToken)) != 1 {
+		http.Error(w, "This quiz is open on another device", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// studentQuizLock says why a student can't see a quiz's questions, or ""
+// if they can. An attempt in progress always sees them.
+func studentQuizLock(access *QuizAccess, quizID, studentID int, now time.Time) string {
+	if access.windowError(now) == "" && !access.proctored() {
+		return ""
+	}
+	attempt, err := loadQuizAttempt(quizID, studentID)
+	if err == nil && attempt != nil && attempt.Status == attemptInProgress {
+		return ""
+	}
+	if reason := access.windowError(now); reason != "" {
+		return reason
+	}
+	return "Start the quiz to see its questions"
+}
+
+// setQuizAccess shows a quiz's access settings; the access code and the
+// allowlist only to teachers
+func setQuizAccess(quiz *Quiz, access *QuizAccess, teacher bool) {
+	quiz.OpensAt, quiz.ClosesAt = access.OpensAt, access.ClosesAt
+	quiz.AccessCodeRequired = access.AccessCode != ""
+	quiz.IPRestricted = len(access.IPAllowlist) > 0
+	quiz.SingleDevice = access.SingleDevice
+	if teacher {
+		quiz.AccessCode, quiz.IPAllowlist = access.AccessCode, access.IPAllowlist
+	}
+}
+
+// hideLockedQuiz removes what a student may not see yet from a quiz, its
+// questions or its PDF: outside the window, and outside an attempt on
+// proctored quizzes
+func hideLockedQuiz(quiz *Quiz, access *QuizAccess, studentID int, now time.Time) {
+	quiz.LockedReason = studentQuizLock(access, quiz.ID, studentID, now)
+	if quiz.LockedReason == "" {
+		return
+	}
+	quiz.Questions = []Question{}
+	quiz.PDFFilePath, quiz.PDFFileURL, quiz.PDFPreview = "", "", nil
+}
+
+// canOpenQuizPDF reports whether a student may download a quiz PDF: it
+// belongs to a quiz in one of their courses that isn't locked for them
+func canOpenQuizPDF(studentID int, urlPath string) bool {
+	rows, err := DB.Query(`
+		SELECT q.id FROM quizzes_new q JOIN course_enrollments e ON e.course_id = q.course_id
+		WHERE q.pdf_file_path = ? AND e.student_id = ?
+	`, urlPath, studentID)
+	if err != nil {
+		log.Printf("Error checking quiz PDF access for %s: %v", urlPath, err)
+		return false
+	}
+	var quizIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			quizIDs = append(quizIDs, id)
+		}
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, id := range quizIDs {
+		access, err := loadQuizAccess(id)
+		if err == nil && studentQuizLock(access, id, studentID, now) == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAllowsIP(t *testing.T) {
+	lab := &QuizAccess{IPAllowlist: []string{"10.20.0.0/16", "203.0.113.7/32", "2001:db8:1::/48"}}
+	tests := []struct {
+		name    string
+		access  *QuizAccess
+		ip      string
+		allowed bool
+	}{
+		{"no allowlist", &QuizAccess{}, "198.51.100.1", true},
+		{"no allowlist, unknown address", &QuizAccess{}, "", true},
+		{"inside a range", lab, "10.20.3.4", true},
+		{"outside the ranges", lab, "10.21.0.1", false},
+		{"single address", lab, "203.0.113.7", true},
+		{"next to the single address", lab, "203.0.113.8", false},
+		{"IPv4-mapped IPv6", lab, "::ffff:10.20.3.4", true},
+		{"IPv6 range", lab, "2001:db8:1:2::5", true},
+		{"IPv6 outside", lab, "2001:db8:2::5", false},
+		{"unknown address", lab, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.access.allowsIP(net.ParseIP(tt.ip)); got != tt.allowed {
+				t.Errorf("allowsIP(%q) = %v, want %v", tt.ip, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxies    string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "", "198.51.100.1:5123", "", "198.51.100.1"},
+		{"forwarded header from an untrusted peer is ignored", "", "198.51.100.1:5123", "10.20.3.4", "198.51.100.1"},
+		{"trusted proxy", "127.0.0.1", "127.0.0.1:5123", "198.51.100.9", "198.51.100.9"},
+		{"spoofed first hop is skipped", "127.0.0.1", "127.0.0.1:5123", "10.20.3.4, 198.51.100.9", "198.51.100.9"},
+		{"chain of trusted proxies", "127.0.0.1,172.16.0.0/12", "127.0.0.1:5123", "198.51.100.9, 172.16.0.5", "198.51.100.9"},
+		{"unreadable hop stops the walk", "127.0.0.1", "127.0.0.1:5123", "198.51.100.9, garbage", "127.0.0.1"},
+		{"trusted proxy without a header", "127.0.0.1", "127.0.0.1:5123", "", "127.0.0.1"},
+		{"address without a port", "", "198.51.100.1", "", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.proxies)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(r); !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("clientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAccessCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		quiz  string
+		given string
+		ok    bool
+	}{
+		{"no code needed", "", "", true},
+		{"no code needed, one given", "", "anything", true},
+		{"right code", "KELAS-7B", "KELAS-7B", true},
+		{"surrounding space is ignored", "KELAS-7B", "  KELAS-7B\n", true},
+		{"codes are case sensitive", "KELAS-7B", "kelas-7b", false},
+		{"wrong code", "KELAS-7B", "KELAS-7A", false},
+		{"prefix of the code", "KELAS-7B", "KELAS", false},
+		{"missing code", "KELAS-7B", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := &QuizAccess{AccessCode: tt.quiz}
+			if got := access.checkAccessCode(tt.given); got != tt.ok {
+				t.Errorf("checkAccessCode(%q) = %v, want %v", tt.given, got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestQuizWindow(t *testing.T) {
+	opens := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	closes := opens.Add(2 * time.Hour)
+	access := &QuizAccess{OpensAt: &opens, ClosesAt: &closes, Grace: 5 * time.Minute}
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		open     bool
+		accepted bool
+	}{
+		{"before opening", opens.Add(-time.Second), false, false},
+		{"at opening", opens, true, true},
+		{"during", opens.Add(time.Hour), true, true},
+		{"at closing", closes, false, true},
+		{"inside the grace period", closes.Add(5 * time.Minute), false, true},
+		{"after the grace period", closes.Add(5*time.Minute + time.Second), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if open := access.windowError(tt.at) == ""; open != tt.open {
+				t.Errorf("windowError() open = %v, want %v", open, tt.open)
+			}
+			if got := access.acceptsWork(tt.at); got != tt.accepted {
+				t.Errorf("acceptsWork() = %v, want %v", got, tt.accepted)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A quiz can allow more than one attempt. max_attempts caps how many a
+// student gets (0 means unlimited), the cooldown is how long they have to
+// wait after submitting before trying again, and the scoring policy picks
+// the score that counts in the gradebook: the highest, the latest or the
+// average of their attempts. Every attempt is its own submission, numbered
+// per student, with its own draw and layout.
+
+const (
+	scoringHighest = "highest"
+	scoringLatest  = "latest"
+	scoringAverage = "average"
+
+	defaultMaxAttempts        = 1
+	maxAttemptCooldownMinutes = 30 * 24 * 60
+)
+
+var scoringPolicies = []string{scoringHighest, scoringLatest, scoringAverage}
+
+// createQuizAttemptPolicyColumns adds the attempt settings to quizzes and
+// numbers submissions, attempts and variants per student, replacing the
+// one-per-student unique keys
+func createQuizAttemptPolicyColumns(db *sql.DB) error {
+	columns := []struct{ table, name, definition string }{
+		{"quizzes_new", "max_attempts", "INT NOT NULL DEFAULT " + strconv.Itoa(defaultMaxAttempts) + " COMMENT '0 = unlimited'"},
+		{"quizzes_new", "attempt_cooldown_minutes", "INT NOT NULL DEFAULT 0"},
+		{"quizzes_new", "scoring_policy", "ENUM('highest', 'latest', 'average') NOT NULL DEFAULT 'highest'"},
+		{"quiz_submissions", "attempt_number", "INT NOT NULL DEFAULT 1"},
+		{"quiz_attempts", "attempt_number", "INT NOT NULL DEFAULT 1"},
+		{"quiz_variants", "attempt_number", "INT NOT NULL DEFAULT 1"},
+	}
+	for _, col := range columns {
+		if err := ensureColumn(db, col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// The new keys start with quiz_id, so the foreign key on it can move
+	// over before the old key is dropped
+	keys := []struct{ table, old, name string }{
+		{"quiz_submissions", "unique_submission", "unique_submission_attempt"},
+		{"quiz_attempts", "unique_attempt", "unique_attempt_number"},
+		{"quiz_variants", "unique_variant", "unique_variant_attempt"},
+	}
+	for _, key := range keys {
+		if err := ensureIndex(db, key.table, key.name, "UNIQUE INDEX", "quiz_id, student_id, attempt_number"); err != nil {
+			return err
+		}
+		if err := dropIndex(db, key.table, key.old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAttemptPolicy checks the attempt settings of a quiz. Settings
+// left out of an update are nil.
+func validateAttemptPolicy(maxAttempts, cooldownMinutes *int, policy *string) error {
+	if maxAttempts != nil && *maxAttempts < 0 {
+		return fmt.Errorf("max_attempts must be 0 (unlimited) or more")
+	}
+	if cooldownMinutes != nil && (*cooldownMinutes < 0 || *cooldownMinutes > maxAttemptCooldownMinutes) {
+		return fmt.Errorf("attempt_cooldown_minutes must be between 0 and %d", maxAttemptCooldownMinutes)
+	}
+	if policy != nil && !containsString(scoringPolicies, *policy) {
+		return fmt.Errorf("scoring_policy must be one of highest, latest or average")
+	}
+	return nil
+}
+
+// AttemptAvailability tells a student whether they can take a quiz again
+type AttemptAvailability struct {
+	AttemptsUsed      int        `json:"attempts_used"`
+	MaxAttempts       int        `json:"max_attempts"`                 // 0 = unlimited
+	AttemptsRemaining *int       `json:"attempts_remaining,omitempty"` // nil when unlimited
+	NextAttempt       int        `json:"next_attempt"`
+	AvailableAt       *time.Time `json:"available_at,omitempty"` // When the cooldown ends
+	CanAttempt        bool       `json:"can_attempt"`
+	Reason            string     `json:"reason,omitempty"`
+}
+
+// loadAttemptAvailability works out whether a student may start another
+// attempt at a quiz now
+func loadAttemptAvailability(quizID, studentID int, now time.Time) (*AttemptAvailability, error) {
+	var cooldownMinutes int
+	a := &AttemptAvailability{CanAttempt: true}
+	err := DB.QueryRow("SELECT max_attempts, attempt_cooldown_minutes FROM quizzes_new WHERE id = ?", quizID).Scan(&a.MaxAttempts, &cooldownMinutes)
+	if err == sql.ErrNoRows {
+		return nil, errQuizNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSubmittedAt sql.NullTime
+	err = DB.QueryRow(`
+		SELECT COALESCE(MAX(attempt_number), 0), MAX(submitted_at) FROM quiz_submissions WHERE quiz_id = ? AND student_id = ?
+	`, quizID, studentID).Scan(&a.AttemptsUsed, &lastSubmittedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.NextAttempt = a.AttemptsUsed + 1
+
+	if a.MaxAttempts > 0 {
+		remaining := a.MaxAttempts - a.AttemptsUsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		a.AttemptsRemaining = &remaining
+		if remaining == 0 {
+			a.CanAttempt = false
+			a.Reason = "You have used all of your attempts for this quiz"
+			return a, nil
+		}
+	}
+	if cooldownMinutes > 0 && lastSubmittedAt.Valid {
+		availableAt := lastSubmittedAt.Time.Add(time.Duration(cooldownMinutes) * time.Minute)
+		if now.Before(availableAt) {
+			a.AvailableAt = &availableAt
+			a.CanAttempt = false
+			wait := int(availableAt.Sub(now).Minutes()) + 1
+			a.Reason = fmt.Sprintf("You can try this quiz again in %d minute(s)", wait)
+		}
+	}
+	return a, nil
+}
+
+// currentAttemptNumber is the attempt whose questions a student is shown:
+// the one in progress, otherwise the next one, or the last one once they
+// have used them all
+func currentAttemptNumber(quizID, studentID int) (int, error) {
+	attempt, err := loadQuizAttempt(quizID, studentID)
+	if err != nil {
+		return 0, err
+	}
+	if attempt != nil && attempt.Status == attemptInProgress {
+		return attempt.AttemptNumber, nil
+	}
+	availability, err := loadAttemptAvailability(quizID, studentID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if availability.AttemptsRemaining != nil && *availability.AttemptsRemaining == 0 && availability.AttemptsUsed > 0 {
+		return availability.AttemptsUsed, nil
+	}
+	return availability.NextAttempt, nil
+}
+
+// policyScore is the score that counts for a student under a scoring
+// policy, from their attempts' scores in attempt order. Attempts waiting
+// for the teacher are nil; they don't count towards the highest or the
+// average, and make the latest score pending. nil when nothing counts yet.
+func policyScore(policy string, scores []*float64) *float64 {
+	if len(scores) == 0 {
+		return nil
+	}
+	if policy == scoringLatest {
+		return scores[len(scores)-1]
+	}
+
+	var best, total float64
+	graded := 0
+	for _, score := range scores {
+		if score == nil {
+			continue
+		}
+		if graded == 0 || *score > best {
+			best = *score
+		}
+		total += *score
+		graded++
+	}
+	if graded == 0 {
+		return nil
+	}
+	if policy == scoringAverage {
+		average := total / float64(graded)
+		return &average
+	}
+	return &best
+}
+
+// AttemptResult is one attempt in a student's history of a quiz
+type AttemptResult struct {
+	SubmissionID  int        `json:"submission_id"`
+	AttemptNumber int        `json:"attempt_number"`
+	Status        string     `json:"status,omitempty"` // Attempt status of timed attempts
+	Score         *float64   `json:"score"`
+	TotalPoints   int        `json:"total_points"`
+	Percentage    *float64   `json:"percentage"`
+	SubmittedAt   time.Time  `json:"submitted_at"`
+	GradedAt      *time.Time `json:"graded_at,omitempty"`
+}
+
+// loadAttemptResults returns a student's submissions of a quiz in attempt
+// order
+func loadAttemptResults(quizID, studentID int) ([]AttemptResult, error) {
+	rows, err := DB.Query(`
+		SELECT qs.id, qs.attempt_number, a.status, qs.score, qs.total_points, qs.submitted_at, qs.graded_at
+		FROM quiz_submissions qs
+		LEFT JOIN quiz_attempts a ON a.id = qs.attempt_id
+		WHERE qs.quiz_id = ? AND qs.student_id = ?
+		ORDER BY qs.attempt_number
+	`, quizID, studentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []AttemptResult{}
+	for rows.Next() {
+		var res AttemptResult
+		var status sql.NullString
+		var score sql.NullFloat64
+		var gradedAt sql.NullTime
+		if err := rows.Scan(&res.SubmissionID, &res.AttemptNumber, &status, &score, &res.TotalPoints, &res.SubmittedAt, &gradedAt); err != nil {
+			return nil, err
+		}
+		res.Status = status.String
+		if score.Valid {
+			res.Score = &score.Float64
+			res.Percentage = percentageOf(score.Float64, res.TotalPoints)
+		}
+		if gradedAt.Valid {
+			res.GradedAt = &gradedAt.Time
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// percentageOf returns score as a percentage of totalPoints, or nil for a
+// quiz worth no points
+func percentageOf(score float64, totalPoints int) *float64 {
+	if totalPoints <= 0 {
+		return nil
+	}
+	percentage := score / float64(totalPoints) * 100
+	return &percentage
+}
+
+// getMyQuizAttemptsHandler returns a student's attempts at a quiz, the
+// score that counts under the quiz's scoring policy and whether they can
+// try again
+func getMyQuizAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+
+	var courseID, totalPoints int
+	var policy string
+	err = DB.QueryRow("SELECT course_id, total_points, scoring_policy FROM quizzes_new WHERE id = ?", quizID).Scan(&courseID, &totalPoints, &policy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Quiz not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !isStudentEnrolled(courseID, studentID) {
+		http.Error(w, "Quiz not found or access denied", http.StatusForbidden)
+		return
+	}
+
+	results, err := loadAttemptResults(quizID, studentID)
+	if err != nil {
+		log.Printf("Error fetching attempts of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	availability, err := loadAttemptAvailability(quizID, studentID, time.Now())
+	if err != nil {
+		log.Printf("Error checking attempts of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	scores := make([]*float64, len(results))
+	for i := range results {
+		scores[i] = results[i].Score
+	}
+
+	response := map[string]interface{}{
+		"success":        true,
+		"attempts":       results,
+		"scoring_policy": policy,
+		"final_score":    nil,
+		"percentage":     nil,
+		"total_points":   totalPoints,
+		"availability":   availability,
+	}
+	if final := policyScore(policy, scores); final != nil {
+		response["final_score"] = *final
+		response["percentage"] = percentageOf(*final, totalPoints)
+	}
+	if attempt, err := loadQuizAttempt(quizID, studentID); err == nil && attempt != nil && attempt.Status == attemptInProgress {
+		response["in_progress"] = attempt.withClock(time.Now())
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// GradebookQuiz is a quiz column of the gradebook
+type GradebookQuiz struct {
+	ID            int    `json:"id"`
+	Title         string `json:"title"`
+	TotalPoints   int    `json:"total_points"`
+	ScoringPolicy string `json:"scoring_policy"`
+	MaxAttempts   int    `json:"max_attempts"`
+}
+
+// GradebookEntry is a student's grade for one quiz
+type GradebookEntry struct {
+	QuizID     int      `json:"quiz_id"`
+	Attempts   int      `json:"attempts"`
+	Score      *float64 `json:"score"` // Under the quiz's scoring policy
+	Percentage *float64 `json:"percentage"`
+	Pending    bool     `json:"pending"` // An attempt is waiting for the teacher
+}
+
+// GradebookRow is a student's line in the gradebook
+type GradebookRow struct {
+	StudentID    int              `json:"student_id"`
+	StudentName  string           `json:"student_name"`
+	StudentEmail string           `json:"student_email"`
+	Grades       []GradebookEntry `json:"grades"`
+	TotalScore   float64          `json:"total_score"`
+	TotalPoints  int              `json:"total_points"` // Of the quizzes with a score
+}
+
+// getCourseGradebookHandler returns every enrolled student's quiz grades
+// in a course, each scored by the quiz's scoring policy
+func getCourseGradebookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	courseID, err := strconv.Atoi(mux.Vars(r)["courseId"])
+	if err != nil {
+		http.Error(w, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if !canAccessCourse("teacher", teacherID, courseID) {
+		http.Error(w, "Course not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+
+	quizRows, err := DB.Query(`
+		SELECT id, title, total_points, scoring_policy, max_attempts FROM quizzes_new WHERE course_id = ? ORDER BY id
+	`, courseID)
+	if err != nil {
+		log.Printf("Error fetching quizzes of course %d: %v", courseID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	quizzes := []GradebookQuiz{}
+	quizIndex := make(map[int]int)
+	for quizRows.Next() {
+		var q GradebookQuiz
+		if err := quizRows.Scan(&q.ID, &q.Title, &q.TotalPoints, &q.ScoringPolicy, &q.MaxAttempts); err != nil {
+			log.Printf("Error scanning quiz: %v", err)
+			continue
+		}
+		quizIndex[q.ID] = len(quizzes)
+		quizzes = append(quizzes, q)
+	}
+	quizRows.Close()
+
+	studentRows, err := DB.Query(`
+		SELECT s.id, s.name, s.email FROM course_enrollments e JOIN students s ON s.id = e.student_id
+		WHERE e.course_id = ? ORDER BY s.name
+	`, courseID)
+	if err != nil {
+		log.Printf("Error fetching students of course %d: %v", courseID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	rows := []GradebookRow{}
+	rowIndex := make(map[int]int)
+	for studentRows.Next() {
+		var row GradebookRow
+		if err := studentRows.Scan(&row.StudentID, &row.StudentName, &row.StudentEmail); err != nil {
+			log.Printf("Error scanning student: %v", err)
+			continue
+		}
+		row.Grades = make([]GradebookEntry, len(quizzes))
+		for i, q := range quizzes {
+			row.Grades[i].QuizID = q.ID
+		}
+		rowIndex[row.StudentID] = len(rows)
+		rows = append(rows, row)
+	}
+	studentRows.Close()
+
+	// Scores of every attempt, in attempt order per student and quiz
+	scoreRows, err := DB.Query(`
+		SELECT qs.quiz_id, qs.student_id, qs.score
+		FROM quiz_submissions qs JOIN quizzes_new q ON q.id = qs.quiz_id
+		WHERE q.course_id = ?
+		ORDER BY qs.student_id, qs.quiz_id, qs.attempt_number
+	`, courseID)
+	if err != nil {
+		log.Printf("Error fetching scores of course %d: %v", courseID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	scores := make(map[[2]int][]*float64)
+	for scoreRows.Next() {
+		var quizID, studentID int
+		var score sql.NullFloat64
+		if err := scoreRows.Scan(&quizID, &studentID, &score); err != nil {
+			log.Printf("Error scanning score: %v", err)
+			continue
+		}
+		var s *float64
+		if score.Valid {
+			s = &score.Float64
+		}
+		key := [2]int{studentID, quizID}
+		scores[key] = append(scores[key], s)
+	}
+	scoreRows.Close()
+
+	for key, attemptScores := range scores {
+		r, ok := rowIndex[key[0]]
+		q, found := quizIndex[key[1]]
+		if !ok || !found {
+			continue // No longer enrolled
+		}
+		quiz := quizzes[q]
+		entry := &rows[r].Grades[q]
+		entry.Attempts = len(attemptScores)
+		for _, s := range attemptScores {
+			entry.Pending = entry.Pending || s == nil
+		}
+		entry.Score = policyScore(quiz.ScoringPolicy, attemptScores)
+		if entry.Score != nil {
+			entry.Percentage = percentageOf(*entry.Score, quiz.TotalPoints)
+			rows[r].TotalScore += *entry.Score
+			rows[r].TotalPoints += quiz.TotalPoints
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"quizzes":  quizzes,
+		"students": rows,
+	})
+}
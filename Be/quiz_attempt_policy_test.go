@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestPolicyScore(t *testing.T) {
+	score := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name   string
+		policy string
+		scores []*float64
+		want   *float64
+	}{
+		{"no attempts", scoringHighest, nil, nil},
+		{"highest", scoringHighest, []*float64{score(60), score(85), score(70)}, score(85)},
+		{"highest skips ungraded attempts", scoringHighest, []*float64{nil, score(40)}, score(40)},
+		{"highest with nothing graded", scoringHighest, []*float64{nil, nil}, nil},
+		{"latest", scoringLatest, []*float64{score(90), score(55)}, score(55)},
+		{"latest still being graded", scoringLatest, []*float64{score(90), nil}, nil},
+		{"average", scoringAverage, []*float64{score(60), score(90)}, score(75)},
+		{"average of graded attempts only", scoringAverage, []*float64{score(50), nil, score(70)}, score(60)},
+		{"average with nothing graded", scoringAverage, []*float64{nil}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policyScore(tt.policy, tt.scores)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("policyScore() = %v, want %v", scoreValue(got), scoreValue(tt.want))
+			}
+		})
+	}
+}
+
+func scoreValue(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A student takes an interactive quiz in an attempt: starting it records
+// the start time on the server and fixes the deadline from the quiz's time
+// limit and due date. The client saves answers as the student goes, per
+// question or with its heartbeats, and they are restored when the quiz is
+// reopened and merged into the submission. Submissions are accepted until the
+// quiz's grace window after the deadline has passed, to allow for slow
+// connections; after that the sweeper submits the last saved answers.
+
+const (
+	attemptInProgress    = "in_progress"
+	attemptSubmitted     = "submitted"
+	attemptAutoSubmitted = "auto_submitted"
+
+	// defaultGracePeriodSeconds is used for quizzes that don't set one
+	defaultGracePeriodSeconds = 30
+	maxGracePeriodSeconds     = 3600
+)
+
+// QuizAttempt is a student's run through a quiz
+type QuizAttempt struct {
+	ID                 int                    `json:"id"`
+	QuizID             int                    `json:"quiz_id"`
+	QuizType           string                 `json:"quiz_type"`
+	StudentID          int                    `json:"student_id"`
+	AttemptNumber      int                    `json:"attempt_number"`
+	Status             string                 `json:"status"`
+	StartedAt          time.Time              `json:"started_at"`
+	Deadline           *time.Time             `json:"deadline,omitempty"` // nil for quizzes without time limit or due date
+	GracePeriodSeconds int                    `json:"grace_period_seconds"`
+	LastHeartbeatAt    *time.Time             `json:"last_heartbeat_at,omitempty"`
+	AnswersSavedAt     *time.Time             `json:"answers_saved_at,omitempty"`
+	SubmittedAt        *time.Time             `json:"submitted_at,omitempty"`
+	SubmissionID       *int                   `json:"submission_id,omitempty"`
+	SavedAnswers       map[string]interface{} `json:"saved_answers,omitempty"`
+	ServerTime         time.Time              `json:"server_time"`
+	RemainingSeconds   *int                   `json:"remaining_seconds,omitempty"` // until the deadline, without grace
+	DeviceToken        string                 `json:"-"`                           // Only given to the device holding the attempt
+}
+
+// createQuizAttemptsTable creates the attempts table and the grace window
+// setting on quizzes
+func createQuizAttemptsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quiz_attempts (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			quiz_id INT NOT NULL,
+			student_id INT NOT NULL,
+			attempt_number INT NOT NULL DEFAULT 1,
+			status ENUM('in_progress', 'submitted', 'auto_submitted') NOT NULL DEFAULT 'in_progress',
+			started_at DATETIME NOT NULL,
+			deadline DATETIME NULL,
+			last_heartbeat_at DATETIME NULL,
+			saved_answers JSON NULL,
+			answers_saved_at DATETIME NULL,
+			submitted_at DATETIME NULL,
+			submission_id INT NULL,
+			UNIQUE KEY unique_attempt_number (quiz_id, student_id, attempt_number),
+			INDEX idx_attempts_deadline (status, deadline),
+			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE,
+			FOREIGN KEY (student_id) REFERENCES students(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci
+	`)
+	if err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "quizzes_new", "grace_period_seconds", "INT NOT NULL DEFAULT "+strconv.Itoa(defaultGracePeriodSeconds)); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "quiz_attempts", "answers_saved_at", "DATETIME NULL"); err != nil {
+		return err
+	}
+	return ensureColumn(db, "quiz_submissions", "attempt_id", "INT NULL")
+}
+
+const attemptSelectColumns = `
+	a.id, a.quiz_id, q.quiz_type, a.student_id, a.attempt_number, a.status, a.started_at, a.deadline, q.grace_period_seconds,
+	a.last_heartbeat_at, a.saved_answers, a.answers_saved_at, a.submitted_at, a.submission_id, a.device_token`
+
+func scanQuizAttempt(row rowScanner) (*QuizAttempt, error) {
+	var a QuizAttempt
+	var deadline, heartbeat, savedAt, submittedAt sql.NullTime
+	var savedAnswers, deviceToken sql.NullString
+	var submissionID sql.NullInt64
+	err := row.Scan(&a.ID, &a.QuizID, &a.QuizType, &a.StudentID, &a.AttemptNumber, &a.Status, &a.StartedAt, &deadline, &a.GracePeriodSeconds,
+		&heartbeat, &savedAnswers, &savedAt, &submittedAt, &submissionID, &deviceToken)
+	if err != nil {
+		return nil, err
+	}
+	a.DeviceToken = deviceToken.String
+	if deadline.Valid {
+		a.Deadline = &deadline.Time
+	}
+	if heartbeat.Valid {
+		a.LastHeartbeatAt = &heartbeat.Time
+	}
+	if savedAt.Valid {
+		a.AnswersSavedAt = &savedAt.Time
+	}
+	if submittedAt.Valid {
+		a.SubmittedAt = &submittedAt.Time
+	}
+	if submissionID.Valid {
+		id := int(submissionID.Int64)
+		a.SubmissionID = &id
+	}
+	if savedAnswers.Valid && savedAnswers.String != "" {
+		json.Unmarshal([]byte(savedAnswers.String), &a.SavedAnswers)
+	}
+	return &a, nil
+}
+
+// loadQuizAttempt returns a student's latest attempt at a quiz, or nil if
+// they have not started it
+func loadQuizAttempt(quizID, studentID int) (*QuizAttempt, error) {
+	a, err := scanQuizAttempt(DB.QueryRow(`
+		SELECT `+attemptSelectColumns+`
+		FROM quiz_attempts a JOIN quizzes_new q ON q.id = a.quiz_id
+		WHERE a.quiz_id = ? AND a.student_id = ?
+		ORDER BY a.attempt_number DESC LIMIT 1
+	`, quizID, studentID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// pastGrace reports whether submissions are no longer accepted
+func (a *QuizAttempt) pastGrace(now time.Time) bool {
+	if a.Deadline == nil {
+		return false
+	}
+	return now.After(a.Deadline.Add(time.Duration(a.GracePeriodSeconds) * time.Second))
+}
+
+// withClock fills in the server time and the time left
+func (a *QuizAttempt) withClock(now time.Time) *QuizAttempt {
+	a.ServerTime = now
+	a.RemainingSeconds = nil
+	if a.Deadline != nil && a.Status == attemptInProgress {
+		remaining := int(a.Deadline.Sub(now) / time.Second)
+		if remaining < 0 {
+			remaining = 0
+		}
+		a.RemainingSeconds = &remaining
+	}
+	return a
+}
+
+// attemptDeadline is when an attempt started at startedAt has to be
+// submitted: after the time limit, but never later than the due date
+func attemptDeadline(startedAt time.Time, timeLimit sql.NullInt32, dueDate sql.NullTime) *time.Time {
+	var deadline *time.Time
+	if timeLimit.Valid && timeLimit.Int32 > 0 {
+		d := startedAt.Add(time.Duration(timeLimit.Int32) * time.Minute)
+		deadline = &d
+	}
+	if dueDate.Valid && (deadline == nil || dueDate.Time.Before(*deadline)) {
+		d := dueDate.Time
+		deadline = &d
+	}
+	return deadline
+}
+
+// finalizeQuizAttempt submits the saved answers of an attempt whose time
+// is up. They count as handed in at the deadline. An attempt at a PDF quiz
+// has no answers to submit; it is closed with an empty submission.
+func finalizeQuizAttempt(a *QuizAttempt) error {
+	handedInAt := time.Now()
+	if a.Deadline != nil && a.Deadline.Before(handedInAt) {
+		handedInAt = *a.Deadline
+	}
+	if a.QuizType != "interactive" {
+		return closePDFQuizAttempt(a, handedInAt)
+	}
+	result, err := saveQuizSubmission(a.QuizID, a.StudentID, a.SavedAnswers, submissionAttempt{
+		Number: a.AttemptNumber, ID: a.ID, Status: attemptAutoSubmitted, HandedInAt: handedInAt,
+	})
+	if err == errQuizAlreadySubmitted {
+		// Submitted without the attempt, e.g. by an older client
+		DB.Exec("UPDATE quiz_attempts SET status = 'submitted' WHERE id = ? AND status = 'in_progress'", a.ID)
+		a.Status = attemptSubmitted
+	}
+	if err != nil {
+		return err
+	}
+	a.Status = attemptAutoSubmitted
+	id := int(result.SubmissionID)
+	a.SubmissionID = &id
+	log.Printf("Auto-submitted attempt %d of quiz %d for student %d", a.ID, a.QuizID, a.StudentID)
+	return nil
+}
+
+// closePDFQuizAttempt auto-submits an attempt at a PDF quiz without an
+// uploaded answer, leaving it to the teacher to grade
+func closePDFQuizAttempt(a *QuizAttempt, handedInAt time.Time) error {
+	deadline, err := loadQuizDeadline(a.QuizID, a.StudentID)
+	if err != nil {
+		return err
+	}
+	late := deadline.lateness(handedInAt)
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO quiz_submissions (quiz_id, student_id, attempt_number, submission_type, attempt_id, total_points,
+		                              submitted_at, is_late, late_seconds, late_penalty_percent)
+		SELECT id, ?, ?, 'pdf_upload', ?, total_points, ?, ?, ?, ? FROM quizzes_new WHERE id = ?
+	`, a.StudentID, a.AttemptNumber, a.ID, handedInAt, late.Late, late.Seconds, late.PenaltyPercent, a.QuizID)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return errQuizAlreadySubmitted
+		}
+		return fmt.Errorf("failed to insert submission: %v", err)
+	}
+	submissionID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	closed, err := tx.Exec(`
+		UPDATE quiz_attempts SET status = ?, submission_id = ?, submitted_at = ?
+		WHERE id = ? AND status = 'in_progress'
+	`, attemptAutoSubmitted, submissionID, handedInAt, a.ID)
+	if err != nil {
+		return fmt.Errorf("failed to close attempt: %v", err)
+	}
+	if affected, _ := closed.RowsAffected(); affected == 0 {
+		return errQuizAlreadySubmitted
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	a.Status = attemptAutoSubmitted
+	id := int(submissionID)
+	a.SubmissionID = &id
+	log.Printf("Auto-submitted attempt %d of PDF quiz %d for student %d without an answer", a.ID, a.QuizID, a.StudentID)
+	return nil
+}
+
+// startQuizAttemptHandler starts a student's next attempt at a quiz, or
+// returns the attempt already in progress. The response carries the
+// attempt token the client sends in the X-Attempt-Token header; on single
+// device quizzes a resume from another device takes the attempt over once
+// the old device has gone quiet.
+func startQuizAttemptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		AccessCode string `json:"access_code"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var courseID int
+	var quizType string
+	var isActive bool
+	var timeLimit sql.NullInt32
+	err = DB.QueryRow(`
+		SELECT course_id, quiz_type, is_active, time_limit FROM quizzes_new WHERE id = ?
+	`, quizID).Scan(&courseID, &quizType, &isActive, &timeLimit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Quiz not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !isStudentEnrolled(courseID, studentID) {
+		http.Error(w, "Quiz not found or access denied", http.StatusForbidden)
+		return
+	}
+	access, err := loadQuizAccess(quizID)
+	if err != nil {
+		log.Printf("Error fetching access settings of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// A PDF quiz is only taken in an attempt when its PDF is proctored
+	if quizType != "interactive" && !access.proctored() {
+		http.Error(w, "Only interactive and proctored quizzes are taken in attempts", http.StatusBadRequest)
+		return
+	}
+	ip := clientIP(r)
+	if !access.allowsIP(ip) {
+		http.Error(w, "This quiz can only be taken from an approved network", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	attempt, err := loadQuizAttempt(quizID, studentID)
+	if err != nil {
+		log.Printf("Error fetching quiz attempt: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if attempt != nil && attempt.Status == attemptInProgress {
+		if attempt.pastGrace(now) {
+			if err := finalizeQuizAttempt(attempt); err != nil && err != errQuizAlreadySubmitted {
+				log.Printf("Error auto-submitting attempt %d: %v", attempt.ID, err)
+			}
+			http.Error(w, "Time is up for this quiz. Your saved answers have been submitted.", http.StatusBadRequest)
+			return
+		}
+		if attempt.DeviceToken == "" || (access.SingleDevice && r.Header.Get(attemptTokenHeader) != attempt.DeviceToken) {
+			if attempt.DeviceToken != "" && now.Sub(attempt.lastActive()) < deviceTakeoverAfter {
+				http.Error(w, "This quiz is open on another device", http.StatusConflict)
+				return
+			}
+			if err := takeOverAttempt(attempt, ip); err == errAttemptTakenOver {
+				http.Error(w, "This quiz is open on another device", http.StatusConflict)
+				return
+			} else if err != nil {
+				log.Printf("Error moving attempt %d to another device: %v", attempt.ID, err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"attempt":       attempt.withClock(now),
+			"attempt_token": attempt.DeviceToken,
+			"resumed":       true,
+		})
+		return
+	}
+
+	if !isActive {
+		http.Error(w, "This quiz is not open", http.StatusForbidden)
+		return
+	}
+	if reason := access.windowError(now); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+	if !access.checkAccessCode(req.AccessCode) {
+		http.Error(w, "A valid access code is required to start this quiz", http.StatusForbidden)
+		return
+	}
+	availability, err := loadAttemptAvailability(quizID, studentID, now)
+	if err != nil {
+		log.Printf("Error checking attempts of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !availability.CanAttempt {
+		http.Error(w, availability.Reason, http.StatusBadRequest)
+		return
+	}
+	deadline, err := loadQuizDeadline(quizID, studentID)
+	if err != nil {
+		log.Printf("Error fetching due date of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if deadline.closed(now) {
+		http.Error(w, "The due date for this quiz has passed", http.StatusForbidden)
+		return
+	}
+
+	token, err := newAttemptToken()
+	if err != nil {
+		log.Printf("Error generating attempt token: %v", err)
+		http.Error(w, "Failed to start quiz", http.StatusInternalServerError)
+		return
+	}
+
+	// A concurrent start for the same student inserts nothing and the
+	// attempt it created is returned
+	if _, err := DB.Exec(`
+		INSERT IGNORE INTO quiz_attempts (quiz_id, student_id, attempt_number, status, started_at, deadline, device_token, client_ip)
+		VALUES (?, ?, ?, 'in_progress', ?, ?, ?, ?)
+	`, quizID, studentID, availability.NextAttempt, now, attemptDeadline(now, timeLimit, deadline.attemptDueDate()),
+		token, nullIfEmpty(ipString(ip))); err != nil {
+		log.Printf("Error starting quiz attempt: %v", err)
+		http.Error(w, "Failed to start quiz", http.StatusInternalServerError)
+		return
+	}
+	attempt, err = loadQuizAttempt(quizID, studentID)
+	if err != nil || attempt == nil {
+		log.Printf("Error fetching started quiz attempt: %v", err)
+		http.Error(w, "Failed to start quiz", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"attempt":       attempt.withClock(now),
+		"attempt_token": attempt.DeviceToken,
+	})
+}
+
+// attemptFromRequest returns the student's attempt named in the URL
+func attemptFromRequest(w http.ResponseWriter, r *http.Request) (*QuizAttempt, bool) {
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	attemptID, err := strconv.Atoi(mux.Vars(r)["attemptId"])
+	if err != nil {
+		http.Error(w, "Invalid attempt ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	attempt, err := scanQuizAttempt(DB.QueryRow(`
+		SELECT `+attemptSelectColumns+`
+		FROM quiz_attempts a JOIN quizzes_new q ON q.id = a.quiz_id
+		WHERE a.id = ? AND a.student_id = ?
+	`, attemptID, studentID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Attempt not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error fetching quiz attempt %d: %v", attemptID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	if !checkAttemptAccess(w, r, attempt) {
+		return nil, false
+	}
+	return attempt, true
+}
+
+// quizAttemptHeartbeatHandler keeps an attempt alive and saves any answers
+// sent with it; a null answer clears a saved one. Once time is up the saved
+// answers are submitted and the attempt is returned as auto_submitted.
+func quizAttemptHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	attempt, ok := attemptFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Answers map[string]interface{} `json:"answers"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	if attempt.Status == attemptInProgress && attempt.pastGrace(now) {
+		if err := finalizeQuizAttempt(attempt); err != nil && err != errQuizAlreadySubmitted {
+			log.Printf("Error auto-submitting attempt %d: %v", attempt.ID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if attempt.Status != attemptInProgress {
+		attempt, ok = attemptFromRequest(w, r)
+		if !ok {
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"attempt": attempt.withClock(now),
+		})
+		return
+	}
+
+	if _, err := DB.Exec(`
+		UPDATE quiz_attempts SET last_heartbeat_at = ? WHERE id = ? AND status = 'in_progress'
+	`, now, attempt.ID); err != nil {
+		log.Printf("Error recording heartbeat of attempt %d: %v", attempt.ID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	attempt.LastHeartbeatAt = &now
+	if len(req.Answers) > 0 {
+		if err := saveAttemptAnswers(attempt, req.Answers, now); err != nil {
+			log.Printf("Error saving answers of attempt %d: %v", attempt.ID, err)
+			http.Error(w, "Failed to save answers", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"attempt": attempt.withClock(now),
+	})
+}
+
+// submitQuizAttemptHandler submits an attempt: its saved answers, updated
+// with any answers in the body.
+func submitQuizAttemptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	attempt, ok := attemptFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if attempt.Status != attemptInProgress {
+		http.Error(w, "You have already submitted this quiz", http.StatusBadRequest)
+		return
+	}
+	if attempt.QuizType != "interactive" {
+		http.Error(w, "Upload your answer file to submit this quiz", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Answers map[string]interface{} `json:"answers"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+	}
+	writeQuizSubmission(w, attempt.QuizID, attempt.StudentID, req.Answers, attempt)
+}
+
+// startQuizAttemptSweeper periodically submits attempts whose time and
+// grace window have run out
+func startQuizAttemptSweeper(interval time.Duration) {
+	go func() {
+		for {
+			sweepQuizAttempts()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func sweepQuizAttempts() {
+	rows, err := DB.Query(`
+		SELECT `+attemptSelectColumns+`
+		FROM quiz_attempts a JOIN quizzes_new q ON q.id = a.quiz_id
+		WHERE a.status = 'in_progress' AND a.deadline IS NOT NULL
+		  AND TIMESTAMPADD(SECOND, q.grace_period_seconds, a.deadline) < ?
+	`, time.Now())
+	if err != nil {
+		log.Printf("Warning: Failed to find expired quiz attempts: %v", err)
+		return
+	}
+	var expired []*QuizAttempt
+	for rows.Next() {
+		a, err := scanQuizAttempt(rows)
+		if err != nil {
+			log.Printf("Warning: Failed to scan quiz attempt: %v", err)
+			continue
+		}
+		expired = append(expired, a)
+	}
+	rows.Close()
+
+	for _, a := range expired {
+		if err := finalizeQuizAttempt(a); err != nil && err != errQuizAlreadySubmitted {
+			log.Printf("Warning: Failed to auto-submit attempt %d: %v", a.ID, err)
+		}
+	}
+}
+
+// maxSavedAnswerBytes caps a single autosaved answer
+const maxSavedAnswerBytes = 64 << 10
+
+// mergeAnswers returns the saved answers updated with the given ones. A
+// null answer clears a saved one.
+func mergeAnswers(saved, given map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(saved)+len(given))
+	for id, answer := range saved {
+		merged[id] = answer
+	}
+	for id, answer := range given {
+		if answer == nil {
+			delete(merged, id)
+		} else {
+			merged[id] = answer
+		}
+	}
+	return merged
+}
+
+// saveAttemptAnswers merges answers, keyed by question ID, into an
+// attempt's saved answers. Answers to questions the student was not given
+// are ignored.
+func saveAttemptAnswers(attempt *QuizAttempt, answers map[string]interface{}, now time.Time) error {
+	questions, _, err := loadStudentQuestions(attempt.QuizID, attempt.StudentID, attempt.AttemptNumber)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool, len(questions))
+	for _, q := range questions {
+		given[strconv.Itoa(q.ID)] = true
+	}
+	patch := make(map[string]interface{}, len(answers))
+	for id, answer := range answers {
+		if given[id] {
+			patch[id] = answer
+		}
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+
+	// JSON_MERGE_PATCH drops keys set to null, which clears those answers
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if _, err := DB.Exec(`
+		UPDATE quiz_attempts
+		SET saved_answers = JSON_MERGE_PATCH(COALESCE(saved_answers, JSON_OBJECT()), CAST(? AS JSON)), answers_saved_at = ?
+		WHERE id = ? AND status = 'in_progress'
+	`, string(encoded), now, attempt.ID); err != nil {
+		return err
+	}
+	attempt.SavedAnswers = mergeAnswers(attempt.SavedAnswers, patch)
+	attempt.AnswersSavedAt = &now
+	return nil
+}
+
+// saveAttemptAnswerHandler autosaves the answer to one question of an
+// attempt in progress. {"answer": null} clears it.
+func saveAttemptAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	attempt, ok := attemptFromRequest(w, r)
+	if !ok {
+		return
+	}
+	questionID, err := strconv.Atoi(mux.Vars(r)["questionId"])
+	if err != nil {
+		http.Error(w, "Invalid question ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Answer json.RawMessage `json:"answer"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSavedAnswerBytes+1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if len(req.Answer) > maxSavedAnswerBytes {
+		http.Error(w, "Answer is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var answer interface{}
+	if len(req.Answer) > 0 {
+		if err := json.Unmarshal(req.Answer, &answer); err != nil {
+			http.Error(w, "Invalid answer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	if attempt.Status == attemptInProgress && attempt.pastGrace(now) {
+		if err := finalizeQuizAttempt(attempt); err != nil && err != errQuizAlreadySubmitted {
+			log.Printf("Error auto-submitting attempt %d: %v", attempt.ID, err)
+		}
+		http.Error(w, "Time is up for this quiz. Your saved answers have been submitted.", http.StatusForbidden)
+		return
+	}
+	if attempt.Status != attemptInProgress {
+		http.Error(w, "You have already submitted this quiz", http.StatusBadRequest)
+		return
+	}
+
+	questions, _, err := loadStudentQuestions(attempt.QuizID, attempt.StudentID, attempt.AttemptNumber)
+	if err != nil {
+		log.Printf("Error fetching questions of quiz %d: %v", attempt.QuizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, q := range questions {
+		if q.ID == questionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Question not found in this quiz", http.StatusNotFound)
+		return
+	}
+
+	if err := saveAttemptAnswers(attempt, map[string]interface{}{strconv.Itoa(questionID): answer}, now); err != nil {
+		log.Printf("Error saving answer of attempt %d: %v", attempt.ID, err)
+		http.Error(w, "Failed to save answer", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"question_id": questionID,
+		"attempt":     attempt.withClock(now),
+	})
+}
+
+// getQuizAttemptHandler returns the student's attempt at a quiz with its
+// saved answers, so a reopened quiz can be restored
+func getQuizAttemptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+
+	attempt, err := loadQuizAttempt(quizID, studentID)
+	if err != nil {
+		log.Printf("Error fetching quiz attempt: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if attempt == nil {
+		http.Error(w, "You have not started this quiz", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	if attempt.Status == attemptInProgress && attempt.pastGrace(now) {
+		if err := finalizeQuizAttempt(attempt); err != nil && err != errQuizAlreadySubmitted {
+			log.Printf("Error auto-submitting attempt %d: %v", attempt.ID, err)
+		}
+		if reloaded, err := loadQuizAttempt(quizID, studentID); err == nil && reloaded != nil {
+			attempt = reloaded
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"attempt": attempt.withClock(now),
+	})
+}
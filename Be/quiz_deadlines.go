@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A teacher can move a quiz's due date for one student with an extension.
+// What happens to work handed in after the due date depends on the quiz's
+// late policy: "reject" refuses it and cuts timed attempts off at the due
+// date, "allow" accepts it flagged late, minus late_penalty_per_day percent
+// of the score for every started day, up to late_penalty_max_percent.
+// Nothing counts as late within the quiz's grace window.
+
+const (
+	latePolicyReject = "reject"
+	latePolicyAllow  = "allow"
+)
+
+var latePolicies = []string{latePolicyReject, latePolicyAllow}
+
+var errQuizPastDue = errors.New("quiz is past its due date")
+
+// createQuizDeadlineTables adds the late policy to quizzes, lateness to
+// submissions and the extensions table
+func createQuizDeadlineTables(db *sql.DB) error {
+	columns := []struct{ table, name, definition string }{
+		{"quizzes_new", "late_policy", "ENUM('reject', 'allow') NOT NULL DEFAULT 'reject'"},
+		{"quizzes_new", "late_penalty_per_day", "DECIMAL(5,2) NOT NULL DEFAULT 0 COMMENT 'Percent of the score'"},
+		{"quizzes_new", "late_penalty_max_percent", "DECIMAL(5,2) NOT NULL DEFAULT 100"},
+		{"quiz_submissions", "is_late", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"quiz_submissions", "late_seconds", "INT NOT NULL DEFAULT 0"},
+		{"quiz_submissions", "late_penalty_percent", "DECIMAL(5,2) NOT NULL DEFAULT 0"},
+	}
+	for _, col := range columns {
+		if err := ensureColumn(db, col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quiz_extensions (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			quiz_id INT NOT NULL,
+			student_id INT NOT NULL,
+			due_date DATETIME NOT NULL,
+			reason TEXT NULL,
+			granted_by INT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_extension (quiz_id, student_id),
+			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE,
+			FOREIGN KEY (student_id) REFERENCES students(id) ON DELETE CASCADE,
+			FOREIGN KEY (granted_by) REFERENCES teachers(id) ON DELETE SET NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci
+	`)
+	return err
+}
+
+// validateLatePolicy checks the late settings of a quiz. Settings left out
+// of an update are nil.
+func validateLatePolicy(policy *string, penaltyPerDay, maxPenalty *float64) error {
+	if policy != nil && !containsString(latePolicies, *policy) {
+		return fmt.Errorf("late_policy must be reject or allow")
+	}
+	if penaltyPerDay != nil && (*penaltyPerDay < 0 || *penaltyPerDay > 100) {
+		return fmt.Errorf("late_penalty_per_day must be between 0 and 100")
+	}
+	if maxPenalty != nil && (*maxPenalty < 0 || *maxPenalty > 100) {
+		return fmt.Errorf("late_penalty_max_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// QuizDeadline is when a student's work on a quiz is due and how late work
+// is treated
+type QuizDeadline struct {
+	DueDate       *time.Time // nil when the quiz has no due date
+	Extended      bool       // DueDate comes from an extension
+	ClosesAt      *time.Time // End of the quiz's availability window
+	Policy        string
+	PenaltyPerDay float64
+	MaxPenalty    float64
+	Grace         time.Duration
+}
+
+// loadQuizDeadline returns a student's deadline for a quiz, taking their
+// extension into account
+func loadQuizDeadline(quizID, studentID int) (*QuizDeadline, error) {
+	var d QuizDeadline
+	var dueDate, extendedDueDate, closesAt sql.NullTime
+	var graceSeconds int
+	err := DB.QueryRow(`
+		SELECT q.due_date, e.due_date, q.late_policy, q.late_penalty_per_day, q.late_penalty_max_percent, q.grace_period_seconds,
+		       q.closes_at
+		FROM quizzes_new q
+		LEFT JOIN quiz_extensions e ON e.quiz_id = q.id AND e.student_id = ?
+		WHERE q.id = ?
+	`, studentID, quizID).Scan(&dueDate, &extendedDueDate, &d.Policy, &d.PenaltyPerDay, &d.MaxPenalty, &graceSeconds, &closesAt)
+	if err == sql.ErrNoRows {
+		return nil, errQuizNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.Grace = time.Duration(graceSeconds) * time.Second
+	if extendedDueDate.Valid {
+		d.DueDate, d.Extended = &extendedDueDate.Time, true
+	} else if dueDate.Valid {
+		d.DueDate = &dueDate.Time
+	}
+	if closesAt.Valid {
+		d.ClosesAt = &closesAt.Time
+	}
+	return &d, nil
+}
+
+// Lateness is how late work handed in at some time is
+type Lateness struct {
+	Late           bool
+	Seconds        int     // Past the due date
+	PenaltyPercent float64 // Taken off the score
+	Rejected       bool    // The late policy refuses it
+}
+
+// lateness works out how late work handed in at the given time is
+func (d *QuizDeadline) lateness(at time.Time) Lateness {
+	if d.DueDate == nil || !at.After(d.DueDate.Add(d.Grace)) {
+		return Lateness{}
+	}
+	late := at.Sub(*d.DueDate)
+	l := Lateness{Late: true, Seconds: int(late / time.Second)}
+	if d.Policy == latePolicyReject {
+		l.Rejected = true
+		return l
+	}
+	days := math.Ceil(late.Hours() / 24)
+	l.PenaltyPercent = math.Min(d.MaxPenalty, d.PenaltyPerDay*days)
+	return l
+}
+
+// closed reports whether new attempts can no longer be started
+func (d *QuizDeadline) closed(now time.Time) bool {
+	return d.Policy == latePolicyReject && d.DueDate != nil && !now.Before(*d.DueDate)
+}
+
+// attemptDueDate is the time attempts are cut off at: the due date, unless
+// late work is allowed, or the end of the availability window if earlier
+func (d *QuizDeadline) attemptDueDate() sql.NullTime {
+	cutoff := d.ClosesAt
+	if d.Policy == latePolicyReject && d.DueDate != nil && (cutoff == nil || d.DueDate.Before(*cutoff)) {
+		cutoff = d.DueDate
+	}
+	if cutoff == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *cutoff, Valid: true}
+}
+
+// applyLatePenalty takes a late penalty off a score
+func applyLatePenalty(score, penaltyPercent float64) float64 {
+	if penaltyPercent <= 0 {
+		return score
+	}
+	return math.Round(score*(100-penaltyPercent)) / 100
+}
+
+// refreshAttemptDeadline recomputes the deadline of a student's attempt in
+// progress after their due date changed
+func refreshAttemptDeadline(quizID, studentID int) error {
+	attempt, err := loadQuizAttempt(quizID, studentID)
+	if err != nil || attempt == nil || attempt.Status != attemptInProgress {
+		return err
+	}
+	deadline, err := loadQuizDeadline(quizID, studentID)
+	if err != nil {
+		return err
+	}
+	var timeLimit sql.NullInt32
+	if err := DB.QueryRow("SELECT time_limit FROM quizzes_new WHERE id = ?", quizID).Scan(&timeLimit); err != nil {
+		return err
+	}
+	_, err = DB.Exec("UPDATE quiz_attempts SET deadline = ? WHERE id = ? AND status = 'in_progress'",
+		attemptDeadline(attempt.StartedAt, timeLimit, deadline.attemptDueDate()), attempt.ID)
+	return err
+}
+
+// refreshQuizAttemptDeadlines recomputes the deadlines of every attempt in
+// progress on a quiz after its due date or time limit changed
+func refreshQuizAttemptDeadlines(quizID int) error {
+	rows, err := DB.Query("SELECT student_id FROM quiz_attempts WHERE quiz_id = ? AND status = 'in_progress'", quizID)
+	if err != nil {
+		return err
+	}
+	var studentIDs []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			studentIDs = append(studentIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, studentID := range studentIDs {
+		if err := refreshAttemptDeadline(quizID, studentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuizExtension is a due date moved for one student
+type QuizExtension struct {
+	ID           int       `json:"id"`
+	QuizID       int       `json:"quiz_id"`
+	StudentID    int       `json:"student_id"`
+	StudentName  string    `json:"student_name"`
+	StudentEmail string    `json:"student_email"`
+	DueDate      time.Time `json:"due_date"`
+	Reason       string    `json:"reason,omitempty"`
+	GrantedBy    *int      `json:"granted_by,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// quizExtensionFromRequest returns the quiz and student named in the URL
+// after checking the teacher owns the quiz
+func quizExtensionFromRequest(w http.ResponseWriter, r *http.Request) (teacherID, quizID int, ok bool) {
+	teacherID, ok = r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if !teacherOwnsQuiz(quizID, teacherID) {
+		http.Error(w, "Quiz not found or you don't have permission", http.StatusNotFound)
+		return 0, 0, false
+	}
+	return teacherID, quizID, true
+}
+
+// getQuizExtensionsHandler lists the extensions granted on a quiz
+func getQuizExtensionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, quizID, ok := quizExtensionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT e.id, e.quiz_id, e.student_id, s.name, s.email, e.due_date, e.reason, e.granted_by, e.updated_at
+		FROM quiz_extensions e JOIN students s ON s.id = e.student_id
+		WHERE e.quiz_id = ?
+		ORDER BY s.name
+	`, quizID)
+	if err != nil {
+		log.Printf("Error fetching extensions of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	extensions := []QuizExtension{}
+	for rows.Next() {
+		var e QuizExtension
+		var reason sql.NullString
+		var grantedBy sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.QuizID, &e.StudentID, &e.StudentName, &e.StudentEmail, &e.DueDate, &reason, &grantedBy, &e.UpdatedAt); err != nil {
+			log.Printf("Error scanning extension: %v", err)
+			continue
+		}
+		e.Reason = reason.String
+		if grantedBy.Valid {
+			id := int(grantedBy.Int64)
+			e.GrantedBy = &id
+		}
+		extensions = append(extensions, e)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"extensions": extensions,
+	})
+}
+
+// grantQuizExtensionHandler gives a student their own due date for a quiz,
+// replacing any earlier extension. The date has to fall before the quiz
+// closes.
+func grantQuizExtensionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, quizID, ok := quizExtensionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	studentID, err := strconv.Atoi(mux.Vars(r)["studentId"])
+	if err != nil {
+		http.Error(w, "Invalid student ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		DueDate string `json:"due_date"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	dueDate := getTimePtr(req.DueDate)
+	if dueDate == nil {
+		http.Error(w, "due_date is required", http.StatusBadRequest)
+		return
+	}
+
+	var courseID int
+	var closesAt sql.NullTime
+	if err := DB.QueryRow("SELECT course_id, closes_at FROM quizzes_new WHERE id = ?", quizID).Scan(&courseID, &closesAt); err != nil {
+		log.Printf("Error fetching quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !isStudentEnrolled(courseID, studentID) {
+		http.Error(w, "Student is not enrolled in this course", http.StatusBadRequest)
+		return
+	}
+	// Work is never accepted after the availability window closes, so an
+	// extension can't go past it
+	if closesAt.Valid && dueDate.After(closesAt.Time) {
+		http.Error(w, "due_date can't be after the quiz closes at "+closesAt.Time.Format("2006-01-02 15:04"), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := DB.Exec(`
+		INSERT INTO quiz_extensions (quiz_id, student_id, due_date, reason, granted_by)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE due_date = VALUES(due_date), reason = VALUES(reason), granted_by = VALUES(granted_by)
+	`, quizID, studentID, *dueDate, nullIfEmpty(req.Reason), teacherID); err != nil {
+		log.Printf("Error granting extension on quiz %d: %v", quizID, err)
+		http.Error(w, "Failed to grant extension", http.StatusInternalServerError)
+		return
+	}
+	if err := refreshAttemptDeadline(quizID, studentID); err != nil {
+		log.Printf("Warning: Failed to move attempt deadline of student %d on quiz %d: %v", studentID, quizID, err)
+	}
+	log.Printf("Teacher %d extended quiz %d for student %d to %s", teacherID, quizID, studentID, dueDate.Format(time.RFC3339))
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"message":    "Extension granted",
+		"student_id": studentID,
+		"due_date":   *dueDate,
+	})
+}
+
+// revokeQuizExtensionHandler puts a student back on the quiz's due date
+func revokeQuizExtensionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, quizID, ok := quizExtensionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	studentID, err := strconv.Atoi(mux.Vars(r)["studentId"])
+	if err != nil {
+		http.Error(w, "Invalid student ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := DB.Exec("DELETE FROM quiz_extensions WHERE quiz_id = ? AND student_id = ?", quizID, studentID)
+	if err != nil {
+		log.Printf("Error revoking extension on quiz %d: %v", quizID, err)
+		http.Error(w, "Failed to revoke extension", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Extension not found", http.StatusNotFound)
+		return
+	}
+	if err := refreshAttemptDeadline(quizID, studentID); err != nil {
+		log.Printf("Warning: Failed to move attempt deadline of student %d on quiz %d: %v", studentID, quizID, err)
+	}
+	log.Printf("Teacher %d revoked the extension of student %d on quiz %d", teacherID, studentID, quizID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Extension revoked",
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLateness(t *testing.T) {
+	due := time.Date(2026, 3, 2, 23, 59, 0, 0, time.UTC)
+	allow := QuizDeadline{DueDate: &due, Policy: latePolicyAllow, PenaltyPerDay: 10, MaxPenalty: 30, Grace: 5 * time.Minute}
+
+	tests := []struct {
+		name     string
+		deadline QuizDeadline
+		at       time.Time
+		want     Lateness
+	}{
+		{
+			name:     "no due date",
+			deadline: QuizDeadline{Policy: latePolicyAllow, PenaltyPerDay: 10, MaxPenalty: 30},
+			at:       due.Add(72 * time.Hour),
+			want:     Lateness{},
+		},
+		{
+			name:     "on time",
+			deadline: allow,
+			at:       due.Add(-time.Hour),
+			want:     Lateness{},
+		},
+		{
+			name:     "within the grace period",
+			deadline: allow,
+			at:       due.Add(5 * time.Minute),
+			want:     Lateness{},
+		},
+		{
+			name:     "past the grace period counts from the due date",
+			deadline: allow,
+			at:       due.Add(6 * time.Minute),
+			want:     Lateness{Late: true, Seconds: 360, PenaltyPercent: 10},
+		},
+		{
+			name:     "a started day counts in full",
+			deadline: allow,
+			at:       due.Add(25 * time.Hour),
+			want:     Lateness{Late: true, Seconds: 25 * 3600, PenaltyPercent: 20},
+		},
+		{
+			name:     "penalty is capped",
+			deadline: allow,
+			at:       due.Add(10 * 24 * time.Hour),
+			want:     Lateness{Late: true, Seconds: 10 * 24 * 3600, PenaltyPercent: 30},
+		},
+		{
+			name:     "rejected",
+			deadline: QuizDeadline{DueDate: &due, Policy: latePolicyReject, PenaltyPerDay: 10, MaxPenalty: 30},
+			at:       due.Add(time.Minute),
+			want:     Lateness{Late: true, Seconds: 60, Rejected: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.deadline.lateness(tt.at); got != tt.want {
+				t.Errorf("lateness() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyLatePenalty(t *testing.T) {
+	tests := []struct {
+		name    string
+		score   float64
+		penalty float64
+		want    float64
+	}{
+		{"no penalty", 87.5, 0, 87.5},
+		{"negative penalty is ignored", 87.5, -10, 87.5},
+		{"penalty", 80, 25, 60},
+		{"rounded to two decimals", 77.77, 10, 69.99},
+		{"full penalty", 80, 100, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyLatePenalty(tt.score, tt.penalty); got != tt.want {
+				t.Errorf("applyLatePenalty(%v, %v) = %v, want %v", tt.score, tt.penalty, got, tt.want)
+			}
+		})
+	}
+}
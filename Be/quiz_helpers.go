@@ -1,6 +1,10 @@
 package main
 
-import "strconv"
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
 
 func getString(v interface{}) string {
 	if s, ok := v.(string); ok {
@@ -20,6 +24,16 @@ func getInt(v interface{}) int {
 	}
 	return 0
 }
+func getBool(v interface{}) bool {
+	switch val := v.(type) {
+	case bool:
+		return val
+	case string:
+		b, _ := strconv.ParseBool(val)
+		return b
+	}
+	return false
+}
 func getIntPtr(v interface{}) *int {
 	i := getInt(v)
 	if i == 0 {
@@ -27,6 +41,42 @@ func getIntPtr(v interface{}) *int {
 	}
 	return &i
 }
+
+// dateLayouts are the date formats accepted for due dates
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// getTimePtr parses a date in any of dateLayouts, or returns nil
+func getTimePtr(v interface{}) *time.Time {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// decodeInto re-decodes a loosely parsed JSON value into a typed value,
+// leaving dst untouched when v is missing or has the wrong shape
+func decodeInto(v interface{}, dst interface{}) bool {
+	if v == nil {
+		return false
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(encoded, dst) == nil
+}
 func parseQuestions(v interface{}) []CreateQuestionRequest {
 	arr, ok := v.([]interface{})
 	if !ok {
@@ -38,7 +88,7 @@ func parseQuestions(v interface{}) []CreateQuestionRequest {
 		if !ok {
 			continue
 		}
-		res = append(res, CreateQuestionRequest{
+		req := CreateQuestionRequest{
 			QuestionType:   getString(qm["question_type"]),
 			Points:         getInt(qm["points"]),
 			QuestionText:   getString(qm["question"]),
@@ -48,7 +98,18 @@ func parseQuestions(v interface{}) []CreateQuestionRequest {
 			OptionD:        getString(qm["option_d"]),
 			CorrectAnswer:  getString(qm["correct_answer"]),
 			EssayAnswerKey: getString(qm["essay_answer_key"]),
-		})
+		}
+		var options QuestionOptions
+		if decodeInto(qm["options"], &options) {
+			req.Options = &options
+		}
+		var key AnswerKey
+		if decodeInto(qm["answer_key"], &key) {
+			req.AnswerKey = &key
+		}
+		req.RubricID = getIntPtr(qm["rubric_id"])
+		req.FullCredit = getBool(qm["full_credit"])
+		res = append(res, req)
 	}
 	return res
 }
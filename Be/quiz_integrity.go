@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// During an attempt the client reports integrity events, such as the tab
+// being hidden, the window losing focus or text being copied and pasted.
+// They are stored with the time the server received them and the time the
+// client saw them. Teachers get a summary of each submission's events and
+// flags from heuristics, e.g. a quiz finished in a fraction of its time
+// limit, next to the submissions, and can read the full log of an attempt.
+// The events are signals for a teacher to look into, not proof.
+
+const (
+	eventTabHidden      = "tab_hidden"
+	eventTabVisible     = "tab_visible"
+	eventWindowBlur     = "window_blur"
+	eventWindowFocus    = "window_focus"
+	eventCopy           = "copy"
+	eventCut            = "cut"
+	eventPaste          = "paste"
+	eventContextMenu    = "context_menu"
+	eventFullscreenExit = "fullscreen_exit"
+	// Recorded by the server when another device takes an attempt over
+	eventDeviceTakeover = "device_takeover"
+
+	maxIntegrityEventsPerRequest = 100
+	maxIntegrityEventsPerAttempt = 2000
+
+	// Heuristic thresholds
+	fastCompletionFraction    = 0.1 // of the time limit
+	minSecondsPerQuestion     = 3
+	frequentTabSwitches       = 5
+	longAbsenceSeconds        = 60
+	highIntegrityFlagsAtLeast = 2
+)
+
+// clientIntegrityEvents are the events a client may report
+var clientIntegrityEvents = []string{
+	eventTabHidden, eventTabVisible, eventWindowBlur, eventWindowFocus,
+	eventCopy, eventCut, eventPaste, eventContextMenu, eventFullscreenExit,
+}
+
+// createQuizIntegrityTable creates the integrity event log
+func createQuizIntegrityTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quiz_integrity_events (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			attempt_id INT NOT NULL,
+			quiz_id INT NOT NULL,
+			student_id INT NOT NULL,
+			event_type VARCHAR(32) NOT NULL,
+			question_id INT NULL,
+			duration_ms INT NULL COMMENT 'How long the tab was hidden or the window unfocused',
+			client_time DATETIME(3) NULL,
+			recorded_at DATETIME(3) NOT NULL,
+			INDEX idx_integrity_attempt (attempt_id, recorded_at),
+			INDEX idx_integrity_quiz (quiz_id, attempt_id),
+			FOREIGN KEY (attempt_id) REFERENCES quiz_attempts(id) ON DELETE CASCADE,
+			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE,
+			FOREIGN KEY (student_id) REFERENCES students(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci
+	`)
+	return err
+}
+
+// IntegrityEvent is one entry in an attempt's integrity log
+type IntegrityEvent struct {
+	ID         int64      `json:"id"`
+	EventType  string     `json:"event_type"`
+	QuestionID *int       `json:"question_id,omitempty"`
+	DurationMs *int       `json:"duration_ms,omitempty"`
+	ClientTime *time.Time `json:"client_time,omitempty"`
+	RecordedAt time.Time  `json:"recorded_at"`
+}
+
+// recordIntegrityEvent logs an event the server observed itself
+func recordIntegrityEvent(attempt *QuizAttempt, eventType string, now time.Time) {
+	if _, err := DB.Exec(`
+		INSERT INTO quiz_integrity_events (attempt_id, quiz_id, student_id, event_type, recorded_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, attempt.ID, attempt.QuizID, attempt.StudentID, eventType, now); err != nil {
+		log.Printf("Warning: Failed to record %s event of attempt %d: %v", eventType, attempt.ID, err)
+	}
+}
+
+// postIntegrityEventsHandler stores a batch of events the client saw during
+// an attempt in progress
+func postIntegrityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	attempt, ok := attemptFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if attempt.Status != attemptInProgress {
+		http.Error(w, "This attempt is over", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Events []struct {
+			EventType  string `json:"event_type"`
+			QuestionID *int   `json:"question_id"`
+			DurationMs *int   `json:"duration_ms"`
+			ClientTime string `json:"client_time"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		http.Error(w, "No events given", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) > maxIntegrityEventsPerRequest {
+		http.Error(w, "At most "+strconv.Itoa(maxIntegrityEventsPerRequest)+" events can be sent at once", http.StatusBadRequest)
+		return
+	}
+	for _, e := range req.Events {
+		if !containsString(clientIntegrityEvents, e.EventType) {
+			http.Error(w, "Unknown event type: "+e.EventType, http.StatusBadRequest)
+			return
+		}
+		if e.DurationMs != nil && *e.DurationMs < 0 {
+			http.Error(w, "duration_ms cannot be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// No absence lasts longer than the attempt has been going
+	now := time.Now()
+	elapsedMs := int(now.Sub(attempt.StartedAt) / time.Millisecond)
+	for i := range req.Events {
+		if d := req.Events[i].DurationMs; d != nil && *d > elapsedMs {
+			capped := elapsedMs
+			req.Events[i].DurationMs = &capped
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the attempt serializes concurrent batches, so the count below
+	// holds until they are inserted
+	var attemptID int
+	err = tx.QueryRow("SELECT id FROM quiz_attempts WHERE id = ? AND status = 'in_progress' FOR UPDATE", attempt.ID).Scan(&attemptID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This attempt is over", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error locking attempt %d: %v", attempt.ID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// A client can't flood the log; once an attempt has too many events
+	// later ones are dropped
+	var logged int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM quiz_integrity_events WHERE attempt_id = ?", attempt.ID).Scan(&logged); err != nil {
+		log.Printf("Error counting integrity events of attempt %d: %v", attempt.ID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	room := maxIntegrityEventsPerAttempt - logged
+	if room < 0 {
+		room = 0
+	}
+	if len(req.Events) > room {
+		req.Events = req.Events[:room]
+	}
+
+	for _, e := range req.Events {
+		if _, err := tx.Exec(`
+			INSERT INTO quiz_integrity_events (attempt_id, quiz_id, student_id, event_type, question_id, duration_ms, client_time, recorded_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, attempt.ID, attempt.QuizID, attempt.StudentID, e.EventType, e.QuestionID, e.DurationMs, getTimePtr(e.ClientTime), now); err != nil {
+			log.Printf("Error recording integrity event of attempt %d: %v", attempt.ID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing integrity events: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"recorded": len(req.Events),
+	})
+}
+
+// getIntegrityEventsHandler returns the full integrity log of an attempt
+// to the teacher of the quiz
+func getIntegrityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	attemptID, err := strconv.Atoi(mux.Vars(r)["attemptId"])
+	if err != nil {
+		http.Error(w, "Invalid attempt ID", http.StatusBadRequest)
+		return
+	}
+
+	var quizID int
+	err = DB.QueryRow("SELECT quiz_id FROM quiz_attempts WHERE id = ?", attemptID).Scan(&quizID)
+	if err != nil || !teacherOwnsQuiz(quizID, teacherID) {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error fetching quiz attempt %d: %v", attemptID, err)
+		}
+		http.Error(w, "Attempt not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT id, event_type, question_id, duration_ms, client_time, recorded_at
+		FROM quiz_integrity_events
+		WHERE attempt_id = ?
+		ORDER BY recorded_at, id
+	`, attemptID)
+	if err != nil {
+		log.Printf("Error fetching integrity events of attempt %d: %v", attemptID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []IntegrityEvent{}
+	for rows.Next() {
+		var e IntegrityEvent
+		var questionID, durationMs sql.NullInt64
+		var clientTime sql.NullTime
+		if err := rows.Scan(&e.ID, &e.EventType, &questionID, &durationMs, &clientTime, &e.RecordedAt); err != nil {
+			log.Printf("Error scanning integrity event: %v", err)
+			continue
+		}
+		if questionID.Valid {
+			id := int(questionID.Int64)
+			e.QuestionID = &id
+		}
+		if durationMs.Valid {
+			ms := int(durationMs.Int64)
+			e.DurationMs = &ms
+		}
+		if clientTime.Valid {
+			e.ClientTime = &clientTime.Time
+		}
+		events = append(events, e)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"attempt_id": attemptID,
+		"events":     events,
+	})
+}
+
+// IntegritySummary sums up an attempt's integrity events with the flags
+// the heuristics raised
+type IntegritySummary struct {
+	Events          map[string]int `json:"events"` // Count per event type
+	TabSwitches     int            `json:"tab_switches"`
+	FocusLosses     int            `json:"focus_losses"`
+	CopyPaste       int            `json:"copy_paste"`
+	AwaySeconds     int            `json:"away_seconds"` // Tab hidden or window unfocused
+	DeviceChanges   int            `json:"device_changes"`
+	DurationSeconds *int           `json:"duration_seconds,omitempty"` // From start to submission
+	Flags           []string       `json:"flags"`
+	Level           string         `json:"level"` // none, low or high
+}
+
+// integrityEventStats are the event counts and away time of one attempt
+type integrityEventStats struct {
+	counts map[string]int
+	awayMs int64
+}
+
+// loadIntegrityStats returns the event counts of every attempt at a quiz,
+// by attempt ID
+func loadIntegrityStats(quizID int) (map[int]*integrityEventStats, error) {
+	rows, err := DB.Query(`
+		SELECT attempt_id, event_type, COUNT(*), COALESCE(SUM(duration_ms), 0)
+		FROM quiz_integrity_events
+		WHERE quiz_id = ?
+		GROUP BY attempt_id, event_type
+	`, quizID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[int]*integrityEventStats)
+	for rows.Next() {
+		var attemptID, count int
+		var eventType string
+		var durationMs int64
+		if err := rows.Scan(&attemptID, &eventType, &count, &durationMs); err != nil {
+			return nil, err
+		}
+		s := stats[attemptID]
+		if s == nil {
+			s = &integrityEventStats{counts: make(map[string]int)}
+			stats[attemptID] = s
+		}
+		s.counts[eventType] = count
+		// The duration comes with the event that ends the absence
+		if eventType == eventTabVisible || eventType == eventWindowFocus {
+			s.awayMs += durationMs
+		}
+	}
+	return stats, rows.Err()
+}
+
+// summarizeIntegrity applies the heuristics to an attempt. stats is nil
+// when no events were logged; duration is nil for submissions made
+// without an attempt.
+func summarizeIntegrity(stats *integrityEventStats, duration *time.Duration, timeLimit sql.NullInt32, questionCount int) *IntegritySummary {
+	s := &IntegritySummary{Events: map[string]int{}, Flags: []string{}}
+	if stats != nil {
+		s.Events = stats.counts
+		s.TabSwitches = stats.counts[eventTabHidden]
+		s.FocusLosses = stats.counts[eventWindowBlur]
+		s.CopyPaste = stats.counts[eventCopy] + stats.counts[eventCut] + stats.counts[eventPaste]
+		s.AwaySeconds = int(stats.awayMs / 1000)
+		s.DeviceChanges = stats.counts[eventDeviceTakeover]
+	}
+
+	if duration != nil {
+		seconds := int(*duration / time.Second)
+		s.DurationSeconds = &seconds
+		if timeLimit.Valid && timeLimit.Int32 > 0 &&
+			duration.Minutes() < float64(timeLimit.Int32)*fastCompletionFraction {
+			s.Flags = append(s.Flags, "fast_completion")
+		}
+		if questionCount > 0 && seconds < questionCount*minSecondsPerQuestion {
+			s.Flags = append(s.Flags, "fast_answers")
+		}
+	}
+	if s.TabSwitches+s.FocusLosses >= frequentTabSwitches {
+		s.Flags = append(s.Flags, "frequent_tab_switching")
+	}
+	if s.AwaySeconds >= longAbsenceSeconds {
+		s.Flags = append(s.Flags, "long_absence")
+	}
+	if stats != nil && stats.counts[eventPaste] > 0 {
+		s.Flags = append(s.Flags, "pasted_text")
+	}
+	if s.DeviceChanges > 0 {
+		s.Flags = append(s.Flags, "device_change")
+	}
+
+	switch {
+	case len(s.Flags) == 0:
+		s.Level = "none"
+	case len(s.Flags) >= highIntegrityFlagsAtLeast:
+		s.Level = "high"
+	default:
+		s.Level = "low"
+	}
+	return s
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// When a teacher edits how a question is graded after students have
+// submitted (its answer key, points or type, or awards full credit for a
+// broken question), the stored answers are graded again and the scores of
+// graded submissions are recomputed, keeping their late penalty. Answers
+// graded by hand, like essays, keep the points the teacher gave. Every
+// regrade is logged with the questions before and after and the score
+// changes, and can be previewed without saving. Points a teacher changed by
+// hand, when grading or accepting a regrade request, are marked as a manual
+// override and kept too; the regrade lists them so the teacher can review
+// them.
+
+// QuestionGrading is what decides how a question is auto-graded
+type QuestionGrading struct {
+	QuestionType string     `json:"question_type"`
+	Points       int        `json:"points"`
+	AnswerKey    *AnswerKey `json:"answer_key,omitempty"`
+	FullCredit   bool       `json:"full_credit"`
+}
+
+// RegradedQuestion is a question whose grading was changed
+type RegradedQuestion struct {
+	QuestionID int             `json:"question_id"`
+	Before     QuestionGrading `json:"before"`
+	After      QuestionGrading `json:"after"`
+}
+
+// AnswerChange is the new points of one answer
+type AnswerChange struct {
+	QuestionID int      `json:"question_id"`
+	OldPoints  *float64 `json:"old_points"`
+	NewPoints  float64  `json:"new_points"`
+}
+
+// OverriddenAnswer is an answer a regrade left alone because a teacher set
+// its points by hand
+type OverriddenAnswer struct {
+	SubmissionID int      `json:"submission_id"`
+	StudentID    int      `json:"student_id"`
+	QuestionID   int      `json:"question_id"`
+	Points       *float64 `json:"points_awarded"`
+}
+
+// ScoreChange is how a regrade changed one submission. The scores are nil
+// while the submission still waits for manual grading.
+type ScoreChange struct {
+	SubmissionID  int            `json:"submission_id"`
+	StudentID     int            `json:"student_id"`
+	StudentName   string         `json:"student_name"`
+	AttemptNumber int            `json:"attempt_number"`
+	OldScore      *float64       `json:"old_score"`
+	NewScore      *float64       `json:"new_score"`
+	Answers       []AnswerChange `json:"answers"`
+}
+
+// QuizRegrade is a logged regrade
+type QuizRegrade struct {
+	ID          int                `json:"id"`
+	QuizID      int                `json:"quiz_id"`
+	TeacherID   *int               `json:"teacher_id"`
+	TeacherName string             `json:"teacher_name,omitempty"`
+	Questions   []RegradedQuestion `json:"questions"`
+	Changes     []ScoreChange      `json:"changes"`
+	CreatedAt   time.Time          `json:"created_at"`
+}
+
+// createQuizRegradeTables adds the full credit and manual override flags
+// and the regrade log
+func createQuizRegradeTables(db *sql.DB) error {
+	err := ensureColumn(db, "quiz_questions_new", "full_credit", "BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'Every student gets the points'")
+	if err != nil {
+		return err
+	}
+	err = ensureColumn(db, "quiz_answers", "manual_override", "BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'Points set by a teacher, kept by regrades'")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS quiz_regrades (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			quiz_id INT NOT NULL,
+			teacher_id INT NULL,
+			questions JSON NOT NULL COMMENT 'RegradedQuestion list',
+			changes JSON NOT NULL COMMENT 'ScoreChange list',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_quiz_regrades_quiz (quiz_id, created_at),
+			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE,
+			FOREIGN KEY (teacher_id) REFERENCES teachers(id) ON DELETE SET NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci
+	`)
+	return err
+}
+
+func (q *Question) grading() QuestionGrading {
+	return QuestionGrading{QuestionType: q.QuestionType, Points: q.Points, AnswerKey: q.AnswerKey, FullCredit: q.FullCredit}
+}
+
+// changedGrading returns the updated questions whose grading differs from
+// before. New questions are left out, nobody has answered them yet.
+func changedGrading(before, after []Question) []RegradedQuestion {
+	old := make(map[int]*Question, len(before))
+	for i := range before {
+		old[before[i].ID] = &before[i]
+	}
+	changed := []RegradedQuestion{}
+	for i := range after {
+		q := &after[i]
+		prev, ok := old[q.ID]
+		if !ok {
+			continue
+		}
+		delete(old, q.ID) // Only the first copy of an ID updates the question
+		// Compared as JSON so a missing and an empty list are the same
+		was, _ := json.Marshal(prev.grading())
+		is, _ := json.Marshal(q.grading())
+		if string(was) != string(is) {
+			changed = append(changed, RegradedQuestion{QuestionID: q.ID, Before: prev.grading(), After: q.grading()})
+		}
+	}
+	return changed
+}
+
+// regradeQuestions grades the stored answers to the questions again and
+// recomputes the scores of the submissions that changed. Answers with a
+// manual override are not regraded and are returned instead.
+func regradeQuestions(tx *sql.Tx, quizID int, questions []Question) ([]ScoreChange, []OverriddenAnswer, error) {
+	changes := make(map[int]*ScoreChange)
+	var order []int
+	overridden := []OverriddenAnswer{}
+
+	for i := range questions {
+		q := &questions[i]
+		type stored struct {
+			submissionID int
+			studentID    int
+			questionIDs  sql.NullString
+			answer       sql.NullString
+			points       sql.NullFloat64
+			override     sql.NullBool
+		}
+		rows, err := tx.Query(`
+			SELECT qs.id, qs.student_id, qs.question_ids, qa.answer, qa.points_awarded, qa.manual_override
+			FROM quiz_submissions qs
+			LEFT JOIN quiz_answers qa ON qa.submission_id = qs.id AND qa.question_id = ?
+			WHERE qs.quiz_id = ? AND qs.submission_type = 'interactive'
+		`, q.ID, quizID)
+		if err != nil {
+			return nil, nil, err
+		}
+		var answers []stored
+		for rows.Next() {
+			var a stored
+			if err := rows.Scan(&a.submissionID, &a.studentID, &a.questionIDs, &a.answer, &a.points, &a.override); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			answers = append(answers, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		for _, a := range answers {
+			if a.questionIDs.Valid {
+				var given []int
+				json.Unmarshal([]byte(a.questionIDs.String), &given)
+				if !containsInt(given, q.ID) {
+					continue // Added after this submission
+				}
+			}
+			if !a.answer.Valid && !q.FullCredit {
+				continue // Not answered
+			}
+			if a.override.Bool {
+				kept := OverriddenAnswer{SubmissionID: a.submissionID, StudentID: a.studentID, QuestionID: q.ID}
+				if a.points.Valid {
+					kept.Points = &a.points.Float64
+				}
+				overridden = append(overridden, kept)
+				continue
+			}
+
+			// quiz_answers holds the original option IDs, whatever order
+			// the student saw them in
+			fraction, auto := gradeAnswer(q, decodeAnswer(q.QuestionType, a.answer.String))
+			if !auto {
+				continue
+			}
+			points := awardedPoints(q.Points, fraction)
+			if a.points.Valid && a.points.Float64 == points {
+				continue
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO quiz_answers (submission_id, question_id, answer, is_correct, points_awarded)
+				VALUES (?, ?, ?, ?, ?)
+				ON DUPLICATE KEY UPDATE is_correct = VALUES(is_correct), points_awarded = VALUES(points_awarded)
+			`, a.submissionID, q.ID, a.answer.String, fraction >= 1, points); err != nil {
+				return nil, nil, err
+			}
+
+			change, ok := changes[a.submissionID]
+			if !ok {
+				change = &ScoreChange{SubmissionID: a.submissionID}
+				changes[a.submissionID] = change
+				order = append(order, a.submissionID)
+			}
+			var oldPoints *float64
+			if a.points.Valid {
+				oldPoints = &a.points.Float64
+			}
+			change.Answers = append(change.Answers, AnswerChange{QuestionID: q.ID, OldPoints: oldPoints, NewPoints: points})
+		}
+	}
+
+	// Graded submissions get a new score; the others are scored when the
+	// teacher grades them
+	result := make([]ScoreChange, 0, len(order))
+	for _, id := range order {
+		change := changes[id]
+		err := tx.QueryRow(`
+			SELECT qs.student_id, s.name, qs.attempt_number
+			FROM quiz_submissions qs
+			JOIN students s ON s.id = qs.student_id
+			WHERE qs.id = ?
+		`, id).Scan(&change.StudentID, &change.StudentName, &change.AttemptNumber)
+		if err == nil {
+			change.OldScore, change.NewScore, err = rescoreSubmission(tx, id)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, *change)
+	}
+	return result, overridden, nil
+}
+
+// rescoreSubmission sums the points of a graded submission again, less its
+// late penalty. Submissions still waiting for manual grading are left
+// alone and give nil scores.
+func rescoreSubmission(tx *sql.Tx, submissionID int) (oldScore, newScore *float64, err error) {
+	var score sql.NullFloat64
+	var total, latePenalty float64
+	err = tx.QueryRow(`
+		SELECT qs.score, qs.late_penalty_percent,
+		       (SELECT COALESCE(SUM(qa.points_awarded), 0) FROM quiz_answers qa WHERE qa.submission_id = qs.id)
+		FROM quiz_submissions qs
+		WHERE qs.id = ?
+	`, submissionID).Scan(&score, &latePenalty, &total)
+	if err != nil || !score.Valid {
+		return nil, nil, err
+	}
+	rescored := applyLatePenalty(total, latePenalty)
+	if _, err := tx.Exec("UPDATE quiz_submissions SET score = ? WHERE id = ?", rescored, submissionID); err != nil {
+		return nil, nil, err
+	}
+	return &score.Float64, &rescored, nil
+}
+
+// logQuizRegrade records who regraded which questions and what it changed
+func logQuizRegrade(tx *sql.Tx, quizID, teacherID int, questions []RegradedQuestion, changes []ScoreChange) error {
+	encodedQuestions, _ := json.Marshal(questions)
+	encodedChanges, _ := json.Marshal(changes)
+	_, err := tx.Exec(`
+		INSERT INTO quiz_regrades (quiz_id, teacher_id, questions, changes) VALUES (?, ?, ?, ?)
+	`, quizID, teacherID, string(encodedQuestions), string(encodedChanges))
+	return err
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// getQuizRegradesHandler lists the regrades of a quiz, newest first
+func getQuizRegradesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	quizID, err := strconv.Atoi(mux.Vars(r)["quizId"])
+	if err != nil {
+		http.Error(w, "Invalid quiz ID", http.StatusBadRequest)
+		return
+	}
+	if !teacherOwnsQuiz(quizID, teacherID) {
+		http.Error(w, "Quiz not found or you don't have permission", http.StatusNotFound)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT r.id, r.quiz_id, r.teacher_id, t.name, r.questions, r.changes, r.created_at
+		FROM quiz_regrades r
+		LEFT JOIN teachers t ON t.id = r.teacher_id
+		WHERE r.quiz_id = ?
+		ORDER BY r.created_at DESC, r.id DESC
+	`, quizID)
+	if err != nil {
+		log.Printf("Error fetching regrades of quiz %d: %v", quizID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	regrades := []QuizRegrade{}
+	for rows.Next() {
+		var rg QuizRegrade
+		var regradedBy sql.NullInt64
+		var teacherName sql.NullString
+		var questions, changes string
+		if err := rows.Scan(&rg.ID, &rg.QuizID, &regradedBy, &teacherName, &questions, &changes, &rg.CreatedAt); err != nil {
+			log.Printf("Error scanning regrade: %v", err)
+			continue
+		}
+		if regradedBy.Valid {
+			id := int(regradedBy.Int64)
+			rg.TeacherID = &id
+		}
+		rg.TeacherName = teacherName.String
+		json.Unmarshal([]byte(questions), &rg.Questions)
+		json.Unmarshal([]byte(changes), &rg.Changes)
+		regrades = append(regrades, rg)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"regrades": regrades,
+	})
+}
@@ -32,7 +32,7 @@ func CreateQuizTables(db *sql.DB) error {
 		CREATE TABLE IF NOT EXISTS quiz_questions_new (
 			id INT(11) NOT NULL AUTO_INCREMENT,
 			quiz_id INT(11) NOT NULL,
-			question_type ENUM('multiple_choice', 'essay') DEFAULT 'multiple_choice',
+			question_type ENUM('multiple_choice', 'multiple_select', 'true_false', 'short_answer', 'numeric', 'matching', 'ordering', 'fill_blank', 'essay') DEFAULT 'multiple_choice',
 			points INT(11) DEFAULT 10,
 			question TEXT NOT NULL,
 			option_a VARCHAR(255) NULL,
@@ -41,6 +41,8 @@ func CreateQuizTables(db *sql.DB) error {
 			option_d VARCHAR(255) NULL,
 			correct_answer ENUM('A','B','C','D') NULL,
 			essay_answer_key TEXT NULL,
+			options JSON NULL COMMENT 'Choices and matching sides',
+			answer_key JSON NULL COMMENT 'Answer key for auto-grading',
 			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			PRIMARY KEY (id),
 			FOREIGN KEY (quiz_id) REFERENCES quizzes_new(id) ON DELETE CASCADE
@@ -99,6 +101,10 @@ func CreateQuizTables(db *sql.DB) error {
 		return err
 	}
 	log.Println("✅ Quiz questions table created/updated successfully!")
+	if err := createQuestionTypeColumns(db); err != nil {
+		log.Printf("Error migrating quiz_questions_new: %v", err)
+		return err
+	}
 
 	if _, err := db.Exec(submissionsTableQuery); err != nil {
 		log.Printf("Error creating quiz_submissions table: %v", err)
@@ -112,5 +118,46 @@ func CreateQuizTables(db *sql.DB) error {
 	}
 	log.Println("✅ Quiz answers table created successfully!")
 
+	if err := createQuestionBankTables(db); err != nil {
+		log.Printf("Error creating question bank tables: %v", err)
+		return err
+	}
+	if err := createQuizShuffleColumns(db); err != nil {
+		log.Printf("Error adding quiz shuffle columns: %v", err)
+		return err
+	}
+	if err := createQuizAttemptsTable(db); err != nil {
+		log.Printf("Error creating quiz_attempts table: %v", err)
+		return err
+	}
+	if err := createQuizAttemptPolicyColumns(db); err != nil {
+		log.Printf("Error adding quiz attempt policy columns: %v", err)
+		return err
+	}
+	if err := createQuizDeadlineTables(db); err != nil {
+		log.Printf("Error creating quiz deadline tables: %v", err)
+		return err
+	}
+	if err := createQuizAccessColumns(db); err != nil {
+		log.Printf("Error adding quiz access columns: %v", err)
+		return err
+	}
+	if err := createQuizIntegrityTable(db); err != nil {
+		log.Printf("Error creating quiz integrity table: %v", err)
+		return err
+	}
+	if err := createRubricTables(db); err != nil {
+		log.Printf("Error creating rubric tables: %v", err)
+		return err
+	}
+	if err := createQuizRegradeTables(db); err != nil {
+		log.Printf("Error creating quiz regrade tables: %v", err)
+		return err
+	}
+	if err := createRegradeRequestsTable(db); err != nil {
+		log.Printf("Error creating quiz regrade requests table: %v", err)
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+)
+
+// Each student can get their own version of a quiz: questions drawn from
+// the question bank (see question_bank.go) and, when the quiz asks for it,
+// shuffled question and option order. Both are decided once per attempt,
+// from a seed stored in quiz_variants, and the layout is copied onto the
+// submission.
+//
+// Shuffled options are relabelled A, B, C, ... in the order shown, so "the
+// answer is B" means something different for each student. Answers are
+// mapped back to the original option IDs before grading and stored that
+// way in quiz_answers; result views map them to the student's labels again.
+
+// OptionOrder is the order a student was shown a question's options in, as
+// original option IDs
+type OptionOrder struct {
+	Choices []string `json:"choices,omitempty"`
+	Right   []string `json:"right,omitempty"` // matching answers; prompts keep their order
+}
+
+// QuizLayout is the order a student was shown a quiz in
+type QuizLayout struct {
+	QuestionOrder []int                `json:"question_order,omitempty"`
+	OptionOrders  map[int]*OptionOrder `json:"option_orders,omitempty"`
+}
+
+// QuizVariant is what one student was given in an attempt at a quiz
+type QuizVariant struct {
+	Seed     int64
+	DrawnIDs []int
+	Layout   *QuizLayout
+}
+
+// createQuizShuffleColumns adds the shuffle settings to quizzes and the
+// recorded layouts to variants and submissions
+func createQuizShuffleColumns(db *sql.DB) error {
+	columns := []struct{ table, name, definition string }{
+		{"quizzes_new", "shuffle_questions", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"quizzes_new", "shuffle_options", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"quiz_variants", "question_order", "JSON NULL"},
+		{"quiz_variants", "option_orders", "JSON NULL"},
+		{"quiz_submissions", "option_orders", "JSON NULL"},
+	}
+	for _, col := range columns {
+		if err := ensureColumn(db, col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadQuizVariant returns a student's variant of a quiz for an attempt, or
+// nil if they have none yet
+func loadQuizVariant(quizID, studentID, attemptNumber int) (*QuizVariant, error) {
+	var v QuizVariant
+	var drawn string
+	var questionOrder, optionOrders sql.NullString
+	err := DB.QueryRow(`
+		SELECT seed, question_ids, question_order, option_orders FROM quiz_variants
+		WHERE quiz_id = ? AND student_id = ? AND attempt_number = ?
+	`, quizID, studentID, attemptNumber).Scan(&v.Seed, &drawn, &questionOrder, &optionOrders)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(drawn), &v.DrawnIDs); err != nil {
+		return nil, err
+	}
+	if questionOrder.Valid {
+		v.Layout = &QuizLayout{}
+		json.Unmarshal([]byte(questionOrder.String), &v.Layout.QuestionOrder)
+		if optionOrders.Valid {
+			json.Unmarshal([]byte(optionOrders.String), &v.Layout.OptionOrders)
+		}
+	}
+	return &v, nil
+}
+
+// studentVariant returns a student's variant of a quiz for an attempt,
+// creating it on first use. Quizzes without draw rules or shuffling have no
+// variants.
+func studentVariant(quizID, studentID, attemptNumber int, shuffled bool) (*QuizVariant, error) {
+	variant, err := loadQuizVariant(quizID, studentID, attemptNumber)
+	if err != nil || variant != nil {
+		return variant, err
+	}
+
+	rules, err := loadDrawRules(quizID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 && !shuffled {
+		return nil, nil
+	}
+
+	seed, err := newVariantSeed()
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		err = drawQuestions(quizID, studentID, attemptNumber, rules, seed)
+	} else {
+		_, err = DB.Exec(`
+			INSERT IGNORE INTO quiz_variants (quiz_id, student_id, attempt_number, seed, question_ids) VALUES (?, ?, ?, ?, '[]')
+		`, quizID, studentID, attemptNumber, seed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadQuizVariant(quizID, studentID, attemptNumber)
+}
+
+// loadStudentQuestions returns the questions a student answers in an
+// attempt, the quiz's fixed questions followed by their draw, and the
+// layout they are shown in (nil when nothing is shuffled). Questions keep
+// their original option IDs; use the layout's apply to get them as the
+// student sees them.
+func loadStudentQuestions(quizID, studentID, attemptNumber int) ([]Question, *QuizLayout, error) {
+	questions, err := loadQuizQuestions(quizID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var shuffleQuestions, shuffleOptions bool
+	if err := DB.QueryRow("SELECT shuffle_questions, shuffle_options FROM quizzes_new WHERE id = ?", quizID).Scan(&shuffleQuestions, &shuffleOptions); err != nil {
+		return nil, nil, err
+	}
+	shuffled := shuffleQuestions || shuffleOptions
+
+	variant, err := studentVariant(quizID, studentID, attemptNumber, shuffled)
+	if err != nil || variant == nil {
+		return questions, nil, err
+	}
+
+	drawn, err := loadQuestionsByID(quizID, variant.DrawnIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[int]bool)
+	for _, q := range questions {
+		seen[q.ID] = true
+	}
+	// A drawn question the teacher later picked for everyone is already
+	// among the fixed ones
+	for _, id := range variant.DrawnIDs {
+		if q, ok := drawn[id]; ok && !seen[id] {
+			questions = append(questions, q)
+			seen[id] = true
+		}
+	}
+
+	// Shuffling may have been switched on after the student drew their
+	// questions; the first layout recorded is kept
+	if variant.Layout == nil && shuffled {
+		layout := newQuizLayout(questions, variant.Seed, shuffleQuestions, shuffleOptions)
+		questionOrder, _ := json.Marshal(layout.QuestionOrder)
+		optionOrders, _ := json.Marshal(layout.OptionOrders)
+		result, err := DB.Exec(`
+			UPDATE quiz_variants SET question_order = ?, option_orders = ?
+			WHERE quiz_id = ? AND student_id = ? AND attempt_number = ? AND question_order IS NULL
+		`, string(questionOrder), string(optionOrders), quizID, studentID, attemptNumber)
+		if err != nil {
+			return nil, nil, err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			reloaded, err := loadQuizVariant(quizID, studentID, attemptNumber)
+			if err != nil || reloaded == nil {
+				return questions, nil, err
+			}
+			layout = reloaded.Layout
+		}
+		variant.Layout = layout
+	}
+	return questions, variant.Layout, nil
+}
+
+// newQuizLayout shuffles a quiz for one student
+func newQuizLayout(questions []Question, seed int64, shuffleQuestions, shuffleOptions bool) *QuizLayout {
+	rng := mathrand.New(mathrand.NewSource(seed))
+	layout := &QuizLayout{OptionOrders: make(map[int]*OptionOrder)}
+	for _, q := range questions {
+		layout.QuestionOrder = append(layout.QuestionOrder, q.ID)
+	}
+	if shuffleQuestions {
+		order := layout.QuestionOrder
+		rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	if !shuffleOptions {
+		return layout
+	}
+
+	shuffledIDs := func(options []QuestionOption) []string {
+		ids := make([]string, len(options))
+		for i, opt := range options {
+			ids[i] = opt.ID
+		}
+		rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		return ids
+	}
+	for _, q := range questions {
+		if q.Options == nil {
+			continue
+		}
+		switch q.QuestionType {
+		case questionMultipleChoice, questionMultipleSelect, questionOrdering:
+			layout.OptionOrders[q.ID] = &OptionOrder{Choices: shuffledIDs(q.Options.Choices)}
+		case questionMatching:
+			layout.OptionOrders[q.ID] = &OptionOrder{Right: shuffledIDs(q.Options.Right)}
+		}
+	}
+	return layout
+}
+
+// apply returns the questions in the order and with the option labels the
+// student was shown. A nil layout leaves them as they are.
+func (l *QuizLayout) apply(questions []Question) []Question {
+	if l == nil {
+		return questions
+	}
+	byID := make(map[int]Question, len(questions))
+	for _, q := range questions {
+		byID[q.ID] = q
+	}
+
+	// Questions added after the layout was made go last
+	ordered := make([]Question, 0, len(questions))
+	placed := make(map[int]bool)
+	for _, id := range l.QuestionOrder {
+		if q, ok := byID[id]; ok && !placed[id] {
+			ordered = append(ordered, q)
+			placed[id] = true
+		}
+	}
+	for _, q := range questions {
+		if !placed[q.ID] {
+			ordered = append(ordered, q)
+		}
+	}
+
+	for i := range ordered {
+		ordered[i] = relabelQuestion(ordered[i], l.OptionOrders[ordered[i].ID])
+	}
+	return ordered
+}
+
+// optionLabel is the label of the i-th option shown
+func optionLabel(i int) string {
+	if i < 26 {
+		return string(rune('A' + i))
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// relabelOptions puts options in the given order and labels them A, B, C,
+// ... It returns the options and a map from original ID to label. Options
+// missing from the order, e.g. added since, go last.
+func relabelOptions(options []QuestionOption, order []string) ([]QuestionOption, map[string]string) {
+	byID := make(map[string]QuestionOption, len(options))
+	for _, opt := range options {
+		byID[opt.ID] = opt
+	}
+	labels := make(map[string]string, len(options))
+	relabelled := make([]QuestionOption, 0, len(options))
+	add := func(opt QuestionOption) {
+		label := optionLabel(len(relabelled))
+		labels[opt.ID] = label
+		relabelled = append(relabelled, QuestionOption{ID: label, Text: opt.Text})
+	}
+	for _, id := range order {
+		if opt, ok := byID[id]; ok && labels[id] == "" {
+			add(opt)
+		}
+	}
+	for _, opt := range options {
+		if labels[opt.ID] == "" {
+			add(opt)
+		}
+	}
+	return relabelled, labels
+}
+
+// optionLabels returns the original-ID-to-label maps of a shuffled question
+func optionLabels(q *Question, order *OptionOrder) (choices, right map[string]string) {
+	if order == nil || q.Options == nil {
+		return nil, nil
+	}
+	if order.Choices != nil {
+		_, choices = relabelOptions(q.Options.Choices, order.Choices)
+	}
+	if order.Right != nil {
+		_, right = relabelOptions(q.Options.Right, order.Right)
+	}
+	return choices, right
+}
+
+// relabelQuestion returns a question with its options, answer key and
+// legacy option columns as the student was shown them
+func relabelQuestion(q Question, order *OptionOrder) Question {
+	if order == nil || q.Options == nil {
+		return q
+	}
+	choiceLabels, rightLabels := optionLabels(&q, order)
+	options := *q.Options
+	if choiceLabels != nil {
+		options.Choices, _ = relabelOptions(q.Options.Choices, order.Choices)
+	}
+	if rightLabels != nil {
+		options.Right, _ = relabelOptions(q.Options.Right, order.Right)
+	}
+	q.Options = &options
+
+	if q.AnswerKey != nil {
+		key := *q.AnswerKey
+		key.Correct = mapIDs(key.Correct, choiceLabels)
+		key.Order = mapIDs(key.Order, choiceLabels)
+		if key.Pairs != nil && rightLabels != nil {
+			key.Pairs = make(map[string]string, len(q.AnswerKey.Pairs))
+			for left, right := range q.AnswerKey.Pairs {
+				key.Pairs[left] = rightLabels[right]
+			}
+		}
+		q.AnswerKey = &key
+	}
+
+	q.OptionA, q.OptionB, q.OptionC, q.OptionD, q.CorrectAnswer = "", "", "", "", ""
+	normalizeQuestion(&q)
+	return q
+}
+
+func mapIDs(ids []string, labels map[string]string) []string {
+	if ids == nil || labels == nil {
+		return ids
+	}
+	mapped := make([]string, len(ids))
+	for i, id := range ids {
+		if label, ok := labels[id]; ok {
+			mapped[i] = label
+		} else {
+			mapped[i] = id
+		}
+	}
+	return mapped
+}
+
+func invertLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	inverted := make(map[string]string, len(labels))
+	for id, label := range labels {
+		inverted[label] = id
+	}
+	return inverted
+}
+
+// originalAnswer maps an answer given with the student's labels back to
+// the question's original option IDs
+func originalAnswer(q *Question, order *OptionOrder, answer interface{}) interface{} {
+	choices, right := optionLabels(q, order)
+	return mapAnswer(q.QuestionType, answer, invertLabels(choices), invertLabels(right))
+}
+
+// shownAnswer maps an answer in original option IDs to the labels the
+// student was shown
+func shownAnswer(q *Question, order *OptionOrder, answer interface{}) interface{} {
+	choices, right := optionLabels(q, order)
+	return mapAnswer(q.QuestionType, answer, choices, right)
+}
+
+func mapAnswer(questionType string, answer interface{}, choices, right map[string]string) interface{} {
+	mapOne := func(v interface{}, labels map[string]string) interface{} {
+		if s, ok := v.(string); ok {
+			if mapped, ok := labels[s]; ok {
+				return mapped
+			}
+			// Labels are matched like multiple_choice answers, ignoring case
+			if mapped, ok := labels[strings.ToUpper(strings.TrimSpace(s))]; ok {
+				return mapped
+			}
+		}
+		return v
+	}
+	switch questionType {
+	case questionMultipleChoice:
+		if choices != nil {
+			return mapOne(answer, choices)
+		}
+	case questionMultipleSelect, questionOrdering:
+		// Lists may also arrive as []string or "A,C", the forms gradeAnswer
+		// accepts
+		if list := answerStrings(answer); list != nil && choices != nil {
+			mapped := make([]interface{}, len(list))
+			for i, v := range list {
+				mapped[i] = mapOne(v, choices)
+			}
+			return mapped
+		}
+	case questionMatching:
+		if pairs, ok := answer.(map[string]interface{}); ok && right != nil {
+			mapped := make(map[string]interface{}, len(pairs))
+			for left, v := range pairs {
+				mapped[left] = mapOne(v, right)
+			}
+			return mapped
+		}
+	}
+	return answer
+}
+
+// decodeAnswer turns an answer stored by encodeAnswer back into the shape
+// it was submitted in
+func decodeAnswer(questionType, stored string) interface{} {
+	switch questionType {
+	case questionMultipleSelect, questionOrdering, questionMatching, questionFillBlank, questionNumeric:
+		var v interface{}
+		if err := json.Unmarshal([]byte(stored), &v); err == nil {
+			return v
+		}
+	}
+	return stored
+}
+
+// loadSubmissionLayout returns the layout recorded on a submission
+func loadSubmissionLayout(submissionID int) *QuizLayout {
+	var questionIDs, optionOrders sql.NullString
+	err := DB.QueryRow("SELECT question_ids, option_orders FROM quiz_submissions WHERE id = ?", submissionID).Scan(&questionIDs, &optionOrders)
+	if err != nil || !questionIDs.Valid {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error loading layout of submission %d: %v", submissionID, err)
+		}
+		return nil
+	}
+	layout := &QuizLayout{}
+	json.Unmarshal([]byte(questionIDs.String), &layout.QuestionOrder)
+	if optionOrders.Valid {
+		json.Unmarshal([]byte(optionOrders.String), &layout.OptionOrders)
+	}
+	return layout
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShuffledAnswerRoundTrip(t *testing.T) {
+	choices := &QuestionOptions{Choices: []QuestionOption{{"A", "Merah"}, {"B", "Kuning"}, {"C", "Hijau"}, {"D", "Biru"}}}
+	matching := &QuestionOptions{
+		Left:  []QuestionOption{{"1", "Kucing"}, {"2", "Anjing"}},
+		Right: []QuestionOption{{"x", "Meong"}, {"y", "Guk"}, {"z", "Kwek"}},
+	}
+	// Shown as A=C, B=A, C=D, D=B and, for matching, A=z, B=x, C=y
+	choiceOrder := &OptionOrder{Choices: []string{"C", "A", "D", "B"}}
+	rightOrder := &OptionOrder{Right: []string{"z", "x", "y"}}
+
+	tests := []struct {
+		name     string
+		question Question
+		order    *OptionOrder
+		shown    interface{} // As the student answered
+		original interface{} // As stored in quiz_answers
+	}{
+		{
+			name:     "multiple choice",
+			question: Question{QuestionType: questionMultipleChoice, Options: choices, AnswerKey: &AnswerKey{Correct: []string{"A"}}},
+			order:    choiceOrder,
+			shown:    "B",
+			original: "A",
+		},
+		{
+			name:     "multiple select",
+			question: Question{QuestionType: questionMultipleSelect, Options: choices, AnswerKey: &AnswerKey{Correct: []string{"A", "C"}}},
+			order:    choiceOrder,
+			shown:    []interface{}{"B", "A"},
+			original: []interface{}{"A", "C"},
+		},
+		{
+			name:     "ordering",
+			question: Question{QuestionType: questionOrdering, Options: choices, AnswerKey: &AnswerKey{Order: []string{"D", "C", "B", "A"}}},
+			order:    choiceOrder,
+			shown:    []interface{}{"C", "A", "D", "B"},
+			original: []interface{}{"D", "C", "B", "A"},
+		},
+		{
+			name:     "matching",
+			question: Question{QuestionType: questionMatching, Options: matching, AnswerKey: &AnswerKey{Pairs: map[string]string{"1": "x", "2": "y"}}},
+			order:    rightOrder,
+			shown:    map[string]interface{}{"1": "B", "2": "C"},
+			original: map[string]interface{}{"1": "x", "2": "y"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := originalAnswer(&tt.question, tt.order, tt.shown); !reflect.DeepEqual(got, tt.original) {
+				t.Errorf("originalAnswer() = %#v, want %#v", got, tt.original)
+			}
+			if got := shownAnswer(&tt.question, tt.order, tt.original); !reflect.DeepEqual(got, tt.shown) {
+				t.Errorf("shownAnswer() = %#v, want %#v", got, tt.shown)
+			}
+
+			// The shown answer is right for the question as the student saw
+			// it exactly when the original answer is right for the question
+			shown := relabelQuestion(tt.question, tt.order)
+			if fraction, _ := gradeAnswer(&shown, tt.shown); fraction != 1 {
+				t.Errorf("relabelled question gives the shown answer %v, want 1", fraction)
+			}
+			if fraction, _ := gradeAnswer(&tt.question, tt.original); fraction != 1 {
+				t.Errorf("original question gives the original answer %v, want 1", fraction)
+			}
+		})
+	}
+}
+
+func TestOriginalAnswerListForms(t *testing.T) {
+	q := Question{
+		QuestionType: questionMultipleSelect,
+		Options:      &QuestionOptions{Choices: []QuestionOption{{"A", "Merah"}, {"B", "Kuning"}, {"C", "Hijau"}}},
+	}
+	order := &OptionOrder{Choices: []string{"C", "A", "B"}}
+	want := []interface{}{"C", "A"}
+
+	tests := []struct {
+		name   string
+		answer interface{}
+	}{
+		{"JSON array", []interface{}{"A", "B"}},
+		{"string slice", []string{"A", "B"}},
+		{"comma-separated string", "a, B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := originalAnswer(&q, order, tt.answer); !reflect.DeepEqual(got, want) {
+				t.Errorf("originalAnswer(%#v) = %#v, want %#v", tt.answer, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Students can dispute the grade of a question on a graded submission.
+// The request waits in the teacher's queue until it is accepted with new
+// points, which rescore the submission, or rejected; either way the
+// teacher can reply. Every request stays in the submission's history.
+
+const (
+	regradeOpen     = "open"
+	regradeAccepted = "accepted"
+	regradeRejected = "rejected"
+
+	maxRegradeCommentLength = 2000
+)
+
+// RegradeRequest is a student's dispute of a question's grade
+type RegradeRequest struct {
+	ID           int        `json:"id"`
+	SubmissionID int        `json:"submission_id"`
+	QuizID       int        `json:"quiz_id"`
+	QuizTitle    string     `json:"quiz_title"`
+	QuestionID   int        `json:"question_id"`
+	QuestionText string     `json:"question_text"`
+	MaxPoints    int        `json:"max_points"`
+	StudentID    int        `json:"student_id"`
+	StudentName  string     `json:"student_name"`
+	Comment      string     `json:"comment"`
+	Status       string     `json:"status"`
+	PointsBefore *float64   `json:"points_before"`
+	PointsAfter  *float64   `json:"points_after,omitempty"`
+	Reply        string     `json:"reply,omitempty"`
+	ResolvedBy   *int       `json:"resolved_by,omitempty"`
+	ResolverName string     `json:"resolver_name,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+}
+
+// createRegradeRequestsTable creates the table of regrade requests. A
+// question can only have one open request per submission: open_marker is 1
+// while a request is open and NULL after, so the unique key only applies to
+// open requests.
+func createRegradeRequestsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quiz_regrade_requests (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			submission_id INT NOT NULL,
+			question_id INT NOT NULL,
+			student_id INT NOT NULL,
+			comment TEXT NOT NULL,
+			status ENUM('open', 'accepted', 'rejected') NOT NULL DEFAULT 'open',
+			points_before DECIMAL(5,2) NULL,
+			points_after DECIMAL(5,2) NULL,
+			reply TEXT NULL,
+			resolved_by INT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			resolved_at TIMESTAMP NULL,
+			INDEX idx_regrade_requests_submission (submission_id, question_id),
+			INDEX idx_regrade_requests_status (status, created_at),
+			FOREIGN KEY (submission_id) REFERENCES quiz_submissions(id) ON DELETE CASCADE,
+			FOREIGN KEY (question_id) REFERENCES quiz_questions_new(id) ON DELETE CASCADE,
+			FOREIGN KEY (student_id) REFERENCES students(id) ON DELETE CASCADE,
+			FOREIGN KEY (resolved_by) REFERENCES teachers(id) ON DELETE SET NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci
+	`)
+	if err != nil {
+		return err
+	}
+	err = ensureColumn(db, "quiz_regrade_requests", "open_marker", "TINYINT AS (IF(status = 'open', 1, NULL)) STORED")
+	if err != nil {
+		return err
+	}
+	return ensureIndex(db, "quiz_regrade_requests", "uniq_regrade_requests_open", "UNIQUE INDEX", "submission_id, question_id, open_marker")
+}
+
+const regradeRequestSelect = `
+	SELECT rr.id, rr.submission_id, qs.quiz_id, q.title, rr.question_id, qq.question, qq.points,
+	       rr.student_id, s.name, rr.comment, rr.status, rr.points_before, rr.points_after,
+	       rr.reply, rr.resolved_by, t.name, rr.created_at, rr.resolved_at
+	FROM quiz_regrade_requests rr
+	JOIN quiz_submissions qs ON qs.id = rr.submission_id
+	JOIN quizzes_new q ON q.id = qs.quiz_id
+	JOIN quiz_questions_new qq ON qq.id = rr.question_id
+	JOIN students s ON s.id = rr.student_id
+	LEFT JOIN teachers t ON t.id = rr.resolved_by`
+
+func scanRegradeRequest(row rowScanner) (*RegradeRequest, error) {
+	var rr RegradeRequest
+	var pointsBefore, pointsAfter sql.NullFloat64
+	var reply, resolverName sql.NullString
+	var resolvedBy sql.NullInt64
+	var resolvedAt sql.NullTime
+	err := row.Scan(&rr.ID, &rr.SubmissionID, &rr.QuizID, &rr.QuizTitle, &rr.QuestionID, &rr.QuestionText, &rr.MaxPoints,
+		&rr.StudentID, &rr.StudentName, &rr.Comment, &rr.Status, &pointsBefore, &pointsAfter,
+		&reply, &resolvedBy, &resolverName, &rr.CreatedAt, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if pointsBefore.Valid {
+		rr.PointsBefore = &pointsBefore.Float64
+	}
+	if pointsAfter.Valid {
+		rr.PointsAfter = &pointsAfter.Float64
+	}
+	rr.Reply = reply.String
+	if resolvedBy.Valid {
+		id := int(resolvedBy.Int64)
+		rr.ResolvedBy = &id
+	}
+	rr.ResolverName = resolverName.String
+	if resolvedAt.Valid {
+		rr.ResolvedAt = &resolvedAt.Time
+	}
+	return &rr, nil
+}
+
+func queryRegradeRequests(query string, args ...interface{}) ([]RegradeRequest, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []RegradeRequest{}
+	for rows.Next() {
+		rr, err := scanRegradeRequest(rows)
+		if err != nil {
+			log.Printf("Error scanning regrade request: %v", err)
+			continue
+		}
+		requests = append(requests, *rr)
+	}
+	return requests, rows.Err()
+}
+
+// loadRegradeRequests returns the regrade history of a submission
+func loadRegradeRequests(submissionID int) ([]RegradeRequest, error) {
+	return queryRegradeRequests(regradeRequestSelect+` WHERE rr.submission_id = ? ORDER BY rr.created_at, rr.id`, submissionID)
+}
+
+// createRegradeRequestHandler lets a student dispute the grade of a
+// question on one of their graded submissions
+func createRegradeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	studentID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	submissionID, err := strconv.Atoi(mux.Vars(r)["submissionId"])
+	if err != nil {
+		http.Error(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		QuestionID int    `json:"question_id"`
+		Comment    string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if req.Comment == "" {
+		http.Error(w, "comment is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Comment) > maxRegradeCommentLength {
+		http.Error(w, fmt.Sprintf("comment cannot be longer than %d characters", maxRegradeCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	// Only graded answers of the student's own submissions can be disputed
+	var score, points sql.NullFloat64
+	err = DB.QueryRow(`
+		SELECT qs.score, qa.points_awarded
+		FROM quiz_submissions qs
+		JOIN quiz_answers qa ON qa.submission_id = qs.id AND qa.question_id = ?
+		WHERE qs.id = ? AND qs.student_id = ?
+	`, req.QuestionID, submissionID, studentID).Scan(&score, &points)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Question not found on this submission", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking submission %d: %v", submissionID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !score.Valid || !points.Valid {
+		http.Error(w, "This question has not been graded yet", http.StatusConflict)
+		return
+	}
+
+	result, err := DB.Exec(`
+		INSERT INTO quiz_regrade_requests (submission_id, question_id, student_id, comment, points_before)
+		VALUES (?, ?, ?, ?, ?)
+	`, submissionID, req.QuestionID, studentID, req.Comment, points.Float64)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			http.Error(w, "There already is an open regrade request for this question", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating regrade request: %v", err)
+		http.Error(w, "Failed to create regrade request", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	rr, err := scanRegradeRequest(DB.QueryRow(regradeRequestSelect+` WHERE rr.id = ?`, id))
+	if err != nil {
+		log.Printf("Error fetching regrade request %d: %v", id, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"regrade_request": rr,
+	})
+}
+
+// getRegradeQueueHandler lists the regrade requests on the teacher's
+// quizzes, oldest first. ?status= picks open (the default), accepted,
+// rejected or all; ?quiz_id= narrows it down to one quiz.
+func getRegradeQueueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	status := params.Get("status")
+	if status == "" {
+		status = regradeOpen
+	}
+	if !containsString([]string{regradeOpen, regradeAccepted, regradeRejected, "all"}, status) {
+		http.Error(w, "status must be one of open, accepted, rejected or all", http.StatusBadRequest)
+		return
+	}
+	quizFilter, _ := strconv.Atoi(params.Get("quiz_id"))
+
+	requests, err := queryRegradeRequests(regradeRequestSelect+`
+		JOIN courses c ON c.id = q.course_id
+		WHERE c.teacher_id = ? AND (? = 'all' OR rr.status = ?) AND (? = 0 OR qs.quiz_id = ?)
+		ORDER BY rr.created_at, rr.id
+	`, teacherID, status, status, quizFilter, quizFilter)
+	if err != nil {
+		log.Printf("Error fetching regrade requests: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"regrade_requests": requests,
+	})
+}
+
+// resolveRegradeRequestHandler accepts a regrade request with the new
+// points of the question, or rejects it, with an optional reply. Accepted
+// points replace a rubric score and rescore the submission.
+func resolveRegradeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	requestID, err := strconv.Atoi(mux.Vars(r)["requestId"])
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status        string   `json:"status"`
+		PointsAwarded *float64 `json:"points_awarded"`
+		Reply         string   `json:"reply"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.Reply = strings.TrimSpace(req.Reply)
+	switch req.Status {
+	case regradeAccepted:
+		if req.PointsAwarded == nil {
+			http.Error(w, "points_awarded is required to accept a regrade request", http.StatusBadRequest)
+			return
+		}
+	case regradeRejected:
+		req.PointsAwarded = nil
+	default:
+		http.Error(w, "status must be accepted or rejected", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var submissionID, questionID, maxPoints int
+	var status string
+	err = tx.QueryRow(`
+		SELECT rr.submission_id, rr.question_id, rr.status, qq.points
+		FROM quiz_regrade_requests rr
+		JOIN quiz_submissions qs ON qs.id = rr.submission_id
+		JOIN quizzes_new q ON q.id = qs.quiz_id
+		JOIN courses c ON c.id = q.course_id
+		JOIN quiz_questions_new qq ON qq.id = rr.question_id
+		WHERE rr.id = ? AND c.teacher_id = ?
+		FOR UPDATE
+	`, requestID, teacherID).Scan(&submissionID, &questionID, &status, &maxPoints)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Regrade request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching regrade request %d: %v", requestID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if status != regradeOpen {
+		http.Error(w, "This regrade request has already been resolved", http.StatusConflict)
+		return
+	}
+
+	if p := req.PointsAwarded; p != nil {
+		if *p < 0 || *p > float64(maxPoints) || math.IsNaN(*p) {
+			http.Error(w, fmt.Sprintf("points_awarded must be between 0 and %d", maxPoints), http.StatusBadRequest)
+			return
+		}
+		points := math.Round(*p*100) / 100
+		req.PointsAwarded = &points
+		_, err = tx.Exec(`
+			UPDATE quiz_answers SET points_awarded = ?, is_correct = ?, rubric_scores = NULL, manual_override = TRUE
+			WHERE submission_id = ? AND question_id = ?
+		`, points, points >= float64(maxPoints), submissionID, questionID)
+		if err == nil {
+			_, _, err = rescoreSubmission(tx, submissionID)
+		}
+		if err != nil {
+			log.Printf("Error regrading submission %d: %v", submissionID, err)
+			http.Error(w, "Failed to resolve regrade request", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE quiz_regrade_requests
+		SET status = ?, points_after = ?, reply = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, req.Status, req.PointsAwarded, nullIfEmpty(req.Reply), teacherID, requestID)
+	if err != nil {
+		log.Printf("Error resolving regrade request %d: %v", requestID, err)
+		http.Error(w, "Failed to resolve regrade request", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, "Failed to resolve regrade request", http.StatusInternalServerError)
+		return
+	}
+
+	rr, err := scanRegradeRequest(DB.QueryRow(regradeRequestSelect+` WHERE rr.id = ?`, requestID))
+	if err != nil {
+		log.Printf("Error fetching regrade request %d: %v", requestID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"regrade_request": rr,
+	})
+}
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable material uploads follow the tus 1.0.0 protocol
+// (https://tus.io/protocols/resumable-upload) with the creation, checksum,
+// termination and expiration extensions:
+//
+//	POST   /api/upload/resumable          Upload-Length + Upload-Metadata, returns Location
+//	HEAD   /api/upload/resumable/{id}     current Upload-Offset
+//	PATCH  /api/upload/resumable/{id}     append a chunk at Upload-Offset
+//	DELETE /api/upload/resumable/{id}     abandon the upload
+//
+// Chunks are staged on local disk. When the last chunk arrives the file goes
+// through processUpload like any other material, so the resulting file_path
+// can be used for course_materials exactly as one from /api/upload/material.
+
+const (
+	tusVersion          = "1.0.0"
+	tusExtensions       = "creation,checksum,termination,expiration"
+	tusChecksumAlgos    = "md5,sha1,sha256"
+	tusHeaders          = "Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum"
+	tusExposedHeaders   = "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, Upload-Length, Upload-Offset, Upload-Expires, Upload-File-Path"
+	statusChecksumError = 460 // tus checksum extension: Checksum Mismatch
+
+	defaultResumableUploadExpiry = 24 * time.Hour
+	// Finished and failed upload records are kept a while so clients can
+	// still look up the outcome
+	resumableUploadRecordRetention = 7 * 24 * time.Hour
+	defaultTeacherStorageQuotaMB   = 10 << 10
+)
+
+// resumableUpload is a row of resumable_uploads
+type resumableUpload struct {
+	ID             string         `json:"id"`
+	TeacherID      int            `json:"-"`
+	FileName       string         `json:"filename"`
+	MaterialType   sql.NullString `json:"-"`
+	UploadLength   int64          `json:"upload_length"`
+	UploadOffset   int64          `json:"upload_offset"`
+	ExpectedSHA256 sql.NullString `json:"-"`
+	Status         string         `json:"status"`
+	FilePath       sql.NullString `json:"-"`
+	ErrorMessage   sql.NullString `json:"-"`
+	ExpiresAt      time.Time      `json:"expires_at"`
+}
+
+// createResumableUploadTables creates the tables for in-progress uploads and
+// per-teacher storage quota overrides
+func createResumableUploadTables() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS resumable_uploads (
+			id CHAR(32) PRIMARY KEY,
+			teacher_id INT NOT NULL,
+			filename VARCHAR(255) NOT NULL,
+			material_type VARCHAR(50) NULL,
+			upload_length BIGINT NOT NULL,
+			upload_offset BIGINT NOT NULL DEFAULT 0,
+			expected_sha256 CHAR(64) NULL,
+			status ENUM('uploading', 'completed', 'failed') NOT NULL DEFAULT 'uploading',
+			file_path VARCHAR(500) NULL,
+			error_message VARCHAR(255) NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			INDEX idx_resumable_teacher (teacher_id, status),
+			INDEX idx_resumable_expires (status, expires_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS teacher_storage_quotas (
+			teacher_id INT PRIMARY KEY,
+			quota_bytes BIGINT NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	log.Println("✅ Resumable upload tables created/verified successfully!")
+	return nil
+}
+
+// resumableUploadDir is where chunks are staged, RESUMABLE_UPLOAD_DIR or a
+// directory under the system temp dir. It must not be inside UPLOADS_DIR.
+func resumableUploadDir() string {
+	if dir := os.Getenv("RESUMABLE_UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "edtech-resumable-uploads")
+}
+
+// resumableUploadExpiry is how long an upload may sit idle before it is
+// abandoned, RESUMABLE_UPLOAD_EXPIRY as a Go duration
+func resumableUploadExpiry() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RESUMABLE_UPLOAD_EXPIRY")); err == nil && d > 0 {
+		return d
+	}
+	return defaultResumableUploadExpiry
+}
+
+func resumableUploadPath(id string) string {
+	return filepath.Join(resumableUploadDir(), id)
+}
+
+// resumableUploadLocks serialises PATCH requests per upload within this
+// process. Only uploads in progress keep an entry.
+var resumableUploadLocks sync.Map
+
+func lockResumableUpload(id string) (unlock func(), ok bool) {
+	value, _ := resumableUploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func getResumableUpload(id string, teacherID int) (*resumableUpload, error) {
+	var u resumableUpload
+	err := DB.QueryRow(`
+		SELECT id, teacher_id, filename, material_type, upload_length, upload_offset, expected_sha256,
+		       status, file_path, error_message, expires_at
+		FROM resumable_uploads WHERE id = ? AND teacher_id = ?
+	`, id, teacherID).Scan(&u.ID, &u.TeacherID, &u.FileName, &u.MaterialType, &u.UploadLength, &u.UploadOffset,
+		&u.ExpectedSHA256, &u.Status, &u.FilePath, &u.ErrorMessage, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// teacherStorageQuota returns a teacher's quota in bytes: their override in
+// teacher_storage_quotas, or TEACHER_STORAGE_QUOTA_MB (default 10 GB)
+func teacherStorageQuota(teacherID int) (int64, error) {
+	var quota int64
+	err := DB.QueryRow("SELECT quota_bytes FROM teacher_storage_quotas WHERE teacher_id = ?", teacherID).Scan(&quota)
+	if err == nil {
+		return quota, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	mb, convErr := strconv.ParseInt(os.Getenv("TEACHER_STORAGE_QUOTA_MB"), 10, 64)
+	if convErr != nil || mb <= 0 {
+		mb = defaultTeacherStorageQuotaMB
+	}
+	return mb << 20, nil
+}
+
+// teacherStorageUsage returns the bytes of stored files a teacher uploaded,
+// and the bytes reserved by their unfinished resumable uploads
+func teacherStorageUsage(teacherID int) (used, reserved int64, err error) {
+	err = DB.QueryRow(`
+		SELECT COALESCE(SUM(u.size_bytes), 0)
+		FROM upload_owners o
+		JOIN uploads u ON u.id = o.upload_id
+		WHERE o.owner_role = 'teacher' AND o.owner_id = ?
+	`, teacherID).Scan(&used)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = DB.QueryRow(`
+		SELECT COALESCE(SUM(upload_length), 0) FROM resumable_uploads
+		WHERE teacher_id = ? AND status = 'uploading' AND expires_at > ?
+	`, teacherID, time.Now()).Scan(&reserved)
+	return used, reserved, err
+}
+
+// checkTeacherStorageQuota refuses a file that would take a teacher over
+// their storage quota
+func checkTeacherStorageQuota(owner uploadOwner, size int64) error {
+	quota, err := teacherStorageQuota(owner.ID)
+	if err != nil {
+		return err
+	}
+	used, reserved, err := teacherStorageUsage(owner.ID)
+	if err != nil {
+		return err
+	}
+	if used+reserved-owner.Reserved+size > quota {
+		return &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Storage quota exceeded: %dMB of %dMB in use", (used+reserved-owner.Reserved)>>20, quota>>20),
+		}
+	}
+	return nil
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseUploadChecksum decodes an Upload-Checksum header, "algorithm base64digest"
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	algo, encoded, _ := strings.Cut(strings.TrimSpace(header), " ")
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid checksum encoding")
+	}
+	switch algo {
+	case "md5":
+		return md5.New(), digest, nil
+	case "sha1":
+		return sha1.New(), digest, nil
+	case "sha256":
+		return sha256.New(), digest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers", tusExposedHeaders)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// tusOptionsHandler answers CORS preflights and tus capability discovery
+func tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, "+tusHeaders)
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgos)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(resumableMaterialUploads.MaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusVersion rejects clients speaking another protocol version
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// createResumableUploadHandler starts a resumable material upload. Metadata
+// keys: filename (required), type (the material type) and sha256 (hex digest
+// of the whole file, checked on completion).
+func createResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Upload-Length must be a positive number of bytes", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileName := strings.TrimSpace(metadata["filename"])
+	if fileName == "" {
+		http.Error(w, "filename metadata is required", http.StatusBadRequest)
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if !resumableMaterialUploads.allows(ext) {
+		http.Error(w, "Invalid file type", http.StatusBadRequest)
+		return
+	}
+	if metadata["type"] == "document" {
+		if _, ok := officeDocumentMarkers[ext]; !ok {
+			http.Error(w, "Document materials must be DOCX or PPTX files", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := resumableMaterialUploads.maxSizeFor(fileFormats[ext].Kind); length > limit {
+		http.Error(w, fmt.Sprintf("File too large. Maximum size is %dMB", limit>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var expectedSHA256 interface{}
+	if digest := strings.ToLower(strings.TrimSpace(metadata["sha256"])); digest != "" {
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			http.Error(w, "sha256 metadata must be a hex SHA-256 digest", http.StatusBadRequest)
+			return
+		}
+		expectedSHA256 = digest
+	}
+
+	quota, err := teacherStorageQuota(teacherID)
+	if err != nil {
+		log.Printf("Error loading storage quota for teacher %d: %v", teacherID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	used, reserved, err := teacherStorageUsage(teacherID)
+	if err != nil {
+		log.Printf("Error loading storage usage for teacher %d: %v", teacherID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if used+reserved+length > quota {
+		http.Error(w, fmt.Sprintf("Storage quota exceeded: %dMB of %dMB in use", (used+reserved)>>20, quota>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+
+	if err := os.MkdirAll(resumableUploadDir(), 0750); err != nil {
+		log.Printf("Error creating resumable upload directory: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	staged, err := os.OpenFile(resumableUploadPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Printf("Error creating resumable upload file: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	staged.Close()
+
+	var materialType interface{}
+	if t := metadata["type"]; t != "" {
+		materialType = truncateString(t, 50)
+	}
+	expiresAt := time.Now().Add(resumableUploadExpiry())
+	_, err = DB.Exec(`
+		INSERT INTO resumable_uploads (id, teacher_id, filename, material_type, upload_length, expected_sha256, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, teacherID, truncateString(fileName, 255), materialType, length, expectedSHA256, expiresAt)
+	if err != nil {
+		os.Remove(resumableUploadPath(id))
+		log.Printf("Error creating resumable upload: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Teacher %d started resumable upload %s (%s, %d bytes)", teacherID, id, fileName, length)
+	w.Header().Set("Location", "/api/upload/resumable/"+id)
+	w.Header().Set("Upload-Expires", expiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// loadResumableUploadForRequest loads the upload named in the URL for the
+// requesting teacher, writing an error response if it cannot be used
+func loadResumableUploadForRequest(w http.ResponseWriter, r *http.Request) (*resumableUpload, bool) {
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	upload, err := getResumableUpload(mux.Vars(r)["uploadId"], teacherID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error loading resumable upload: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return upload, true
+}
+
+// lockResumableUploadForRequest loads the upload of a request and takes its
+// lock, so only the teacher's own uploads get one, then loads it again to
+// read the state the lock protects. unlock forgets the lock once the upload
+// is no longer in progress.
+func lockResumableUploadForRequest(w http.ResponseWriter, r *http.Request) (upload *resumableUpload, unlock func(), ok bool) {
+	if upload, ok = loadResumableUploadForRequest(w, r); !ok {
+		return nil, nil, false
+	}
+	release, ok := lockResumableUpload(upload.ID)
+	if !ok {
+		http.Error(w, "A chunk for this upload is in progress", http.StatusLocked)
+		return nil, nil, false
+	}
+	if upload, ok = loadResumableUploadForRequest(w, r); !ok {
+		release()
+		return nil, nil, false
+	}
+	unlock = func() {
+		release()
+		if upload.Status != "uploading" {
+			resumableUploadLocks.Delete(upload.ID)
+		}
+	}
+	return upload, unlock, true
+}
+
+func setResumableUploadHeaders(w http.ResponseWriter, upload *resumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	if upload.Status == "uploading" {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if upload.FilePath.Valid {
+		w.Header().Set("Upload-File-Path", upload.FilePath.String)
+	}
+}
+
+// headResumableUploadHandler reports how much of an upload has arrived
+func headResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	upload, ok := loadResumableUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+	if upload.Status == "uploading" && time.Now().After(upload.ExpiresAt) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	setResumableUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getResumableUploadHandler returns an upload's state as JSON, including the
+// file_path once it has completed
+func getResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	upload, ok := loadResumableUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"upload":  upload,
+	}
+	if upload.FilePath.Valid {
+		response["file_path"] = upload.FilePath.String
+	}
+	if upload.ErrorMessage.Valid {
+		response["error"] = upload.ErrorMessage.String
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// patchResumableUploadHandler appends a chunk. The chunk must start at the
+// current offset; with Upload-Checksum it is kept only if it verifies,
+// without one whatever arrived before a dropped connection is kept.
+func patchResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	upload, unlock, ok := lockResumableUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	switch {
+	case upload.Status == "completed":
+		setResumableUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case upload.Status == "failed":
+		http.Error(w, "Upload failed: "+upload.ErrorMessage.String, http.StatusConflict)
+		return
+	case time.Now().After(upload.ExpiresAt):
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.UploadOffset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+
+	var checksum hash.Hash
+	var expectedDigest []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		checksum, expectedDigest, err = parseUploadChecksum(header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	staged, err := os.OpenFile(resumableUploadPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		log.Printf("Error opening staged upload %s: %v", upload.ID, err)
+		http.Error(w, "Upload data is missing, please start again", http.StatusGone)
+		return
+	}
+	defer staged.Close()
+
+	// Drop anything past the recorded offset left by an interrupted request
+	if err := staged.Truncate(offset); err != nil {
+		log.Printf("Error truncating staged upload %s: %v", upload.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := staged.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var dst io.Writer = staged
+	if checksum != nil {
+		dst = io.MultiWriter(staged, checksum)
+	}
+	remaining := upload.UploadLength - offset
+	written, copyErr := io.Copy(dst, io.LimitReader(r.Body, remaining))
+	if copyErr == nil && written == remaining {
+		if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+			staged.Truncate(offset)
+			http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	if checksum != nil {
+		if copyErr != nil {
+			staged.Truncate(offset)
+			log.Printf("Resumable upload %s chunk interrupted: %v", upload.ID, copyErr)
+			http.Error(w, "Chunk was not received completely", http.StatusBadRequest)
+			return
+		}
+		if !bytes.Equal(checksum.Sum(nil), expectedDigest) {
+			staged.Truncate(offset)
+			http.Error(w, "Checksum mismatch", statusChecksumError)
+			return
+		}
+	}
+	if err := staged.Sync(); err != nil {
+		log.Printf("Error syncing staged upload %s: %v", upload.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if written > 0 {
+		upload.UploadOffset = offset + written
+		upload.ExpiresAt = time.Now().Add(resumableUploadExpiry())
+		result, err := DB.Exec(`
+			UPDATE resumable_uploads SET upload_offset = ?, expires_at = ? WHERE id = ? AND upload_offset = ?
+		`, upload.UploadOffset, upload.ExpiresAt, upload.ID, offset)
+		if err != nil {
+			log.Printf("Error recording resumable upload offset: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// Another server moved the upload on meanwhile; its data wins
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+			return
+		}
+	}
+	if copyErr != nil {
+		log.Printf("Resumable upload %s interrupted at %d bytes: %v", upload.ID, upload.UploadOffset, copyErr)
+		return
+	}
+
+	if upload.UploadOffset == upload.UploadLength {
+		if err := completeResumableUpload(r, upload); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+	}
+
+	setResumableUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeResumableUpload runs a fully received file through the material
+// upload pipeline. Rejections mark the upload failed; internal errors leave
+// it in place so an empty PATCH at the final offset retries.
+func completeResumableUpload(r *http.Request, upload *resumableUpload) error {
+	stagedPath := resumableUploadPath(upload.ID)
+	staged, err := os.Open(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+
+	fail := func(err error) error {
+		if ue, ok := err.(*uploadError); ok {
+			DB.Exec(`
+				UPDATE resumable_uploads SET status = 'failed', error_message = ? WHERE id = ?
+			`, truncateString(ue.Message, 255), upload.ID)
+			os.Remove(stagedPath)
+			upload.Status = "failed"
+			log.Printf("Resumable upload %s rejected: %s", upload.ID, ue.Message)
+		} else {
+			log.Printf("Error completing resumable upload %s: %v", upload.ID, err)
+		}
+		return err
+	}
+
+	if upload.ExpectedSHA256.Valid {
+		digest, err := hashContent(staged)
+		if err != nil {
+			return fail(err)
+		}
+		if digest != upload.ExpectedSHA256.String {
+			return fail(&uploadError{Status: statusChecksumError, Message: "File checksum does not match the sha256 given when the upload was created"})
+		}
+	}
+
+	header := &multipart.FileHeader{Filename: upload.FileName, Size: upload.UploadLength}
+	owner := uploadOwner{Role: "teacher", ID: upload.TeacherID, Reserved: upload.UploadLength}
+	stored, err := processUpload(r.Context(), resumableMaterialUploads, staged, header, owner)
+	if err != nil {
+		return fail(err)
+	}
+
+	if _, err := DB.Exec(`
+		UPDATE resumable_uploads SET status = 'completed', file_path = ? WHERE id = ?
+	`, stored.URLPath, upload.ID); err != nil {
+		return fail(err)
+	}
+	queueUploadedPDF(stored)
+	os.Remove(stagedPath)
+	upload.Status = "completed"
+	upload.FilePath = sql.NullString{String: stored.URLPath, Valid: true}
+	log.Printf("Resumable upload %s completed. Path: %s", upload.ID, stored.URLPath)
+	return nil
+}
+
+// deleteResumableUploadHandler abandons an unfinished upload
+func deleteResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	upload, unlock, ok := lockResumableUploadForRequest(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if _, err := DB.Exec("DELETE FROM resumable_uploads WHERE id = ?", upload.ID); err != nil {
+		log.Printf("Error deleting resumable upload: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(resumableUploadPath(upload.ID))
+	resumableUploadLocks.Delete(upload.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTeacherStorageQuotaHandler shows a teacher their storage quota and usage
+func getTeacherStorageQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	quota, err := teacherStorageQuota(teacherID)
+	if err != nil {
+		log.Printf("Error loading storage quota: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	used, reserved, err := teacherStorageUsage(teacherID)
+	if err != nil {
+		log.Printf("Error loading storage usage: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	available := quota - used - reserved
+	if available < 0 {
+		available = 0
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"quota_bytes":     quota,
+		"used_bytes":      used,
+		"reserved_bytes":  reserved,
+		"available_bytes": available,
+	})
+}
+
+// setTeacherStorageQuotaHandler lets an admin override a teacher's quota.
+// A null quota_mb returns the teacher to the default.
+func setTeacherStorageQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	teacherID, err := strconv.Atoi(mux.Vars(r)["teacherId"])
+	if err != nil {
+		http.Error(w, "Invalid teacher ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		QuotaMB *int64 `json:"quota_mb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.QuotaMB == nil {
+		_, err = DB.Exec("DELETE FROM teacher_storage_quotas WHERE teacher_id = ?", teacherID)
+	} else if *req.QuotaMB < 0 {
+		http.Error(w, "quota_mb cannot be negative", http.StatusBadRequest)
+		return
+	} else {
+		_, err = DB.Exec(`
+			INSERT INTO teacher_storage_quotas (teacher_id, quota_bytes) VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE quota_bytes = VALUES(quota_bytes)
+		`, teacherID, *req.QuotaMB<<20)
+	}
+	if err != nil {
+		log.Printf("Error saving storage quota: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	quota, err := teacherStorageQuota(teacherID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"teacher_id":  teacherID,
+		"quota_bytes": quota,
+	})
+}
+
+// startResumableUploadSweeper periodically removes abandoned uploads and old
+// upload records
+func startResumableUploadSweeper(interval time.Duration) {
+	go func() {
+		for {
+			sweepResumableUploads()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func sweepResumableUploads() {
+	rows, err := DB.Query(`
+		SELECT id FROM resumable_uploads
+		WHERE (status = 'uploading' AND expires_at < ?) OR (status != 'uploading' AND updated_at < ?)
+	`, time.Now(), time.Now().Add(-resumableUploadRecordRetention))
+	if err != nil {
+		log.Printf("Warning: Failed to find expired resumable uploads: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		unlock, ok := lockResumableUpload(id)
+		if !ok {
+			continue
+		}
+		if _, err := DB.Exec("DELETE FROM resumable_uploads WHERE id = ?", id); err != nil {
+			log.Printf("Warning: Failed to delete expired resumable upload %s: %v", id, err)
+		} else if err := os.Remove(resumableUploadPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to delete staged upload %s: %v", id, err)
+		}
+		unlock()
+		resumableUploadLocks.Delete(id)
+	}
+	if len(ids) > 0 {
+		log.Printf("Removed %d expired resumable uploads", len(ids))
+	}
+}
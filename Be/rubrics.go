@@ -0,0 +1,490 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A rubric is a teacher's reusable grid for grading essays: criteria, each
+// with performance levels worth some points. Attached to an essay
+// question, it replaces the bare points when grading: the teacher picks a
+// level per criterion and the question's points are the rubric score scaled
+// to the points of the question. The scores are stored in quiz_answers with
+// the criterion and level titles of the time, so editing or deleting a
+// rubric leaves existing grades alone.
+
+const (
+	maxRubricCriteria = 20
+	maxRubricLevels   = 10
+)
+
+// Rubric is a grading grid
+type Rubric struct {
+	ID            int               `json:"id"`
+	TeacherID     int               `json:"teacher_id"`
+	Title         string            `json:"title"`
+	Description   string            `json:"description,omitempty"`
+	Criteria      []RubricCriterion `json:"criteria"`
+	MaxPoints     float64           `json:"max_points"`
+	QuestionCount int               `json:"question_count"` // Quiz questions using it
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// RubricCriterion is one row of a rubric
+type RubricCriterion struct {
+	ID          string        `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description,omitempty"`
+	Levels      []RubricLevel `json:"levels"`
+}
+
+// RubricLevel is one performance level of a criterion
+type RubricLevel struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Description string  `json:"description,omitempty"`
+	Points      float64 `json:"points"`
+}
+
+// RubricScore is how an answer did on a rubric
+type RubricScore struct {
+	RubricID int              `json:"rubric_id"`
+	Criteria []CriterionScore `json:"criteria"`
+	Score    float64          `json:"score"`
+	MaxScore float64          `json:"max_score"`
+}
+
+// CriterionScore is the level picked for one criterion. A grading request
+// only gives the IDs and the comment.
+type CriterionScore struct {
+	CriterionID string  `json:"criterion_id"`
+	LevelID     string  `json:"level_id"`
+	Criterion   string  `json:"criterion,omitempty"`
+	Level       string  `json:"level,omitempty"`
+	Points      float64 `json:"points"`
+	MaxPoints   float64 `json:"max_points"`
+	Comment     string  `json:"comment,omitempty"`
+}
+
+// createRubricTables creates the rubrics table and the rubric columns of
+// questions and answers
+func createRubricTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS rubrics (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			teacher_id INT NOT NULL,
+			title VARCHAR(255) NOT NULL,
+			description TEXT NULL,
+			criteria JSON NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_rubrics_teacher (teacher_id),
+			FOREIGN KEY (teacher_id) REFERENCES teachers(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci
+	`)
+	if err != nil {
+		return err
+	}
+
+	columns := []struct{ table, name, definition string }{
+		{"quiz_questions_new", "rubric_id", "INT NULL"},
+		{"quiz_answers", "rubric_scores", "JSON NULL COMMENT 'RubricScore of a rubric graded answer'"},
+		{"quiz_answers", "comment", "TEXT NULL COMMENT 'Teacher comment on the answer'"},
+	}
+	for _, col := range columns {
+		if err := ensureColumn(db, col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	return ensureIndex(db, "quiz_questions_new", "idx_questions_rubric", "INDEX", "rubric_id")
+}
+
+// validate checks a rubric and gives criteria and levels without an ID
+// one. IDs only have to be unique within the rubric or criterion.
+func (rb *Rubric) validate() error {
+	rb.Title = strings.TrimSpace(rb.Title)
+	if rb.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	if len(rb.Criteria) == 0 || len(rb.Criteria) > maxRubricCriteria {
+		return fmt.Errorf("a rubric needs between 1 and %d criteria", maxRubricCriteria)
+	}
+
+	criterionIDs := make(map[string]bool)
+	rb.MaxPoints = 0
+	for i := range rb.Criteria {
+		c := &rb.Criteria[i]
+		c.Title = strings.TrimSpace(c.Title)
+		if c.Title == "" {
+			return fmt.Errorf("criterion %d needs a title", i+1)
+		}
+		if c.ID == "" {
+			c.ID = "c" + strconv.Itoa(i+1)
+		}
+		if criterionIDs[c.ID] {
+			return fmt.Errorf("criterion ID %q is used twice", c.ID)
+		}
+		criterionIDs[c.ID] = true
+
+		if len(c.Levels) == 0 || len(c.Levels) > maxRubricLevels {
+			return fmt.Errorf("criterion %q needs between 1 and %d levels", c.Title, maxRubricLevels)
+		}
+		levelIDs := make(map[string]bool)
+		best := 0.0
+		for j := range c.Levels {
+			l := &c.Levels[j]
+			l.Title = strings.TrimSpace(l.Title)
+			if l.Title == "" {
+				return fmt.Errorf("level %d of criterion %q needs a title", j+1, c.Title)
+			}
+			if l.Points < 0 || math.IsNaN(l.Points) || math.IsInf(l.Points, 0) {
+				return fmt.Errorf("level %q of criterion %q has invalid points", l.Title, c.Title)
+			}
+			if l.ID == "" {
+				l.ID = "l" + strconv.Itoa(j+1)
+			}
+			if levelIDs[l.ID] {
+				return fmt.Errorf("level ID %q is used twice in criterion %q", l.ID, c.Title)
+			}
+			levelIDs[l.ID] = true
+			best = math.Max(best, l.Points)
+		}
+		rb.MaxPoints += best
+	}
+	if rb.MaxPoints <= 0 {
+		return fmt.Errorf("a rubric has to be worth more than 0 points")
+	}
+	return nil
+}
+
+// maxPoints is the most points a rubric can give
+func (rb *Rubric) maxPoints() float64 {
+	total := 0.0
+	for _, c := range rb.Criteria {
+		best := 0.0
+		for _, l := range c.Levels {
+			best = math.Max(best, l.Points)
+		}
+		total += best
+	}
+	return total
+}
+
+// score works out the rubric score of the levels picked for an answer.
+// Every criterion has to be scored.
+func (rb *Rubric) score(given []CriterionScore) (*RubricScore, error) {
+	picked := make(map[string]CriterionScore, len(given))
+	for _, g := range given {
+		if _, dup := picked[g.CriterionID]; dup {
+			return nil, fmt.Errorf("criterion %q is scored twice", g.CriterionID)
+		}
+		picked[g.CriterionID] = g
+	}
+
+	s := &RubricScore{RubricID: rb.ID, Criteria: []CriterionScore{}}
+	for _, c := range rb.Criteria {
+		g, ok := picked[c.ID]
+		if !ok {
+			return nil, fmt.Errorf("criterion %q is not scored", c.Title)
+		}
+		delete(picked, c.ID)
+
+		cs := CriterionScore{CriterionID: c.ID, LevelID: g.LevelID, Criterion: c.Title, Comment: strings.TrimSpace(g.Comment)}
+		found := false
+		for _, l := range c.Levels {
+			cs.MaxPoints = math.Max(cs.MaxPoints, l.Points)
+			if l.ID == g.LevelID {
+				cs.Level, cs.Points, found = l.Title, l.Points, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("criterion %q has no level %q", c.Title, g.LevelID)
+		}
+		s.Criteria = append(s.Criteria, cs)
+		s.Score += cs.Points
+		s.MaxScore += cs.MaxPoints
+	}
+	for id := range picked {
+		return nil, fmt.Errorf("the rubric has no criterion %q", id)
+	}
+	return s, nil
+}
+
+// points scales a rubric score to the points of a question
+func (s *RubricScore) points(questionPoints int) float64 {
+	if s.MaxScore <= 0 {
+		return 0
+	}
+	return math.Round(float64(questionPoints)*s.Score/s.MaxScore*100) / 100
+}
+
+const rubricSelectColumns = `
+	r.id, r.teacher_id, r.title, r.description, r.criteria, r.created_at, r.updated_at,
+	(SELECT COUNT(*) FROM quiz_questions_new qq WHERE qq.rubric_id = r.id)`
+
+func scanRubric(row rowScanner) (*Rubric, error) {
+	var rb Rubric
+	var description sql.NullString
+	var criteria string
+	err := row.Scan(&rb.ID, &rb.TeacherID, &rb.Title, &description, &criteria, &rb.CreatedAt, &rb.UpdatedAt, &rb.QuestionCount)
+	if err != nil {
+		return nil, err
+	}
+	rb.Description = description.String
+	if err := json.Unmarshal([]byte(criteria), &rb.Criteria); err != nil {
+		return nil, fmt.Errorf("invalid criteria of rubric %d: %v", rb.ID, err)
+	}
+	rb.MaxPoints = rb.maxPoints()
+	return &rb, nil
+}
+
+// loadRubric returns a rubric, or sql.ErrNoRows
+func loadRubric(rubricID int) (*Rubric, error) {
+	return scanRubric(DB.QueryRow(`SELECT `+rubricSelectColumns+` FROM rubrics r WHERE r.id = ?`, rubricID))
+}
+
+// teacherOwnsRubric checks that a rubric belongs to the teacher
+func teacherOwnsRubric(rubricID, teacherID int) bool {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM rubrics WHERE id = ? AND teacher_id = ?)", rubricID, teacherID).Scan(&exists)
+	return err == nil && exists
+}
+
+// questionRubric returns the points of a quiz question and the rubric it
+// is graded with, nil when it has none. sql.ErrNoRows means the question
+// is not in the quiz.
+func questionRubric(quizID, questionID int) (int, *Rubric, error) {
+	var points int
+	var rubricID sql.NullInt64
+	err := DB.QueryRow(`
+		SELECT points, rubric_id FROM quiz_questions_new WHERE id = ? AND quiz_id = ?
+	`, questionID, quizID).Scan(&points, &rubricID)
+	if err != nil || !rubricID.Valid {
+		return points, nil, err
+	}
+	rb, err := loadRubric(int(rubricID.Int64))
+	if err == sql.ErrNoRows {
+		return points, nil, nil
+	}
+	return points, rb, err
+}
+
+// checkQuestionRubrics makes sure the rubrics attached to questions are
+// the teacher's own
+func checkQuestionRubrics(questions []Question, teacherID int) error {
+	for i, q := range questions {
+		if q.RubricID != nil && !teacherOwnsRubric(*q.RubricID, teacherID) {
+			return fmt.Errorf("Question %d: rubric %d not found", i+1, *q.RubricID)
+		}
+	}
+	return nil
+}
+
+// rubricFromRequest decodes and validates a rubric create or edit payload
+func rubricFromRequest(w http.ResponseWriter, r *http.Request) (*Rubric, bool) {
+	var req struct {
+		Title       string            `json:"title"`
+		Description string            `json:"description"`
+		Criteria    []RubricCriterion `json:"criteria"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return nil, false
+	}
+	rb := &Rubric{Title: req.Title, Description: strings.TrimSpace(req.Description), Criteria: req.Criteria}
+	if err := rb.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return rb, true
+}
+
+// rubricFromURL returns the teacher's rubric named in the URL
+func rubricFromURL(w http.ResponseWriter, r *http.Request) (teacherID int, rb *Rubric, ok bool) {
+	teacherID, ok = r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, nil, false
+	}
+	rubricID, err := strconv.Atoi(mux.Vars(r)["rubricId"])
+	if err != nil {
+		http.Error(w, "Invalid rubric ID", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	rb, err = loadRubric(rubricID)
+	if err != nil || rb.TeacherID != teacherID {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error fetching rubric %d: %v", rubricID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+		} else {
+			http.Error(w, "Rubric not found", http.StatusNotFound)
+		}
+		return 0, nil, false
+	}
+	return teacherID, rb, true
+}
+
+// getRubricsHandler lists the teacher's rubrics
+func getRubricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := DB.Query(`SELECT `+rubricSelectColumns+` FROM rubrics r WHERE r.teacher_id = ? ORDER BY r.title, r.id`, teacherID)
+	if err != nil {
+		log.Printf("Error fetching rubrics: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rubrics := []Rubric{}
+	for rows.Next() {
+		rb, err := scanRubric(rows)
+		if err != nil {
+			log.Printf("Error scanning rubric: %v", err)
+			continue
+		}
+		rubrics = append(rubrics, *rb)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"rubrics": rubrics,
+	})
+}
+
+// getRubricHandler returns one of the teacher's rubrics
+func getRubricHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, rb, ok := rubricFromURL(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"rubric":  rb,
+	})
+}
+
+// createRubricHandler adds a rubric to the teacher's library
+func createRubricHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	teacherID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rb, ok := rubricFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	criteria, _ := json.Marshal(rb.Criteria)
+	result, err := DB.Exec(`
+		INSERT INTO rubrics (teacher_id, title, description, criteria) VALUES (?, ?, ?, ?)
+	`, teacherID, rb.Title, nullIfEmpty(rb.Description), string(criteria))
+	if err != nil {
+		log.Printf("Error creating rubric: %v", err)
+		http.Error(w, "Failed to create rubric", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	if created, err := loadRubric(int(id)); err == nil {
+		rb = created
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"rubric":  rb,
+	})
+}
+
+// updateRubricHandler edits a rubric. Answers graded with it keep their
+// scores; later grading uses the new criteria.
+func updateRubricHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, existing, ok := rubricFromURL(w, r)
+	if !ok {
+		return
+	}
+	rb, ok := rubricFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	criteria, _ := json.Marshal(rb.Criteria)
+	if _, err := DB.Exec(`
+		UPDATE rubrics SET title = ?, description = ?, criteria = ? WHERE id = ?
+	`, rb.Title, nullIfEmpty(rb.Description), string(criteria), existing.ID); err != nil {
+		log.Printf("Error updating rubric %d: %v", existing.ID, err)
+		http.Error(w, "Failed to update rubric", http.StatusInternalServerError)
+		return
+	}
+	if updated, err := loadRubric(existing.ID); err == nil {
+		rb = updated
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"rubric":  rb,
+	})
+}
+
+// deleteRubricHandler removes a rubric and detaches it from its questions,
+// which are graded with bare points again
+func deleteRubricHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, rb, ok := rubricFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE quiz_questions_new SET rubric_id = NULL WHERE rubric_id = ?", rb.ID); err != nil {
+		log.Printf("Error detaching rubric %d: %v", rb.ID, err)
+		http.Error(w, "Failed to delete rubric", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM rubrics WHERE id = ?", rb.ID); err != nil {
+		log.Printf("Error deleting rubric %d: %v", rb.ID, err)
+		http.Error(w, "Failed to delete rubric", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		http.Error(w, "Failed to delete rubric", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":            true,
+		"message":            "Rubric deleted",
+		"detached_questions": rb.QuestionCount,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRubricScore(t *testing.T) {
+	rubric := &Rubric{ID: 3, Criteria: []RubricCriterion{
+		{ID: "isi", Title: "Isi", Levels: []RubricLevel{
+			{ID: "kurang", Title: "Kurang", Points: 1},
+			{ID: "baik", Title: "Baik", Points: 3},
+			{ID: "sangat-baik", Title: "Sangat baik", Points: 4},
+		}},
+		{ID: "bahasa", Title: "Bahasa", Levels: []RubricLevel{
+			{ID: "kurang", Title: "Kurang", Points: 0},
+			{ID: "baik", Title: "Baik", Points: 2},
+		}},
+	}}
+
+	tests := []struct {
+		name     string
+		given    []CriterionScore
+		score    float64
+		maxScore float64
+		points   float64 // Of a 10 point question
+		wantErr  bool
+	}{
+		{
+			name:  "top levels",
+			given: []CriterionScore{{CriterionID: "isi", LevelID: "sangat-baik"}, {CriterionID: "bahasa", LevelID: "baik"}},
+			score: 6, maxScore: 6, points: 10,
+		},
+		{
+			name:  "mixed levels, in any order",
+			given: []CriterionScore{{CriterionID: "bahasa", LevelID: "kurang"}, {CriterionID: "isi", LevelID: "baik"}},
+			score: 3, maxScore: 6, points: 5,
+		},
+		{
+			name:  "rounded to two decimals",
+			given: []CriterionScore{{CriterionID: "isi", LevelID: "kurang"}, {CriterionID: "bahasa", LevelID: "kurang"}},
+			score: 1, maxScore: 6, points: 1.67,
+		},
+		{
+			name:    "criterion left out",
+			given:   []CriterionScore{{CriterionID: "isi", LevelID: "baik"}},
+			wantErr: true,
+		},
+		{
+			name:    "criterion scored twice",
+			given:   []CriterionScore{{CriterionID: "isi", LevelID: "baik"}, {CriterionID: "isi", LevelID: "kurang"}, {CriterionID: "bahasa", LevelID: "baik"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown level",
+			given:   []CriterionScore{{CriterionID: "isi", LevelID: "cukup"}, {CriterionID: "bahasa", LevelID: "baik"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown criterion",
+			given:   []CriterionScore{{CriterionID: "isi", LevelID: "baik"}, {CriterionID: "bahasa", LevelID: "baik"}, {CriterionID: "rapi", LevelID: "baik"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := rubric.score(tt.given)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("score() = %+v, want an error", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("score() error = %v", err)
+			}
+			if s.RubricID != rubric.ID || len(s.Criteria) != len(rubric.Criteria) {
+				t.Errorf("score() = %+v, want one entry per criterion of rubric %d", s, rubric.ID)
+			}
+			if s.Score != tt.score || s.MaxScore != tt.maxScore {
+				t.Errorf("score() = %v of %v, want %v of %v", s.Score, s.MaxScore, tt.score, tt.maxScore)
+			}
+			if got := s.points(10); math.Abs(got-tt.points) > 1e-9 {
+				t.Errorf("points(10) = %v, want %v", got, tt.points)
+			}
+		})
+	}
+}
+
+func TestRubricScorePointsWithoutMaximum(t *testing.T) {
+	s := &RubricScore{Score: 0, MaxScore: 0}
+	if got := s.points(10); got != 0 {
+		t.Errorf("points(10) of a rubric worth nothing = %v, want 0", got)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search covers course titles and descriptions, material titles,
+// descriptions and extracted PDF text, quiz titles and descriptions, and
+// news. It goes through the Searcher interface so the MySQL FULLTEXT
+// implementation can be swapped for an embedded index later.
+
+const (
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 50
+	maxSearchOffset     = 1000
+	maxSearchQueryRunes = 200
+	maxSearchTerms      = 10
+	searchSnippetRunes  = 200
+)
+
+// Result types
+const (
+	searchTypeCourse   = "course"
+	searchTypeMaterial = "material"
+	searchTypeQuiz     = "quiz"
+	searchTypeNews     = "news"
+)
+
+var searchTypes = []string{searchTypeCourse, searchTypeMaterial, searchTypeQuiz, searchTypeNews}
+
+// SearchViewer is who a search runs for. Role is "student", "teacher",
+// "admin" or "" for anonymous requests.
+type SearchViewer struct {
+	Role string
+	ID   int
+}
+
+// SearchRequest is a parsed search
+type SearchRequest struct {
+	Terms  []string
+	Types  map[string]bool
+	Viewer SearchViewer
+	Limit  int
+	Offset int
+}
+
+// SearchResult is one hit
+type SearchResult struct {
+	Type     string  `json:"type"`
+	ID       int     `json:"id"`
+	CourseID int     `json:"course_id,omitempty"`
+	Title    string  `json:"title"`
+	Snippet  string  `json:"snippet,omitempty"`
+	Score    float64 `json:"score"`
+}
+
+// Searcher finds content matching a request. Implementations must only
+// return results the viewer may see: courses they teach or may enrol in,
+// materials and quizzes of courses they teach or are enrolled in, and news.
+// Results are ordered by descending score; one extra result past
+// Offset+Limit tells the caller there are more.
+type Searcher interface {
+	Search(ctx context.Context, req SearchRequest) ([]SearchResult, error)
+}
+
+// searcher is the Searcher used by searchHandler
+var searcher Searcher = mysqlSearcher{}
+
+// createSearchIndexes adds the FULLTEXT indexes used by mysqlSearcher. It
+// runs after the quiz tables exist.
+func createSearchIndexes() error {
+	indexes := []struct{ table, name, columns string }{
+		{"courses", "ft_courses_search", "title, description"},
+		{"course_materials", "ft_materials_search", "title, description"},
+		{"pdf_documents", "ft_pdf_documents_text", "text_content"},
+		{"quizzes_new", "ft_quizzes_search", "title, description"},
+	}
+	for _, idx := range indexes {
+		if err := ensureIndex(DB, idx.table, idx.name, "FULLTEXT INDEX", idx.columns); err != nil {
+			return err
+		}
+	}
+	if DB2 != nil {
+		if err := ensureIndex(DB2, "news", "ft_news_search", "FULLTEXT INDEX", "title, content"); err != nil {
+			return err
+		}
+	}
+	log.Println("✅ Search indexes created/verified successfully!")
+	return nil
+}
+
+// searchTerms splits a query into words, dropping punctuation so nothing
+// is read as a boolean-mode operator
+func searchTerms(query string) []string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var terms []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if len([]rune(word)) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// booleanQuery requires every term, matching words that start with it
+func booleanQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = "+" + term + "*"
+	}
+	return strings.Join(parts, " ")
+}
+
+// searchSnippet returns a window of text around the first matching term
+func searchSnippet(text string, terms []string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= searchSnippetRunes {
+		return text
+	}
+
+	lower := strings.ToLower(text)
+	start := 0
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 {
+			start = utf8.RuneCountInString(lower[:i]) - searchSnippetRunes/4
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + searchSnippetRunes
+	if end > len(runes) {
+		end = len(runes)
+		start = end - searchSnippetRunes
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	snippet := string(runes[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// mysqlSearcher searches with MySQL FULLTEXT indexes in boolean mode
+type mysqlSearcher struct{}
+
+func (mysqlSearcher) Search(ctx context.Context, req SearchRequest) ([]SearchResult, error) {
+	query := booleanQuery(req.Terms)
+	want := req.Offset + req.Limit + 1
+
+	sources := []struct {
+		kind   string
+		search func(context.Context, SearchRequest, string, int) ([]SearchResult, error)
+	}{
+		{searchTypeCourse, searchCourses},
+		{searchTypeMaterial, searchMaterials},
+		{searchTypeQuiz, searchQuizzes},
+		{searchTypeNews, searchNews},
+	}
+
+	var results []SearchResult
+	for _, source := range sources {
+		if !req.Types[source.kind] {
+			continue
+		}
+		found, err := source.search(ctx, req, query, want)
+		if err != nil {
+			return nil, fmt.Errorf("searching %s: %w", source.kind, err)
+		}
+		results = append(results, found...)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) <= req.Offset {
+		return nil, nil
+	}
+	results = results[req.Offset:]
+	if len(results) > req.Limit+1 {
+		results = results[:req.Limit+1]
+	}
+	return results, nil
+}
+
+// courseVisibility returns the condition on a course ID column limiting
+// materials and quizzes to the viewer's courses, or false if the viewer
+// has no course content
+func courseVisibility(viewer SearchViewer, column string) (string, []interface{}, bool) {
+	switch viewer.Role {
+	case "teacher":
+		return column + " IN (SELECT id FROM courses WHERE teacher_id = ?)", []interface{}{viewer.ID}, true
+	case "student":
+		return column + " IN (SELECT course_id FROM course_enrollments WHERE student_id = ?)", []interface{}{viewer.ID}, true
+	}
+	return "", nil, false
+}
+
+func searchCourses(ctx context.Context, req SearchRequest, query string, limit int) ([]SearchResult, error) {
+	// Students and admins see the whole catalogue; teachers their own courses
+	filter := ""
+	args := []interface{}{query, query}
+	switch req.Viewer.Role {
+	case "student", "admin":
+	case "teacher":
+		filter = "AND teacher_id = ?"
+		args = append(args, req.Viewer.ID)
+	default:
+		return nil, nil
+	}
+	args = append(args, limit)
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, title, IFNULL(description, ''), MATCH(title, description) AGAINST (? IN BOOLEAN MODE) AS score
+		FROM courses
+		WHERE MATCH(title, description) AGAINST (? IN BOOLEAN MODE) `+filter+`
+		ORDER BY score DESC, id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{Type: searchTypeCourse}
+		var description string
+		if err := rows.Scan(&result.ID, &result.Title, &description, &result.Score); err != nil {
+			return nil, err
+		}
+		result.CourseID = result.ID
+		result.Snippet = searchSnippet(description, req.Terms)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func searchMaterials(ctx context.Context, req SearchRequest, query string, limit int) ([]SearchResult, error) {
+	filter, filterArgs, ok := courseVisibility(req.Viewer, "cm.course_id")
+	if !ok {
+		return nil, nil
+	}
+
+	// Title and description matches rank above matches in the PDF text. The
+	// excerpt is a window of the PDF text around the first term.
+	args := []interface{}{req.Terms[0], query, query, query, query}
+	args = append(args, filterArgs...)
+	args = append(args, limit)
+	rows, err := DB.QueryContext(ctx, `
+		SELECT cm.id, cm.course_id, cm.title, IFNULL(cm.description, ''),
+		       IFNULL(SUBSTRING(pd.text_content, GREATEST(1, LOCATE(?, pd.text_content) - 200), 600), '') AS excerpt,
+		       MATCH(cm.title, cm.description) AGAINST (? IN BOOLEAN MODE) * 2 +
+		       IFNULL(MATCH(pd.text_content) AGAINST (? IN BOOLEAN MODE), 0) AS score
+		FROM course_materials cm
+		LEFT JOIN pdf_documents pd ON pd.file_path = cm.file_path AND pd.status = 'ready' AND cm.type = 'pdf'
+		WHERE (MATCH(cm.title, cm.description) AGAINST (? IN BOOLEAN MODE)
+		       OR MATCH(pd.text_content) AGAINST (? IN BOOLEAN MODE))
+		  AND `+filter+`
+		ORDER BY score DESC, cm.id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{Type: searchTypeMaterial}
+		var description, excerpt string
+		if err := rows.Scan(&result.ID, &result.CourseID, &result.Title, &description, &excerpt, &result.Score); err != nil {
+			return nil, err
+		}
+		text := description
+		if excerpt != "" && !containsAnyTerm(result.Title+" "+description, req.Terms) {
+			text = excerpt
+		}
+		result.Snippet = searchSnippet(text, req.Terms)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func containsAnyTerm(text string, terms []string) bool {
+	text = strings.ToLower(text)
+	for _, term := range terms {
+		if strings.Contains(text, term) {
+			return true
+		}
+	}
+	return false
+}
+
+func searchQuizzes(ctx context.Context, req SearchRequest, query string, limit int) ([]SearchResult, error) {
+	filter, filterArgs, ok := courseVisibility(req.Viewer, "course_id")
+	if !ok {
+		return nil, nil
+	}
+
+	args := []interface{}{query, query}
+	args = append(args, filterArgs...)
+	args = append(args, limit)
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, course_id, title, IFNULL(description, ''), MATCH(title, description) AGAINST (? IN BOOLEAN MODE) AS score
+		FROM quizzes_new
+		WHERE MATCH(title, description) AGAINST (? IN BOOLEAN MODE) AND `+filter+`
+		ORDER BY score DESC, id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{Type: searchTypeQuiz}
+		var description string
+		if err := rows.Scan(&result.ID, &result.CourseID, &result.Title, &description, &result.Score); err != nil {
+			return nil, err
+		}
+		result.Snippet = searchSnippet(description, req.Terms)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// searchNews searches the public news in DB2, skipped while it is unavailable
+func searchNews(ctx context.Context, req SearchRequest, query string, limit int) ([]SearchResult, error) {
+	if DB2 == nil {
+		return nil, nil
+	}
+	rows, err := DB2.QueryContext(ctx, `
+		SELECT id, title, content, MATCH(title, content) AGAINST (? IN BOOLEAN MODE) AS score
+		FROM news
+		WHERE MATCH(title, content) AGAINST (? IN BOOLEAN MODE)
+		ORDER BY score DESC, id DESC
+		LIMIT ?
+	`, query, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{Type: searchTypeNews}
+		var content string
+		if err := rows.Scan(&result.ID, &result.Title, &content, &result.Score); err != nil {
+			return nil, err
+		}
+		result.Snippet = searchSnippet(content, req.Terms)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// searchViewer identifies the caller from an optional bearer token
+func searchViewer(r *http.Request) SearchViewer {
+	claims, ok := claimsFromRequest(r)
+	if !ok {
+		return SearchViewer{}
+	}
+	switch claims.Role {
+	case "student":
+		return SearchViewer{Role: "student", ID: claims.StudentID}
+	case "teacher":
+		return SearchViewer{Role: "teacher", ID: claims.TeacherID}
+	case "admin":
+		return SearchViewer{Role: "admin", ID: claims.AdminID}
+	}
+	return SearchViewer{}
+}
+
+// searchHandler serves GET /api/search?q=...&types=course,material&limit=&offset=.
+// Anonymous callers only see news.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := r.URL.Query()
+	q := strings.TrimSpace(params.Get("q"))
+	if len([]rune(q)) > maxSearchQueryRunes {
+		http.Error(w, fmt.Sprintf("Search query must be at most %d characters", maxSearchQueryRunes), http.StatusBadRequest)
+		return
+	}
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		http.Error(w, "Search query must contain a word of at least 2 characters", http.StatusBadRequest)
+		return
+	}
+
+	req := SearchRequest{
+		Terms:  terms,
+		Types:  make(map[string]bool),
+		Viewer: searchViewer(r),
+		Limit:  defaultSearchLimit,
+	}
+	if raw := params.Get("types"); raw != "" {
+		for _, t := range strings.Split(raw, ",") {
+			t = strings.TrimSpace(t)
+			valid := false
+			for _, known := range searchTypes {
+				if t == known {
+					valid = true
+				}
+			}
+			if !valid {
+				http.Error(w, fmt.Sprintf("Unknown search type %q", t), http.StatusBadRequest)
+				return
+			}
+			req.Types[t] = true
+		}
+	} else {
+		for _, t := range searchTypes {
+			req.Types[t] = true
+		}
+	}
+	if raw := params.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		req.Limit = limit
+	}
+	if raw := params.Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 || offset > maxSearchOffset {
+			http.Error(w, fmt.Sprintf("offset must be between 0 and %d", maxSearchOffset), http.StatusBadRequest)
+			return
+		}
+		req.Offset = offset
+	}
+
+	results, err := searcher.Search(r.Context(), req)
+	if err != nil {
+		log.Printf("Error searching for %q: %v", q, err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	hasMore := len(results) > req.Limit
+	if hasMore {
+		results = results[:req.Limit]
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"query":    q,
+		"results":  results,
+		"offset":   req.Offset,
+		"limit":    req.Limit,
+		"has_more": hasMore,
+	})
+}
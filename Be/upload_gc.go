@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultUploadGCGrace is how long an upload must have been unreferenced
+	// before it is collected. It covers files uploaded but not yet attached
+	// to anything, and leaves time to undo accidental deletes.
+	defaultUploadGCGrace = 7 * 24 * time.Hour
+	// defaultQuarantineRetention is how long collected files stay in
+	// quarantine before they are deleted for good
+	defaultQuarantineRetention = 30 * 24 * time.Hour
+
+	quarantinePrefix = "quarantine/"
+	uploadGCLockName = "lms_upload_gc"
+	// uploadKeyLockWait is how long storing a file waits, in seconds, for
+	// the garbage collector to finish with identical content
+	uploadKeyLockWait = 60
+)
+
+// uploadGCOptions controls a garbage collection run
+type uploadGCOptions struct {
+	Grace               time.Duration
+	QuarantineRetention time.Duration
+	DryRun              bool
+}
+
+// uploadGCCandidate is a file that is (or in a dry run, would be) collected
+type uploadGCCandidate struct {
+	FilePath          string
+	Size              int64
+	UnreferencedSince time.Time
+	Tracked           bool // false for files with no row in the uploads table
+}
+
+// uploadGCReport summarises a garbage collection run
+type uploadGCReport struct {
+	DryRun      bool
+	Scanned     int
+	Registered  int
+	Candidates  []uploadGCCandidate
+	Quarantined int
+	Purged      int
+	BytesFreed  int64
+	Failed      int
+}
+
+// createUploadQuarantineTable creates the table of collected files waiting
+// to be purged
+func createUploadQuarantineTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS upload_quarantine (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			file_path VARCHAR(500) NOT NULL,
+			quarantine_key VARCHAR(600) NOT NULL,
+			sha256 CHAR(64) NULL,
+			size_bytes BIGINT NOT NULL,
+			quarantined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_quarantine_path (file_path),
+			INDEX idx_quarantine_time (quarantined_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	log.Println("✅ Upload quarantine table created/verified successfully!")
+	return nil
+}
+
+// uploadGCOptionsFromEnv reads UPLOAD_GC_GRACE, UPLOAD_GC_QUARANTINE_RETENTION
+// (Go durations such as "168h") and UPLOAD_GC_DRY_RUN
+func uploadGCOptionsFromEnv() uploadGCOptions {
+	opts := uploadGCOptions{Grace: defaultUploadGCGrace, QuarantineRetention: defaultQuarantineRetention}
+	if d, err := time.ParseDuration(os.Getenv("UPLOAD_GC_GRACE")); err == nil && d > 0 {
+		opts.Grace = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("UPLOAD_GC_QUARANTINE_RETENTION")); err == nil && d > 0 {
+		opts.QuarantineRetention = d
+	}
+	opts.DryRun, _ = strconv.ParseBool(os.Getenv("UPLOAD_GC_DRY_RUN"))
+	return opts
+}
+
+// withAdvisoryLock runs fn while holding a MySQL advisory lock, waiting up
+// to timeout seconds for it. busy is returned when the lock is not free.
+func withAdvisoryLock(ctx context.Context, name string, timeout int, busy error, fn func() error) error {
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, timeout).Scan(&acquired); err != nil {
+		return err
+	}
+	if acquired.Int64 != 1 {
+		return busy
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+
+	return fn()
+}
+
+// withUploadGCLock runs fn while holding a MySQL advisory lock, so the
+// scheduled job and the gc command never collect at the same time
+func withUploadGCLock(ctx context.Context, fn func() error) error {
+	return withAdvisoryLock(ctx, uploadGCLockName, 0,
+		fmt.Errorf("another upload garbage collection is already running"), fn)
+}
+
+// withUploadKeyLock runs fn while holding the lock of one stored file.
+// Storing content checks whether it already exists under this lock, and the
+// garbage collector only quarantines a file under it, so a file is never
+// moved away just as identical content is uploaded again.
+func withUploadKeyLock(ctx context.Context, filePath string, timeout int, fn func() error) error {
+	// Lock names are limited to 64 characters
+	digest := sha256.Sum256([]byte(filePath))
+	name := "lms_upload:" + hex.EncodeToString(digest[:16])
+	return withAdvisoryLock(ctx, name, timeout, fmt.Errorf("upload %s is in use", filePath), fn)
+}
+
+// runUploadGC collects uploads that no row in either database has pointed
+// at for longer than the grace period. Collected files are moved to
+// quarantine, and quarantined files older than the retention are purged.
+// A dry run only reports what would happen.
+func runUploadGC(ctx context.Context, opts uploadGCOptions) (*uploadGCReport, error) {
+	report := &uploadGCReport{DryRun: opts.DryRun}
+	err := withUploadGCLock(ctx, func() error {
+		cutoff := time.Now().Add(-opts.Grace)
+
+		blobs, err := Storage.List(ctx, "")
+		if err != nil {
+			return fmt.Errorf("failed to list stored files: %w", err)
+		}
+		counts, err := countUploadReferences(nil)
+		if err != nil {
+			return fmt.Errorf("failed to count upload references: %w", err)
+		}
+		tracked, err := loadTrackedUploads()
+		if err != nil {
+			return err
+		}
+		variants, err := loadImageVariantPaths()
+		if err != nil {
+			return err
+		}
+
+		for _, blob := range blobs {
+			// Image variants are collected together with their original,
+			// and so are the HLS output of videos and PDF thumbnails
+			if strings.HasPrefix(blob.Key, quarantinePrefix) || strings.HasPrefix(blob.Key, hlsPrefix) ||
+				strings.HasPrefix(blob.Key, pdfPreviewPrefix) || variants[blobURL(blob.Key)] {
+				continue
+			}
+			report.Scanned++
+			urlPath := blobURL(blob.Key)
+
+			n, counted := counts[urlPath]
+			if !counted && strings.HasPrefix(urlPath, newsUploadPrefix) {
+				continue // DB2 is unavailable, so the file may be in use
+			}
+
+			row, isTracked := tracked[urlPath]
+			if !isTracked {
+				// Files from before the uploads table was added, or left
+				// behind by a failed request, count from their modification time
+				since := blob.ModTime
+				if since.IsZero() {
+					since = time.Now()
+				}
+				if !opts.DryRun {
+					if err := registerUntrackedUpload(ctx, blob, n, since); err != nil {
+						log.Printf("Warning: Failed to register untracked file %s: %v", urlPath, err)
+						report.Failed++
+						continue
+					}
+					report.Registered++
+				}
+				row = trackedUpload{RefCount: n, Size: blob.Size}
+				if n == 0 {
+					row.UnreferencedSince = sql.NullTime{Time: since, Valid: true}
+				}
+			} else if !opts.DryRun && (row.RefCount != n || (n == 0 && !row.UnreferencedSince.Valid)) {
+				if err := setUploadRefCount(urlPath, n); err != nil {
+					report.Failed++
+					continue
+				}
+				if n == 0 && !row.UnreferencedSince.Valid {
+					row.UnreferencedSince = sql.NullTime{Time: time.Now(), Valid: true}
+				}
+			}
+
+			if n > 0 || !row.UnreferencedSince.Valid || !row.UnreferencedSince.Time.Before(cutoff) {
+				continue
+			}
+			report.Candidates = append(report.Candidates, uploadGCCandidate{
+				FilePath:          urlPath,
+				Size:              blob.Size,
+				UnreferencedSince: row.UnreferencedSince.Time,
+				Tracked:           isTracked,
+			})
+		}
+
+		// Tracked rows whose file has disappeared from storage
+		if !opts.DryRun {
+			present := make(map[string]bool, len(blobs))
+			for _, blob := range blobs {
+				present[blobURL(blob.Key)] = true
+			}
+			for filePath := range tracked {
+				if !present[filePath] {
+					log.Printf("Warning: Upload %s is tracked but missing from storage", filePath)
+				}
+			}
+		}
+
+		if opts.DryRun {
+			purgeable, err := expiredQuarantineCount(opts.QuarantineRetention)
+			if err != nil {
+				return err
+			}
+			report.Purged = purgeable
+			return nil
+		}
+
+		for _, candidate := range report.Candidates {
+			if err := quarantineUpload(ctx, candidate.FilePath, cutoff); err != nil {
+				log.Printf("Error quarantining %s: %v", candidate.FilePath, err)
+				report.Failed++
+				continue
+			}
+			report.Quarantined++
+		}
+
+		purged, freed, err := purgeQuarantine(ctx, opts.QuarantineRetention)
+		report.Purged, report.BytesFreed = purged, freed
+		return err
+	})
+	return report, err
+}
+
+type trackedUpload struct {
+	RefCount          int
+	Size              int64
+	UnreferencedSince sql.NullTime
+}
+
+func loadTrackedUploads() (map[string]trackedUpload, error) {
+	rows, err := DB.Query("SELECT file_path, ref_count, size_bytes, unreferenced_since FROM uploads")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracked := make(map[string]trackedUpload)
+	for rows.Next() {
+		var filePath string
+		var row trackedUpload
+		if err := rows.Scan(&filePath, &row.RefCount, &row.Size, &row.UnreferencedSince); err != nil {
+			return nil, err
+		}
+		tracked[filePath] = row
+	}
+	return tracked, rows.Err()
+}
+
+// registerUntrackedUpload adds an uploads row for a stored file without one
+func registerUntrackedUpload(ctx context.Context, blob BlobInfo, refCount int, since time.Time) error {
+	body, _, err := Storage.Get(ctx, blob.Key)
+	if err != nil {
+		return err
+	}
+	digest, err := hashContent(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	var unreferencedSince interface{}
+	if refCount == 0 {
+		unreferencedSince = since
+	}
+	_, err = DB.Exec(`
+		INSERT IGNORE INTO uploads (file_path, sha256, original_name, mime_type, size_bytes, ref_count, unreferenced_since)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, blobURL(blob.Key), digest, truncateString(path.Base(blob.Key), 255), blobContentType(blob.Key),
+		blob.Size, refCount, unreferencedSince)
+	return err
+}
+
+// quarantineUpload re-checks that a file is still unreferenced and has been
+// since before the cutoff, drops its uploads row and moves it under
+// quarantine/
+func quarantineUpload(ctx context.Context, filePath string, cutoff time.Time) error {
+	return withUploadKeyLock(ctx, filePath, 0, func() error {
+		return quarantineLockedUpload(ctx, filePath, cutoff)
+	})
+}
+
+func quarantineLockedUpload(ctx context.Context, filePath string, cutoff time.Time) error {
+	counts, err := countUploadReferences([]string{filePath})
+	if err != nil {
+		return err
+	}
+	if n, ok := counts[filePath]; !ok || n > 0 {
+		return fmt.Errorf("file is referenced again")
+	}
+	key, ok := blobKeyFromURL(filePath)
+	if !ok {
+		return fmt.Errorf("invalid file path")
+	}
+
+	var digest sql.NullString
+	DB.QueryRow("SELECT sha256 FROM uploads WHERE file_path = ?", filePath).Scan(&digest)
+
+	// Drop the row first: if moving the file then fails, it is picked up
+	// again as untracked on the next run. Uploading the file again restarts
+	// its grace period, which keeps the row.
+	res, err := DB.Exec(`
+		DELETE FROM uploads WHERE file_path = ? AND ref_count = 0 AND unreferenced_since < ?
+	`, filePath, cutoff)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		if exists, _ := uploadExists(filePath); exists {
+			return fmt.Errorf("file is referenced or uploaded again")
+		}
+	}
+
+	body, info, err := Storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	quarantineKey := quarantinePrefix + time.Now().Format("20060102") + "/" + key
+	err = Storage.Put(ctx, quarantineKey, body, info.Size, info.ContentType)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	if _, err := DB.Exec(`
+		INSERT INTO upload_quarantine (file_path, quarantine_key, sha256, size_bytes) VALUES (?, ?, ?, ?)
+	`, filePath, quarantineKey, digest, info.Size); err != nil {
+		Storage.Delete(ctx, quarantineKey)
+		return err
+	}
+	if err := Storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	// Variants, transcodes and PDF previews are not quarantined; they can
+	// be made again
+	deleteImageVariants(ctx, filePath)
+	deleteVideoTranscode(ctx, filePath)
+	deletePDFDocument(ctx, filePath)
+
+	log.Printf("Quarantined unreferenced upload %s as %s", filePath, quarantineKey)
+	return nil
+}
+
+func expiredQuarantineCount(retention time.Duration) (int, error) {
+	var n int
+	err := DB.QueryRow("SELECT COUNT(*) FROM upload_quarantine WHERE quarantined_at < ?", time.Now().Add(-retention)).Scan(&n)
+	return n, err
+}
+
+// purgeQuarantine permanently deletes files quarantined longer than retention
+func purgeQuarantine(ctx context.Context, retention time.Duration) (int, int64, error) {
+	rows, err := DB.Query(`
+		SELECT id, quarantine_key, size_bytes FROM upload_quarantine WHERE quarantined_at < ?
+	`, time.Now().Add(-retention))
+	if err != nil {
+		return 0, 0, err
+	}
+	type expired struct {
+		id   int
+		key  string
+		size int64
+	}
+	var due []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.id, &e.key, &e.size); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		due = append(due, e)
+	}
+	rows.Close()
+
+	purged, freed := 0, int64(0)
+	for _, e := range due {
+		if err := Storage.Delete(ctx, e.key); err != nil {
+			log.Printf("Error purging quarantined file %s: %v", e.key, err)
+			continue
+		}
+		if _, err := DB.Exec("DELETE FROM upload_quarantine WHERE id = ?", e.id); err != nil {
+			log.Printf("Error removing quarantine record %d: %v", e.id, err)
+			continue
+		}
+		purged++
+		freed += e.size
+	}
+	return purged, freed, nil
+}
+
+// restoreQuarantinedUpload moves the most recently quarantined copy of a
+// file back to its original path
+func restoreQuarantinedUpload(ctx context.Context, filePath string) error {
+	var id int
+	var quarantineKey string
+	err := DB.QueryRow(`
+		SELECT id, quarantine_key FROM upload_quarantine WHERE file_path = ? ORDER BY quarantined_at DESC, id DESC LIMIT 1
+	`, filePath).Scan(&id, &quarantineKey)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s is not in quarantine", filePath)
+	}
+	if err != nil {
+		return err
+	}
+	key, ok := blobKeyFromURL(filePath)
+	if !ok {
+		return fmt.Errorf("invalid file path")
+	}
+
+	body, info, err := Storage.Get(ctx, quarantineKey)
+	if err != nil {
+		return err
+	}
+	err = Storage.Put(ctx, key, body, info.Size, info.ContentType)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	blob := BlobInfo{Key: key, Size: info.Size, ContentType: info.ContentType}
+	if err := registerUntrackedUpload(ctx, blob, 0, time.Now()); err != nil {
+		return err
+	}
+	refreshUploadReferences(filePath)
+	if err := regenerateImageVariants(ctx, filePath); err != nil {
+		log.Printf("Warning: Failed to recreate image variants for %s: %v", filePath, err)
+	}
+	if strings.EqualFold(path.Ext(filePath), ".pdf") {
+		if _, err := queuePDFProcessing(filePath); err != nil {
+			log.Printf("Warning: Failed to queue processing of %s: %v", filePath, err)
+		}
+	}
+
+	if _, err := DB.Exec("DELETE FROM upload_quarantine WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := Storage.Delete(ctx, quarantineKey); err != nil {
+		log.Printf("Warning: Failed to remove restored quarantine copy %s: %v", quarantineKey, err)
+	}
+	log.Printf("Restored %s from quarantine", filePath)
+	return nil
+}
+
+// startUploadGCWorker runs the garbage collector periodically with options
+// from the environment
+func startUploadGCWorker(interval time.Duration) {
+	opts := uploadGCOptionsFromEnv()
+	go func() {
+		for {
+			report, err := runUploadGC(context.Background(), opts)
+			if err != nil {
+				log.Printf("Upload garbage collection failed: %v", err)
+			} else if len(report.Candidates) > 0 || report.Purged > 0 || report.Failed > 0 {
+				log.Printf("Upload garbage collection: %s", report.summary())
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (r *uploadGCReport) summary() string {
+	var candidateBytes int64
+	for _, c := range r.Candidates {
+		candidateBytes += c.Size
+	}
+	if r.DryRun {
+		return fmt.Sprintf("dry run: scanned %d files, would quarantine %d (%d bytes), would purge %d from quarantine",
+			r.Scanned, len(r.Candidates), candidateBytes, r.Purged)
+	}
+	return fmt.Sprintf("scanned %d files, registered %d untracked, quarantined %d (%d bytes), purged %d (%d bytes freed), %d failed",
+		r.Scanned, r.Registered, r.Quarantined, candidateBytes, r.Purged, r.BytesFreed, r.Failed)
+}
+
+// runGCCommand implements "edtech-backend gc [flags]" for running the
+// collector by hand, e.g. "go run . gc -dry-run"
+func runGCCommand(args []string) int {
+	defaults := uploadGCOptionsFromEnv()
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", defaults.DryRun, "only report what would be collected")
+	grace := flags.Duration("grace", defaults.Grace, "how long a file must be unreferenced before it is collected")
+	retention := flags.Duration("quarantine-retention", defaults.QuarantineRetention, "how long collected files stay in quarantine")
+	restore := flags.String("restore", "", "move a quarantined file (e.g. /uploads/materials/<sha>.pdf) back into place")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+	if *restore != "" {
+		if err := restoreQuarantinedUpload(ctx, *restore); err != nil {
+			fmt.Fprintf(os.Stderr, "restore failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Restored %s\n", *restore)
+		return 0
+	}
+
+	report, err := runUploadGC(ctx, uploadGCOptions{Grace: *grace, QuarantineRetention: *retention, DryRun: *dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "garbage collection failed: %v\n", err)
+		return 1
+	}
+	for _, c := range report.Candidates {
+		state := "tracked"
+		if !c.Tracked {
+			state = "untracked"
+		}
+		fmt.Printf("%s\t%d bytes\tunreferenced since %s\t%s\n", c.FilePath, c.Size, c.UnreferencedSince.Format(time.RFC3339), state)
+	}
+	fmt.Println(report.summary())
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
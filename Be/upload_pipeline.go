@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileFormat describes how to recognise one kind of uploaded file by its content
+type fileFormat struct {
+	Kind  string // image, document, video, audio, archive or text
+	Match func(head []byte) bool
+	Zip   bool // ZIP-based container, so a trailing ZIP directory is expected
+}
+
+func hasPrefix(prefixes ...string) func([]byte) bool {
+	return func(head []byte) bool {
+		for _, p := range prefixes {
+			if bytes.HasPrefix(head, []byte(p)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func hasAt(offset int, values ...string) func([]byte) bool {
+	return func(head []byte) bool {
+		for _, v := range values {
+			if len(head) >= offset+len(v) && string(head[offset:offset+len(v)]) == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func riffOf(form string) func([]byte) bool {
+	return func(head []byte) bool {
+		return hasPrefix("RIFF")(head) && hasAt(8, form)(head)
+	}
+}
+
+// isMPEGAudio matches an ID3 tag or a bare MPEG/ADTS frame sync
+func isMPEGAudio(head []byte) bool {
+	return hasPrefix("ID3")(head) || (len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0)
+}
+
+// isPlainText accepts UTF-8 text without NUL bytes (an optional BOM is fine)
+func isPlainText(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	// The head may end in the middle of a multi-byte rune
+	for i := 0; i < 3 && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head)
+}
+
+func textStartingWith(prefixes ...string) func([]byte) bool {
+	return func(head []byte) bool {
+		if !isPlainText(head) {
+			return false
+		}
+		trimmed := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n")
+		return hasPrefix(prefixes...)(trimmed)
+	}
+}
+
+var (
+	isoMediaBoxes = []string{"ftyp", "moov", "mdat", "wide", "free", "skip"}
+	oleCompound   = "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"
+	zipLocal      = "PK\x03\x04"
+	ebml          = "\x1A\x45\xDF\xA3"
+	asfHeader     = "\x30\x26\xB2\x75\x8E\x66\xCF\x11"
+)
+
+// fileFormats maps each accepted extension to the signature its content must have
+var fileFormats = map[string]fileFormat{
+	// Images
+	".jpg":  {Kind: "image", Match: hasPrefix("\xFF\xD8\xFF")},
+	".jpeg": {Kind: "image", Match: hasPrefix("\xFF\xD8\xFF")},
+	".png":  {Kind: "image", Match: hasPrefix("\x89PNG\r\n\x1A\n")},
+	".gif":  {Kind: "image", Match: hasPrefix("GIF87a", "GIF89a")},
+	".webp": {Kind: "image", Match: riffOf("WEBP")},
+	".bmp":  {Kind: "image", Match: hasPrefix("BM")},
+	// Documents
+	".pdf":  {Kind: "document", Match: hasPrefix("%PDF-")},
+	".doc":  {Kind: "document", Match: hasPrefix(oleCompound)},
+	".xls":  {Kind: "document", Match: hasPrefix(oleCompound)},
+	".ppt":  {Kind: "document", Match: hasPrefix(oleCompound)},
+	".docx": {Kind: "document", Match: hasPrefix(zipLocal), Zip: true},
+	".xlsx": {Kind: "document", Match: hasPrefix(zipLocal), Zip: true},
+	".pptx": {Kind: "document", Match: hasPrefix(zipLocal), Zip: true},
+	".odt":  {Kind: "document", Match: hasPrefix(zipLocal), Zip: true},
+	".ods":  {Kind: "document", Match: hasPrefix(zipLocal), Zip: true},
+	".odp":  {Kind: "document", Match: hasPrefix(zipLocal), Zip: true},
+	".rtf":  {Kind: "document", Match: hasPrefix("{\\rtf")},
+	// Videos
+	".mp4":  {Kind: "video", Match: hasAt(4, isoMediaBoxes...)},
+	".m4v":  {Kind: "video", Match: hasAt(4, isoMediaBoxes...)},
+	".mov":  {Kind: "video", Match: hasAt(4, isoMediaBoxes...)},
+	".3gp":  {Kind: "video", Match: hasAt(4, isoMediaBoxes...)},
+	".avi":  {Kind: "video", Match: riffOf("AVI ")},
+	".wmv":  {Kind: "video", Match: hasPrefix(asfHeader)},
+	".flv":  {Kind: "video", Match: hasPrefix("FLV\x01")},
+	".webm": {Kind: "video", Match: hasPrefix(ebml)},
+	".mkv":  {Kind: "video", Match: hasPrefix(ebml)},
+	".mpg":  {Kind: "video", Match: hasPrefix("\x00\x00\x01\xBA", "\x00\x00\x01\xB3")},
+	".mpeg": {Kind: "video", Match: hasPrefix("\x00\x00\x01\xBA", "\x00\x00\x01\xB3")},
+	// Audio
+	".mp3":  {Kind: "audio", Match: isMPEGAudio},
+	".aac":  {Kind: "audio", Match: func(h []byte) bool { return isMPEGAudio(h) || hasPrefix("ADIF")(h) }},
+	".wav":  {Kind: "audio", Match: riffOf("WAVE")},
+	".flac": {Kind: "audio", Match: hasPrefix("fLaC")},
+	".ogg":  {Kind: "audio", Match: hasPrefix("OggS")},
+	".wma":  {Kind: "audio", Match: hasPrefix(asfHeader)},
+	".m4a":  {Kind: "audio", Match: hasAt(4, isoMediaBoxes...)},
+	// Archives
+	".zip": {Kind: "archive", Match: hasPrefix(zipLocal, "PK\x05\x06"), Zip: true},
+	".rar": {Kind: "archive", Match: hasPrefix("Rar!\x1A\x07")},
+	".7z":  {Kind: "archive", Match: hasPrefix("7z\xBC\xAF\x27\x1C")},
+	".gz":  {Kind: "archive", Match: hasPrefix("\x1F\x8B")},
+	".tar": {Kind: "archive", Match: hasAt(257, "ustar")},
+	// Text
+	".txt":  {Kind: "text", Match: isPlainText},
+	".csv":  {Kind: "text", Match: isPlainText},
+	".json": {Kind: "text", Match: textStartingWith("{", "[")},
+}
+
+// uploadCategory is the set of rules for one kind of upload
+type uploadCategory struct {
+	Name        string
+	Dir         string // Directory in the blob store ("" for the root)
+	Exts        []string
+	MaxSize     int64
+	KindMaxSize map[string]int64 // Tighter limits for some kinds of file
+	Image       *imageRules      // Dimension limits and resized variants for images
+}
+
+var (
+	imageUploadExts = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+
+	courseImageUploads = uploadCategory{Name: "course image", Dir: "", Exts: imageUploadExts, MaxSize: 15 << 20, Image: courseImageRules}
+	newsImageUploads   = uploadCategory{Name: "news image", Dir: "news", Exts: imageUploadExts, MaxSize: 5 << 20, Image: newsImageRules}
+	quizPDFUploads     = uploadCategory{Name: "quiz PDF", Dir: "quiz-pdfs", Exts: []string{".pdf"}, MaxSize: 15 << 20}
+	quizAnswerUploads  = uploadCategory{Name: "quiz answer", Dir: "quiz-answers", Exts: []string{".pdf", ".jpg", ".jpeg", ".png"}, MaxSize: 15 << 20}
+	materialUploads    = uploadCategory{
+		Name: "material",
+		Dir:  "materials",
+		Exts: []string{
+			".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp",
+			".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".txt", ".rtf", ".odt", ".ods", ".odp",
+			".mp4", ".avi", ".mov", ".wmv", ".flv", ".webm", ".mkv", ".m4v", ".3gp", ".mpg", ".mpeg",
+			".mp3", ".wav", ".flac", ".aac", ".ogg", ".wma", ".m4a",
+			".zip", ".rar", ".7z", ".tar", ".gz",
+			".csv", ".json",
+		},
+		MaxSize:     100 << 20,
+		KindMaxSize: map[string]int64{"image": 15 << 20},
+	}
+	// Resumable uploads exist for lecture recordings, so video and audio may
+	// be far larger than through the single-request material upload
+	resumableMaterialUploads = uploadCategory{
+		Name:    "material",
+		Dir:     materialUploads.Dir,
+		Exts:    materialUploads.Exts,
+		MaxSize: 2 << 30,
+		KindMaxSize: map[string]int64{
+			"image": 15 << 20, "document": 100 << 20, "archive": 100 << 20, "text": 100 << 20,
+		},
+	}
+)
+
+func (c uploadCategory) allows(ext string) bool {
+	return containsString(c.Exts, ext)
+}
+
+func (c uploadCategory) maxSizeFor(kind string) int64 {
+	if limit, ok := c.KindMaxSize[kind]; ok && limit < c.MaxSize {
+		return limit
+	}
+	return c.MaxSize
+}
+
+// uploadError is a rejection that should be reported to the uploader as-is
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+func rejectUpload(format string, args ...interface{}) *uploadError {
+	return &uploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeUploadError reports a processUpload failure without leaking internal errors
+func writeUploadError(w http.ResponseWriter, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		http.Error(w, ue.Message, ue.Status)
+		return
+	}
+	http.Error(w, "Error saving file", http.StatusInternalServerError)
+}
+
+// StoredUpload describes a file accepted and saved by processUpload
+type StoredUpload struct {
+	URLPath      string
+	FileName     string
+	OriginalName string
+	ContentType  string
+	Kind         string
+	Size         int64
+	SHA256       string
+	Deduplicated bool // The same content was already stored
+	Width        int  // Image dimensions, zero for other files
+	Height       int
+	Variants     []ImageVariant
+}
+
+var (
+	// Markup that turns an image or media file into something a browser
+	// may execute when the file is opened directly
+	polyglotMarkers = [][]byte{[]byte("<script"), []byte("<html"), []byte("<?php"), []byte("<iframe"), []byte("<object"), []byte("<embed")}
+	// The end-of-central-directory record that lets ZIP readers open a file
+	zipEndOfDirectory = []byte("PK\x05\x06")
+	uploadSlugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+const (
+	uploadHeadSize = 8 << 10
+	uploadTailSize = 64 << 10
+)
+
+// sanitizeUploadName turns an uploaded file name into a safe lowercase slug
+// such as "chapter-1-notes.pdf"
+func sanitizeUploadName(name, ext string) string {
+	base := strings.TrimSuffix(filepath.Base(strings.ReplaceAll(name, "\\", "/")), filepath.Ext(name))
+	slug := strings.Trim(uploadSlugPattern.ReplaceAllString(strings.ToLower(base), "-"), "-")
+	if len(slug) > 80 {
+		slug = strings.TrimRight(slug[:80], "-")
+	}
+	if slug == "" {
+		slug = "file"
+	}
+	return slug + ext
+}
+
+// processUpload validates an uploaded file against its category, scans it
+// for malware and saves it to the blob store under its SHA-256, so the same
+// content is only stored once per category. Rejections are returned as
+// *uploadError; anything else is an internal failure.
+func processUpload(ctx context.Context, category uploadCategory, file multipart.File, header *multipart.FileHeader, owner uploadOwner) (*StoredUpload, error) {
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if !category.allows(ext) {
+		return nil, rejectUpload("Invalid file type. Allowed types: %s", strings.ToUpper(strings.ReplaceAll(strings.Join(category.Exts, ", "), ".", "")))
+	}
+	format := fileFormats[ext]
+
+	size := header.Size
+	if size <= 0 {
+		return nil, rejectUpload("File is empty")
+	}
+	if limit := category.maxSizeFor(format.Kind); size > limit {
+		return nil, rejectUpload("File too large. Maximum size is %dMB", limit>>20)
+	}
+	if owner.Role == "teacher" {
+		if err := checkTeacherStorageQuota(owner, size); err != nil {
+			return nil, err
+		}
+	}
+
+	// The content must really be what the extension claims
+	head := make([]byte, uploadHeadSize)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	if format.Match == nil || !format.Match(head) {
+		return nil, rejectUpload("File content does not match its %s extension", ext)
+	}
+
+	if err := checkPolyglot(file, size, format, head); err != nil {
+		return nil, err
+	}
+
+	if _, isOffice := officeDocumentMarkers[ext]; isOffice {
+		if err := validateOfficeDocument(file, size, ext); err != nil {
+			return nil, rejectUpload("%s", err.Error())
+		}
+	}
+
+	result, err := Scanner.Scan(ctx, io.NewSectionReader(file, 0, size))
+	if err != nil {
+		log.Printf("Malware scan failed for %s: %v", header.Filename, err)
+		return nil, &uploadError{Status: http.StatusServiceUnavailable, Message: "File could not be scanned, please try again later"}
+	}
+	if result.Infected {
+		log.Printf("⚠️  Rejected infected upload %s: %s", header.Filename, result.Signature)
+		return nil, rejectUpload("File rejected by malware scan")
+	}
+
+	// Images are stored without their metadata, so the stripped content is
+	// what gets hashed and saved
+	var content io.ReaderAt = file
+	var prepared *preparedImage
+	if format.Kind == "image" {
+		prepared, err = prepareImage(ctx, file, size, ext, category.Image)
+		if err != nil {
+			return nil, err
+		}
+		if prepared != nil && prepared.Data != nil {
+			content, size = bytes.NewReader(prepared.Data), int64(len(prepared.Data))
+		}
+	}
+
+	digest, err := hashContent(io.NewSectionReader(content, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	key := contentAddressedKey(category.Dir, digest, ext)
+
+	upload := &StoredUpload{
+		URLPath:      blobURL(key),
+		FileName:     path.Base(key),
+		OriginalName: sanitizeUploadName(header.Filename, ext),
+		ContentType:  blobContentType(key),
+		Kind:         format.Kind,
+		Size:         size,
+		SHA256:       digest,
+	}
+
+	// The garbage collector must not quarantine the file between finding
+	// it stored and registering it again
+	err = withUploadKeyLock(ctx, upload.URLPath, uploadKeyLockWait, func() error {
+		var err error
+		upload.Deduplicated, err = uploadExists(upload.URLPath)
+		if err != nil {
+			return err
+		}
+		if !upload.Deduplicated {
+			if err := Storage.Put(ctx, key, io.NewSectionReader(content, 0, size), size, upload.ContentType); err != nil {
+				return err
+			}
+		}
+		return registerUpload(upload, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if prepared != nil {
+		upload.Width, upload.Height = prepared.Width, prepared.Height
+		if category.Image != nil && len(category.Image.VariantWidths) > 0 {
+			// The original is already stored, so missing variants are not fatal
+			upload.Variants, err = ensureImageVariants(ctx, upload, prepared, category.Image)
+			if err != nil {
+				log.Printf("Warning: Failed to create image variants for %s: %v", upload.URLPath, err)
+			}
+		}
+	}
+
+	if upload.Deduplicated {
+		log.Printf("Reused stored %s %s for upload %s", category.Name, upload.URLPath, header.Filename)
+	} else {
+		log.Printf("Stored %s upload %s (%d bytes) as %s", category.Name, header.Filename, size, upload.URLPath)
+	}
+	return upload, nil
+}
+
+// checkPolyglot rejects files that are also valid as a second format: markup
+// a browser would run, or a ZIP archive appended to an image, PDF or video
+func checkPolyglot(file io.ReaderAt, size int64, format fileFormat, head []byte) error {
+	tailSize := int64(uploadTailSize)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := file.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return err
+	}
+
+	if format.Kind != "text" {
+		lowerHead, lowerTail := bytes.ToLower(head), bytes.ToLower(tail)
+		for _, marker := range polyglotMarkers {
+			if bytes.Contains(lowerHead, marker) || bytes.Contains(lowerTail, marker) {
+				return rejectUpload("File contains embedded web content and was rejected")
+			}
+		}
+	}
+
+	if !format.Zip && format.Kind != "archive" && bytes.Contains(tail, zipEndOfDirectory) {
+		return rejectUpload("File contains an embedded archive and was rejected")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFileFormatsMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		ext   string
+		head  string
+		match bool
+	}{
+		{"jpeg", ".jpg", "\xFF\xD8\xFF\xE0\x00\x10JFIF", true},
+		{"png named jpeg", ".jpg", "\x89PNG\r\n\x1A\n", false},
+		{"png", ".png", "\x89PNG\r\n\x1A\n\x00\x00", true},
+		{"webp", ".webp", "RIFF\x10\x00\x00\x00WEBPVP8 ", true},
+		{"wav named webp", ".webp", "RIFF\x10\x00\x00\x00WAVEfmt ", false},
+		{"pdf", ".pdf", "%PDF-1.7\n", true},
+		{"html named pdf", ".pdf", "<html><body>", false},
+		{"docx", ".docx", "PK\x03\x04\x14\x00", true},
+		{"mp4", ".mp4", "\x00\x00\x00\x18ftypmp42", true},
+		{"executable named mp4", ".mp4", "MZ\x90\x00\x03\x00\x00\x00", false},
+		{"mp3 with ID3 tag", ".mp3", "ID3\x04\x00", true},
+		{"bare mp3 frame", ".mp3", "\xFF\xFB\x90\x00", true},
+		{"tar", ".tar", strings.Repeat("\x00", 257) + "ustar\x0000", true},
+		{"text", ".txt", "Catatan kuliah\nminggu 1", true},
+		{"text with BOM", ".csv", "\xEF\xBB\xBFnama,nilai\n", true},
+		{"binary named text", ".txt", "abc\x00def", false},
+		{"json object", ".json", "  {\"a\": 1}", true},
+		{"text named json", ".json", "hello", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, ok := fileFormats[tt.ext]
+			if !ok {
+				t.Fatalf("no format for %s", tt.ext)
+			}
+			if got := format.Match([]byte(tt.head)); got != tt.match {
+				t.Errorf("fileFormats[%q].Match() = %v, want %v", tt.ext, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestCheckPolyglot(t *testing.T) {
+	png := "\x89PNG\r\n\x1A\n" + strings.Repeat("\x00", 64)
+	tests := []struct {
+		name    string
+		ext     string
+		content string
+		wantErr bool
+	}{
+		{"plain image", ".png", png, false},
+		{"script in an image", ".png", png + "<SCRIPT>alert(1)</script>", true},
+		{"html at the start of a pdf", ".pdf", "%PDF-1.4\n<html><body>", true},
+		{"php in a pdf", ".pdf", "%PDF-1.4\n" + strings.Repeat(" ", 100) + "<?php echo 1; ?>", true},
+		{"zip appended to an image", ".png", png + "PK\x05\x06" + strings.Repeat("\x00", 18), true},
+		{"zip appended to a video", ".mp4", "\x00\x00\x00\x18ftypmp42" + "PK\x05\x06", true},
+		{"zip-based document", ".docx", "PK\x03\x04" + strings.Repeat("\x00", 32) + "PK\x05\x06", false},
+		{"zip archive", ".zip", "PK\x03\x04" + strings.Repeat("\x00", 32) + "PK\x05\x06", false},
+		{"markup in a text file", ".txt", "Contoh: <script>alert(1)</script>", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := []byte(tt.content)
+			head := content
+			if len(head) > uploadHeadSize {
+				head = head[:uploadHeadSize]
+			}
+			err := checkPolyglot(bytes.NewReader(content), int64(len(content)), fileFormats[tt.ext], head)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkPolyglot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := err.(*uploadError); err != nil && !ok {
+				t.Errorf("checkPolyglot() error = %T, want an upload error", err)
+			}
+		})
+	}
+}
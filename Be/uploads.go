@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// uploadOwner identifies who uploaded a file
+type uploadOwner struct {
+	Role string // teacher, student or admin
+	ID   int
+	// Bytes of the teacher's quota a resumable upload already reserved
+	// for this file
+	Reserved int64
+}
+
+// uploadReferenceSource is a column in the main database that stores
+// /uploads/ paths
+type uploadReferenceSource struct {
+	Table  string
+	Column string
+}
+
+var uploadReferenceSources = []uploadReferenceSource{
+	{"courses", "image_path"},
+	{"course_materials", "file_path"},
+	{"material_versions", "file_path"},
+	{"quizzes_new", "pdf_file_path"},
+	{"quiz_submissions", "uploaded_file_path"},
+}
+
+// News images live in the admin database (DB2)
+const newsUploadPrefix = "/uploads/news/"
+
+// createUploadsTable creates the table of content-addressed uploads and
+// the table of who uploaded each of them. Identical content is stored once
+// but belongs to everyone who uploaded it; uploads.owner_role and owner_id
+// only record the first of them.
+func createUploadsTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS uploads (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			file_path VARCHAR(500) NOT NULL,
+			sha256 CHAR(64) NOT NULL,
+			owner_role ENUM('teacher', 'student', 'admin') NULL,
+			owner_id INT NULL,
+			original_name VARCHAR(255) NULL,
+			mime_type VARCHAR(100) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			ref_count INT NOT NULL DEFAULT 0,
+			unreferenced_since TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_upload_path (file_path),
+			INDEX idx_upload_sha256 (sha256),
+			INDEX idx_upload_owner (owner_role, owner_id),
+			INDEX idx_upload_unreferenced (ref_count, unreferenced_since)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS upload_owners (
+			upload_id INT NOT NULL,
+			owner_role ENUM('teacher', 'student', 'admin') NOT NULL,
+			owner_id INT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (upload_id, owner_role, owner_id),
+			INDEX idx_upload_owners_owner (owner_role, owner_id),
+			FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// Uploads registered before upload_owners existed
+	_, err = DB.Exec(`
+		INSERT IGNORE INTO upload_owners (upload_id, owner_role, owner_id, created_at)
+		SELECT id, owner_role, owner_id, created_at FROM uploads
+		WHERE owner_role IS NOT NULL AND owner_id IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+	log.Println("✅ Uploads table created/verified successfully!")
+	return nil
+}
+
+// contentAddressedKey is the blob key for content with the given digest
+func contentAddressedKey(dir, digest, ext string) string {
+	if dir == "" {
+		return digest + ext
+	}
+	return dir + "/" + digest + ext
+}
+
+// hashContent returns the hex SHA-256 of r
+func hashContent(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadExists reports whether a file is already tracked in the uploads table
+func uploadExists(filePath string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM uploads WHERE file_path = ?)", filePath).Scan(&exists)
+	return err == nil && exists, err
+}
+
+// registerUpload records a stored file and who uploaded it. Uploading
+// content that is already stored adds the uploader as an owner and restarts
+// its grace period, so a pending garbage collection does not remove a file
+// someone is about to use again.
+func registerUpload(upload *StoredUpload, owner uploadOwner) error {
+	var ownerRole, ownerID interface{}
+	if owner.Role != "" {
+		ownerRole, ownerID = owner.Role, owner.ID
+	}
+	_, err := DB.Exec(`
+		INSERT INTO uploads (file_path, sha256, owner_role, owner_id, original_name, mime_type, size_bytes, unreferenced_since)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE unreferenced_since = IF(ref_count = 0, NOW(), NULL)
+	`, upload.URLPath, upload.SHA256, ownerRole, ownerID, truncateString(upload.OriginalName, 255),
+		upload.ContentType, upload.Size)
+	if err != nil || owner.Role == "" {
+		return err
+	}
+	_, err = DB.Exec(`
+		INSERT IGNORE INTO upload_owners (upload_id, owner_role, owner_id)
+		SELECT id, ?, ? FROM uploads WHERE file_path = ?
+	`, owner.Role, owner.ID, upload.URLPath)
+	return err
+}
+
+// uploadOwnedBy is an EXISTS condition on a file path and owner ID, true
+// when the owner uploaded the file; %s is the owner role
+const uploadOwnedBy = `EXISTS(SELECT 1 FROM upload_owners o JOIN uploads u ON u.id = o.upload_id
+	              WHERE u.file_path = ? AND o.owner_role = '%s' AND o.owner_id = ?)`
+
+func truncateString(s string, max int) string {
+	if runes := []rune(s); len(runes) > max {
+		return string(runes[:max])
+	}
+	return s
+}
+
+// countUploadReferences counts how many rows in the main and admin databases
+// point at each of the given files. A nil filePaths counts every reference.
+// News files cannot be counted while DB2 is unavailable, so they are
+// reported as missing from the result and must be treated as in use.
+func countUploadReferences(filePaths []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	if filePaths != nil && len(filePaths) == 0 {
+		return counts, nil
+	}
+
+	where := "%[1]s IS NOT NULL AND %[1]s != ''"
+	var args []interface{}
+	if filePaths != nil {
+		where = "%[1]s IN (?" + strings.Repeat(", ?", len(filePaths)-1) + ")"
+		for _, p := range filePaths {
+			args = append(args, p)
+		}
+	}
+
+	count := func(db *sql.DB, table, column string) error {
+		query := fmt.Sprintf("SELECT %[1]s, COUNT(*) FROM %[2]s WHERE "+where+" GROUP BY %[1]s", column, table)
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to count references in %s.%s: %w", table, column, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var filePath string
+			var n int
+			if err := rows.Scan(&filePath, &n); err != nil {
+				return err
+			}
+			counts[filePath] += n
+		}
+		return rows.Err()
+	}
+
+	for _, source := range uploadReferenceSources {
+		if err := count(DB, source.Table, source.Column); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every requested main-database path now has a count, even if zero
+	for _, p := range filePaths {
+		if _, ok := counts[p]; !ok {
+			counts[p] = 0
+		}
+	}
+
+	if DB2 == nil {
+		for p := range counts {
+			if strings.HasPrefix(p, newsUploadPrefix) {
+				delete(counts, p)
+			}
+		}
+		return counts, nil
+	}
+	if err := count(DB2, "news", "image_url"); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// refreshUploadReferences recounts the references to the given files after
+// rows pointing at them were created, changed or deleted
+func refreshUploadReferences(filePaths ...string) {
+	var tracked []string
+	for _, p := range filePaths {
+		if strings.HasPrefix(p, "/uploads/") && !containsString(tracked, p) {
+			tracked = append(tracked, p)
+		}
+	}
+	if len(tracked) == 0 {
+		return
+	}
+
+	counts, err := countUploadReferences(tracked)
+	if err != nil {
+		log.Printf("Warning: Failed to count upload references: %v", err)
+		return
+	}
+	for filePath, n := range counts {
+		if err := setUploadRefCount(filePath, n); err != nil {
+			log.Printf("Warning: Failed to update references for %s: %v", filePath, err)
+		}
+	}
+}
+
+// setUploadRefCount stores a reference count, starting the grace period when
+// it drops to zero and clearing it when the file is used again
+func setUploadRefCount(filePath string, n int) error {
+	_, err := DB.Exec(`
+		UPDATE uploads
+		SET ref_count = ?,
+		    unreferenced_since = IF(? = 0, IFNULL(unreferenced_since, NOW()), NULL)
+		WHERE file_path = ?
+	`, n, n, filePath)
+	return err
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Uploaded video materials are transcoded in the background into an HLS
+// ladder so players can adapt to the connection. Output is stored next to
+// the uploads under hls/<source hash>/, shared by every material that uses
+// the same file:
+//
+//	hls/<hash>/master.m3u8, 360p.m3u8, 360p_000.ts, ..., poster.jpg
+
+const (
+	transcodeVideoJob = "transcode_video"
+	hlsPrefix         = "hls/"
+	hlsSegmentSeconds = 6
+	// ffmpeg gets this long per rendition before it is killed
+	transcodeTimeout = 2 * time.Hour
+)
+
+// hlsRendition is one rung of the bitrate ladder
+type hlsRendition struct {
+	Name         string `json:"name"`
+	Height       int    `json:"height"`
+	Width        int    `json:"width"`
+	VideoBitrate int    `json:"video_bitrate"` // kbit/s
+	AudioBitrate int    `json:"audio_bitrate"` // kbit/s
+}
+
+var hlsLadder = []hlsRendition{
+	{Name: "360p", Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+	{Name: "480p", Height: 480, VideoBitrate: 1400, AudioBitrate: 128},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+}
+
+// createVideoTranscodesTable creates the table of HLS transcodes and the
+// processing columns on course_materials
+func createVideoTranscodesTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS video_transcodes (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			source_path VARCHAR(500) NOT NULL,
+			status ENUM('queued', 'processing', 'ready', 'failed') NOT NULL DEFAULT 'queued',
+			hls_prefix VARCHAR(500) NULL,
+			poster_path VARCHAR(500) NULL,
+			duration_seconds DOUBLE NULL,
+			renditions JSON NULL,
+			job_id BIGINT NULL,
+			error_message TEXT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_transcode_source (source_path)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	newColumns := []struct{ name, definition string }{
+		{"processing_status", "VARCHAR(20) NULL"},
+		{"duration_seconds", "DOUBLE NULL"},
+		{"poster_path", "VARCHAR(500) NULL"},
+	}
+	for _, col := range newColumns {
+		if err := ensureColumn(DB, "course_materials", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	log.Println("✅ Video transcodes table created/verified successfully!")
+	return nil
+}
+
+func init() {
+	registerJobHandler(transcodeVideoJob, transcodeVideoHandler)
+}
+
+// syncMaterialProcessing starts any background processing a material's file
+// needs and returns the material's processing status
+func syncMaterialProcessing(materialID int) string {
+	var materialType, filePath string
+	err := DB.QueryRow(`
+		SELECT type, IFNULL(file_path, '') FROM course_materials WHERE id = ?
+	`, materialID).Scan(&materialType, &filePath)
+	if err != nil {
+		log.Printf("Warning: Failed to load material %d for processing: %v", materialID, err)
+		return ""
+	}
+
+	// Clear what an earlier file or type left behind; the queue functions
+	// below copy the current file's state back
+	DB.Exec(`
+		UPDATE course_materials
+		SET processing_status = NULL, duration_seconds = NULL, poster_path = NULL, page_count = NULL, thumbnail_path = NULL
+		WHERE id = ?
+	`, materialID)
+	if !strings.HasPrefix(filePath, "/uploads/") {
+		return ""
+	}
+
+	var status string
+	switch materialType {
+	case "video":
+		status, err = queueVideoTranscode(filePath)
+		if err != nil {
+			log.Printf("Warning: Failed to queue transcode of %s: %v", filePath, err)
+		}
+	case "pdf":
+		status, err = queuePDFProcessing(filePath)
+		if err != nil {
+			log.Printf("Warning: Failed to queue processing of %s: %v", filePath, err)
+		}
+	}
+	return status
+}
+
+// queueVideoTranscode makes sure a video has been or will be transcoded and
+// copies the transcode's state onto the materials using it
+func queueVideoTranscode(sourcePath string) (string, error) {
+	var status string
+	err := DB.QueryRow("SELECT status FROM video_transcodes WHERE source_path = ?", sourcePath).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if err == sql.ErrNoRows || status == "failed" {
+		jobID, err := enqueueJob(transcodeVideoJob, map[string]string{"source_path": sourcePath})
+		if err != nil {
+			return "", err
+		}
+		status = "queued"
+		if _, err := DB.Exec(`
+			INSERT INTO video_transcodes (source_path, status, job_id) VALUES (?, 'queued', ?)
+			ON DUPLICATE KEY UPDATE status = 'queued', job_id = VALUES(job_id), error_message = NULL
+		`, sourcePath, jobID); err != nil {
+			return "", err
+		}
+		log.Printf("Queued transcode of %s as job %d", sourcePath, jobID)
+	}
+
+	return status, syncTranscodeToMaterials(sourcePath)
+}
+
+// syncTranscodeToMaterials copies a transcode's status, duration and poster
+// onto every video material that uses the source file
+func syncTranscodeToMaterials(sourcePath string) error {
+	_, err := DB.Exec(`
+		UPDATE course_materials cm
+		JOIN video_transcodes vt ON vt.source_path = cm.file_path
+		SET cm.processing_status = vt.status, cm.duration_seconds = vt.duration_seconds, cm.poster_path = vt.poster_path
+		WHERE cm.file_path = ? AND cm.type = 'video'
+	`, sourcePath)
+	return err
+}
+
+func setTranscodeStatus(sourcePath, status string, errorMessage interface{}) {
+	if _, err := DB.Exec(`
+		UPDATE video_transcodes SET status = ?, error_message = ? WHERE source_path = ?
+	`, status, errorMessage, sourcePath); err != nil {
+		log.Printf("Warning: Failed to update transcode status of %s: %v", sourcePath, err)
+	}
+	if err := syncTranscodeToMaterials(sourcePath); err != nil {
+		log.Printf("Warning: Failed to update material processing status for %s: %v", sourcePath, err)
+	}
+}
+
+// ffmpegPath and ffprobePath come from FFMPEG_PATH and FFPROBE_PATH,
+// defaulting to the binaries on PATH
+func ffmpegPath() string {
+	if p := os.Getenv("FFMPEG_PATH"); p != "" {
+		return p
+	}
+	return "ffmpeg"
+}
+
+func ffprobePath() string {
+	if p := os.Getenv("FFPROBE_PATH"); p != "" {
+		return p
+	}
+	return "ffprobe"
+}
+
+// transcodeVideoHandler runs a transcode_video job
+func transcodeVideoHandler(ctx context.Context, job *Job) (err error) {
+	var payload struct {
+		SourcePath string `json:"source_path"`
+	}
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	sourcePath := payload.SourcePath
+
+	setTranscodeStatus(sourcePath, "processing", nil)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if job.FinalAttempt() {
+			setTranscodeStatus(sourcePath, "failed", err.Error())
+		} else {
+			setTranscodeStatus(sourcePath, "queued", err.Error())
+		}
+	}()
+
+	sourceKey, ok := blobKeyFromURL(sourcePath)
+	if !ok {
+		return fmt.Errorf("invalid source path %s", sourcePath)
+	}
+	outputPrefix := hlsOutputPrefix(sourceKey)
+
+	workDir, err := os.MkdirTemp("", "transcode-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	input := filepath.Join(workDir, "source"+path.Ext(sourceKey))
+	if err := downloadBlob(ctx, sourceKey, input); err != nil {
+		return fmt.Errorf("failed to fetch source: %w", err)
+	}
+
+	probe, err := probeVideo(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	outDir := filepath.Join(workDir, "hls")
+	if err := os.Mkdir(outDir, 0700); err != nil {
+		return err
+	}
+	renditions := renditionsFor(probe.Width, probe.Height)
+	for _, rendition := range renditions {
+		if err := transcodeRendition(ctx, input, outDir, rendition, probe.HasAudio); err != nil {
+			return fmt.Errorf("%s rendition: %w", rendition.Name, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "master.m3u8"), []byte(hlsMasterPlaylist(renditions, probe.HasAudio)), 0600); err != nil {
+		return err
+	}
+	if err := extractPoster(ctx, input, filepath.Join(outDir, "poster.jpg"), probe.Duration); err != nil {
+		return fmt.Errorf("poster frame: %w", err)
+	}
+
+	// Upload playlists last so a half-uploaded ladder is never served
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return err
+	}
+	for _, playlistsPass := range []bool{false, true} {
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".m3u8") != playlistsPass {
+				continue
+			}
+			if err := uploadBlobFile(ctx, filepath.Join(outDir, entry.Name()), outputPrefix+entry.Name()); err != nil {
+				return fmt.Errorf("failed to store %s: %w", entry.Name(), err)
+			}
+		}
+	}
+
+	renditionsJSON, _ := json.Marshal(renditions)
+	if _, err := DB.Exec(`
+		UPDATE video_transcodes
+		SET status = 'ready', hls_prefix = ?, poster_path = ?, duration_seconds = ?, renditions = ?, error_message = NULL
+		WHERE source_path = ?
+	`, outputPrefix, blobURL(outputPrefix+"poster.jpg"), probe.Duration, string(renditionsJSON), sourcePath); err != nil {
+		return err
+	}
+	if err := syncTranscodeToMaterials(sourcePath); err != nil {
+		return err
+	}
+	log.Printf("Transcoded %s into %d HLS renditions (%.0fs)", sourcePath, len(renditions), probe.Duration)
+	return nil
+}
+
+// hlsOutputPrefix is where the HLS files for a source are stored
+func hlsOutputPrefix(sourceKey string) string {
+	name := path.Base(sourceKey)
+	return hlsPrefix + strings.TrimSuffix(name, path.Ext(name)) + "/"
+}
+
+func downloadBlob(ctx context.Context, key, dst string) error {
+	body, _, err := Storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func uploadBlobFile(ctx context.Context, src, key string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	contentType := blobContentType(key)
+	switch path.Ext(key) {
+	case ".m3u8":
+		contentType = "application/vnd.apple.mpegurl"
+	case ".ts":
+		contentType = "video/mp2t"
+	}
+	return Storage.Put(ctx, key, f, info.Size(), contentType)
+}
+
+type videoProbe struct {
+	Width, Height int
+	Duration      float64
+	HasAudio      bool
+}
+
+// probeVideo reads the dimensions, duration and audio presence of a video
+func probeVideo(ctx context.Context, input string) (*videoProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, ffprobePath(), "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", input).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var result struct {
+		Streams []struct {
+			CodecType string            `json:"codec_type"`
+			Width     int               `json:"width"`
+			Height    int               `json:"height"`
+			Tags      map[string]string `json:"tags"`
+			SideData  []struct {
+				Rotation int `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("ffprobe output: %w", err)
+	}
+
+	probe := &videoProbe{}
+	for _, s := range result.Streams {
+		switch s.CodecType {
+		case "video":
+			if probe.Width == 0 {
+				probe.Width, probe.Height = s.Width, s.Height
+				// Phone videos are often stored sideways with a rotate tag
+				rotation, _ := strconv.Atoi(s.Tags["rotate"])
+				for _, sd := range s.SideData {
+					if sd.Rotation != 0 {
+						rotation = sd.Rotation
+					}
+				}
+				if rotation%180 != 0 {
+					probe.Width, probe.Height = s.Height, s.Width
+				}
+			}
+		case "audio":
+			probe.HasAudio = true
+		}
+	}
+	if probe.Width == 0 || probe.Height == 0 {
+		return nil, fmt.Errorf("file has no video stream")
+	}
+	probe.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	return probe, nil
+}
+
+// renditionsFor picks the ladder rungs whose short edge is no larger than
+// the source's, always keeping at least the smallest. Portrait videos are
+// scaled by width so they get the same quality as landscape ones.
+func renditionsFor(width, height int) []hlsRendition {
+	short, long := height, width
+	if width < height {
+		short, long = width, height
+	}
+	var renditions []hlsRendition
+	for _, r := range hlsLadder {
+		if r.Height > short && len(renditions) > 0 {
+			break
+		}
+		edge := r.Height
+		if edge > short {
+			edge = short - short%2
+		}
+		other := int(math.Round(float64(long)*float64(edge)/float64(short)/2)) * 2
+		if width >= height {
+			r.Width, r.Height = other, edge
+		} else {
+			r.Width, r.Height = edge, other
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions
+}
+
+func transcodeRendition(ctx context.Context, input, outDir string, r hlsRendition, hasAudio bool) error {
+	gop := strconv.Itoa(hlsSegmentSeconds * 24)
+	args := []string{
+		"-hide_banner", "-nostdin", "-y", "-i", input,
+		"-map", "0:v:0",
+		"-vf", fmt.Sprintf("scale=%d:%d", r.Width, r.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main", "-pix_fmt", "yuv420p",
+		"-b:v", fmt.Sprintf("%dk", r.VideoBitrate),
+		"-maxrate", fmt.Sprintf("%dk", r.VideoBitrate*107/100),
+		"-bufsize", fmt.Sprintf("%dk", r.VideoBitrate*3/2),
+		"-g", gop, "-keyint_min", gop, "-sc_threshold", "0",
+	}
+	if hasAudio {
+		args = append(args, "-map", "0:a:0", "-c:a", "aac", "-ac", "2", "-b:a", fmt.Sprintf("%dk", r.AudioBitrate))
+	}
+	args = append(args,
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, r.Name+"_%03d.ts"),
+		filepath.Join(outDir, r.Name+".m3u8"),
+	)
+	return runFFmpeg(ctx, args)
+}
+
+// extractPoster saves a frame from a tenth of the way in, at most 5 seconds
+func extractPoster(ctx context.Context, input, output string, duration float64) error {
+	at := math.Min(duration/10, 5)
+	return runFFmpeg(ctx, []string{
+		"-hide_banner", "-nostdin", "-y", "-ss", strconv.FormatFloat(at, 'f', 2, 64), "-i", input,
+		"-frames:v", "1", "-vf", "scale='min(1280,iw)':-2", "-q:v", "3", output,
+	})
+}
+
+func runFFmpeg(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithTimeout(ctx, transcodeTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, ffmpegPath(), args...).CombinedOutput()
+	if err != nil {
+		// The end of ffmpeg's output has the actual error
+		tail := strings.TrimSpace(string(output))
+		if len(tail) > 500 {
+			tail = tail[len(tail)-500:]
+		}
+		return fmt.Errorf("ffmpeg: %v: %s", err, tail)
+	}
+	return nil
+}
+
+func hlsMasterPlaylist(renditions []hlsRendition, hasAudio bool) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		bandwidth := r.VideoBitrate * 1000 * 107 / 100
+		codecs := "avc1.4d401f" // H.264 Main, level 3.1
+		if r.Width*r.Height > 1280*720 {
+			codecs = "avc1.4d4028" // level 4.0
+		}
+		if hasAudio {
+			bandwidth += r.AudioBitrate * 1000
+			codecs += ",mp4a.40.2"
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n%s.m3u8\n",
+			bandwidth, r.Width, r.Height, codecs, r.Name)
+	}
+	return b.String()
+}
+
+// deleteVideoTranscode removes the HLS output of a video that is being deleted
+func deleteVideoTranscode(ctx context.Context, sourcePath string) {
+	key, ok := blobKeyFromURL(sourcePath)
+	if !ok {
+		return
+	}
+	prefix := hlsOutputPrefix(key)
+	blobs, err := Storage.List(ctx, prefix)
+	if err != nil {
+		log.Printf("Warning: Failed to list HLS output of %s: %v", sourcePath, err)
+		return
+	}
+	for _, blob := range blobs {
+		if err := Storage.Delete(ctx, blob.Key); err != nil && err != ErrBlobNotFound {
+			log.Printf("Warning: Failed to delete %s: %v", blob.Key, err)
+		}
+	}
+	DB.Exec("DELETE FROM video_transcodes WHERE source_path = ?", sourcePath)
+}
+
+// materialHLSURL is the authorized playlist endpoint for a video material
+func materialHLSURL(materialID int) string {
+	return fmt.Sprintf("/api/materials/%d/hls/master.m3u8", materialID)
+}
+
+// signedHLSPlaylistURL signs a playlist URL so players that cannot send an
+// Authorization header can fetch it
+func signedHLSPlaylistURL(urlPath string, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	return fmt.Sprintf("%s?expires=%d&sig=%s", urlPath, expires, fileSignature(urlPath, expires))
+}
+
+// hlsURLTTL is how long the URLs in a playlist stay valid. A VOD playlist is
+// loaded once, so its segment URLs must outlive a viewing with pauses.
+func hlsURLTTL(duration float64) time.Duration {
+	ttl := signedURLTTL + 3*time.Duration(duration)*time.Second
+	if ttl > 12*time.Hour {
+		ttl = 12 * time.Hour
+	}
+	return ttl
+}
+
+// getMaterialHLSHandler serves the HLS playlists of a video material to
+// users who can see the course. Playlist entries are rewritten to signed
+// URLs, so the variant playlists and segments load without credentials.
+func getMaterialHLSHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	materialID, err := strconv.Atoi(vars["materialId"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+	playlist := vars["playlist"]
+
+	var courseID int
+	var sourcePath string
+	err = DB.QueryRow(`
+		SELECT course_id, IFNULL(file_path, '') FROM course_materials WHERE id = ? AND type = 'video'
+	`, materialID).Scan(&courseID, &sourcePath)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Material not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading material %d: %v", materialID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	allowed := verifyFileSignature(r.URL.Path, r.URL.Query())
+	if !allowed {
+		if claims, ok := claimsFromRequest(r); ok {
+			userID := claims.StudentID
+			if claims.Role == "teacher" {
+				userID = claims.TeacherID
+			}
+			allowed = canAccessCourse(claims.Role, userID, courseID)
+		}
+	}
+	if !allowed {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	var status string
+	var prefix sql.NullString
+	var duration sql.NullFloat64
+	err = DB.QueryRow(`
+		SELECT status, hls_prefix, duration_seconds FROM video_transcodes WHERE source_path = ?
+	`, sourcePath).Scan(&status, &prefix, &duration)
+	if err == sql.ErrNoRows || (err == nil && status != "ready") {
+		http.Error(w, "Video is still being processed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading transcode of %s: %v", sourcePath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	body, _, err := Storage.Get(r.Context(), prefix.String+playlist)
+	if err == ErrBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading playlist %s%s: %v", prefix.String, playlist, err)
+		http.Error(w, "Error reading playlist", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// Each URI line is either a variant playlist (served by this endpoint)
+	// or a segment (served from storage)
+	playlistDir := path.Dir(r.URL.Path)
+	ttl := hlsURLTTL(duration.Float64)
+	var out strings.Builder
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			name := path.Base(line)
+			if strings.HasSuffix(name, ".m3u8") {
+				line = signedHLSPlaylistURL(playlistDir+"/"+url.PathEscape(name), ttl)
+			} else if line, err = Storage.SignedURL(r.Context(), prefix.String+name, ttl); err != nil {
+				log.Printf("Error signing HLS segment %s%s: %v", prefix.String, name, err)
+				http.Error(w, "Error reading playlist", http.StatusInternalServerError)
+				return
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading playlist %s%s: %v", prefix.String, playlist, err)
+		http.Error(w, "Error reading playlist", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	// Signed URLs inside expire, so the playlist must not be cached for long
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	io.WriteString(w, out.String())
+}